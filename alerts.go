@@ -0,0 +1,550 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// -------------------------
+// ALERT RULES ENGINE
+// -------------------------
+// Leak, burst, reverse flow and stuck meter detection over flow (tag 0x04)
+// and total (tag 0x02).
+//
+// burst and reverse_flow are checked on every ingested reading; leak and
+// stuck_meter need a window of readings and are checked by the periodic
+// sweep. An alert stays open (one row, occurrences counted) while its
+// condition holds and is closed the first time it no longer does.
+
+const (
+	alertLeak        = "leak"
+	alertBurst       = "burst"
+	alertReverseFlow = "reverse_flow"
+	alertStuckMeter  = "stuck_meter"
+)
+
+// alertRules are the thresholds for one device group ("" is the default).
+// A zero threshold disables its rule.
+type alertRules struct {
+	Group           string `json:"group"`
+	LeakMinFlow     int64  `json:"leak_min_flow"`     // flow that must be sustained all night
+	LeakNightStart  int    `json:"leak_night_start"`  // local hour the night window opens
+	LeakNightEnd    int    `json:"leak_night_end"`    // local hour it closes
+	LeakMinReadings int    `json:"leak_min_readings"` // readings needed inside the window
+	BurstFlow       int64  `json:"burst_flow"`        // single-reading flow that counts as a burst
+	ReverseMinDelta int64  `json:"reverse_min_delta"` // how far total must go backwards
+	StuckDays       int    `json:"stuck_days"`        // days of unchanged total
+}
+
+var defaultAlertRules = alertRules{
+	LeakMinFlow:     1,
+	LeakNightStart:  2,
+	LeakNightEnd:    5,
+	LeakMinReadings: 2,
+	BurstFlow:       1000,
+	ReverseMinDelta: 1,
+	StuckDays:       3,
+}
+
+// alertFinding is one rule's verdict: Raise with details, or resolve when !Raise.
+type alertFinding struct {
+	Type    string
+	Raise   bool
+	Details map[string]interface{}
+}
+
+// evaluateIngestRules checks the rules that only need the new reading and the one before it.
+func evaluateIngestRules(rules alertRules, prev *meterReading, cur meterReading) []alertFinding {
+	var out []alertFinding
+
+	if rules.BurstFlow > 0 {
+		out = append(out, alertFinding{
+			Type:    alertBurst,
+			Raise:   cur.Flow >= rules.BurstFlow,
+			Details: map[string]interface{}{"flow": cur.Flow, "threshold": rules.BurstFlow},
+		})
+	}
+
+	if prev == nil {
+		return out
+	}
+
+	delta, flag := readingDelta(*prev, cur, defaultCounterMax)
+	if rules.ReverseMinDelta > 0 && flag != flagRollover && flag != flagMeterReplace && flag != flagMeterReset {
+		back := prev.Total - cur.Total
+		out = append(out, alertFinding{
+			Type:    alertReverseFlow,
+			Raise:   flag == flagNegative && back >= rules.ReverseMinDelta,
+			Details: map[string]interface{}{"previous_total": prev.Total, "total": cur.Total, "threshold": rules.ReverseMinDelta},
+		})
+	}
+
+	// any movement un-sticks the meter straight away; raising waits for the sweep
+	if rules.StuckDays > 0 && delta > 0 {
+		out = append(out, alertFinding{Type: alertStuckMeter, Raise: false})
+	}
+
+	return out
+}
+
+// nightWindow returns the most recent completed [start, end) night window before now.
+func nightWindow(rules alertRules, now time.Time, loc *time.Location) (time.Time, time.Time) {
+	// wall-clock hours, so a DST change inside the window moves neither end
+	n := now.In(loc)
+	y, m, d := n.Date()
+	end := time.Date(y, m, d, rules.LeakNightEnd, 0, 0, 0, loc)
+	if end.After(n) {
+		d--
+		end = time.Date(y, m, d, rules.LeakNightEnd, 0, 0, 0, loc)
+	}
+	if rules.LeakNightStart > rules.LeakNightEnd {
+		// window crosses midnight, e.g. 23 -> 4
+		d--
+	}
+	return time.Date(y, m, d, rules.LeakNightStart, 0, 0, 0, loc), end
+}
+
+// evaluateWindowRules checks leak and stuck meter over the readings since
+// now-StuckDays (plus the one just before). readings must be sorted by time.
+func evaluateWindowRules(rules alertRules, readings []meterReading, now time.Time, loc *time.Location) []alertFinding {
+	var out []alertFinding
+
+	if rules.LeakMinFlow > 0 {
+		start, end := nightWindow(rules, now, loc)
+		var night []meterReading
+		for _, rd := range readings {
+			if !rd.At.Before(start) && rd.At.Before(end) {
+				night = append(night, rd)
+			}
+		}
+		if len(night) >= rules.LeakMinReadings && len(night) > 0 {
+			minFlow := night[0].Flow
+			for _, rd := range night {
+				if rd.Flow < minFlow {
+					minFlow = rd.Flow
+				}
+			}
+			out = append(out, alertFinding{
+				Type:  alertLeak,
+				Raise: minFlow >= rules.LeakMinFlow,
+				Details: map[string]interface{}{
+					"night_start": start, "night_end": end,
+					"min_flow": minFlow, "readings": len(night), "threshold": rules.LeakMinFlow,
+				},
+			})
+		}
+	}
+
+	if rules.StuckDays > 0 && len(readings) >= 2 {
+		since := now.Add(-time.Duration(rules.StuckDays) * 24 * time.Hour)
+		// only judge when the readings actually reach back far enough
+		if !readings[0].At.After(since) {
+			stuck := true
+			for _, rd := range readings[1:] {
+				if rd.Total != readings[0].Total {
+					stuck = false
+					break
+				}
+			}
+			out = append(out, alertFinding{
+				Type:    alertStuckMeter,
+				Raise:   stuck,
+				Details: map[string]interface{}{"total": readings[len(readings)-1].Total, "days": rules.StuckDays},
+			})
+		}
+	}
+
+	return out
+}
+
+// -------------------------
+// ALERT STORAGE
+// -------------------------
+
+// loadAlertRules returns the group's rules, falling back to the default row,
+// then to defaultAlertRules.
+func loadAlertRules(group string) (alertRules, error) {
+	r := alertRules{}
+	err := db.QueryRow(`
+        SELECT group_name, leak_min_flow, leak_night_start, leak_night_end, leak_min_readings,
+               burst_flow, reverse_min_delta, stuck_days
+        FROM alert_rules
+        WHERE group_name IN ($1, '')
+        ORDER BY group_name DESC LIMIT 1
+    `, group).Scan(&r.Group, &r.LeakMinFlow, &r.LeakNightStart, &r.LeakNightEnd, &r.LeakMinReadings,
+		&r.BurstFlow, &r.ReverseMinDelta, &r.StuckDays)
+	if err == sql.ErrNoRows {
+		return defaultAlertRules, nil
+	}
+	return r, err
+}
+
+// applyFindings raises or resolves each finding; it returns the alerts newly opened.
+func applyFindings(imei string, frameID int, findings []alertFinding) ([]Alert, error) {
+	var opened []Alert
+	for _, f := range findings {
+		if !f.Raise {
+			if _, err := db.Exec(`
+                UPDATE alerts SET status = 'closed', closed_at = now()
+                WHERE imei = $1 AND type = $2 AND status = 'open'
+            `, imei, f.Type); err != nil {
+				return opened, err
+			}
+			continue
+		}
+
+		details, _ := json.Marshal(f.Details)
+		var frame interface{}
+		if frameID > 0 {
+			frame = frameID
+		}
+
+		// an alert that was opened, not seen again, queues alarm.raised
+		eventID, eventData := outboxEvent(map[string]interface{}{"type": f.Type, "details": f.Details})
+
+		var a Alert
+		var inserted bool
+		err := db.QueryRow(`
+            WITH a AS (
+                INSERT INTO alerts (imei, type, status, frame_id, details, opened_at, last_seen_at, occurrences, tenant_id)
+                VALUES ($1, $2, 'open', $3, $4, now(), now(), 1, (SELECT tenant_id FROM devices WHERE imei = $1))
+                ON CONFLICT (imei, type) WHERE status = 'open' DO UPDATE SET
+                    last_seen_at = now(),
+                    occurrences  = alerts.occurrences + 1,
+                    frame_id     = COALESCE(EXCLUDED.frame_id, alerts.frame_id),
+                    details      = EXCLUDED.details
+                RETURNING *, (xmax = 0) AS inserted
+            ), ev AS (
+                INSERT INTO event_outbox (event_id, event_type, schema_version, imei, tenant_id, frame_id, data)
+                SELECT $5, $6, $7, a.imei, a.tenant_id, a.frame_id,
+                    $8::jsonb || jsonb_build_object('alert_id', a.id, 'opened_at', a.opened_at)
+                FROM a WHERE a.inserted AND $8::jsonb IS NOT NULL
+            )
+            SELECT `+alertColumns+`, inserted FROM a
+        `, imei, f.Type, frame, string(details),
+			eventID, eventAlarmRaised, eventSchemaVersion[eventAlarmRaised], eventData,
+		).Scan(append(a.scanDest(), &inserted)...)
+		if err != nil {
+			return opened, err
+		}
+		if inserted {
+			opened = append(opened, a)
+		}
+	}
+	return opened, nil
+}
+
+// evaluateReadingAlerts runs the ingest-time rules for a freshly stored reading.
+func evaluateReadingAlerts(imei string, frameID int, decoded map[string]interface{}, at time.Time) ([]Alert, error) {
+	if imei == "" {
+		return nil, nil
+	}
+
+	var group string
+	db.QueryRow(`SELECT COALESCE(group_name, '') FROM devices WHERE imei = $1`, imei).Scan(&group)
+	rules, err := loadAlertRules(group)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := meterReading{
+		At:     at,
+		Total:  int64(getInt(decoded["total"])),
+		Flow:   int64(getInt(decoded["flow"])),
+		Serial: getString(decoded["serial"]),
+	}
+
+	var prev *meterReading
+	var p meterReading
+	err = db.QueryRow(`
+        SELECT m.measured_at, m.total, m.flow, COALESCE(m.serial, '')
+        FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+        WHERE f.imei = $1 AND m.frame_id <> $2
+        ORDER BY m.id DESC LIMIT 1
+    `, imei, frameID).Scan(&p.At, &p.Total, &p.Flow, &p.Serial)
+	if err == nil {
+		prev = &p
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return applyFindings(imei, frameID, evaluateIngestRules(rules, prev, cur))
+}
+
+// sweepAlerts runs the window rules for every device. A device that fails is
+// logged and skipped so it cannot hold up the rest; the failures are returned
+// together at the end.
+func sweepAlerts(now time.Time, loc *time.Location) error {
+	rows, err := db.Query(`SELECT imei, COALESCE(group_name, '') FROM devices ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type dev struct{ imei, group string }
+	var devs []dev
+	for rows.Next() {
+		var d dev
+		if err := rows.Scan(&d.imei, &d.group); err != nil {
+			rows.Close()
+			return err
+		}
+		devs = append(devs, d)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range devs {
+		if err := sweepDevice(d.imei, d.group, now, loc); err != nil {
+			slog.Error("alert sweep failed for device", "imei", d.imei, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", d.imei, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sweepDevice runs the window rules for one device.
+func sweepDevice(imei, group string, now time.Time, loc *time.Location) error {
+	rules, err := loadAlertRules(group)
+	if err != nil {
+		return err
+	}
+
+	days := rules.StuckDays
+	if days < 2 {
+		days = 2 // enough to cover last night's window
+	}
+	readings, err := loadReadings(imei, now.AddDate(0, 0, -days), now)
+	if err != nil {
+		return err
+	}
+
+	_, err = applyFindings(imei, 0, evaluateWindowRules(rules, readings, now, loc))
+	return err
+}
+
+// startAlertSweeper runs sweepAlerts every ALERT_SWEEP_INTERVAL (default 15m)
+// in ALERT_TZ (default UTC).
+func startAlertSweeper() {
+	every, err := time.ParseDuration(getenv("ALERT_SWEEP_INTERVAL", "15m"))
+	if err != nil || every <= 0 {
+		slog.Warn("invalid ALERT_SWEEP_INTERVAL, alert sweep disabled")
+		return
+	}
+	loc, err := time.LoadLocation(getenv("ALERT_TZ", "UTC"))
+	if err != nil {
+		slog.Warn("invalid ALERT_TZ, using UTC", "err", err)
+		loc = time.UTC
+	}
+
+	for range time.Tick(every) {
+		if err := sweepAlerts(time.Now(), loc); err != nil {
+			slog.Error("alert sweep failed", "err", err)
+		}
+	}
+}
+
+// -------------------------
+// API: ALERTS
+// -------------------------
+
+type Alert struct {
+	ID          int             `json:"id"`
+	IMEI        string          `json:"imei"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	FrameID     *int            `json:"frame_id"`
+	Details     json.RawMessage `json:"details"`
+	Occurrences int             `json:"occurrences"`
+	OpenedAt    time.Time       `json:"opened_at"`
+	LastSeenAt  time.Time       `json:"last_seen_at"`
+	ClosedAt    *time.Time      `json:"closed_at"`
+	TenantID    *int            `json:"tenant_id"`
+}
+
+const alertColumns = `id, imei, type, status, frame_id, COALESCE(details, '{}')::text, occurrences, opened_at, last_seen_at, closed_at, tenant_id`
+
+func (a *Alert) scanDest() []interface{} {
+	return []interface{}{&a.ID, &a.IMEI, &a.Type, &a.Status, &a.FrameID, (*rawJSON)(&a.Details),
+		&a.Occurrences, &a.OpenedAt, &a.LastSeenAt, &a.ClosedAt, &a.TenantID}
+}
+
+// rawJSON scans a text column straight into a json.RawMessage.
+type rawJSON json.RawMessage
+
+func (j *rawJSON) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		*j = append((*j)[:0], v...)
+	case string:
+		*j = rawJSON(v)
+	case nil:
+		*j = rawJSON("null")
+	default:
+		return fmt.Errorf("rawJSON: unsupported type %T", src)
+	}
+	return nil
+}
+
+// GET /api/alerts?imei=&type=&status=open|closed&from=&to=&limit=&cursor=
+func getAlerts(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "opened_at", "last_seen_at")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	q := r.URL.Query()
+
+	var where sqlWhere
+	if p.Tenant != 0 {
+		where.add("tenant_id = $%d", p.Tenant)
+	}
+	if !p.From.IsZero() {
+		where.add(p.TimeField+" >= $%d", p.From)
+	}
+	if !p.To.IsZero() {
+		where.add(p.TimeField+" < $%d", p.To)
+	}
+	if p.IMEI != "" {
+		where.add("imei = $%d", p.IMEI)
+	}
+	if v := q.Get("type"); v != "" {
+		where.add("type = $%d", v)
+	}
+	if v := q.Get("status"); v != "" {
+		where.add("status = $%d", v)
+	}
+
+	total, err := p.totalCount("SELECT COUNT(*) FROM alerts "+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "id")
+	rows, err := db.Query("SELECT "+alertColumns+" FROM alerts "+where.String()+" "+p.orderSQL("id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var list []Alert
+	var ids []int
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(a.scanDest()...); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, a)
+		ids = append(ids, a.ID)
+	}
+
+	writePage(w, p, list, ids, total)
+}
+
+// AlertRulesList is the built-in defaults plus the configured groups.
+type AlertRulesList struct {
+	Defaults alertRules   `json:"defaults"`
+	Groups   []alertRules `json:"groups"`
+}
+
+// GET /api/alert-rules lists the configured groups ("" is the default).
+func getAlertRules(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+        SELECT group_name, leak_min_flow, leak_night_start, leak_night_end, leak_min_readings,
+               burst_flow, reverse_min_delta, stuck_days
+        FROM alert_rules ORDER BY group_name
+    `)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	list := []alertRules{}
+	for rows.Next() {
+		var a alertRules
+		if err := rows.Scan(&a.Group, &a.LeakMinFlow, &a.LeakNightStart, &a.LeakNightEnd, &a.LeakMinReadings,
+			&a.BurstFlow, &a.ReverseMinDelta, &a.StuckDays); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, a)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AlertRulesList{Defaults: defaultAlertRules, Groups: list})
+}
+
+// PUT /api/alert-rules/{group} replaces a group's thresholds; use "default"
+// for the fallback row.
+func putAlertRules(w http.ResponseWriter, r *http.Request) {
+	a := defaultAlertRules
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+	a.Group = r.PathValue("group")
+	if a.Group == "default" {
+		a.Group = ""
+	}
+	if a.LeakNightStart < 0 || a.LeakNightStart > 23 || a.LeakNightEnd < 0 || a.LeakNightEnd > 23 {
+		writeError(w, 400, "leak_night_start and leak_night_end must be hours 0-23")
+		return
+	}
+	if a.LeakMinFlow < 0 || a.LeakMinReadings < 0 || a.BurstFlow < 0 || a.ReverseMinDelta < 0 || a.StuckDays < 0 {
+		writeError(w, 400, "thresholds must not be negative (0 disables a rule)")
+		return
+	}
+
+	_, err := db.Exec(`
+        INSERT INTO alert_rules (
+            group_name, leak_min_flow, leak_night_start, leak_night_end, leak_min_readings,
+            burst_flow, reverse_min_delta, stuck_days, updated_at
+        ) VALUES ($1,$2,$3,$4,$5,$6,$7,$8, now())
+        ON CONFLICT (group_name) DO UPDATE SET
+            leak_min_flow     = EXCLUDED.leak_min_flow,
+            leak_night_start  = EXCLUDED.leak_night_start,
+            leak_night_end    = EXCLUDED.leak_night_end,
+            leak_min_readings = EXCLUDED.leak_min_readings,
+            burst_flow        = EXCLUDED.burst_flow,
+            reverse_min_delta = EXCLUDED.reverse_min_delta,
+            stuck_days        = EXCLUDED.stuck_days,
+            updated_at        = now()
+    `, a.Group, a.LeakMinFlow, a.LeakNightStart, a.LeakNightEnd, a.LeakMinReadings,
+		a.BurstFlow, a.ReverseMinDelta, a.StuckDays)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// POST /api/admin/alerts/sweep runs the window rules now instead of waiting for the ticker.
+func postAlertSweep(w http.ResponseWriter, r *http.Request) {
+	loc, err := time.LoadLocation(getenv("ALERT_TZ", "UTC"))
+	if err != nil {
+		loc = time.UTC
+	}
+	if err := sweepAlerts(time.Now(), loc); err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// findings indexes fs by type; a missing type means the rule had no verdict.
+func findings(fs []alertFinding) map[string]alertFinding {
+	m := map[string]alertFinding{}
+	for _, f := range fs {
+		m[f.Type] = f
+	}
+	return m
+}
+
+func TestEvaluateIngestRules(t *testing.T) {
+	rules := alertRules{BurstFlow: 1000, ReverseMinDelta: 5, StuckDays: 3}
+	reading := func(total, flow int64) *meterReading { return &meterReading{Total: total, Flow: flow} }
+
+	for _, c := range []struct {
+		name      string
+		prev, cur *meterReading
+		want      map[string]bool // type -> Raise; types not listed must be absent
+	}{
+		{"first reading", nil, reading(100, 10), map[string]bool{alertBurst: false}},
+		{"burst", reading(100, 10), reading(150, 1000), map[string]bool{alertBurst: true, alertReverseFlow: false, alertStuckMeter: false}},
+		{"standstill", reading(100, 0), reading(100, 0), map[string]bool{alertBurst: false, alertReverseFlow: false}},
+		{"reverse flow", reading(100, 0), reading(90, 0), map[string]bool{alertBurst: false, alertReverseFlow: true}},
+		{"reverse below threshold", reading(100, 0), reading(97, 0), map[string]bool{alertBurst: false, alertReverseFlow: false}},
+		{"reset is not reverse flow", reading(500, 0), reading(20, 0), map[string]bool{alertBurst: false, alertStuckMeter: false}},
+		{"rollover is not reverse flow", reading(defaultCounterMax-10, 0), reading(5, 0), map[string]bool{alertBurst: false, alertStuckMeter: false}},
+		{"replaced meter is not reverse flow", &meterReading{Total: 500, Serial: "A"}, &meterReading{Total: 3, Serial: "B"}, map[string]bool{alertBurst: false}},
+	} {
+		got := findings(evaluateIngestRules(rules, c.prev, *c.cur))
+		if len(got) != len(c.want) {
+			t.Errorf("%s: findings %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for typ, raise := range c.want {
+			if f, ok := got[typ]; !ok || f.Raise != raise {
+				t.Errorf("%s: %s = %+v, want raise %v", c.name, typ, f, raise)
+			}
+		}
+	}
+
+	// zero thresholds disable their rules
+	if got := evaluateIngestRules(alertRules{}, reading(100, 0), *reading(50, 5000)); len(got) != 0 {
+		t.Errorf("disabled rules: %v", got)
+	}
+}
+
+func TestNightWindow(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	at := func(loc *time.Location, mo time.Month, d, h, mi int) time.Time {
+		return time.Date(2026, mo, d, h, mi, 0, 0, loc)
+	}
+
+	for _, c := range []struct {
+		name               string
+		from, to           int
+		now                time.Time
+		loc                *time.Location
+		wantStart, wantEnd time.Time
+	}{
+		{"after tonight's window", 2, 5, at(time.UTC, time.June, 10, 12, 0), time.UTC,
+			at(time.UTC, time.June, 10, 2, 0), at(time.UTC, time.June, 10, 5, 0)},
+		{"inside tonight's window", 2, 5, at(time.UTC, time.June, 10, 3, 0), time.UTC,
+			at(time.UTC, time.June, 9, 2, 0), at(time.UTC, time.June, 9, 5, 0)},
+		{"across midnight", 23, 4, at(time.UTC, time.June, 10, 12, 0), time.UTC,
+			at(time.UTC, time.June, 9, 23, 0), at(time.UTC, time.June, 10, 4, 0)},
+		{"across midnight and a month", 23, 4, at(time.UTC, time.July, 1, 6, 0), time.UTC,
+			at(time.UTC, time.June, 30, 23, 0), at(time.UTC, time.July, 1, 4, 0)},
+		// clocks go forward at 02:00 on 2026-03-29: the window is an hour shorter
+		{"spring forward", 1, 4, at(berlin, time.March, 29, 12, 0), berlin,
+			at(berlin, time.March, 29, 1, 0), at(berlin, time.March, 29, 4, 0)},
+		// and back at 03:00 on 2026-10-25: an hour longer
+		{"fall back", 1, 4, at(berlin, time.October, 25, 12, 0), berlin,
+			at(berlin, time.October, 25, 1, 0), at(berlin, time.October, 25, 4, 0)},
+		{"fall back across midnight", 22, 5, at(berlin, time.October, 25, 12, 0), berlin,
+			at(berlin, time.October, 24, 22, 0), at(berlin, time.October, 25, 5, 0)},
+	} {
+		start, end := nightWindow(alertRules{LeakNightStart: c.from, LeakNightEnd: c.to}, c.now, c.loc)
+		if !start.Equal(c.wantStart) || !end.Equal(c.wantEnd) {
+			t.Errorf("%s: [%v, %v), want [%v, %v)", c.name, start, end, c.wantStart, c.wantEnd)
+		}
+	}
+}
+
+func TestEvaluateWindowRules(t *testing.T) {
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	rules := alertRules{LeakMinFlow: 5, LeakNightStart: 2, LeakNightEnd: 5, LeakMinReadings: 2, StuckDays: 3}
+	rd := func(day, hour int, total, flow int64) meterReading {
+		return meterReading{At: time.Date(2026, 6, day, hour, 0, 0, 0, time.UTC), Total: total, Flow: flow}
+	}
+
+	for _, c := range []struct {
+		name     string
+		readings []meterReading
+		want     map[string]bool
+	}{
+		{"no readings", nil, map[string]bool{}},
+		{"leak", []meterReading{rd(7, 0, 100, 0), rd(10, 2, 110, 6), rd(10, 3, 116, 5), rd(10, 4, 122, 7)},
+			map[string]bool{alertLeak: true, alertStuckMeter: false}},
+		{"flow stops during the night", []meterReading{rd(7, 0, 100, 0), rd(10, 2, 110, 6), rd(10, 3, 112, 0)},
+			map[string]bool{alertLeak: false, alertStuckMeter: false}},
+		{"too few night readings", []meterReading{rd(7, 0, 100, 0), rd(10, 3, 110, 9)},
+			map[string]bool{alertStuckMeter: false}},
+		{"stuck", []meterReading{rd(7, 0, 100, 0), rd(8, 0, 100, 0), rd(10, 11, 100, 0)},
+			map[string]bool{alertStuckMeter: true}},
+		{"readings do not reach back far enough", []meterReading{rd(8, 0, 100, 0), rd(10, 11, 100, 0)},
+			map[string]bool{}},
+	} {
+		got := findings(evaluateWindowRules(rules, c.readings, now, time.UTC))
+		if len(got) != len(c.want) {
+			t.Errorf("%s: findings %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for typ, raise := range c.want {
+			if f, ok := got[typ]; !ok || f.Raise != raise {
+				t.Errorf("%s: %s = %+v, want raise %v", c.name, typ, f, raise)
+			}
+		}
+	}
+}
+
+func TestSweepAlertsContinuesPastAFailingDevice(t *testing.T) {
+	mock := useMockDB(t)
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT imei, COALESCE\(group_name, ''\) FROM devices`).
+		WillReturnRows(sqlmock.NewRows([]string{"imei", "group_name"}).AddRow("bad", "g").AddRow("good", ""))
+	mock.ExpectQuery(`FROM alert_rules`).WithArgs("g").WillReturnError(errors.New("boom"))
+	mock.ExpectQuery(`FROM alert_rules`).WithArgs("").
+		WillReturnRows(sqlmock.NewRows([]string{"group_name"}))
+	mock.ExpectQuery(`FROM messages m`).WithArgs("good", sqlmock.AnyArg(), now).
+		WillReturnRows(sqlmock.NewRows([]string{"measured_at", "total", "flow", "serial"}))
+
+	err := sweepAlerts(now, time.UTC)
+	if err == nil || !strings.Contains(err.Error(), "bad: boom") {
+		t.Errorf("sweepAlerts = %v, want the bad device's error", err)
+	}
+}
+
+func TestPutAlertRulesValidates(t *testing.T) {
+	for _, body := range []string{
+		`{"leak_night_start": 24}`,
+		`{"leak_night_end": -1}`,
+		`{"burst_flow": -1}`,
+		`{"stuck_days": -3}`,
+		`{"leak_min_readings": -1}`,
+	} {
+		req := httptest.NewRequest("PUT", "/alert-rules/g", strings.NewReader(body))
+		req.SetPathValue("group", "g")
+		rec := httptest.NewRecorder()
+		putAlertRules(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+}
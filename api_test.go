@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// loadSpec round-trips the generated document through JSON, as clients see it.
+func loadSpec(t *testing.T) map[string]interface{} {
+	t.Helper()
+	b, err := json.Marshal(buildOpenAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func specOperation(t *testing.T, spec map[string]interface{}, method, path string) map[string]interface{} {
+	t.Helper()
+	item, _ := spec["paths"].(map[string]interface{})[path].(map[string]interface{})
+	op, _ := item[strings.ToLower(method)].(map[string]interface{})
+	if op == nil {
+		t.Fatalf("%s %s not in the OpenAPI document", method, path)
+	}
+	return op
+}
+
+// responseSchema returns the JSON schema documented for status (or default).
+func responseSchema(t *testing.T, spec map[string]interface{}, method, path string, status int) interface{} {
+	t.Helper()
+	responses := specOperation(t, spec, method, path)["responses"].(map[string]interface{})
+	res, ok := responses[fmt.Sprint(status)]
+	if !ok {
+		res = responses["default"]
+	}
+	res = resolveRef(spec, res)
+	content := res.(map[string]interface{})["content"].(map[string]interface{})
+	return content["application/json"].(map[string]interface{})["schema"]
+}
+
+func resolveRef(spec map[string]interface{}, v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	ref, ok := m["$ref"].(string)
+	if !ok {
+		return v
+	}
+	var cur interface{} = spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		cur, _ = cur.(map[string]interface{})[part]
+		if cur == nil {
+			return nil
+		}
+	}
+	return resolveRef(spec, cur)
+}
+
+// validate checks v against the subset of OpenAPI schema the generator emits.
+// Objects are closed: a field the schema does not know about is an error.
+func validate(spec map[string]interface{}, schema interface{}, v interface{}, at string) []string {
+	s := resolveRef(spec, schema).(map[string]interface{})
+	if v == nil {
+		if s["nullable"] == true || len(s) == 0 {
+			return nil
+		}
+		return []string{at + ": null not allowed"}
+	}
+	if all, ok := s["allOf"].([]interface{}); ok {
+		var errs []string
+		for _, sub := range all {
+			errs = append(errs, validate(spec, sub, v, at)...)
+		}
+		return errs
+	}
+
+	switch s["type"] {
+	case nil:
+		return nil
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: want object, got %T", at, v)}
+		}
+		var errs []string
+		props, _ := s["properties"].(map[string]interface{})
+		req, _ := s["required"].([]interface{})
+		for _, name := range req {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required %s", at, name))
+			}
+		}
+		for k, fv := range obj {
+			if ps, ok := props[k]; ok {
+				errs = append(errs, validate(spec, ps, fv, at+"."+k)...)
+			} else if ap, ok := s["additionalProperties"]; ok {
+				errs = append(errs, validate(spec, ap, fv, at+"."+k)...)
+			} else {
+				errs = append(errs, fmt.Sprintf("%s: undocumented field %s", at, k))
+			}
+		}
+		return errs
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: want array, got %T", at, v)}
+		}
+		var errs []string
+		for i, item := range arr {
+			errs = append(errs, validate(spec, s["items"], item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+		return errs
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: want string, got %T", at, v)}
+		}
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return []string{fmt.Sprintf("%s: %v", at, err)}
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return []string{fmt.Sprintf("%s: want integer, got %v", at, v)}
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return []string{fmt.Sprintf("%s: want number, got %T", at, v)}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("%s: want boolean, got %T", at, v)}
+		}
+	}
+	return nil
+}
+
+func checkBody(t *testing.T, spec map[string]interface{}, method, path string, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	var body interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	for _, e := range validate(spec, responseSchema(t, spec, method, path, rec.Code), body, "$") {
+		t.Errorf("%s %s %d: %s", method, path, rec.Code, e)
+	}
+}
+
+// testFrame wraps tlv in a header and trailer that pass validateFrame.
+func testFrame(tlv []byte) []byte {
+	f := make([]byte, frameHeaderLen, frameHeaderLen+len(tlv)+2)
+	f[0] = frameStartFlag
+	n := frameHeaderLen + len(tlv) + 2
+	f[1], f[2] = byte(n>>8), byte(n)
+	copy(f[4:12], []byte{0x12, 0x34, 0x56, 0x78, 0x90, 0x12, 0x34, 0x56})
+	copy(f[12:14], []byte{0x00, 0x01})
+	copy(f[14:22], []byte{0x08, 0x61, 0x23, 0x45, 0x67, 0x89, 0x01, 0x23})
+	f[27], f[28] = byte(len(tlv)>>8), byte(len(tlv))
+	f = append(f, tlv...)
+	f = append(f, 0, frameEndFlag)
+	f[len(f)-2] = frameChecksum(f)
+	return f
+}
+
+func TestOpenAPIDocumentIsWellFormed(t *testing.T) {
+	spec := loadSpec(t)
+	if spec["openapi"] != openAPIVersion {
+		t.Errorf("openapi = %v", spec["openapi"])
+	}
+
+	ids := map[string]string{}
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method, op := range item.(map[string]interface{}) {
+			op := op.(map[string]interface{})
+			id, _ := op["operationId"].(string)
+			if id == "" || ids[id] != "" {
+				t.Errorf("%s %s: operationId %q missing or also used by %s", method, path, id, ids[id])
+			}
+			ids[id] = method + " " + path
+
+			declared := map[string]bool{}
+			params, _ := op["parameters"].([]interface{})
+			for _, p := range params {
+				p := p.(map[string]interface{})
+				if p["in"] == "path" {
+					declared[p["name"].(string)] = true
+				}
+				if p["in"] == "query" && p["description"] == "" {
+					t.Errorf("%s %s: query parameter %v has no entry in paramDocs", method, path, p["name"])
+				}
+			}
+			for _, m := range pathParamRe.FindAllStringSubmatch(path, -1) {
+				if !declared[m[1]] {
+					t.Errorf("%s %s: path parameter %s not declared", method, path, m[1])
+				}
+			}
+		}
+	}
+
+	// every $ref must point at something
+	var walk func(v interface{}, at string)
+	walk = func(v interface{}, at string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok && resolveRef(spec, v) == nil {
+				t.Errorf("%s: dangling $ref %s", at, ref)
+			}
+			for k, c := range v {
+				walk(c, at+"/"+k)
+			}
+		case []interface{}:
+			for i, c := range v {
+				walk(c, fmt.Sprintf("%s/%d", at, i))
+			}
+		}
+	}
+	walk(spec, "#")
+}
+
+func TestEveryRouteIsRegisteredAndDocumented(t *testing.T) {
+	spec := loadSpec(t)
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	for _, rt := range apiRoutes() {
+		specOperation(t, spec, rt.Method, apiPrefix+rt.Path)
+
+		path := pathParamRe.ReplaceAllString(rt.Path, "1")
+		for _, prefix := range []string{apiPrefix, apiLegacyPrefix} {
+			req := httptest.NewRequest(rt.Method, prefix+path, nil)
+			if _, pattern := mux.Handler(req); pattern != rt.Method+" "+prefix+rt.Path {
+				t.Errorf("%s %s routed to %q", rt.Method, prefix+path, pattern)
+			}
+		}
+	}
+	for _, rt := range opsRoutes {
+		specOperation(t, spec, rt.Method, rt.Path)
+	}
+}
+
+func TestLegacyPathIsDeprecatedAlias(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Deprecation") != "true" {
+		t.Fatalf("legacy path: %d, Deprecation %q", rec.Code, rec.Header().Get("Deprecation"))
+	}
+	if link := rec.Header().Get("Link"); link != `</api/v1/openapi.json>; rel="successor-version"` {
+		t.Errorf("Link = %q", link)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if rec.Header().Get("Deprecation") != "" {
+		t.Error("v1 path marked deprecated")
+	}
+}
+
+func TestDecodeResponseMatchesSchema(t *testing.T) {
+	spec := loadSpec(t)
+
+	// battery 90, flow 16, valve open, then an unknown tag
+	frame := testFrame([]byte{0x08, 0x5A, 0x04, 0x00, 0x00, 0x00, 0x10, 0x13, 0x01, 0xEE})
+	body := fmt.Sprintf(`{"hex": "% X"}`, frame)
+	rec := httptest.NewRecorder()
+	postDecode(rec, httptest.NewRequest("POST", "/api/v1/decode", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("decode: %d %s", rec.Code, rec.Body)
+	}
+	checkBody(t, spec, "POST", "/api/v1/decode", rec)
+
+	rec = httptest.NewRecorder()
+	postDecode(rec, httptest.NewRequest("POST", "/api/v1/decode", strings.NewReader(`{"hex": "08 5A", "kind": "bogus"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bogus kind: %d", rec.Code)
+	}
+	checkBody(t, spec, "POST", "/api/v1/decode", rec)
+}
+
+func TestErrorResponseShape(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, http.StatusNotFound, "device 123 not found")
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var e APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	want := APIErrorBody{Status: 404, Code: "not_found", Message: "device 123 not found"}
+	if rec.Code != 404 || e.Error != want {
+		t.Errorf("got %d %+v, want %+v", rec.Code, e.Error, want)
+	}
+	checkBody(t, loadSpec(t), "GET", "/api/v1/devices/{imei}", rec)
+}
+
+func TestHealthzMatchesSchema(t *testing.T) {
+	rec := httptest.NewRecorder()
+	getHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	checkBody(t, loadSpec(t), "GET", "/healthz", rec)
+}
+
+func TestReadingsPageMatchesSchema(t *testing.T) {
+	spec := loadSpec(t)
+
+	msgs := []Msg{
+		Msg{ID: 2, FrameID: 2, Temperature: 215, Valve: 1, Serial: "A1", RTC: []interface{}{24.0, 5.0, 1.0}, CreatedAt: time.Now()},
+		Msg{ID: 1, FrameID: 1, CreatedAt: time.Now()},
+	}
+	rec := httptest.NewRecorder()
+	total := 2
+	writePage(rec, listParams{Limit: 1, Desc: true}, msgs, []int{2, 1}, &total)
+	checkBody(t, spec, "GET", "/api/v1/messages", rec)
+
+	// one reading type for every readings endpoint: temperature and valve are
+	// integers under the same names whichever route returned them
+	msg := resolveRef(spec, schemaRef("Msg")).(map[string]interface{})["properties"].(map[string]interface{})
+	for _, name := range []string{"temperature", "valve"} {
+		if s, _ := msg[name].(map[string]interface{}); s == nil || s["type"] != "integer" {
+			t.Errorf("Msg.%s schema = %v", name, msg[name])
+		}
+	}
+	for _, path := range []string{"/api/v1/messages", "/api/v1/devices/{imei}/readings"} {
+		items := responseSchema(t, spec, "GET", path, 200).(map[string]interface{})["properties"].(map[string]interface{})["data"].(map[string]interface{})["items"]
+		if ref := items.(map[string]interface{})["$ref"]; ref != "#/components/schemas/Msg" {
+			t.Errorf("%s items = %v", path, ref)
+		}
+	}
+}
+
+func TestDecodedFramesRejectsCorruptDecodeErrors(t *testing.T) {
+	mock := useMockDB(t)
+	columns := []string{"id", "meter_address", "imei", "tlv_hex", "checksum", "end_flag", "created_at", "decode_errors", "transport"}
+	mock.ExpectQuery(`FROM meter_frames f`).WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(9, "", "0861234567890123", "", "", "", time.Now(), []byte(`{not json`), "tcp"))
+
+	rec := httptest.NewRecorder()
+	getDecodedFrames(rec, httptest.NewRequest("GET", "/api/v1/frames/decoded/all", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "frame 9") {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
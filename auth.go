@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// -------------------------
+// AUTHENTICATION
+// -------------------------
+// Every HTTP route is wrapped in requireRole. Callers authenticate with
+//
+//	X-API-Key: mk_<prefix>_<secret>           (or Authorization: Bearer mk_...)
+//	Authorization: Bearer <JWT>               (HS256, signed with JWT_SECRET)
+//
+// API keys are stored as SHA-256 hashes and looked up by their public prefix;
+// the full key is shown once, when it is created. JWTs carry the role in a
+// "role" claim, the caller in "sub" and optionally a "tenant" id (no claim
+// means a platform caller, a claim that is not a positive integer fails); they
+// are rejected unless JWT_SECRET is set. JWT_ISSUER and JWT_AUDIENCE, when set, must match.
+//
+// Roles are ordered: read-only < operator < admin. Operators can act on
+// meters and alerts (groups, alert rules, sweeps, webhook retries); admins
+// also manage webhooks, reprocessing, API keys and the audit log.
+
+type role int
+
+const (
+	roleReadOnly role = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleReadOnly: "read-only",
+	roleOperator: "operator",
+	roleAdmin:    "admin",
+}
+
+func (r role) String() string { return roleNames[r] }
+
+func parseRole(s string) (role, bool) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Name     string // "key:<name>#<id>" or "jwt:<sub>"
+	Role     role
+	KeyID    int
+	TenantID int // 0 for platform-wide credentials
+}
+
+type principalKey struct{}
+
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+var (
+	errNoCredentials  = errors.New("missing credentials")
+	errBadCredentials = errors.New("invalid credentials")
+	// errAuthUnavailable means the credentials could not be checked at all;
+	// the cause is logged, not sent to the client
+	errAuthUnavailable = errors.New("authentication temporarily unavailable")
+)
+
+const apiKeyPrefix = "mk_"
+
+// generateAPIKey returns a new key and its lookup prefix.
+func generateAPIKey() (key, prefix string) {
+	p := make([]byte, 4)
+	s := make([]byte, 16)
+	rand.Read(p)
+	rand.Read(s)
+	prefix = hex.EncodeToString(p)
+	return apiKeyPrefix + prefix + "_" + hex.EncodeToString(s), prefix
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func lookupAPIKey(key string) (*principal, error) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return nil, errBadCredentials
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, errBadCredentials
+	}
+
+	var id, tenant int
+	var name, hash, roleName string
+	err := db.QueryRow(`
+        SELECT id, name, key_hash, role, COALESCE(tenant_id, 0) FROM api_keys WHERE prefix = $1 AND revoked_at IS NULL
+    `, prefix).Scan(&id, &name, &hash, &roleName, &tenant)
+	if err == sql.ErrNoRows {
+		return nil, errBadCredentials
+	}
+	if err != nil {
+		slog.Error("looking up API key failed", "prefix", prefix, "err", err)
+		return nil, errAuthUnavailable
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashAPIKey(key))) != 1 {
+		return nil, errBadCredentials
+	}
+	r, ok := parseRole(roleName)
+	if !ok {
+		return nil, errBadCredentials
+	}
+
+	if _, err := db.Exec(`UPDATE api_keys SET last_used_at = now() WHERE id = $1`, id); err != nil {
+		slog.Warn("recording API key use failed", "key_id", id, "err", err)
+	}
+	return &principal{Name: fmt.Sprintf("key:%s#%d", name, id), Role: r, KeyID: id, TenantID: tenant}, nil
+}
+
+func parseJWT(token string) (*principal, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, errBadCredentials
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired()}
+	if iss := os.Getenv("JWT_ISSUER"); iss != "" {
+		opts = append(opts, jwt.WithIssuer(iss))
+	}
+	if aud := os.Getenv("JWT_AUDIENCE"); aud != "" {
+		opts = append(opts, jwt.WithAudience(aud))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, opts...)
+	if err != nil {
+		return nil, errBadCredentials
+	}
+
+	sub, _ := claims.GetSubject()
+	roleName, _ := claims["role"].(string)
+	r, ok := parseRole(roleName)
+	if sub == "" || !ok {
+		return nil, errBadCredentials
+	}
+	p := &principal{Name: "jwt:" + sub, Role: r}
+	if v, ok := claims["tenant"]; ok {
+		// only a missing claim means platform scope; anything that is not a
+		// tenant id is rejected rather than read as 0
+		tenant, ok := v.(float64)
+		if !ok || tenant < 1 || tenant > math.MaxInt32 || tenant != math.Trunc(tenant) {
+			return nil, errBadCredentials
+		}
+		p.TenantID = int(tenant)
+	}
+	return p, nil
+}
+
+// authenticate resolves the caller from the request headers. Browsers cannot
+// set headers on EventSource/WebSocket requests, so the live feed also
+// accepts ?access_token=.
+func authenticate(r *http.Request) (*principal, error) {
+	token := r.Header.Get("X-API-Key")
+	if token == "" {
+		if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = strings.TrimSpace(v)
+		}
+	}
+	if token == "" && (strings.HasPrefix(r.URL.Path, apiPrefix+"/live/") || strings.HasPrefix(r.URL.Path, apiLegacyPrefix+"/live/")) {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return nil, errNoCredentials
+	}
+
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return lookupAPIKey(token)
+	}
+	return parseJWT(token)
+}
+
+// requireRole authenticates the request, checks the caller's role against
+// min, records the outcome in the audit log and times it for /metrics.
+func requireRole(min role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		status := http.StatusOK
+		var p *principal
+		defer func() {
+			recordAudit(p, r, status, start)
+			observeHTTP(r, status, start)
+		}()
+
+		p, err := authenticate(r)
+		if err == errAuthUnavailable {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			status = http.StatusServiceUnavailable
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="meters"`)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			status = http.StatusUnauthorized
+			return
+		}
+		if p.Role < min {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("role %s required", min))
+			status = http.StatusForbidden
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		status = rec.code()
+	}
+}
+
+// statusRecorder captures the response status for the audit log while still
+// letting the live feed flush and hijack the connection.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *statusRecorder) code() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// -------------------------
+// AUDIT LOG
+// -------------------------
+// Entries are queued and written by a single background goroutine so that
+// auditing never adds a database round trip to the response.
+
+type auditEntry struct {
+	ID         int       `json:"id"`
+	At         time.Time `json:"at"`
+	Principal  string    `json:"principal"`
+	Role       string    `json:"role,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remote_addr"`
+	DurationMS int       `json:"duration_ms"`
+}
+
+var auditQueue = make(chan auditEntry, 1024)
+
+func recordAudit(p *principal, r *http.Request, status int, start time.Time) {
+	q := r.URL.Query()
+	if q.Has("access_token") {
+		q.Set("access_token", "REDACTED")
+	}
+	e := auditEntry{
+		At:         start,
+		Principal:  "anonymous",
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      q.Encode(),
+		Status:     status,
+		RemoteAddr: r.RemoteAddr,
+		DurationMS: int(time.Since(start).Milliseconds()),
+	}
+	if p != nil {
+		e.Principal, e.Role = p.Name, p.Role.String()
+	}
+
+	select {
+	case auditQueue <- e:
+	default:
+		slog.Warn("audit queue full, dropping entry", "principal", e.Principal, "method", e.Method, "path", e.Path, "status", e.Status)
+	}
+}
+
+func startAuditWriter() {
+	for e := range auditQueue {
+		_, err := db.Exec(`
+            INSERT INTO audit_log (at, principal, role, method, path, query, status, remote_addr, duration_ms)
+            VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7, $8, $9)
+        `, e.At, e.Principal, e.Role, e.Method, e.Path, e.Query, e.Status, e.RemoteAddr, e.DurationMS)
+		if err != nil {
+			slog.Error("writing audit log failed", "err", err)
+		}
+	}
+}
+
+// GET /api/admin/audit?principal=&path=&status=&from=&to=&limit=&cursor=
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "at")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	q := r.URL.Query()
+
+	var where sqlWhere
+	if v := q.Get("principal"); v != "" {
+		where.add("principal = $%d", v)
+	}
+	if v := q.Get("path"); v != "" {
+		where.add("path LIKE $%d || '%%'", v)
+	}
+	if v := q.Get("status"); v != "" {
+		where.add("status = $%d", v)
+	}
+	if !p.From.IsZero() {
+		where.add("at >= $%d", p.From)
+	}
+	if !p.To.IsZero() {
+		where.add("at < $%d", p.To)
+	}
+
+	total, err := p.totalCount("SELECT COUNT(*) FROM audit_log "+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "id")
+	rows, err := db.Query(`
+        SELECT id, at, principal, COALESCE(role, ''), method, path, COALESCE(query, ''), status,
+               COALESCE(remote_addr, ''), COALESCE(duration_ms, 0)
+        FROM audit_log `+where.String()+" "+p.orderSQL("id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var list []auditEntry
+	var ids []int
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.At, &e.Principal, &e.Role, &e.Method, &e.Path, &e.Query,
+			&e.Status, &e.RemoteAddr, &e.DurationMS); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, e)
+		ids = append(ids, e.ID)
+	}
+
+	writePage(w, p, list, ids, total)
+}
+
+// -------------------------
+// API: API KEYS
+// -------------------------
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Role       string     `json:"role"`
+	TenantID   *int       `json:"tenant_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Key        string     `json:"key,omitempty"` // only set in the create response
+}
+
+func createAPIKey(name, roleName string, tenant int) (APIKey, error) {
+	if name == "" {
+		return APIKey{}, errors.New("name is required")
+	}
+	if _, ok := parseRole(roleName); !ok {
+		return APIKey{}, fmt.Errorf("role must be one of read-only, operator, admin")
+	}
+
+	k := APIKey{Name: name, Role: roleName}
+	if tenant != 0 {
+		k.TenantID = &tenant
+	}
+	k.Key, k.Prefix = generateAPIKey()
+	err := db.QueryRow(`
+        INSERT INTO api_keys (name, prefix, key_hash, role, tenant_id) VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at
+    `, k.Name, k.Prefix, hashAPIKey(k.Key), k.Role, nullTenant(tenant)).Scan(&k.ID, &k.CreatedAt)
+	return k, err
+}
+
+func revokeAPIKey(id string) (bool, error) {
+	res, err := db.Exec(`UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GET /api/admin/api-keys
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+        SELECT id, name, prefix, role, tenant_id, created_at, last_used_at, revoked_at FROM api_keys ORDER BY id
+    `)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	list := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Role, &k.TenantID, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, k)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// APIKeyRequest is the POST /api/v1/admin/api-keys body.
+type APIKeyRequest struct {
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	TenantID int    `json:"tenant_id,omitempty"`
+}
+
+// POST /api/admin/api-keys {"name": "...", "role": "read-only|operator|admin", "tenant_id": optional}
+func postAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+
+	k, err := createAPIKey(body.Name, body.Role, body.TenantID)
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	slog.Info("API key created", "key_id", k.ID, "name", k.Name, "role", k.Role, "by", requestPrincipal(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(k)
+}
+
+// DELETE /api/admin/api-keys/{id}
+func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	ok, err := revokeAPIKey(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, 404, "api key not found")
+		return
+	}
+	slog.Info("API key revoked", "key_id", r.PathValue("id"), "by", requestPrincipal(r).Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// -------------------------
+// CLI: apikey
+// -------------------------
+// apikey create -name NAME -role ROLE [-tenant ID]   prints the new key (needed to bootstrap the first admin)
+// apikey revoke -id ID
+func apiKeyCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: server apikey create -name NAME -role read-only|operator|admin [-tenant ID]\n       server apikey revoke -id ID")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "key name (who or what uses it)")
+	roleName := fs.String("role", "read-only", "read-only, operator or admin")
+	tenant := fs.Int("tenant", 0, "restrict the key to one tenant's data")
+	id := fs.String("id", "", "key id to revoke")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if err := openDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		k, err := createAPIKey(*name, *roleName, *tenant)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("id=%d role=%s\n%s\n", k.ID, k.Role, k.Key)
+		return 0
+	case "revoke":
+		ok, err := revokeAPIKey(*id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, "api key not found")
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown apikey command %q\n", args[0])
+		return 2
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useMockDB points db at a sqlmock for the length of the test; expected
+// queries are regular expressions.
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = conn
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db = old
+		conn.Close()
+	})
+	return mock
+}
+
+func TestLookupAPIKey(t *testing.T) {
+	key, prefix := generateAPIKey()
+	other, _ := generateAPIKey()
+	columns := []string{"id", "name", "key_hash", "role", "tenant_id"}
+
+	for _, c := range []struct {
+		name string
+		key  string
+		row  []driver.Value // nil: no such key
+		want *principal
+	}{
+		{"valid", key, []driver.Value{7, "ops", hashAPIKey(key), "operator", 3},
+			&principal{Name: "key:ops#7", Role: roleOperator, KeyID: 7, TenantID: 3}},
+		{"platform key", key, []driver.Value{8, "root", hashAPIKey(key), "admin", 0},
+			&principal{Name: "key:root#8", Role: roleAdmin, KeyID: 8}},
+		{"wrong secret", key, []driver.Value{7, "ops", hashAPIKey(other), "operator", 3}, nil},
+		{"unknown role", key, []driver.Value{7, "ops", hashAPIKey(key), "superuser", 3}, nil},
+		{"unknown or revoked", key, nil, nil},
+		{"no prefix separator", apiKeyPrefix + "abcdef", nil, nil},
+		{"not an API key", "secret", nil, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			if c.key == key {
+				q := mock.ExpectQuery(`FROM api_keys WHERE prefix = \$1 AND revoked_at IS NULL`).WithArgs(prefix)
+				if c.row == nil {
+					q.WillReturnError(sql.ErrNoRows)
+				} else {
+					q.WillReturnRows(sqlmock.NewRows(columns).AddRow(c.row...))
+				}
+			}
+			if c.want != nil {
+				mock.ExpectExec(`UPDATE api_keys SET last_used_at`).WithArgs(c.want.KeyID).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			p, err := lookupAPIKey(c.key)
+			if c.want == nil {
+				if err != errBadCredentials {
+					t.Fatalf("got %+v, %v; want invalid credentials", p, err)
+				}
+				return
+			}
+			if err != nil || *p != *c.want {
+				t.Fatalf("got %+v, %v; want %+v", p, err, c.want)
+			}
+		})
+	}
+}
+
+func TestLookupAPIKeyStoreError(t *testing.T) {
+	key, prefix := generateAPIKey()
+	mock := useMockDB(t)
+	mock.ExpectQuery(`FROM api_keys`).WithArgs(prefix).WillReturnError(errors.New("connection refused"))
+
+	if p, err := lookupAPIKey(key); err != errAuthUnavailable {
+		t.Fatalf("got %+v, %v; want auth unavailable", p, err)
+	}
+
+	// requireRole answers 503 without the driver's error text
+	mock.ExpectQuery(`FROM api_keys`).WithArgs(prefix).WillReturnError(errors.New("connection refused"))
+	r := httptest.NewRequest("GET", apiPrefix+"/groups", nil)
+	r.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	requireRole(roleReadOnly, func(http.ResponseWriter, *http.Request) { t.Error("handler ran") })(w, r)
+	if w.Code != http.StatusServiceUnavailable || strings.Contains(w.Body.String(), "refused") {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+const testJWTSecret = "test-secret"
+
+func signTestJWT(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testClaims returns valid claims for sub with the changes applied; a nil
+// value removes the claim.
+func testClaims(changes jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{"sub": "alice", "role": "operator", "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range changes {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestParseJWT(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	hs256 := func(changes jwt.MapClaims) string {
+		return signTestJWT(t, jwt.SigningMethodHS256, []byte(testJWTSecret), testClaims(changes))
+	}
+
+	for _, c := range []struct {
+		name  string
+		token string
+		want  *principal
+	}{
+		{"platform", hs256(nil), &principal{Name: "jwt:alice", Role: roleOperator}},
+		{"tenant", hs256(jwt.MapClaims{"tenant": 3}), &principal{Name: "jwt:alice", Role: roleOperator, TenantID: 3}},
+		{"admin", hs256(jwt.MapClaims{"role": "admin"}), &principal{Name: "jwt:alice", Role: roleAdmin}},
+
+		{"wrong alg HS384", signTestJWT(t, jwt.SigningMethodHS384, []byte(testJWTSecret), testClaims(nil)), nil},
+		{"alg none", signTestJWT(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, testClaims(nil)), nil},
+		{"wrong secret", signTestJWT(t, jwt.SigningMethodHS256, []byte("other"), testClaims(nil)), nil},
+		{"expired", hs256(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), nil},
+		{"no expiry", hs256(jwt.MapClaims{"exp": nil}), nil},
+		{"no subject", hs256(jwt.MapClaims{"sub": nil}), nil},
+		{"bad role", hs256(jwt.MapClaims{"role": "root"}), nil},
+		{"no role", hs256(jwt.MapClaims{"role": nil}), nil},
+		{"tenant as string", hs256(jwt.MapClaims{"tenant": "3"}), nil},
+		{"tenant zero", hs256(jwt.MapClaims{"tenant": 0}), nil},
+		{"negative tenant", hs256(jwt.MapClaims{"tenant": -2}), nil},
+		{"fractional tenant", hs256(jwt.MapClaims{"tenant": 2.5}), nil},
+		{"tenant out of range", hs256(jwt.MapClaims{"tenant": 1 << 40}), nil},
+		{"tenant bool", hs256(jwt.MapClaims{"tenant": true}), nil},
+		{"tenant object", hs256(jwt.MapClaims{"tenant": map[string]int{"id": 3}}), nil},
+		{"garbage", "not.a.jwt", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := parseJWT(c.token)
+			if c.want == nil {
+				if err != errBadCredentials {
+					t.Fatalf("got %+v, %v; want invalid credentials", p, err)
+				}
+				return
+			}
+			if err != nil || *p != *c.want {
+				t.Fatalf("got %+v, %v; want %+v", p, err, c.want)
+			}
+		})
+	}
+
+	// a null tenant is present, so it is not a platform token either
+	token := signTestJWT(t, jwt.SigningMethodHS256, []byte(testJWTSecret), jwt.MapClaims{
+		"sub": "alice", "role": "operator", "exp": time.Now().Add(time.Hour).Unix(), "tenant": nil,
+	})
+	if p, err := parseJWT(token); err != errBadCredentials {
+		t.Errorf("null tenant: got %+v, %v", p, err)
+	}
+
+	t.Setenv("JWT_SECRET", "")
+	if p, err := parseJWT(hs256(nil)); err != errBadCredentials {
+		t.Errorf("without JWT_SECRET: got %+v, %v", p, err)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	token := func(role string) string {
+		return "Bearer " + signTestJWT(t, jwt.SigningMethodHS256, []byte(testJWTSecret), testClaims(jwt.MapClaims{"role": role}))
+	}
+
+	for _, c := range []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"bad token", "Bearer not.a.jwt", http.StatusUnauthorized},
+		{"unknown role", token("root"), http.StatusUnauthorized},
+		{"read-only below operator", token("read-only"), http.StatusForbidden},
+		{"operator", token("operator"), http.StatusOK},
+		{"admin above operator", token("admin"), http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var got *principal
+			h := requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+				got = requestPrincipal(r)
+			})
+			r := httptest.NewRequest("GET", apiPrefix+"/groups", nil)
+			if c.auth != "" {
+				r.Header.Set("Authorization", c.auth)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != c.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.status, w.Body)
+			}
+			if c.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if (c.status == http.StatusOK) != (got != nil) {
+				t.Errorf("handler saw principal %+v", got)
+			}
+		})
+	}
+}
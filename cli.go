@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// -------------------------
+// CLI SUBCOMMANDS
+// -------------------------
+// `server` with no arguments runs the TCP + HTTP service; anything else is a
+// one-shot command that exits with the returned status.
+func runCommand(name string, args []string) int {
+	switch name {
+	case "serve":
+		serve()
+		return 0
+	case "reprocess":
+		return reprocessCommand(args)
+	case "apikey":
+		return apiKeyCommand(args)
+	case "export":
+		return exportCommand(args)
+	case "simulate":
+		return simulateCommand(args)
+	case "replay":
+		return replayCommand(args)
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `usage: server [command] [flags]
+
+commands:
+  serve       run the TCP listener and HTTP API (default)
+  reprocess   re-run the current decoder over stored meter_frames
+  apikey      create or revoke HTTP API keys
+  export      write readings as csv, excel, ndjson or parquet
+  simulate    send synthetic meter frames to the TCP listener
+  replay      decode frames from pcap/pcapng captures or hex logs`)
+}
+
+// openDB connects and migrates for commands that need the database.
+func openDB() error {
+	var err error
+	db, err = connectDB()
+	if err != nil {
+		return fmt.Errorf("DB error: %w", err)
+	}
+	return migrateDB(db)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------------
+// CONSUMPTION AGGREGATION
+// -------------------------
+// messages.total is a cumulative register. Consumption for a bucket is the
+// increase of that register, with each pair of successive readings spread
+// linearly over the time between them so gaps are interpolated rather than
+// dumped into the bucket of the next reading.
+
+// data-quality flags attached to buckets
+const (
+	flagRollover     = "rollover"       // register wrapped past counter_max
+	flagMeterReplace = "meter_replaced" // serial changed between readings
+	flagMeterReset   = "meter_reset"    // register dropped to near zero
+	flagNegative     = "negative_delta" // register went backwards (reverse flow/tamper)
+	flagInterpolated = "interpolated"   // spread across a gap longer than max_gap
+	flagNoData       = "no_data"        // no pair of readings covers this bucket
+	flagPartial      = "partial"        // only part of the bucket is covered
+)
+
+// default width of tag 0x02 (3 bytes)
+const defaultCounterMax = 1 << 24
+
+const maxConsumptionBuckets = 10000
+
+type meterReading struct {
+	At     time.Time
+	Total  int64
+	Flow   int64
+	Serial string
+}
+
+type consumptionBucket struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Consumption float64   `json:"consumption"`
+	Readings    int       `json:"readings"`
+	Flags       []string  `json:"flags"`
+
+	covered time.Duration
+	flagSet map[string]bool
+}
+
+type consumptionOptions struct {
+	Interval   string
+	From       time.Time
+	To         time.Time
+	Location   *time.Location
+	CounterMax int64
+	MaxGap     time.Duration
+}
+
+func bucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	default: // month
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+}
+
+func nextBucket(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return t.Add(time.Hour)
+	case "day":
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+func nominalInterval(interval string) time.Duration {
+	switch interval {
+	case "hour":
+		return time.Hour
+	case "day":
+		return 24 * time.Hour
+	default:
+		return 30 * 24 * time.Hour
+	}
+}
+
+// readingDelta is how much the register advanced from prev to cur, and why it
+// is not simply cur-prev when it isn't.
+func readingDelta(prev, cur meterReading, counterMax int64) (int64, string) {
+	if prev.Serial != "" && cur.Serial != "" && prev.Serial != cur.Serial {
+		// new meter: whatever it was installed with is not consumption we saw
+		return 0, flagMeterReplace
+	}
+	d := cur.Total - prev.Total
+	if d >= 0 {
+		return d, ""
+	}
+	// wrapped: old value near the top, new value near the bottom
+	if prev.Total > counterMax*9/10 && cur.Total < counterMax/10 {
+		return cur.Total + counterMax - prev.Total, flagRollover
+	}
+	if cur.Total < prev.Total/10 {
+		// restarted from zero: what it shows now was used since the reset
+		return cur.Total, flagMeterReset
+	}
+	return 0, flagNegative
+}
+
+// computeConsumption buckets readings (sorted by time, may include one reading
+// either side of the range) into consumption per interval. Readings, the
+// pairs between them and the buckets are all in time order, so one forward
+// walk over each covers them.
+func computeConsumption(readings []meterReading, opt consumptionOptions) []*consumptionBucket {
+	var buckets []*consumptionBucket
+	for s := bucketStart(opt.From, opt.Interval, opt.Location); s.Before(opt.To); s = nextBucket(s, opt.Interval) {
+		buckets = append(buckets, &consumptionBucket{Start: s, End: nextBucket(s, opt.Interval), flagSet: map[string]bool{}})
+	}
+
+	k := 0
+	for _, rd := range readings {
+		for k < len(buckets) && !rd.At.Before(buckets[k].End) {
+			k++
+		}
+		if k == len(buckets) {
+			break
+		}
+		if !rd.At.Before(buckets[k].Start) {
+			buckets[k].Readings++
+		}
+	}
+
+	k = 0
+	for i := 1; i < len(readings); i++ {
+		prev, cur := readings[i-1], readings[i]
+		span := cur.At.Sub(prev.At)
+		if span <= 0 {
+			continue
+		}
+
+		delta, flag := readingDelta(prev, cur, opt.CounterMax)
+		gap := span > opt.MaxGap
+
+		// skip buckets that end before this pair starts; the next pair
+		// starts where this one ends, so k never has to move back
+		for k < len(buckets) && !buckets[k].End.After(prev.At) {
+			k++
+		}
+		for _, b := range buckets[k:] {
+			if !b.Start.Before(cur.At) {
+				break
+			}
+			lo, hi := prev.At, cur.At
+			if b.Start.After(lo) {
+				lo = b.Start
+			}
+			if b.End.Before(hi) {
+				hi = b.End
+			}
+			overlap := hi.Sub(lo)
+			b.Consumption += float64(delta) * float64(overlap) / float64(span)
+			b.covered += overlap
+			if flag != "" {
+				b.flagSet[flag] = true
+			}
+			if gap {
+				b.flagSet[flagInterpolated] = true
+			}
+		}
+	}
+
+	for _, b := range buckets {
+		b.Consumption = math.Round(b.Consumption*1000) / 1000
+		if b.covered == 0 {
+			b.flagSet[flagNoData] = true
+		} else if b.covered < b.End.Sub(b.Start) {
+			b.flagSet[flagPartial] = true
+		}
+		b.Flags = sortedFlags(b.flagSet)
+	}
+
+	return buckets
+}
+
+func sortedFlags(set map[string]bool) []string {
+	flags := []string{}
+	for f := range set {
+		flags = append(flags, f)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// loadReadings returns the device's readings inside [from, to) plus the nearest
+// reading on either side, so the edges of the range can be interpolated.
+func loadReadings(imei string, from, to time.Time) ([]meterReading, error) {
+	rows, err := db.Query(`
+        (SELECT m.measured_at, m.total, m.flow, COALESCE(m.serial, '')
+         FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+         WHERE f.imei = $1 AND m.measured_at < $2
+         ORDER BY m.measured_at DESC LIMIT 1)
+        UNION ALL
+        (SELECT m.measured_at, m.total, m.flow, COALESCE(m.serial, '')
+         FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+         WHERE f.imei = $1 AND m.measured_at >= $2 AND m.measured_at < $3)
+        UNION ALL
+        (SELECT m.measured_at, m.total, m.flow, COALESCE(m.serial, '')
+         FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+         WHERE f.imei = $1 AND m.measured_at >= $3
+         ORDER BY m.measured_at ASC LIMIT 1)
+        ORDER BY 1
+    `, imei, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []meterReading
+	for rows.Next() {
+		var rd meterReading
+		if err := rows.Scan(&rd.At, &rd.Total, &rd.Flow, &rd.Serial); err != nil {
+			return nil, err
+		}
+		list = append(list, rd)
+	}
+	return list, rows.Err()
+}
+
+// ConsumptionSeries is one device's (or the group sum's) bucketed usage.
+type ConsumptionSeries struct {
+	IMEI    string               `json:"imei,omitempty"`
+	Group   string               `json:"group,omitempty"`
+	Total   float64              `json:"total"`
+	Flags   []string             `json:"flags"`
+	Buckets []*consumptionBucket `json:"buckets"`
+}
+
+// ConsumptionResult is the consumption endpoints' response.
+type ConsumptionResult struct {
+	Interval string              `json:"interval"`
+	From     time.Time           `json:"from"`
+	To       time.Time           `json:"to"`
+	Devices  []ConsumptionSeries `json:"devices"`
+	Group    *ConsumptionSeries  `json:"group,omitempty"`
+}
+
+// -------------------------
+// API: CONSUMPTION
+// -------------------------
+// GET /api/consumption?imei=A&imei=B | group=G
+//
+//	&interval=hour|day|month&from=RFC3339&to=RFC3339
+//	&tz=Europe/Berlin&counter_max=16777216&max_gap=6h
+//
+// Returns a series per device and, with group=, the summed group series.
+func getConsumption(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	opt := consumptionOptions{Interval: q.Get("interval"), Location: time.UTC, CounterMax: defaultCounterMax}
+	if opt.Interval == "" {
+		opt.Interval = "day"
+	}
+	if opt.Interval != "hour" && opt.Interval != "day" && opt.Interval != "month" {
+		writeError(w, 400, "interval must be hour, day or month")
+		return
+	}
+
+	if tz := q.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			writeError(w, 400, "invalid tz: "+err.Error())
+			return
+		}
+		opt.Location = loc
+	}
+
+	var err error
+	if opt.From, err = time.Parse(time.RFC3339, q.Get("from")); err != nil {
+		writeError(w, 400, "from is required (RFC3339)")
+		return
+	}
+	opt.To = time.Now()
+	if v := q.Get("to"); v != "" {
+		if opt.To, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, 400, "invalid to: "+err.Error())
+			return
+		}
+	}
+	if !opt.To.After(opt.From) {
+		writeError(w, 400, "to must be after from")
+		return
+	}
+
+	if opt.To.Sub(opt.From)/nominalInterval(opt.Interval) > maxConsumptionBuckets {
+		writeError(w, 400, fmt.Sprintf("range too large: more than %d %s buckets", maxConsumptionBuckets, opt.Interval))
+		return
+	}
+
+	if v := q.Get("counter_max"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, 400, "invalid counter_max")
+			return
+		}
+		opt.CounterMax = n
+	}
+
+	opt.MaxGap = 2 * nominalInterval(opt.Interval)
+	if v := q.Get("max_gap"); v != "" {
+		if opt.MaxGap, err = time.ParseDuration(v); err != nil {
+			writeError(w, 400, "invalid max_gap: "+err.Error())
+			return
+		}
+	}
+
+	tenant := callerTenant(r)
+	imeis, err := visibleIMEIs(tenant, q["imei"])
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	group := q.Get("group")
+	if group != "" {
+		rows, err := db.Query(`SELECT imei FROM devices WHERE group_name = $1 AND ($2 = 0 OR tenant_id = $2) ORDER BY imei`, group, tenant)
+		if err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		for rows.Next() {
+			var imei string
+			rows.Scan(&imei)
+			imeis = append(imeis, imei)
+		}
+		rows.Close()
+	}
+	if len(imeis) == 0 {
+		writeError(w, 400, "imei or group is required")
+		return
+	}
+
+	res := ConsumptionResult{Interval: opt.Interval, From: opt.From, To: opt.To}
+
+	var groupBuckets []*consumptionBucket
+	for _, imei := range imeis {
+		readings, err := loadReadings(imei, opt.From, opt.To)
+		if err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+
+		buckets := computeConsumption(readings, opt)
+		s := ConsumptionSeries{IMEI: imei, Buckets: buckets}
+		flags := map[string]bool{}
+		for _, b := range buckets {
+			s.Total += b.Consumption
+			for _, f := range b.Flags {
+				flags[f] = true
+			}
+		}
+		s.Total = math.Round(s.Total*1000) / 1000
+		s.Flags = sortedFlags(flags)
+		res.Devices = append(res.Devices, s)
+
+		if group == "" {
+			continue
+		}
+		if groupBuckets == nil {
+			for _, b := range buckets {
+				groupBuckets = append(groupBuckets, &consumptionBucket{Start: b.Start, End: b.End, flagSet: map[string]bool{}})
+			}
+		}
+		for i, b := range buckets {
+			groupBuckets[i].Consumption += b.Consumption
+			groupBuckets[i].Readings += b.Readings
+			for _, f := range b.Flags {
+				groupBuckets[i].flagSet[f] = true
+			}
+		}
+	}
+
+	if group != "" {
+		g := &ConsumptionSeries{Group: group, Buckets: groupBuckets}
+		flags := map[string]bool{}
+		for _, b := range groupBuckets {
+			b.Consumption = math.Round(b.Consumption*1000) / 1000
+			b.Flags = sortedFlags(b.flagSet)
+			g.Total += b.Consumption
+			for _, f := range b.Flags {
+				flags[f] = true
+			}
+		}
+		g.Total = math.Round(g.Total*1000) / 1000
+		g.Flags = sortedFlags(flags)
+		res.Group = g
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// GET /api/devices/{imei}/consumption (same params as /api/consumption)
+func getDeviceConsumption(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDevice(w, r)
+	if !ok {
+		return
+	}
+	getConsumption(w, withIMEI(r, d.IMEI))
+}
+
+// -------------------------
+// API: DEVICE GROUP
+// -------------------------
+// DeviceGroupRequest is the PUT /api/v1/devices/{imei}/group body.
+type DeviceGroupRequest struct {
+	Group string `json:"group"`
+}
+
+// PUT /api/devices/{imei}/group with {"group": "district-7"}; an empty group clears it.
+func putDeviceGroup(w http.ResponseWriter, r *http.Request) {
+	var req DeviceGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+
+	var group interface{}
+	if g := strings.TrimSpace(req.Group); g != "" {
+		group = g
+	}
+
+	res, err := db.Exec(`UPDATE devices SET group_name = $2 WHERE imei = $1 AND ($3 = 0 OR tenant_id = $3)`,
+		r.PathValue("imei"), group, callerTenant(r))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, 404, fmt.Sprintf("device %s not found", r.PathValue("imei")))
+		return
+	}
+
+	getDevice(w, r)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReadingDelta(t *testing.T) {
+	const max = 1000
+	for _, c := range []struct {
+		name      string
+		prev, cur meterReading
+		delta     int64
+		flag      string
+	}{
+		{"advance", meterReading{Total: 100}, meterReading{Total: 130}, 30, ""},
+		{"standstill", meterReading{Total: 100}, meterReading{Total: 100}, 0, ""},
+		{"rollover", meterReading{Total: 990}, meterReading{Total: 15}, 25, flagRollover},
+		{"meter replaced", meterReading{Total: 500, Serial: "A1"}, meterReading{Total: 3, Serial: "B2"}, 0, flagMeterReplace},
+		{"replaced meter reading higher", meterReading{Total: 5, Serial: "A1"}, meterReading{Total: 800, Serial: "B2"}, 0, flagMeterReplace},
+		{"serial missing on one side", meterReading{Total: 100, Serial: "A1"}, meterReading{Total: 110}, 10, ""},
+		{"reset", meterReading{Total: 500}, meterReading{Total: 20}, 20, flagMeterReset},
+		{"reset to zero", meterReading{Total: 500}, meterReading{Total: 0}, 0, flagMeterReset},
+		{"negative", meterReading{Total: 500}, meterReading{Total: 480}, 0, flagNegative},
+		{"high but not wrapped", meterReading{Total: 950}, meterReading{Total: 400}, 0, flagNegative},
+	} {
+		delta, flag := readingDelta(c.prev, c.cur, max)
+		if delta != c.delta || flag != c.flag {
+			t.Errorf("%s: got %d %q, want %d %q", c.name, delta, flag, c.delta, c.flag)
+		}
+	}
+}
+
+func consumptionAt(h int, total int64) meterReading {
+	return meterReading{At: time.Date(2026, 6, 1, h, 0, 0, 0, time.UTC), Total: total}
+}
+
+func TestComputeConsumptionFlags(t *testing.T) {
+	opt := consumptionOptions{
+		Interval: "hour", Location: time.UTC, CounterMax: 1000, MaxGap: 2 * time.Hour,
+		From: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	readings := []meterReading{
+		{At: time.Date(2026, 6, 1, 0, 30, 0, 0, time.UTC), Total: 100}, // starts half way into hour 0
+		consumptionAt(1, 160),
+		consumptionAt(2, 990),
+		consumptionAt(3, 10), // rollover: 20
+		consumptionAt(7, 90), // 4h gap: 80 spread over hours 3-6
+		consumptionAt(8, 5),  // reset: 5 since zero
+		consumptionAt(9, 3),  // negative
+		// nothing after 09:00
+	}
+
+	buckets := computeConsumption(readings, opt)
+	if len(buckets) != 12 {
+		t.Fatalf("%d buckets", len(buckets))
+	}
+	for _, c := range []struct {
+		hour     int
+		want     float64
+		readings int
+		flags    []string
+	}{
+		{0, 60, 1, []string{flagPartial}},
+		{1, 830, 1, []string{}},
+		{2, 20, 1, []string{flagRollover}},
+		{3, 20, 1, []string{flagInterpolated}},
+		{6, 20, 0, []string{flagInterpolated}},
+		{7, 5, 1, []string{flagMeterReset}},
+		{8, 0, 1, []string{flagNegative}},
+		{9, 0, 1, []string{flagNoData}},
+		{11, 0, 0, []string{flagNoData}},
+	} {
+		b := buckets[c.hour]
+		if b.Consumption != c.want || b.Readings != c.readings || !slices.Equal(b.Flags, c.flags) {
+			t.Errorf("hour %d: %v with %d readings %v, want %v with %d %v",
+				c.hour, b.Consumption, b.Readings, b.Flags, c.want, c.readings, c.flags)
+		}
+	}
+}
+
+func TestComputeConsumptionAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	// 2026-03-29 has 23 hours in Berlin and 2026-10-25 has 25
+	for _, c := range []struct {
+		day   int
+		month time.Month
+		hours int
+	}{
+		{29, time.March, 23},
+		{25, time.October, 25},
+	} {
+		from := time.Date(2026, c.month, c.day, 0, 0, 0, 0, berlin)
+		to := time.Date(2026, c.month, c.day+1, 0, 0, 0, 0, berlin)
+		readings := []meterReading{{At: from, Total: 0}, {At: to, Total: int64(100 * c.hours)}}
+
+		days := computeConsumption(readings, consumptionOptions{
+			Interval: "day", Location: berlin, CounterMax: defaultCounterMax, MaxGap: 48 * time.Hour, From: from, To: to,
+		})
+		if len(days) != 1 || days[0].End.Sub(days[0].Start) != time.Duration(c.hours)*time.Hour ||
+			days[0].Consumption != float64(100*c.hours) || len(days[0].Flags) != 0 {
+			t.Errorf("%s day: %+v", c.month, days[0])
+		}
+
+		hours := computeConsumption(readings, consumptionOptions{
+			Interval: "hour", Location: berlin, CounterMax: defaultCounterMax, MaxGap: 48 * time.Hour, From: from, To: to,
+		})
+		if len(hours) != c.hours {
+			t.Fatalf("%s: %d hour buckets, want %d", c.month, len(hours), c.hours)
+		}
+		for _, h := range hours {
+			if h.Consumption != 100 || len(h.Flags) != 0 {
+				t.Errorf("%s hour %s: %v %v", c.month, h.Start, h.Consumption, h.Flags)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	frameStartFlag = 0x68
+	frameEndFlag   = 0x16
+
+	// start flag .. tlv_length is 29 bytes; checksum and end flag follow the TLV.
+	frameHeaderLen = 29
+	frameMinLen    = frameHeaderLen + 2
+)
+
+// headerField describes where a header value lives in the raw frame.
+type headerField struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Hex    string `json:"hex,omitempty"`
+}
+
+var frameHeaderLayout = []headerField{
+	{Name: "start_flag", Offset: 0, Length: 1},
+	{Name: "frame_length", Offset: 1, Length: 2},
+	{Name: "product_type", Offset: 3, Length: 1},
+	{Name: "meter_address", Offset: 4, Length: 8},
+	{Name: "manufacturer_code", Offset: 12, Length: 2},
+	{Name: "imei", Offset: 14, Length: 8},
+	{Name: "protocol_version", Offset: 22, Length: 1},
+	{Name: "mid", Offset: 23, Length: 2},
+	{Name: "encryption_flag", Offset: 25, Length: 1},
+	{Name: "function_code", Offset: 26, Length: 1},
+	{Name: "tlv_length", Offset: 27, Length: 2},
+}
+
+// frameChecksum is the byte sum (mod 256) of everything before the checksum byte.
+func frameChecksum(packet []byte) byte {
+	var sum byte
+	for _, b := range packet[:len(packet)-2] {
+		sum += b
+	}
+	return sum
+}
+
+// validateFrame returns the problems that would make parseFrameHeader unsafe
+// or the frame untrustworthy. An empty result means the frame is well formed.
+func validateFrame(packet []byte) []protocolError {
+	var errs []protocolError
+
+	if len(packet) < frameMinLen {
+		return append(errs, *checkFrameBounds(packet))
+	}
+	if packet[0] != frameStartFlag {
+		errs = append(errs, protoErrorf(protoBadFlag, 0, "invalid start flag %02X, want %02X", packet[0], frameStartFlag))
+	}
+
+	if e := checkFrameBounds(packet); e != nil {
+		// parseFrameHeader would slice past the end; nothing else is worth checking
+		return append(errs, *e)
+	}
+	tlvLen := int(packet[27])<<8 | int(packet[28])
+	if end := frameHeaderLen + tlvLen + 2; end < len(packet) {
+		errs = append(errs, protoErrorf(protoLengthMismatch, end, "%d trailing bytes after tlv_length %d", len(packet)-end, tlvLen))
+	}
+
+	if frameLen := int(packet[1])<<8 | int(packet[2]); frameLen != len(packet) {
+		errs = append(errs, protoErrorf(protoLengthMismatch, 1, "frame_length %d does not match received %d bytes", frameLen, len(packet)))
+	}
+	if want, got := frameChecksum(packet), packet[len(packet)-2]; want != got {
+		errs = append(errs, protoErrorf(protoBadChecksum, len(packet)-2, "checksum %02X, computed %02X", got, want))
+	}
+	if packet[len(packet)-1] != frameEndFlag {
+		errs = append(errs, protoErrorf(protoBadFlag, len(packet)-1, "invalid end flag %02X, want %02X", packet[len(packet)-1], frameEndFlag))
+	}
+
+	return errs
+}
+
+// checkFrameBounds reports why parseFrameHeader cannot read packet: it is
+// shorter than a header, or tlv_length runs past its end.
+func checkFrameBounds(packet []byte) *protocolError {
+	var e protocolError
+	if len(packet) < frameMinLen {
+		e = protoErrorf(protoTruncatedFrame, len(packet), "frame too short: %d bytes, need at least %d", len(packet), frameMinLen)
+		return &e
+	}
+	tlvLen := int(packet[27])<<8 | int(packet[28])
+	if frameHeaderLen+tlvLen+2 > len(packet) {
+		e = protoErrorf(protoTruncatedFrame, 27, "tlv_length %d overruns frame of %d bytes", tlvLen, len(packet))
+		return &e
+	}
+	return nil
+}
+
+// decodePayloadBytes turns the request's hex or base64 text into bytes.
+// Hex may be spaced or not ("68 00 2F" or "68002F"); a bad byte is a 400.
+func decodePayloadBytes(hexStr, b64 string) ([]byte, error) {
+	if b64 != "" {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %w", err)
+		}
+		return b, nil
+	}
+
+	hexStr = strings.TrimPrefix(strings.TrimSpace(hexStr), "0x")
+	b, err := parseHexBytes(hexStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex payload: %w", err)
+	}
+	return b, nil
+}
+
+// -------------------------
+// API: DECODE ON DEMAND (no DB writes)
+// -------------------------
+
+// DecodeResult is the POST /api/v1/decode response.
+type DecodeResult struct {
+	Kind         string                 `json:"kind"`
+	Length       int                    `json:"length"`
+	Header       map[string]interface{} `json:"header,omitempty"`
+	HeaderFields []headerField          `json:"header_fields,omitempty"`
+	Decoded      map[string]interface{} `json:"decoded,omitempty"`
+	TLVFields    []tlvSpan              `json:"tlv_fields,omitempty"`
+	TLVOffset    int                    `json:"tlv_offset"`
+	Errors       []string               `json:"errors"`
+	// ProtocolErrors are Errors with their kind and frame offset.
+	ProtocolErrors []protocolError `json:"protocol_errors"`
+}
+
+// DecodeRequest is the JSON form of the POST /api/v1/decode body.
+type DecodeRequest struct {
+	Hex    string `json:"hex,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+}
+
+// POST /api/decode
+//
+//	{"hex": "68 00 2F ...", "kind": "frame"}
+//	{"base64": "aAAv...", "kind": "tlv"}
+//
+// kind is optional: anything starting with 0x68 is treated as a full frame,
+// everything else as a bare TLV payload. A plain-text body is read as hex.
+func postDecode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	var req DecodeRequest
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, 400, "invalid JSON: "+err.Error())
+			return
+		}
+	} else {
+		req.Hex = string(body)
+	}
+
+	payload, err := decodePayloadBytes(req.Hex, req.Base64)
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if len(payload) == 0 {
+		writeError(w, 400, "empty payload")
+		return
+	}
+
+	kind := strings.ToLower(req.Kind)
+	if kind == "" {
+		kind = "tlv"
+		if payload[0] == frameStartFlag {
+			kind = "frame"
+		}
+	}
+
+	res := DecodeResult{Kind: kind, Length: len(payload), ProtocolErrors: []protocolError{}}
+	tlv := payload
+
+	switch kind {
+	case "frame":
+		res.ProtocolErrors = append(res.ProtocolErrors, validateFrame(payload)...)
+		header, err := parseFrameHeader(payload)
+		if err != nil {
+			break // validateFrame already said why
+		}
+
+		res.Header = header
+		for _, f := range frameHeaderLayout {
+			f.Hex = fmt.Sprintf("% X", payload[f.Offset:f.Offset+f.Length])
+			res.HeaderFields = append(res.HeaderFields, f)
+		}
+		res.TLVOffset = frameHeaderLen
+		tlv = hexStringToBytes(res.Header["tlv_hex"].(string))
+
+	case "tlv":
+	default:
+		writeError(w, 400, "kind must be frame or tlv")
+		return
+	}
+
+	if kind == "tlv" || res.Header != nil {
+		var errs []protocolError
+		res.Decoded, res.TLVFields, errs = decodeTLVSpans(tlv)
+		res.ProtocolErrors = append(res.ProtocolErrors, shiftProtocolErrors(errs, res.TLVOffset)...)
+	}
+	res.Errors = protocolMessages(res.ProtocolErrors)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
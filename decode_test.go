@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata/frames/*.golden.json from the current decoder")
+
+// goldenResult is what a corpus frame decodes to; Error is set instead of
+// Header and Decoded when the header cannot be read.
+type goldenResult struct {
+	Problems []protocolError        `json:"problems,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Header   map[string]interface{} `json:"header,omitempty"`
+	Decoded  map[string]interface{} `json:"decoded,omitempty"`
+}
+
+// readHexFile reads a corpus frame: hex bytes, # starts a comment.
+func readHexFile(t testing.TB, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hex []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		hex = append(hex, strings.TrimSpace(line))
+	}
+	return hexStringToBytes(strings.Join(hex, " "))
+}
+
+func corpusFrames(t testing.TB) map[string][]byte {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "frames", "*.hex"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no corpus frames: %v", err)
+	}
+	frames := map[string][]byte{}
+	for _, p := range paths {
+		frames[strings.TrimSuffix(p, ".hex")] = readHexFile(t, p)
+	}
+	return frames
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for base, frame := range corpusFrames(t) {
+		t.Run(filepath.Base(base), func(t *testing.T) {
+			var res goldenResult
+			var err error
+			res.Header, res.Decoded, res.Problems, err = decodeFrame(frame)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			got, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			path := base + ".golden.json"
+			if *updateGolden {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -run TestGoldenFrames -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded output differs from %s; if the change is intended, bump decoderVersion and rerun with -update\ngot:\n%s", path, got)
+			}
+		})
+	}
+}
+
+func FuzzParseFrameHeader(f *testing.F) {
+	for _, frame := range corpusFrames(f) {
+		f.Add(frame)
+	}
+	f.Add(testFrame(nil))
+	f.Add([]byte{frameStartFlag})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		header, err := parseFrameHeader(packet)
+		if (err == nil) != (checkFrameBounds(packet) == nil) {
+			t.Fatalf("parseFrameHeader error %v disagrees with checkFrameBounds", err)
+		}
+		if err != nil {
+			if header != nil {
+				t.Fatal("header returned with an error")
+			}
+			return
+		}
+		if tlv := hexStringToBytes(header["tlv_hex"].(string)); len(tlv) != header["tlv_length"].(int) {
+			t.Fatalf("tlv_hex has %d bytes, tlv_length %v", len(tlv), header["tlv_length"])
+		}
+		// whatever the header says, the TLV must decode without panicking
+		_, _, errs, err := decodeFrame(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range errs {
+			if e.Offset < 0 || e.Offset > len(packet) {
+				t.Fatalf("error offset outside the frame: %+v", e)
+			}
+		}
+	})
+}
+
+func FuzzDecodeTLV(f *testing.F) {
+	for _, frame := range corpusFrames(f) {
+		if header, err := parseFrameHeader(frame); err == nil {
+			f.Add(hexStringToBytes(header["tlv_hex"].(string)))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, tlv []byte) {
+		decoded, spans, errs := decodeTLVSpans(tlv)
+		if decoded == nil {
+			t.Fatal("nil result")
+		}
+		// spans tile the input: every byte is consumed exactly once
+		next := 0
+		for _, s := range spans {
+			if s.Offset != next || s.Length < 1 {
+				t.Fatalf("span %+v, want offset %d", s, next)
+			}
+			next += s.Length
+		}
+		if next != len(tlv) {
+			t.Fatalf("spans cover %d of %d bytes", next, len(tlv))
+		}
+		// every error points at a tag the spans know about
+		starts := map[int]bool{}
+		for _, s := range spans {
+			starts[s.Offset] = true
+		}
+		for _, e := range errs {
+			if !starts[e.Offset] || e.Tag == "" {
+				t.Fatalf("error %+v is not at a tag", e)
+			}
+		}
+	})
+}
+
+func TestParseHexBytes(t *testing.T) {
+	for in, want := range map[string]string{"68 00 2f": "68002F", "68002F": "68002F", "": ""} {
+		b, err := parseHexBytes(in)
+		if err != nil || fmt.Sprintf("%X", b) != want {
+			t.Errorf("%q: % X, %v", in, b, err)
+		}
+	}
+	for in, offset := range map[string]int{"68 0G 2F": 1, "68 002F": 1, "68002": 2} {
+		_, err := parseHexBytes(in)
+		var pe *protocolError
+		if !errors.As(err, &pe) || pe.Kind != protoInvalidHex || pe.Offset != offset {
+			t.Errorf("%q: %v", in, err)
+		}
+	}
+}
+
+func TestDecodeTLVProblems(t *testing.T) {
+	for _, c := range []struct {
+		tlv   string
+		key   string
+		value interface{}
+		kind  string
+	}{
+		{"02 80", "total", nil, protoLengthMismatch},
+		{"08 50 02", "battery", 80, protoLengthMismatch},
+		{"02 80 64", "total", 0x8064, ""},
+		{"1B 57 4D 00 08 50", "model", "WM", ""},
+		{"1B 57 4D", "model", "WM", ""},
+		{"04 00 01", "flow", nil, protoTagOverrun},
+	} {
+		tlv, _ := parseHexBytes(c.tlv)
+		decoded, _, errs := decodeTLVSpans(tlv)
+		if decoded[c.key] != c.value {
+			t.Errorf("%s: %s = %v, want %v", c.tlv, c.key, decoded[c.key], c.value)
+		}
+		var kinds []string
+		for _, e := range errs {
+			kinds = append(kinds, e.Kind)
+		}
+		if c.kind == "" && len(kinds) != 0 || c.kind != "" && (len(kinds) != 1 || kinds[0] != c.kind) {
+			t.Errorf("%s: problems %v, want %q", c.tlv, kinds, c.kind)
+		}
+	}
+}
+
+func TestDecodeStoredTLV(t *testing.T) {
+	decoded, errs := decodeStoredTLV("08 50 02 80")
+	if decoded["battery"] != 80 || len(errs) != 1 || errs[0].Kind != protoLengthMismatch || errs[0].Offset != frameHeaderLen+2 {
+		t.Errorf("got %v %+v", decoded, errs)
+	}
+
+	// tokens that are not hex fail the row instead of being dropped
+	decoded, errs = decodeStoredTLV("08 5O 13 01")
+	if decoded != nil || len(errs) != 1 || errs[0].Kind != protoInvalidHex || errs[0].Offset != frameHeaderLen+1 {
+		t.Errorf("got %v %+v", decoded, errs)
+	}
+}
+
+// TestCorpusHandChecked pins values read off the corpus bytes by hand, so a
+// golden rewritten by -update cannot silently change them.
+func TestCorpusHandChecked(t *testing.T) {
+	frames := corpusFrames(t)
+	for _, c := range []struct {
+		name   string
+		header map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{"periodic_report", map[string]interface{}{
+			"frame_length": 63, // 00 3F
+			"imei":         "0861234567890123",
+			"mid":          258, // 01 02
+			"tlv_length":   32,  // 00 20
+			"checksum":     "D9",
+		}, map[string]interface{}{
+			"serial":          "67890123", // 00 04 67 89 01 23
+			"total":           500000,     // 02 07 A1 20
+			"flow":            500,        // 04 00 00 01 F4
+			"battery":         88,         // 08 58
+			"pressure":        50,         // 09 32
+			"temperature":     15,         // 0A 00 0F
+			"magnetic_tamper": 0,          // 0C 00 00
+			"rssi_raw":        90,         // 0D 00 5A
+			"valve":           1,          // 13 01
+			"firmware":        18,         // 17 12
+		}},
+		{"documented_samples", map[string]interface{}{"tlv_length": 69, "checksum": "72"}, map[string]interface{}{
+			"serial":         "010203040506070809", // 00 09 01 .. 09
+			"model":          "WM-DN20",            // 1B 57 4D 2D 44 4E 32 30 00
+			"network_status": 0x2511,               // 19 25 11, repeated in 1F
+			"temperature":    15,                   // 0A 00 0F
+		}},
+		{"total_two_byte", map[string]interface{}{"checksum": "B8"}, map[string]interface{}{
+			"total":   0x8064, // 02 00 80 64
+			"battery": 100,    // 08 64
+		}},
+		{"one_byte_temperature", map[string]interface{}{"checksum": "DB"}, map[string]interface{}{
+			"temperature": 23, // 0A 17
+			"battery":     80, // 08 50
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			frame, ok := frames[filepath.Join("testdata", "frames", c.name)]
+			if !ok {
+				t.Fatal("not in the corpus")
+			}
+			header, decoded, errs, err := decodeFrame(frame)
+			if err != nil || len(errs) != 0 {
+				t.Fatalf("%v %+v", err, errs)
+			}
+			for k, v := range c.header {
+				if header[k] != v {
+					t.Errorf("header %s = %v, want %v", k, header[k], v)
+				}
+			}
+			for k, v := range c.want {
+				if decoded[k] != v {
+					t.Errorf("%s = %v, want %v", k, decoded[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// -------------------------
+// DEVICES
+// -------------------------
+// One row per IMEI, kept current from every uplink by upsertDevice. The
+// tenant is resolved when the device is first seen (or while it has none);
+// moving a device between tenants is restampTenants' job, not every uplink's.
+
+type Device struct {
+	ID               int       `json:"id"`
+	IMEI             string    `json:"imei"`
+	MeterAddress     string    `json:"meter_address"`
+	ManufacturerCode string    `json:"manufacturer_code"`
+	Model            string    `json:"model"`
+	Firmware         *int      `json:"firmware"`
+	Group            string    `json:"group"`
+	FirstSeen        time.Time `json:"first_seen"`
+	LastSeen         time.Time `json:"last_seen"`
+	LastFrameID      int       `json:"last_frame_id"`
+	FrameCount       int64     `json:"frame_count"`
+	TenantID         *int      `json:"tenant_id"`
+}
+
+const deviceColumns = `
+    id, imei, COALESCE(meter_address, ''), COALESCE(manufacturer_code, ''),
+    COALESCE(model, ''), firmware, COALESCE(group_name, ''), first_seen, last_seen,
+    COALESCE(last_frame_id, 0), frame_count, tenant_id
+`
+
+func scanDevice(row interface{ Scan(...interface{}) error }) (Device, error) {
+	var d Device
+	var fw sql.NullInt64
+	err := row.Scan(&d.ID, &d.IMEI, &d.MeterAddress, &d.ManufacturerCode,
+		&d.Model, &fw, &d.Group, &d.FirstSeen, &d.LastSeen, &d.LastFrameID, &d.FrameCount, &d.TenantID)
+	if fw.Valid {
+		v := int(fw.Int64)
+		d.Firmware = &v
+	}
+	return d, err
+}
+
+// upsertDevice records the identity seen in an uplink. model (tag 0x1B) and
+// firmware (tag 0x17) are only sent by some frames, so missing values keep
+// whatever was stored before; the model stored afterwards is returned.
+func upsertDevice(h map[string]interface{}, decoded map[string]interface{}, frameID int) (string, error) {
+	imei, _ := h["imei"].(string)
+	if imei == "" {
+		return "", nil
+	}
+
+	var model, firmware interface{}
+	if v, ok := decoded["model"].(string); ok && v != "" {
+		model = v
+	}
+	if v, ok := decoded["firmware"]; ok {
+		firmware = getInt(v)
+	}
+
+	var stored string
+	err := db.QueryRow(`
+        INSERT INTO devices (
+            imei, meter_address, manufacturer_code, model, firmware,
+            first_seen, last_seen, last_frame_id, frame_count, tenant_id
+        ) VALUES ($1,$2,$3,$4,$5, now(), now(), $6, 1, tenant_for($1, $3))
+        ON CONFLICT (imei) DO UPDATE SET
+            meter_address     = EXCLUDED.meter_address,
+            manufacturer_code = EXCLUDED.manufacturer_code,
+            model             = COALESCE(EXCLUDED.model, devices.model),
+            firmware          = COALESCE(EXCLUDED.firmware, devices.firmware),
+            last_seen         = now(),
+            last_frame_id     = EXCLUDED.last_frame_id,
+            frame_count       = devices.frame_count + 1,
+            tenant_id         = COALESCE(devices.tenant_id, EXCLUDED.tenant_id)
+        RETURNING COALESCE(model, '')
+    `, imei, h["meter_address"], h["manufacturer_code"], model, firmware, frameID).Scan(&stored)
+	return stored, err
+}
+
+// -------------------------
+// ALARMS
+// -------------------------
+// A reading is in alarm when the meter reports a magnetic tamper or a battery
+// level under LOW_BATTERY_THRESHOLD. The valve byte (tag 0x13) is not an
+// alarm: which values mean open and closed differs between meter models, so
+// it is passed through as is and changes are reported as valve.changed.
+
+const (
+	alarmMagneticTamper = "magnetic_tamper"
+	alarmLowBattery     = "low_battery"
+)
+
+func lowBatteryThreshold() int {
+	n, err := strconv.Atoi(getenv("LOW_BATTERY_THRESHOLD", "20"))
+	if err != nil {
+		return 20
+	}
+	return n
+}
+
+func readingAlarms(battery, magneticTamper int) []string {
+	alarms := []string{}
+	if magneticTamper != 0 {
+		alarms = append(alarms, alarmMagneticTamper)
+	}
+	if battery > 0 && battery < lowBatteryThreshold() {
+		alarms = append(alarms, alarmLowBattery)
+	}
+	return alarms
+}
+
+// -------------------------
+// API: DEVICES
+// -------------------------
+
+// GET /api/devices?manufacturer=&meter_address=&imei=&group=&from=&to=&limit=&cursor=
+func getDevices(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "last_seen", "first_seen")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	var where sqlWhere
+	if p.Tenant != 0 {
+		where.add("tenant_id = $%d", p.Tenant)
+	}
+	if !p.From.IsZero() {
+		where.add(p.TimeField+" >= $%d", p.From)
+	}
+	if !p.To.IsZero() {
+		where.add(p.TimeField+" < $%d", p.To)
+	}
+	if p.IMEI != "" {
+		where.add("imei = $%d", p.IMEI)
+	}
+	if p.MeterAddress != "" {
+		where.add("meter_address = $%d", p.MeterAddress)
+	}
+	if p.Manufacturer != "" {
+		where.add("manufacturer_code = $%d", p.Manufacturer)
+	}
+	if g := r.URL.Query().Get("group"); g != "" {
+		where.add("group_name = $%d", g)
+	}
+
+	total, err := p.totalCount("SELECT COUNT(*) FROM devices "+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "id")
+	rows, err := db.Query("SELECT "+deviceColumns+" FROM devices "+where.String()+" "+p.orderSQL("id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var list []Device
+	var ids []int
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, d)
+		ids = append(ids, d.ID)
+	}
+
+	writePage(w, p, list, ids, total)
+}
+
+// GET /api/devices/{imei}
+func getDevice(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDevice(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// lookupDevice loads the {imei} path device, writing a 404/500 when it can't.
+// Devices of other tenants are reported as not found.
+func lookupDevice(w http.ResponseWriter, r *http.Request) (Device, bool) {
+	imei := r.PathValue("imei")
+	d, err := scanDevice(db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE imei = $1 AND ($2 = 0 OR tenant_id = $2)",
+		imei, callerTenant(r)))
+	if err == sql.ErrNoRows {
+		writeError(w, 404, fmt.Sprintf("device %s not found", imei))
+		return d, false
+	}
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return d, false
+	}
+	return d, true
+}
+
+// withIMEI pins the imei filter to the path device so the generic list
+// handlers can serve the per-device sub-resources.
+func withIMEI(r *http.Request, imei string) *http.Request {
+	q := r.URL.Query()
+	q.Set("imei", imei)
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = q.Encode()
+	return r2
+}
+
+// GET /api/devices/{imei}/readings (same query params as /api/messages)
+func getDeviceReadings(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDevice(w, r)
+	if !ok {
+		return
+	}
+	getMessages(w, withIMEI(r, d.IMEI))
+}
+
+// GET /api/devices/{imei}/frames (same query params as /api/frames/decoded/all)
+func getDeviceFrames(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDevice(w, r)
+	if !ok {
+		return
+	}
+	getDecodedFrames(w, withIMEI(r, d.IMEI))
+}
+
+// LatestReading is a device's most recent reading with its alarms.
+type LatestReading struct {
+	Msg
+	Alarms []string `json:"alarms"`
+}
+
+// DeviceAlarm is one reading that raised at least one alarm.
+type DeviceAlarm struct {
+	MessageID      int       `json:"message_id"`
+	FrameID        int       `json:"frame_id"`
+	Alarms         []string  `json:"alarms"`
+	Battery        int       `json:"battery"`
+	Valve          int       `json:"valve"`
+	MagneticTamper int       `json:"magnetic_tamper"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// GET /api/devices/{imei}/latest
+func getDeviceLatest(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDevice(w, r)
+	if !ok {
+		return
+	}
+
+	msgs, err := queryMessages(`
+        FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+        WHERE f.imei = $1
+        ORDER BY m.id DESC LIMIT 1
+    `, d.IMEI)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if len(msgs) == 0 {
+		writeError(w, 404, "no readings for device "+d.IMEI)
+		return
+	}
+
+	m := msgs[0]
+	res := LatestReading{m, readingAlarms(m.Battery, m.MagneticTamper)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// GET /api/devices/{imei}/alarms lists readings that raised at least one alarm.
+func getDeviceAlarms(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDevice(w, r)
+	if !ok {
+		return
+	}
+	p, err := parseListParams(r, "created_at", "measured_at")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	var where sqlWhere
+	where.add("f.imei = $%d", d.IMEI)
+	p.filters(&where, "m."+p.TimeField, true)
+	where.add("(m.magnetic_tamper <> 0 OR (m.battery > 0 AND m.battery < $%d))", lowBatteryThreshold())
+	from := "FROM messages m JOIN meter_frames f ON f.id = m.frame_id "
+
+	total, err := p.totalCount("SELECT COUNT(*) "+from+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "m.id")
+	msgs, err := queryMessages(from+where.String()+" "+p.orderSQL("m.id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	var list []DeviceAlarm
+	var ids []int
+	for _, m := range msgs {
+		list = append(list, DeviceAlarm{
+			MessageID:      m.ID,
+			FrameID:        m.FrameID,
+			Alarms:         readingAlarms(m.Battery, m.MagneticTamper),
+			Battery:        m.Battery,
+			Valve:          m.Valve,
+			MagneticTamper: m.MagneticTamper,
+			CreatedAt:      m.CreatedAt,
+		})
+		ids = append(ids, m.ID)
+	}
+
+	writePage(w, p, list, ids, total)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReadingAlarms(t *testing.T) {
+	t.Setenv("LOW_BATTERY_THRESHOLD", "20")
+	for _, c := range []struct {
+		name                    string
+		battery, magneticTamper int
+		want                    []string
+	}{
+		{"healthy", 80, 0, []string{}},
+		{"battery not reported", 0, 0, []string{}},
+		{"low battery", 19, 0, []string{alarmLowBattery}},
+		{"at the threshold", 20, 0, []string{}},
+		{"tamper", 80, 1, []string{alarmMagneticTamper}},
+		{"both", 5, 3, []string{alarmMagneticTamper, alarmLowBattery}},
+	} {
+		if got := readingAlarms(c.battery, c.magneticTamper); !slices.Equal(got, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUpsertDevice(t *testing.T) {
+	header := map[string]interface{}{"imei": "0861234567890123", "meter_address": "1234567890123456", "manufacturer_code": "0001"}
+
+	t.Run("keeps the stored tenant", func(t *testing.T) {
+		mock := useMockDB(t)
+		mock.ExpectQuery(`(?s)INSERT INTO devices .*tenant_for\(\$1, \$3\).*tenant_id\s+= COALESCE\(devices\.tenant_id, EXCLUDED\.tenant_id\)`).
+			WithArgs("0861234567890123", "1234567890123456", "0001", "WM20", 7, 42).
+			WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow("WM20"))
+
+		model, err := upsertDevice(header, map[string]interface{}{"model": "WM20", "firmware": 7}, 42)
+		if err != nil || model != "WM20" {
+			t.Errorf("upsertDevice = %q, %v", model, err)
+		}
+	})
+
+	t.Run("missing model and firmware keep the stored ones", func(t *testing.T) {
+		mock := useMockDB(t)
+		mock.ExpectQuery(`INSERT INTO devices`).
+			WithArgs("0861234567890123", "1234567890123456", "0001", nil, nil, 43).
+			WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow("WM20"))
+
+		if model, err := upsertDevice(header, map[string]interface{}{"model": ""}, 43); err != nil || model != "WM20" {
+			t.Errorf("upsertDevice = %q, %v", model, err)
+		}
+	})
+
+	t.Run("no IMEI", func(t *testing.T) {
+		useMockDB(t) // any query fails the test
+		if model, err := upsertDevice(map[string]interface{}{}, nil, 44); err != nil || model != "" {
+			t.Errorf("upsertDevice = %q, %v", model, err)
+		}
+	})
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// -------------------------
+// EVENT STREAM
+// -------------------------
+// With EVENT_SINK set to nats or file, every stored frame, reading and
+// newly opened alert is published as an event for downstream consumers:
+//
+//	frame.received   a meter_frames row: the header and receive metadata
+//	reading.decoded  a messages row: the decoded values and their alarms
+//	alarm.raised     an alerts row that was opened (not one seen again)
+//
+// Events go through an outbox. The row that describes the event is written
+// to event_outbox by the same SQL statement that inserts the frame, reading
+// or alert, so an event exists if and only if its insert committed, however
+// the process dies. A relay claims the oldest rows for a while, publishes them
+// with no transaction open and then marks them published.
+//
+// Outbox ids are taken before commit, so id order is not commit order. Each
+// row also records the transaction that wrote it. The relay only takes rows
+// whose transaction is older than every one still running, and goes in
+// transaction order, so nothing that commits later can slip in ahead of what
+// was already published. Frames of one device that are stored one after
+// another therefore go out in that order. Events from concurrent
+// transactions are in no particular order relative to each other. A long
+// running transaction anywhere in the database holds the stream back until
+// it ends.
+//
+// Delivery is at least once, not exactly once. A crash between publishing
+// and marking publishes the claimed rows again when the claim runs out. NATS
+// JetStream drops those through the Nats-Msg-Id header; core NATS and file
+// consumers should skip event ids they have seen.
+//
+// An event the sink rejects is retried with backoff, and the events after it
+// wait so that they still go out in order. After outboxMaxAttempts failures,
+// a couple of hours of backoff, it is parked with dead_at set and the relay
+// moves on. Parked rows are kept for inspection. Clearing dead_at and attempts
+// queues one again.
+//
+// Every event carries schema_version; a change that is not purely additive
+// bumps it for that event type, and consumers dispatch on (type, version).
+
+const (
+	eventFrameReceived  = "frame.received"
+	eventReadingDecoded = "reading.decoded"
+	eventAlarmRaised    = "alarm.raised"
+)
+
+// eventSchemaVersion is the current schema version of each event type.
+var eventSchemaVersion = map[string]int{
+	eventFrameReceived:  1,
+	eventReadingDecoded: 1,
+	eventAlarmRaised:    1,
+}
+
+const (
+	outboxBatch       = 100
+	outboxRetention   = 7 * 24 * time.Hour // published rows are kept this long
+	outboxMaxWait     = 30 * time.Second   // relay backoff cap while the database or sink is down
+	outboxClaim       = 2 * time.Minute    // a claimed row is not handed out again before this
+	outboxPublishWait = 30 * time.Second
+	outboxMaxAttempts = 16               // failed publishes before an event is parked
+	outboxMaxBackoff  = 30 * time.Minute // retry delay cap of a failing event
+)
+
+// streamEvent is the published envelope.
+type streamEvent struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	IMEI          string          `json:"imei,omitempty"`
+	TenantID      int             `json:"tenant_id,omitempty"`
+	FrameID       int             `json:"frame_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+
+	outboxID int64
+	outboxTx uint64 // xid8 of the transaction that wrote the row
+}
+
+// eventsEnabled says whether inserts queue outbox rows; without a sink
+// nothing would ever drain them.
+var eventsEnabled = sync.OnceValue(func() bool { return os.Getenv("EVENT_SINK") != "" })
+
+// outboxEvent returns the event id and JSON data to queue with an insert, or
+// nils when events are disabled. The insert statements only write the outbox
+// row when data is not NULL.
+func outboxEvent(data interface{}) (id, payload interface{}) {
+	if !eventsEnabled() {
+		return nil, nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("encoding event data failed", "err", err)
+		return nil, nil
+	}
+	return uuid.NewString(), string(b)
+}
+
+// frameEventData is the data of frame.received.
+func frameEventData(h map[string]interface{}, m frameMeta, errs []protocolError) map[string]interface{} {
+	if errs == nil {
+		errs = []protocolError{}
+	}
+	transport := m.Transport
+	if transport == "" {
+		transport = transportTCP
+	}
+	return map[string]interface{}{
+		"header":          h,
+		"raw_hex":         fmt.Sprintf("%X", m.Raw),
+		"transport":       transport,
+		"remote_addr":     m.RemoteAddr,
+		"session_id":      m.SessionID,
+		"received_at":     m.ReceivedAt,
+		"protocol_errors": errs,
+	}
+}
+
+// readingEventData is the data of reading.decoded; the insert adds
+// message_id and measured_at.
+func readingEventData(d map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"decoded":         d,
+		"alarms":          readingAlarms(getInt(d["battery"]), getInt(d["magnetic_tamper"])),
+		"decoder_version": decoderVersion,
+	}
+}
+
+// eventSink publishes a batch of events in order; an error means the whole
+// batch is retried.
+type eventSink interface {
+	Publish(ctx context.Context, events []streamEvent) error
+	Close() error
+}
+
+func newEventSink(kind string) (eventSink, error) {
+	switch kind {
+	case "file":
+		return newFileSink(getenv("EVENT_FILE", "events.ndjson"))
+	case "nats":
+		js, err := strconv.ParseBool(getenv("NATS_JETSTREAM", "true"))
+		if err != nil {
+			return nil, fmt.Errorf("NATS_JETSTREAM: %w", err)
+		}
+		return newNATSSink(getenv("NATS_URL", nats.DefaultURL), getenv("NATS_SUBJECT_PREFIX", "meters"), js)
+	}
+	return nil, fmt.Errorf("unknown EVENT_SINK %q (nats or file)", kind)
+}
+
+// startEventRelay connects the sink and publishes the outbox until the
+// process exits.
+func startEventRelay() error {
+	kind := os.Getenv("EVENT_SINK")
+	if kind == "" {
+		return nil
+	}
+	sink, err := newEventSink(kind)
+	if err != nil {
+		return err
+	}
+	slog.Info("event stream enabled", "sink", kind)
+
+	go func() {
+		wait := time.Second
+		lastPrune := time.Time{}
+		for {
+			n, err := relayOutbox(sink, outboxBatch)
+			if err != nil {
+				slog.Error("publishing events failed", "sink", kind, "err", err)
+				time.Sleep(wait)
+				wait = min(wait*2, outboxMaxWait)
+				continue
+			}
+			wait = time.Second
+			if time.Since(lastPrune) > time.Hour {
+				if _, err := db.Exec(`DELETE FROM event_outbox WHERE published_at < $1`, time.Now().Add(-outboxRetention)); err != nil {
+					slog.Error("pruning event outbox failed", "err", err)
+				}
+				lastPrune = time.Now()
+			}
+			if n == 0 {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// relayOutbox publishes the oldest unpublished events. Rows are claimed by
+// one statement that commits before the sink is called, so no lock is held
+// while it publishes; a second relay skips claimed rows.
+func relayOutbox(sink eventSink, batch int) (int, error) {
+	events, err := claimOutbox(batch)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	publish := func(events []streamEvent) error {
+		ctx, cancel := context.WithTimeout(context.Background(), outboxPublishWait)
+		defer cancel()
+		return sink.Publish(ctx, events)
+	}
+	pubErr := publish(events)
+	if pubErr == nil {
+		return len(events), markPublished(events)
+	}
+	if len(events) == 1 {
+		return 0, failOutboxEvent(events[0], pubErr)
+	}
+
+	// Find the event that fails, so that only it is charged an attempt: the
+	// ones before it go one at a time, the ones after it are released and
+	// wait behind its retry.
+	for i, e := range events {
+		pubErr := publish(events[i : i+1])
+		if pubErr == nil {
+			continue
+		}
+		if err := markPublished(events[:i]); err != nil {
+			return i, err
+		}
+		failErr := failOutboxEvent(e, pubErr)
+		if failErr != nil && failErr != pubErr {
+			// not recorded: the rest stay claimed as well and come back
+			// together with it when the claim runs out
+			return i, failErr
+		}
+		if err := releaseOutbox(events[i+1:]); err != nil {
+			return i, err
+		}
+		return i, failErr
+	}
+	return len(events), markPublished(events)
+}
+
+// claimOutbox claims up to batch events in outbox order, stopping short of
+// the first event that is waiting to be retried.
+func claimOutbox(batch int) ([]streamEvent, error) {
+	rows, err := db.Query(`
+        WITH waiting AS (
+            SELECT txid, id FROM event_outbox
+            WHERE published_at IS NULL AND dead_at IS NULL AND retry_at > now()
+            ORDER BY txid, id LIMIT 1
+        )
+        UPDATE event_outbox SET claimed_until = now() + make_interval(secs => $2)
+        WHERE id IN (
+            SELECT o.id FROM event_outbox o
+            WHERE o.published_at IS NULL AND o.dead_at IS NULL
+              AND (o.claimed_until IS NULL OR o.claimed_until < now())
+              AND o.txid < pg_snapshot_xmin(pg_current_snapshot())
+              AND NOT EXISTS (SELECT 1 FROM waiting w WHERE (w.txid, w.id) <= (o.txid, o.id))
+            ORDER BY o.txid, o.id LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, txid::text, event_id::text, event_type, schema_version, COALESCE(imei, ''),
+                  COALESCE(tenant_id, 0), COALESCE(frame_id, 0), data::text, created_at
+    `, batch, outboxClaim.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []streamEvent
+	for rows.Next() {
+		var e streamEvent
+		var txid, data string
+		if err := rows.Scan(&e.outboxID, &txid, &e.ID, &e.Type, &e.SchemaVersion, &e.IMEI, &e.TenantID, &e.FrameID, &data, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		if e.outboxTx, err = strconv.ParseUint(txid, 10, 64); err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(data)
+		events = append(events, e)
+	}
+	// RETURNING has no order
+	slices.SortFunc(events, func(a, b streamEvent) int {
+		return cmp.Or(cmp.Compare(a.outboxTx, b.outboxTx), cmp.Compare(a.outboxID, b.outboxID))
+	})
+	return events, rows.Err()
+}
+
+func outboxIDs(events []streamEvent) []int64 {
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		ids[i] = e.outboxID
+	}
+	return ids
+}
+
+func markPublished(events []streamEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if _, err := db.Exec(`
+        UPDATE event_outbox
+        SET attempts = attempts + 1, published_at = now(), last_error = NULL, claimed_until = NULL, retry_at = NULL
+        WHERE id = ANY($1)
+    `, pq.Array(outboxIDs(events))); err != nil {
+		return err
+	}
+	for _, e := range events {
+		eventsPublished.WithLabelValues(e.Type).Inc()
+	}
+	return nil
+}
+
+// failOutboxEvent records a failed publish: the event is retried after a
+// backoff that doubles per attempt, or parked once it has failed
+// outboxMaxAttempts times. It returns pubErr while the event will be retried,
+// nil once it is parked and the database error if neither could be recorded.
+func failOutboxEvent(e streamEvent, pubErr error) error {
+	var dead bool
+	err := db.QueryRow(`
+        UPDATE event_outbox
+        SET attempts = attempts + 1, last_error = $2, claimed_until = NULL,
+            retry_at = now() + make_interval(secs => LEAST(power(2, attempts), $3)),
+            dead_at = CASE WHEN attempts + 1 >= $4 THEN now() END
+        WHERE id = $1
+        RETURNING dead_at IS NOT NULL
+    `, e.outboxID, pubErr.Error(), outboxMaxBackoff.Seconds(), outboxMaxAttempts).Scan(&dead)
+	if err != nil {
+		return err
+	}
+	eventsFailed.Inc()
+	if dead {
+		eventsDead.Inc()
+		slog.Error("event dead-lettered", "event_id", e.ID, "type", e.Type, "attempts", outboxMaxAttempts, "err", pubErr)
+		return nil
+	}
+	return pubErr
+}
+
+// releaseOutbox hands claimed events back without charging an attempt.
+func releaseOutbox(events []streamEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	_, err := db.Exec(`UPDATE event_outbox SET claimed_until = NULL WHERE id = ANY($1)`, pq.Array(outboxIDs(events)))
+	return err
+}
+
+// -------------------------
+// FILE SINK
+// -------------------------
+// One JSON event per line, appended and synced per batch; meant for local
+// testing and for shipping with a log forwarder.
+
+type fileSink struct {
+	f *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+func (s *fileSink) Publish(_ context.Context, events []streamEvent) error {
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close() error { return s.f.Close() }
+
+// -------------------------
+// NATS SINK
+// -------------------------
+// Events go to {prefix}.{type}, e.g. meters.reading.decoded, with the
+// Nats-Msg-Id, Event-Type and Schema-Version headers. With JetStream (the
+// default) a stream must cover the subjects; each publish waits for its ack
+// and the server discards duplicates by message id. NATS_JETSTREAM=false
+// publishes on core NATS, where nothing is stored for absent subscribers.
+
+type natsSink struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream // nil on core NATS
+	prefix string
+}
+
+func newNATSSink(url, prefix string, useJetStream bool) (*natsSink, error) {
+	nc, err := nats.Connect(url,
+		nats.Name("meter-server events"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s := &natsSink{nc: nc, prefix: prefix}
+	if useJetStream {
+		if s.js, err = jetstream.New(nc); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *natsSink) message(e streamEvent) (*nats.Msg, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	m := nats.NewMsg(natsSubject(s.prefix, e.Type))
+	m.Data = b
+	m.Header.Set(jetstream.MsgIDHeader, e.ID)
+	m.Header.Set("Event-Type", e.Type)
+	m.Header.Set("Schema-Version", strconv.Itoa(e.SchemaVersion))
+	return m, nil
+}
+
+func (s *natsSink) Publish(ctx context.Context, events []streamEvent) error {
+	if s.js == nil {
+		for _, e := range events {
+			m, err := s.message(e)
+			if err != nil {
+				return err
+			}
+			if err := s.nc.PublishMsg(m); err != nil {
+				return err
+			}
+		}
+		return s.nc.FlushWithContext(ctx)
+	}
+
+	futures := make([]jetstream.PubAckFuture, 0, len(events))
+	for _, e := range events {
+		m, err := s.message(e)
+		if err != nil {
+			return err
+		}
+		f, err := s.js.PublishMsgAsync(m)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *natsSink) Close() error {
+	return s.nc.Drain()
+}
+
+// natsSubject returns the subject an event type is published on.
+func natsSubject(prefix, eventType string) string {
+	return strings.TrimSuffix(prefix, ".") + "." + eventType
+}
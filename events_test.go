@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func testEvents(imeis ...string) []streamEvent {
+	var events []streamEvent
+	for i, imei := range imeis {
+		events = append(events, streamEvent{
+			ID: "00000000-0000-0000-0000-00000000000" + strconv.Itoa(i), Type: eventReadingDecoded, SchemaVersion: 1,
+			OccurredAt: time.Date(2026, 10, 1, 12, 0, i, 0, time.UTC), IMEI: imei, FrameID: i + 1,
+			Data: json.RawMessage(`{"decoded":{"total":` + strconv.Itoa(i) + `}}`),
+		})
+	}
+	return events
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	s, err := newFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := testEvents("0861234567800042", "0861234567800043")
+	if err := s.Publish(context.Background(), events[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(context.Background(), events[1:]); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var got []streamEvent
+	for sc.Scan() {
+		var e streamEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", sc.Bytes(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 || got[0].ID != events[0].ID || got[1].IMEI != events[1].IMEI || string(got[1].Data) != string(events[1].Data) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestNATSSubject(t *testing.T) {
+	if s := natsSubject("meters.", eventAlarmRaised); s != "meters.alarm.raised" {
+		t.Error(s)
+	}
+}
+
+// funcSink hands each Publish call to publish.
+type funcSink struct {
+	publish func([]streamEvent) error
+}
+
+func (s funcSink) Publish(_ context.Context, events []streamEvent) error { return s.publish(events) }
+func (s funcSink) Close() error                                          { return nil }
+
+func TestRelayOutbox(t *testing.T) {
+	// claimRows returns the claimed rows; txid is the writing transaction of each id
+	claimRows := func(txid map[int64]uint64, ids ...int64) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "txid", "event_id", "event_type", "schema_version", "imei", "tenant_id", "frame_id", "data", "created_at"})
+		for _, id := range ids {
+			tx, ok := txid[id]
+			if !ok {
+				tx = 100 + uint64(id)
+			}
+			rows.AddRow(id, fmt.Sprint(tx), fmt.Sprintf("00000000-0000-0000-0000-%012d", id), eventReadingDecoded, 1,
+				"0861234567800042", 0, int(id), `{}`, time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+		}
+		return rows
+	}
+	claimQuery := `UPDATE event_outbox SET claimed_until = now\(\) \+ make_interval.*txid < pg_snapshot_xmin\(pg_current_snapshot\(\)\)`
+	expectClaim := func(mock sqlmock.Sqlmock, ids ...int64) {
+		mock.ExpectQuery(claimQuery).WithArgs(outboxBatch, outboxClaim.Seconds()).WillReturnRows(claimRows(nil, ids...))
+	}
+	expectFail := func(mock sqlmock.Sqlmock, id int64, dead bool) {
+		mock.ExpectQuery(`UPDATE event_outbox\s+SET attempts = attempts \+ 1, last_error = \$2`).
+			WithArgs(id, "rejected", outboxMaxBackoff.Seconds(), outboxMaxAttempts).
+			WillReturnRows(sqlmock.NewRows([]string{"dead"}).AddRow(dead))
+	}
+	rejecting := func(bad int64, calls *[][]int64) funcSink {
+		return funcSink{func(events []streamEvent) error {
+			var ids []int64
+			for _, e := range events {
+				ids = append(ids, e.outboxID)
+			}
+			*calls = append(*calls, ids)
+			for _, e := range events {
+				if e.outboxID == bad {
+					return errors.New("rejected")
+				}
+			}
+			return nil
+		}}
+	}
+
+	t.Run("publishes in id order", func(t *testing.T) {
+		mock := useMockDB(t)
+		expectClaim(mock, 3, 1, 2)
+		mock.ExpectExec(`SET attempts = attempts \+ 1, published_at = now\(\)`).
+			WithArgs(pq.Array([]int64{1, 2, 3})).WillReturnResult(sqlmock.NewResult(0, 3))
+
+		var calls [][]int64
+		n, err := relayOutbox(rejecting(0, &calls), outboxBatch)
+		if n != 3 || err != nil || len(calls) != 1 || !slices.Equal(calls[0], []int64{1, 2, 3}) {
+			t.Fatalf("got %d, %v, publishes %v", n, err, calls)
+		}
+	})
+
+	t.Run("publishes in transaction order", func(t *testing.T) {
+		mock := useMockDB(t)
+		// 3 took its id last but its transaction wrote first
+		mock.ExpectQuery(claimQuery).WithArgs(outboxBatch, outboxClaim.Seconds()).
+			WillReturnRows(claimRows(map[int64]uint64{1: 12, 2: 11, 3: 10}, 1, 2, 3))
+		mock.ExpectExec(`published_at = now\(\)`).
+			WithArgs(pq.Array([]int64{3, 2, 1})).WillReturnResult(sqlmock.NewResult(0, 3))
+
+		var calls [][]int64
+		if n, err := relayOutbox(rejecting(0, &calls), outboxBatch); n != 3 || err != nil || !slices.Equal(calls[0], []int64{3, 2, 1}) {
+			t.Fatalf("got %d, %v, publishes %v", n, err, calls)
+		}
+	})
+
+	t.Run("only the failing event is charged", func(t *testing.T) {
+		mock := useMockDB(t)
+		expectClaim(mock, 1, 2, 3)
+		mock.ExpectExec(`published_at = now\(\)`).WithArgs(pq.Array([]int64{1})).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectFail(mock, 2, false)
+		mock.ExpectExec(`UPDATE event_outbox SET claimed_until = NULL WHERE id = ANY\(\$1\)`).
+			WithArgs(pq.Array([]int64{3})).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		var calls [][]int64
+		n, err := relayOutbox(rejecting(2, &calls), outboxBatch)
+		if n != 1 || err == nil || err.Error() != "rejected" {
+			t.Fatalf("got %d, %v", n, err)
+		}
+		// the batch, then one at a time up to the failure; 3 is not tried
+		// ahead of 2
+		if len(calls) != 3 || !slices.Equal(calls[1], []int64{1}) || !slices.Equal(calls[2], []int64{2}) {
+			t.Errorf("publishes %v", calls)
+		}
+	})
+
+	t.Run("parks the event after the last attempt", func(t *testing.T) {
+		mock := useMockDB(t)
+		expectClaim(mock, 7)
+		expectFail(mock, 7, true)
+
+		var calls [][]int64
+		if n, err := relayOutbox(rejecting(7, &calls), outboxBatch); n != 0 || err != nil {
+			t.Fatalf("got %d, %v", n, err)
+		}
+	})
+
+	t.Run("empty outbox", func(t *testing.T) {
+		mock := useMockDB(t)
+		expectClaim(mock)
+		var calls [][]int64
+		if n, err := relayOutbox(rejecting(0, &calls), outboxBatch); n != 0 || err != nil || len(calls) != 0 {
+			t.Fatalf("got %d, %v, publishes %v", n, err, calls)
+		}
+	})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// -------------------------
+// EXPORT
+// -------------------------
+// Readings are streamed straight from the query to the response (or file):
+// rows are written as they are scanned, and Parquet buffers at most one row
+// group. Formats:
+//
+//	csv      RFC 4180, RFC3339 timestamps, empty cell for NULL
+//	excel    CSV that Excel opens as-is: UTF-8 BOM, CRLF, "name [unit]" headers,
+//	         "2006-01-02 15:04:05" local times and identifiers kept as text
+//	ndjson   one JSON object per line
+//	parquet  one file, every column optional
+//
+// Units default to exportColumns and can be overridden with
+// EXPORT_UNITS="total=m3,flow=m3/h".
+
+const exportRowGroupSize = 50000
+
+type exportKind int
+
+const (
+	exportInt exportKind = iota
+	exportString
+	exportTime
+)
+
+type exportColumn struct {
+	Name string
+	SQL  string
+	Kind exportKind
+	Unit string
+	Text bool // identifier that Excel must not turn into a number
+}
+
+var exportColumns = []exportColumn{
+	{Name: "reading_id", SQL: "m.id", Kind: exportInt},
+	{Name: "frame_id", SQL: "m.frame_id", Kind: exportInt},
+	{Name: "imei", SQL: "f.imei", Kind: exportString, Text: true},
+	{Name: "meter_address", SQL: "f.meter_address", Kind: exportString, Text: true},
+	{Name: "manufacturer_code", SQL: "f.manufacturer_code", Kind: exportString, Text: true},
+	{Name: "group", SQL: "d.group_name", Kind: exportString},
+	{Name: "serial", SQL: "m.serial", Kind: exportString, Text: true},
+	{Name: "measured_at", SQL: "m.measured_at", Kind: exportTime},
+	{Name: "received_at", SQL: "f.created_at", Kind: exportTime},
+	{Name: "total", SQL: "m.total", Kind: exportInt, Unit: "L"},
+	{Name: "flow", SQL: "m.flow", Kind: exportInt, Unit: "L/h"},
+	{Name: "battery", SQL: "m.battery", Kind: exportInt, Unit: "%"},
+	{Name: "pressure", SQL: "m.pressure", Kind: exportInt, Unit: "kPa"},
+	{Name: "temperature", SQL: "m.temperature", Kind: exportInt, Unit: "°C"},
+	{Name: "magnetic_tamper", SQL: "m.magnetic_tamper", Kind: exportInt},
+	{Name: "rssi_raw", SQL: "m.rssi_raw", Kind: exportInt},
+	{Name: "valve", SQL: "m.valve", Kind: exportInt},
+	{Name: "firmware", SQL: "m.firmware", Kind: exportInt},
+	{Name: "network_status", SQL: "m.network_status", Kind: exportInt},
+}
+
+var exportFormats = map[string]struct{ ContentType, Ext string }{
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"excel":   {"text/csv; charset=utf-8", "csv"},
+	"ndjson":  {"application/x-ndjson", "ndjson"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+}
+
+// exportUnits applies EXPORT_UNITS on top of the column defaults.
+func exportUnits() map[string]string {
+	units := map[string]string{}
+	for _, c := range exportColumns {
+		units[c.Name] = c.Unit
+	}
+	for _, kv := range strings.Split(getenv("EXPORT_UNITS", ""), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			units[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return units
+}
+
+type exportFilter struct {
+	Format   string
+	Tenant   int
+	IMEIs    []string
+	Group    string
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+}
+
+// parseExportFilter reads format, imei (repeatable or comma separated),
+// group, from/to (RFC3339) or month (YYYY-MM in tz) and tz.
+func parseExportFilter(q url.Values, tenant int) (exportFilter, error) {
+	f := exportFilter{Format: q.Get("format"), Tenant: tenant, Group: q.Get("group"), Location: time.UTC}
+	if f.Format == "" {
+		f.Format = "csv"
+	}
+	if _, ok := exportFormats[f.Format]; !ok {
+		return f, fmt.Errorf("format must be csv, excel, ndjson or parquet")
+	}
+
+	for _, v := range q["imei"] {
+		for _, imei := range strings.Split(v, ",") {
+			if imei = strings.TrimSpace(imei); imei != "" {
+				f.IMEIs = append(f.IMEIs, imei)
+			}
+		}
+	}
+
+	if tz := q.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return f, fmt.Errorf("invalid tz: %v", err)
+		}
+		f.Location = loc
+	}
+
+	var err error
+	if m := q.Get("month"); m != "" {
+		if f.From, err = time.ParseInLocation("2006-01", m, f.Location); err != nil {
+			return f, fmt.Errorf("month must be YYYY-MM")
+		}
+		f.To = f.From.AddDate(0, 1, 0)
+	} else {
+		if f.From, err = time.Parse(time.RFC3339, q.Get("from")); err != nil {
+			return f, fmt.Errorf("month or from (RFC3339) is required")
+		}
+		f.To = time.Now()
+		if v := q.Get("to"); v != "" {
+			if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("invalid to: %v", err)
+			}
+		}
+	}
+	if !f.To.After(f.From) {
+		return f, fmt.Errorf("to must be after from")
+	}
+	return f, nil
+}
+
+func (f exportFilter) filename() string {
+	return fmt.Sprintf("readings-%s-%s.%s", f.From.In(f.Location).Format("20060102"),
+		f.To.In(f.Location).Format("20060102"), exportFormats[f.Format].Ext)
+}
+
+// exportReadings streams the matching readings into ew and returns the row count.
+func exportReadings(ctx context.Context, f exportFilter, ew exportWriter) (int, error) {
+	var where sqlWhere
+	where.add("m.measured_at >= $%d", f.From)
+	where.add("m.measured_at < $%d", f.To)
+	if f.Tenant != 0 {
+		where.add("f.tenant_id = $%d", f.Tenant)
+	}
+	if len(f.IMEIs) > 0 {
+		where.add("f.imei = ANY($%d)", pq.Array(f.IMEIs))
+	}
+	if f.Group != "" {
+		where.add("d.group_name = $%d", f.Group)
+	}
+
+	cols := make([]string, len(exportColumns))
+	for i, c := range exportColumns {
+		cols[i] = c.SQL
+	}
+	rows, err := db.QueryContext(ctx, `
+        SELECT `+strings.Join(cols, ", ")+`
+        FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+        LEFT JOIN devices d ON d.imei = f.imei
+        `+where.String()+`
+        ORDER BY f.imei, m.measured_at, m.id`, where.args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	dest := make([]interface{}, len(exportColumns))
+	for i, c := range exportColumns {
+		switch c.Kind {
+		case exportInt:
+			dest[i] = new(sql.NullInt64)
+		case exportString:
+			dest[i] = new(sql.NullString)
+		case exportTime:
+			dest[i] = new(sql.NullTime)
+		}
+	}
+
+	n := 0
+	row := make([]interface{}, len(exportColumns))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, d := range dest {
+			row[i] = nil
+			switch v := d.(type) {
+			case *sql.NullInt64:
+				if v.Valid {
+					row[i] = v.Int64
+				}
+			case *sql.NullString:
+				if v.Valid {
+					row[i] = v.String
+				}
+			case *sql.NullTime:
+				if v.Valid {
+					row[i] = v.Time
+				}
+			}
+		}
+		if err := ew.Write(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// -------------------------
+// EXPORT WRITERS
+// -------------------------
+// Rows are exportColumns-ordered values: nil, int64, string or time.Time.
+
+type exportWriter interface {
+	Write(row []interface{}) error
+	Close() error
+}
+
+func newExportWriter(format string, w io.Writer, loc *time.Location) (exportWriter, error) {
+	switch format {
+	case "csv", "excel":
+		return newCSVExport(w, format == "excel", loc)
+	case "ndjson":
+		return &ndjsonExport{w: bufio.NewWriter(w), loc: loc}, nil
+	case "parquet":
+		cols := make([]parquetColumn, len(exportColumns))
+		for i, c := range exportColumns {
+			cols[i] = parquetColumn{Name: c.Name, Type: parquetInt64}
+			switch c.Kind {
+			case exportString:
+				cols[i].Type = parquetString
+			case exportTime:
+				cols[i].Type = parquetTimestamp
+			}
+		}
+		return newParquetWriter(w, cols, exportRowGroupSize), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+type csvExport struct {
+	cw    *csv.Writer
+	excel bool
+	loc   *time.Location
+	rec   []string
+}
+
+func newCSVExport(w io.Writer, excel bool, loc *time.Location) (*csvExport, error) {
+	if excel {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return nil, err
+		}
+	}
+	e := &csvExport{cw: csv.NewWriter(w), excel: excel, loc: loc, rec: make([]string, len(exportColumns))}
+	e.cw.UseCRLF = excel
+
+	units := exportUnits()
+	for i, c := range exportColumns {
+		e.rec[i] = c.Name
+		if excel && units[c.Name] != "" {
+			e.rec[i] += " [" + units[c.Name] + "]"
+		}
+	}
+	return e, e.cw.Write(e.rec)
+}
+
+func (e *csvExport) Write(row []interface{}) error {
+	for i, v := range row {
+		switch v := v.(type) {
+		case nil:
+			e.rec[i] = ""
+		case int64:
+			e.rec[i] = strconv.FormatInt(v, 10)
+		case time.Time:
+			if e.excel {
+				e.rec[i] = v.In(e.loc).Format("2006-01-02 15:04:05")
+			} else {
+				e.rec[i] = v.In(e.loc).Format(time.RFC3339)
+			}
+		case string:
+			e.rec[i] = v
+			if e.excel && exportColumns[i].Text && v != "" {
+				// a formula keeps long digit strings from becoming 8.61E+14
+				e.rec[i] = `="` + strings.ReplaceAll(v, `"`, `""`) + `"`
+			}
+		}
+	}
+	return e.cw.Write(e.rec)
+}
+
+func (e *csvExport) Close() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+type ndjsonExport struct {
+	w   *bufio.Writer
+	loc *time.Location
+}
+
+func (e *ndjsonExport) Write(row []interface{}) error {
+	obj := make(map[string]interface{}, len(row))
+	for i, v := range row {
+		if t, ok := v.(time.Time); ok {
+			v = t.In(e.loc)
+		}
+		obj[exportColumns[i].Name] = v
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	e.w.Write(b)
+	return e.w.WriteByte('\n')
+}
+
+func (e *ndjsonExport) Close() error { return e.w.Flush() }
+
+// flushWriter pushes every write to the client so a long export streams.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// -------------------------
+// API: EXPORT
+// -------------------------
+// GET /api/v1/export/readings?format=csv|excel|ndjson|parquet
+//
+//	&month=2026-09 | from=RFC3339&to=RFC3339
+//	&imei=A&imei=B | imei=A,B &group=G &tz=Europe/Berlin
+//
+// A failure after the first byte can only be reported in the X-Export-Error
+// trailer; X-Export-Rows carries the row count.
+func getExportReadings(w http.ResponseWriter, r *http.Request) {
+	f, err := parseExportFilter(r.URL.Query(), callerTenant(r))
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", exportFormats[f.Format].ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+f.filename()+`"`)
+	w.Header().Set("Trailer", "X-Export-Rows, X-Export-Error")
+
+	fl, _ := w.(http.Flusher)
+	ew, err := newExportWriter(f.Format, flushWriter{w, fl}, f.Location)
+	if err == nil {
+		var n int
+		n, err = exportReadings(r.Context(), f, ew)
+		if cerr := ew.Close(); err == nil {
+			err = cerr
+		}
+		w.Header().Set("X-Export-Rows", strconv.Itoa(n))
+	}
+	if err != nil {
+		slog.Error("export failed", "err", err, "format", f.Format)
+		w.Header().Set("X-Export-Error", err.Error())
+	}
+}
+
+// -------------------------
+// CLI: server export [flags]
+// -------------------------
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "csv, excel, ndjson or parquet")
+	imeis := fs.String("imei", "", "comma-separated IMEIs (default all)")
+	group := fs.String("group", "", "only devices in this group")
+	month := fs.String("month", "", "calendar month YYYY-MM in -tz")
+	from := fs.String("from", "", "start, RFC3339 (instead of -month)")
+	to := fs.String("to", "", "end, RFC3339 (default now)")
+	tz := fs.String("tz", "", "time zone for -month and timestamps (default UTC)")
+	tenant := fs.Int("tenant", 0, "only this tenant's devices")
+	out := fs.String("o", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	q := url.Values{}
+	for k, v := range map[string]string{"format": *format, "imei": *imeis, "group": *group,
+		"month": *month, "from": *from, "to": *to, "tz": *tz} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	f, err := parseExportFilter(q, *tenant)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := openDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	bw := bufio.NewWriterSize(w, 1<<16)
+
+	ew, err := newExportWriter(f.Format, bw, f.Location)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	n, err := exportReadings(context.Background(), f, ew)
+	if cerr := ew.Close(); err == nil {
+		err = cerr
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export error:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d readings\n", n)
+	return 0
+}
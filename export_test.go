@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportRow builds a row in exportColumns order from name/value pairs.
+func exportRow(kv map[string]interface{}) []interface{} {
+	row := make([]interface{}, len(exportColumns))
+	for i, c := range exportColumns {
+		row[i] = kv[c.Name]
+	}
+	return row
+}
+
+var exportSample = []map[string]interface{}{
+	{"reading_id": int64(7), "frame_id": int64(70), "imei": "861234567890123", "serial": "00012345",
+		"measured_at": time.Date(2026, 9, 30, 22, 15, 0, 0, time.UTC), "total": int64(123456), "battery": int64(88)},
+	{"reading_id": int64(8), "frame_id": int64(71), "imei": "861234567890123", "group": `north "A"`,
+		"measured_at": time.Date(2026, 9, 30, 23, 15, 0, 0, time.UTC), "total": int64(-1)},
+}
+
+func runExport(t *testing.T, format string, loc *time.Location) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ew, err := newExportWriter(format, &buf, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range exportSample {
+		if err := ew.Write(exportRow(kv)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportCSV(t *testing.T) {
+	lines := strings.Split(string(runExport(t, "csv", time.UTC)), "\n")
+	if !strings.HasPrefix(lines[0], "reading_id,frame_id,imei,") || strings.Contains(lines[0], "[") {
+		t.Errorf("header = %q", lines[0])
+	}
+	if want := "7,70,861234567890123,,,,00012345,2026-09-30T22:15:00Z,,123456,,88,"; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("row = %q, want prefix %q", lines[1], want)
+	}
+	if !strings.Contains(lines[2], `"north ""A"""`) {
+		t.Errorf("quoted group missing in %q", lines[2])
+	}
+}
+
+func TestExportExcel(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	out := string(runExport(t, "excel", berlin))
+	if !strings.HasPrefix(out, "\ufeff") {
+		t.Error("missing UTF-8 BOM")
+	}
+	lines := strings.Split(strings.TrimPrefix(out, "\ufeff"), "\r\n")
+	if !strings.Contains(lines[0], "total [L]") || !strings.Contains(lines[0], "temperature [°C]") {
+		t.Errorf("header without units: %q", lines[0])
+	}
+	// identifiers as text formulas, local wall time
+	if want := `7,70,"=""861234567890123""",,,,"=""00012345""",2026-10-01 00:15:00,`; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("row = %q, want prefix %q", lines[1], want)
+	}
+
+	t.Setenv("EXPORT_UNITS", "total=m3")
+	out = string(runExport(t, "excel", time.UTC))
+	if !strings.Contains(out, "total [m3]") {
+		t.Error("EXPORT_UNITS not applied")
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(string(runExport(t, "ndjson", time.UTC))), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["imei"] != "861234567890123" || got["total"] != 123456.0 || got["flow"] != nil || got["measured_at"] != "2026-09-30T22:15:00Z" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestParseExportFilter(t *testing.T) {
+	f, err := parseExportFilter(url.Values{"month": {"2026-09"}, "imei": {"a,b", "c"}, "format": {"parquet"}}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.From.Equal(time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)) || !f.To.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("month range %v - %v", f.From, f.To)
+	}
+	if strings.Join(f.IMEIs, " ") != "a b c" || f.Tenant != 3 || f.filename() != "readings-20260901-20261001.parquet" {
+		t.Errorf("got %+v, %s", f, f.filename())
+	}
+
+	for _, q := range []url.Values{
+		{},
+		{"month": {"2026-09"}, "format": {"xlsx"}},
+		{"from": {"2026-09-02T00:00:00Z"}, "to": {"2026-09-01T00:00:00Z"}},
+	} {
+		if _, err := parseExportFilter(q, 0); err == nil {
+			t.Errorf("%v accepted", q)
+		}
+	}
+}
+
+// -------------------------
+// minimal Thrift compact reader, enough to check the Parquet footer
+// -------------------------
+type thriftReader struct {
+	b []byte
+	i int
+}
+
+func (r *thriftReader) byte() byte { r.i++; return r.b[r.i-1] }
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.i:])
+	r.i += n
+	return v
+}
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b[r.i:])
+	r.i += n
+	return v
+}
+
+// value decodes one value of compact type typ into Go values: int64, string,
+// []interface{} or map[int16]interface{} for structs.
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3:
+		return int64(int8(r.byte()))
+	case 4, 5, 6:
+		return r.varint()
+	case 8:
+		n := int(r.uvarint())
+		r.i += n
+		return string(r.b[r.i-n : r.i])
+	case 9, 10:
+		h := r.byte()
+		n, elem := int(h>>4), h&0x0F
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for k := range list {
+			list[k] = r.value(elem)
+		}
+		return list
+	case 12:
+		s := map[int16]interface{}{}
+		var last int16
+		for {
+			h := r.byte()
+			if h == 0 {
+				return s
+			}
+			id := last + int16(h>>4)
+			if h>>4 == 0 {
+				id = int16(r.varint())
+			}
+			s[id] = r.value(h & 0x0F)
+			last = id
+		}
+	}
+	panic(fmt.Sprintf("thrift type %d", typ))
+}
+
+func TestExportParquetRoundTrip(t *testing.T) {
+	b := runExport(t, "parquet", time.UTC)
+	if string(b[:4]) != parquetMagic || string(b[len(b)-4:]) != parquetMagic {
+		t.Fatal("missing PAR1 magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := (&thriftReader{b: b[len(b)-8-footerLen : len(b)-8]}).value(12).(map[int16]interface{})
+
+	if meta[3] != int64(len(exportSample)) {
+		t.Errorf("num_rows = %v", meta[3])
+	}
+	schema := meta[2].([]interface{})
+	if len(schema) != len(exportColumns)+1 {
+		t.Fatalf("%d schema elements", len(schema))
+	}
+
+	// read every column back: RLE definition levels, then PLAIN values
+	chunks := meta[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+	got := make([]map[string]interface{}, len(exportSample))
+	for i := range got {
+		got[i] = map[string]interface{}{}
+	}
+	for ci, c := range chunks {
+		name := schema[ci+1].(map[int16]interface{})[4].(string)
+		cm := c.(map[int16]interface{})[3].(map[int16]interface{})
+		r := &thriftReader{b: b, i: int(cm[9].(int64))}
+		page := r.value(12).(map[int16]interface{})
+		if page[5].(map[int16]interface{})[1] != int64(len(exportSample)) {
+			t.Fatalf("%s: page num_values %v", name, page[5])
+		}
+
+		levelsEnd := r.i + 4 + int(binary.LittleEndian.Uint32(b[r.i:]))
+		r.i += 4
+		var defs []byte
+		for r.i < levelsEnd {
+			n := int(r.uvarint() >> 1)
+			v := r.byte()
+			for k := 0; k < n; k++ {
+				defs = append(defs, v)
+			}
+		}
+		for row, d := range defs {
+			if d == 0 {
+				continue
+			}
+			switch schema[ci+1].(map[int16]interface{})[1] {
+			case int64(pqTypeByteArray):
+				n := int(binary.LittleEndian.Uint32(b[r.i:]))
+				got[row][name] = string(b[r.i+4 : r.i+4+n])
+				r.i += 4 + n
+			default:
+				v := int64(binary.LittleEndian.Uint64(b[r.i:]))
+				if schema[ci+1].(map[int16]interface{})[6] == int64(pqConvertedTimestampMillis) {
+					got[row][name] = time.UnixMilli(v).UTC()
+				} else {
+					got[row][name] = v
+				}
+				r.i += 8
+			}
+		}
+	}
+
+	for i, want := range exportSample {
+		if fmt.Sprint(got[i]) != fmt.Sprint(want) {
+			t.Errorf("row %d:\n got %v\nwant %v", i, got[i], want)
+		}
+	}
+}
@@ -1,14 +1,40 @@
-<<<<<<< HEAD
-module github.com/sani-kumar2323/test_api
-=======
 module test_api
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 
 go 1.25.4
 
 require github.com/lib/pq v1.10.9
-<<<<<<< HEAD
-=======
 
-require github.com/google/uuid v1.6.0 // indirect
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
+require github.com/google/uuid v1.6.0
+
+require github.com/gorilla/websocket v1.5.3
+
+require github.com/golang-jwt/jwt/v5 v5.3.0
+
+require github.com/google/gopacket v1.1.19
+
+require github.com/eclipse/paho.mqtt.golang v1.5.1
+
+require github.com/nats-io/nats.go v1.48.0
+
+require github.com/klauspost/compress v1.18.0
+
+require google.golang.org/protobuf v1.36.8
+
+require github.com/DATA-DOG/go-sqlmock v1.5.2
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/nats-io/nkeys v0.4.11 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/prometheus/client_golang v1.23.2
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.66.1 // indirect
+	github.com/prometheus/procfs v0.16.1 // indirect
+	go.yaml.in/yaml/v2 v2.4.2 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+)
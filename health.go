@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------
+// HEALTH
+// -------------------------
+// GET /healthz answers as long as the process is serving HTTP.
+// GET /readyz returns 503 unless the database answers, the TCP listener is
+// up, in-flight ingest is under INGEST_MAX_INFLIGHT (default 1000) and every
+// migration has been applied. Both are unauthenticated for orchestrators.
+//
+// database/sql redials on its own once Postgres is back; watchDB pings with
+// backoff so the outage is visible in /readyz and the logs, and connectDB
+// waits with the same backoff at startup instead of exiting immediately.
+
+var (
+	startedAt      = time.Now()
+	dbUp           atomic.Bool
+	tcpListening   atomic.Bool
+	ingestInflight atomic.Int64
+)
+
+const (
+	dbBackoffMin = time.Second
+	dbBackoffMax = 30 * time.Second
+)
+
+func nextDBBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > dbBackoffMax {
+		return dbBackoffMax
+	}
+	return d
+}
+
+// connectDBWithRetry keeps trying connectDB until it succeeds or
+// DB_CONNECT_TIMEOUT (default 2m) passes.
+func connectDBWithRetry() (*sql.DB, error) {
+	timeout, err := time.ParseDuration(getenv("DB_CONNECT_TIMEOUT", "2m"))
+	if err != nil {
+		timeout = 2 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	wait := dbBackoffMin
+	for {
+		conn, err := connectDB()
+		if err == nil {
+			dbUp.Store(true)
+			return conn, nil
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		slog.Warn("database not reachable, retrying", "err", err, "in", wait)
+		time.Sleep(wait)
+		wait = nextDBBackoff(wait)
+	}
+}
+
+// watchDB pings the database every 5s while it is up and with exponential
+// backoff while it is down.
+func watchDB() {
+	wait := dbBackoffMin
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+
+		switch {
+		case err == nil && !dbUp.Load():
+			slog.Info("database reconnected")
+			dbUp.Store(true)
+			wait = dbBackoffMin
+		case err != nil && dbUp.Load():
+			slog.Error("database connection lost", "err", err)
+			dbUp.Store(false)
+		case err != nil:
+			slog.Warn("database still unreachable", "err", err, "retry_in", wait)
+		}
+
+		if err == nil {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		time.Sleep(wait)
+		wait = nextDBBackoff(wait)
+	}
+}
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthStatus struct {
+	Status        string `json:"status"`
+	UptimeSeconds int    `json:"uptime_seconds"`
+}
+
+type ReadyStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// GET /healthz
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthStatus{Status: "ok", UptimeSeconds: int(time.Since(startedAt).Seconds())})
+}
+
+// GET /readyz
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		checks["database"] = healthCheck{Detail: err.Error()}
+	} else {
+		checks["database"] = healthCheck{OK: true}
+	}
+
+	if tcpListening.Load() {
+		checks["tcp_listener"] = healthCheck{OK: true, Detail: ":9000"}
+	} else {
+		checks["tcp_listener"] = healthCheck{Detail: "not listening"}
+	}
+
+	maxInflight, err := strconv.ParseInt(getenv("INGEST_MAX_INFLIGHT", "1000"), 10, 64)
+	if err != nil {
+		maxInflight = 1000
+	}
+	n := ingestInflight.Load()
+	checks["ingest_queue"] = healthCheck{OK: n < maxInflight, Detail: fmt.Sprintf("%d in flight, limit %d", n, maxInflight)}
+
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		checks["migrations"] = healthCheck{Detail: err.Error()}
+	} else {
+		checks["migrations"] = healthCheck{OK: version == len(migrations),
+			Detail: fmt.Sprintf("schema version %d of %d", version, len(migrations))}
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ReadyStatus{Status: status, Checks: checks})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// -------------------------
+// INGEST PIPELINE
+// -------------------------
+// ingestFrame is everything that happens to a frame once a transport has its
+// bytes: framing checks, decoding, storage, device and alert updates, webhook
+// events, the live feed and MQTT. The raw TCP and UDP listeners, the CoAP
+// server, the HTTP endpoint and the MQTT subscriber all call it, so a frame is
+// treated the same whichever way it arrived. Each transport acknowledges only
+// a stored frame: TCP and UDP write "OK", CoAP answers 2.04, HTTP 200, MQTT
+// sends its PUBACK.
+
+// transports, stored on meter_frames.transport
+const (
+	transportTCP  = "tcp"
+	transportHTTP = "http"
+	transportMQTT = "mqtt"
+	transportUDP  = "udp"
+	transportCoAP = "coap"
+)
+
+// ingestResult tells the transport what to answer. A frame is acknowledged
+// when neither Rejected nor Err is set.
+type ingestResult struct {
+	FrameID  int
+	TenantID int
+	IMEI     string
+	Rejected string // framesInvalid reason when the frame was not stored
+	Err      error  // storing the frame failed; the sender should retry
+}
+
+func (r ingestResult) stored() bool { return r.Rejected == "" && r.Err == nil }
+
+func ingestFrame(meta frameMeta, logger *slog.Logger) (res ingestResult) {
+	ingestInflight.Add(1)
+	defer ingestInflight.Add(-1)
+	defer func() {
+		outcome := "stored"
+		if res.Rejected != "" {
+			outcome = "rejected"
+		} else if res.Err != nil {
+			outcome = "failed"
+		}
+		ingestFrames.WithLabelValues(meta.Transport, outcome).Inc()
+	}()
+
+	packet := meta.Raw
+	n := len(packet)
+	framesReceived.Inc()
+	logger.Debug("frame received", "bytes", n)
+
+	// rejected packets are logged with their hex when sampled
+	reject := func(reason, msg string) ingestResult {
+		framesInvalid.WithLabelValues(reason).Inc()
+		if sampleHex() {
+			logger.Warn(msg, "bytes", n, "hex", fmt.Sprintf("% X", packet))
+		} else {
+			logger.Warn(msg, "bytes", n)
+		}
+		return ingestResult{Rejected: reason}
+	}
+
+	if n < 30 {
+		return reject(invalidShort, "ignoring short packet")
+	}
+
+	if packet[0] != 0x68 {
+		return reject(invalidStartFlag, "invalid start flag")
+	}
+
+	header, decoded, protoErrs, err := decodeFrame(packet)
+	if err != nil {
+		return reject(invalidTruncated, "TLV length runs past end of packet")
+	}
+	manufacturer, _ := header["manufacturer_code"].(string)
+	countParsedFrame(manufacturer, protoErrs)
+
+	imei, _ := header["imei"].(string)
+	res.IMEI = imei
+	logger = logger.With("imei", imei)
+	if debugDevices.enabled(imei) {
+		logger.Debug("frame hex", "hex", fmt.Sprintf("% X", packet))
+	} else if sampleHex() {
+		logger.Info("frame hex", "hex", fmt.Sprintf("% X", packet))
+	}
+
+	countProtocolErrors(protoErrs)
+	logger.Debug("frame decoded", "decoded", decoded, "protocol_errors", len(protoErrs))
+
+	// ---- SAVE FRAME ----
+	// the ticket holds back live events of frames stored after this one
+	// until it is published or dropped
+	ticket := liveFeed.begin()
+	defer liveFeed.drop(ticket) // no-op once published
+	t := time.Now()
+	frameID, tenantID, err := saveFrameToDB(header, meta, protoErrs)
+	observeDB("meter_frames", t)
+	if err != nil {
+		logger.Error("saving frame failed", "err", err)
+		res.Err = err
+		return res
+	}
+	res.FrameID, res.TenantID = frameID, tenantID
+	logger = logger.With("frame_id", frameID)
+
+	// ---- SAVE READING ----
+	t = time.Now()
+	err = saveReadingToDB(frameID, decoded)
+	observeDB("messages", t)
+	if err != nil {
+		logger.Error("saving reading failed", "err", err)
+	}
+
+	// ---- LIVE FEED ----
+	// published as soon as the rows are in, so a slow device update, alert
+	// or webhook step doesn't hold back the frames stored after this one
+	ev := newLiveEvent(frameID, header, decoded, meta.ReceivedAt)
+	ev.TenantID = tenantID
+	liveFeed.publish(ticket, ev)
+
+	// ---- UPDATE DEVICE ----
+	t = time.Now()
+	model, err := upsertDevice(header, decoded, frameID)
+	observeDB("devices", t)
+	if err != nil {
+		logger.Error("updating device failed", "err", err)
+	}
+
+	// ---- ALERT RULES ----
+	opened, err := evaluateReadingAlerts(imei, frameID, decoded, meta.ReceivedAt)
+	if err != nil {
+		logger.Error("evaluating alert rules failed", "err", err)
+	}
+
+	// ---- WEBHOOK EVENTS ----
+	if err := emitReadingEvents(imei, frameID, decoded, opened); err != nil {
+		logger.Error("queueing webhook events failed", "err", err)
+	}
+
+	// ---- MQTT / TSDB ----
+	mqttOut.publishReading(ev, opened)
+	tsdbOut.publishReading(ev, model)
+
+	logger.Info("frame stored", "bytes", n, "manufacturer", manufacturer, "tenant_id", tenantID)
+	return res
+}
+
+// singleFrameMeta is the receive metadata of a frame that arrived on its own,
+// as an HTTP request or MQTT message: a session of one frame.
+func singleFrameMeta(transport string, packet []byte, remote, local string) frameMeta {
+	return frameMeta{
+		Raw:        append([]byte(nil), packet...),
+		Transport:  transport,
+		RemoteAddr: remote,
+		LocalAddr:  local,
+		SessionID:  uuid.NewString(),
+		ReceivedAt: time.Now(),
+	}
+}
+
+// framePayload accepts the frame bytes or their hex text, for transports
+// whose senders may only be able to send text.
+func framePayload(p []byte) ([]byte, error) {
+	if len(p) == 0 || p[0] == frameStartFlag {
+		return p, nil
+	}
+	return parseHexBytes(string(p))
+}
+
+// -------------------------
+// API: HTTP INGEST
+// -------------------------
+
+// IngestResult is the response of POST /api/v1/ingest.
+type IngestResult struct {
+	FrameID  int    `json:"frame_id"`
+	TenantID int    `json:"tenant_id,omitempty"`
+	IMEI     string `json:"imei"`
+}
+
+// POST /api/v1/ingest stores one frame posted by a carrier IoT platform. The
+// body is the frame itself as application/octet-stream, or like POST /decode
+// hex text or {"hex": ...} / {"base64": ...}. 200 is the ACK; a rejected
+// frame is a 422 and a storage failure a 503, which the platform should retry.
+func postIngest(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	packet := body
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/octet-stream") {
+		var req DecodeRequest
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+			if err := json.Unmarshal(body, &req); err != nil {
+				writeError(w, 400, "invalid JSON: "+err.Error())
+				return
+			}
+		} else {
+			req.Hex = string(body)
+		}
+		if packet, err = decodePayloadBytes(req.Hex, req.Base64); err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+	}
+
+	if len(packet) > maxFrameLen {
+		writeError(w, 413, fmt.Sprintf("frames are at most %d bytes", maxFrameLen))
+		return
+	}
+
+	meta := singleFrameMeta(transportHTTP, packet, r.RemoteAddr, r.Host)
+	res := ingestFrame(meta, slog.With("session", meta.SessionID, "remote", meta.RemoteAddr, "transport", transportHTTP))
+	switch {
+	case res.Rejected != "":
+		writeError(w, http.StatusUnprocessableEntity, "frame rejected: "+res.Rejected)
+	case res.Err != nil:
+		writeError(w, http.StatusServiceUnavailable, "storing frame failed")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(IngestResult{FrameID: res.FrameID, TenantID: res.TenantID, IMEI: res.IMEI})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// These requests all stop before the database.
+func TestPostIngestRejects(t *testing.T) {
+	for _, c := range []struct {
+		name, contentType, body string
+		status                  int
+	}{
+		{"short frame", "text/plain", "68 00 2F 16", http.StatusUnprocessableEntity},
+		{"start flag", "application/json", `{"hex": "` + strings.Repeat("00 ", 31) + `"}`, http.StatusUnprocessableEntity},
+		{"raw bytes", "application/octet-stream", "\x68\x00", http.StatusUnprocessableEntity},
+		{"bad hex", "text/plain", "68 0G", http.StatusBadRequest},
+		{"bad json", "application/json", `{"hex": `, http.StatusBadRequest},
+		{"too long", "text/plain", strings.Repeat("68", maxFrameLen+1), http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", apiPrefix+"/ingest", strings.NewReader(c.body))
+			r.Header.Set("Content-Type", c.contentType)
+			w := httptest.NewRecorder()
+			postIngest(w, r)
+			if w.Code != c.status {
+				t.Errorf("status %d, want %d: %s", w.Code, c.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestManufacturerLabel(t *testing.T) {
+	allowed := parseManufacturerList(" 0001, 1a2b ,")
+	for code, want := range map[string]string{
+		"0001": "0001",
+		"1A2B": "1A2B",
+		"FFFF": "other",
+		"":     "other",
+	} {
+		if got := manufacturerLabel(allowed, code); got != want {
+			t.Errorf("manufacturerLabel(%q) = %q, want %q", code, got, want)
+		}
+	}
+	if got := manufacturerLabel(parseManufacturerList(""), "0001"); got != "other" {
+		t.Errorf("empty allow-list: %q", got)
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------------------
+// LIVE FEED (SSE + WebSocket)
+// -------------------------
+// ingestFrame publishes every stored frame to liveFeed, in frame id order.
+// Subscribers get the frames matching their filter; the event id is the
+// meter_frames id, so a reconnecting client sends the last id it saw and gets
+// everything after it, from the in-memory ring when it still holds it, from
+// the database otherwise.
+
+const (
+	liveRingSize    = 1000
+	liveSubBuffer   = 256
+	liveReplayLimit = 5000
+	liveHeartbeat   = 15 * time.Second
+)
+
+type liveEvent struct {
+	ID               int                    `json:"id"`
+	IMEI             string                 `json:"imei"`
+	ManufacturerCode string                 `json:"manufacturer_code"`
+	MeterAddress     string                 `json:"meter_address"`
+	TenantID         int                    `json:"tenant_id,omitempty"`
+	ReceivedAt       time.Time              `json:"received_at"`
+	Decoded          map[string]interface{} `json:"decoded"`
+	Alarms           []string               `json:"alarms"`
+	// DecodeErrors is set on replayed frames whose stored tlv_hex is not hex.
+	DecodeErrors []protocolError `json:"decode_errors,omitempty"`
+}
+
+func newLiveEvent(frameID int, h map[string]interface{}, decoded map[string]interface{}, at time.Time) liveEvent {
+	imei, _ := h["imei"].(string)
+	manufacturer, _ := h["manufacturer_code"].(string)
+	addr, _ := h["meter_address"].(string)
+	return liveEvent{
+		ID:               frameID,
+		IMEI:             imei,
+		ManufacturerCode: manufacturer,
+		MeterAddress:     addr,
+		ReceivedAt:       at,
+		Decoded:          decoded,
+		Alarms:           readingAlarms(getInt(decoded["battery"]), getInt(decoded["magnetic_tamper"])),
+	}
+}
+
+// liveFilter narrows a subscription; empty fields match everything.
+// Alarm "any" matches any reading in alarm. Tenant is the caller's scope.
+type liveFilter struct {
+	Tenant       int
+	IMEIs        map[string]bool
+	Manufacturer string
+	Alarm        string
+}
+
+func parseLiveFilter(r *http.Request) liveFilter {
+	q := r.URL.Query()
+	f := liveFilter{Tenant: callerTenant(r), Manufacturer: q.Get("manufacturer"), Alarm: q.Get("alarm")}
+	for _, imei := range q["imei"] {
+		if f.IMEIs == nil {
+			f.IMEIs = map[string]bool{}
+		}
+		f.IMEIs[imei] = true
+	}
+	return f
+}
+
+func (f liveFilter) match(ev liveEvent) bool {
+	if f.Tenant != 0 && f.Tenant != ev.TenantID {
+		return false
+	}
+	if f.IMEIs != nil && !f.IMEIs[ev.IMEI] {
+		return false
+	}
+	if f.Manufacturer != "" && f.Manufacturer != ev.ManufacturerCode {
+		return false
+	}
+	if f.Alarm == "" {
+		return true
+	}
+	for _, a := range ev.Alarms {
+		if f.Alarm == "any" || f.Alarm == a {
+			return true
+		}
+	}
+	return false
+}
+
+type liveSub struct {
+	ch     chan liveEvent
+	filter liveFilter
+	// closed when the subscriber fell too far behind; it should reconnect with its last id
+	lagged chan struct{}
+}
+
+type liveHub struct {
+	mu   sync.Mutex
+	subs map[*liveSub]bool
+	ring []liveEvent
+
+	// Frame ids come from a sequence, so concurrent sessions commit them out
+	// of order. Events are held until every insert that could still commit a
+	// lower id has finished, then released in id order; released is the
+	// highest id handed out, everything up to it is final.
+	nextTicket int
+	pending    map[int]bool
+	held       []heldLiveEvent
+	released   int
+}
+
+type heldLiveEvent struct {
+	ev liveEvent
+	// tickets below this were open when the frame was stored
+	after int
+}
+
+// liveTicket stands for a frame insert in progress. Take one before the
+// insert, then publish the event or drop the ticket when nothing was stored.
+type liveTicket int
+
+var liveFeed = newLiveHub()
+
+func newLiveHub() *liveHub {
+	return &liveHub{subs: map[*liveSub]bool{}, pending: map[int]bool{}}
+}
+
+// startLiveFeed picks up the frame ids stored before this process started.
+func startLiveFeed() error {
+	var last int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM meter_frames`).Scan(&last); err != nil {
+		return err
+	}
+	liveFeed.mu.Lock()
+	defer liveFeed.mu.Unlock()
+	liveFeed.released = max(liveFeed.released, last)
+	return nil
+}
+
+func (h *liveHub) begin() liveTicket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextTicket++
+	h.pending[h.nextTicket] = true
+	return liveTicket(h.nextTicket)
+}
+
+// drop ends a ticket whose frame was not stored.
+func (h *liveHub) drop(t liveTicket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending[int(t)] {
+		delete(h.pending, int(t))
+		h.release()
+	}
+}
+
+func (h *liveHub) publish(t liveTicket, ev liveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.pending[int(t)] {
+		return
+	}
+	delete(h.pending, int(t))
+
+	i, _ := slices.BinarySearchFunc(h.held, ev.ID, func(e heldLiveEvent, id int) int { return cmp.Compare(e.ev.ID, id) })
+	h.held = slices.Insert(h.held, i, heldLiveEvent{ev: ev, after: h.nextTicket + 1})
+	h.release()
+}
+
+// release sends the held events, lowest id first, as long as no insert that
+// was running when they were stored is still open.
+func (h *liveHub) release() {
+	oldest := h.nextTicket + 1
+	for t := range h.pending {
+		oldest = min(oldest, t)
+	}
+	n := 0
+	for n < len(h.held) && h.held[n].after <= oldest {
+		h.send(h.held[n].ev)
+		n++
+	}
+	h.held = slices.Delete(h.held, 0, n)
+}
+
+func (h *liveHub) send(ev liveEvent) {
+	h.released = max(h.released, ev.ID)
+	h.ring = append(h.ring, ev)
+	if len(h.ring) > liveRingSize {
+		h.ring = h.ring[len(h.ring)-liveRingSize:]
+	}
+
+	for s := range h.subs {
+		if !s.filter.match(ev) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			close(s.lagged)
+			delete(h.subs, s)
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the buffered events after
+// lastID. Everything sent to the subscriber later has an id above upTo;
+// covered is false when the ring no longer reaches back to lastID and the
+// gap up to upTo has to be filled from the database.
+func (h *liveHub) subscribe(f liveFilter, lastID int) (s *liveSub, backlog []liveEvent, upTo int, covered bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s = &liveSub{ch: make(chan liveEvent, liveSubBuffer), filter: f, lagged: make(chan struct{})}
+	h.subs[s] = true
+
+	covered = lastID == 0 || lastID >= h.released || (len(h.ring) > 0 && h.ring[0].ID <= lastID+1)
+	if lastID == 0 {
+		return s, nil, h.released, true
+	}
+	for _, ev := range h.ring {
+		if ev.ID > lastID && f.match(ev) {
+			backlog = append(backlog, ev)
+		}
+	}
+	return s, backlog, h.released, covered
+}
+
+func (h *liveHub) unsubscribe(s *liveSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+// replayFromDB rebuilds events for frames in (lastID, upTo] by decoding their stored TLV.
+func replayFromDB(f liveFilter, lastID, upTo int) ([]liveEvent, error) {
+	var where sqlWhere
+	where.add("id > $%d", lastID)
+	where.add("id <= $%d", upTo)
+	if f.Tenant != 0 {
+		where.add("tenant_id = $%d", f.Tenant)
+	}
+	if f.Manufacturer != "" {
+		where.add("manufacturer_code = $%d", f.Manufacturer)
+	}
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT id, COALESCE(imei, ''), COALESCE(manufacturer_code, ''), COALESCE(meter_address, ''),
+               COALESCE(received_at, created_at), COALESCE(tlv_hex, ''), COALESCE(tenant_id, 0)
+        FROM meter_frames %s ORDER BY id LIMIT %d
+    `, where.String(), liveReplayLimit), where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []liveEvent
+	for rows.Next() {
+		var id, tenant int
+		var at time.Time
+		h := map[string]interface{}{}
+		var imei, manufacturer, addr, tlv string
+		if err := rows.Scan(&id, &imei, &manufacturer, &addr, &at, &tlv, &tenant); err != nil {
+			return nil, err
+		}
+		h["imei"], h["manufacturer_code"], h["meter_address"] = imei, manufacturer, addr
+
+		decoded, errs := decodeStoredTLV(tlv)
+		if decoded == nil {
+			decoded = map[string]interface{}{}
+		} else {
+			errs = nil // the TLV's own problems are not part of a live event
+		}
+		ev := newLiveEvent(id, h, decoded, at)
+		ev.TenantID = tenant
+		ev.DecodeErrors = errs
+		if f.match(ev) {
+			list = append(list, ev)
+		}
+	}
+	return list, rows.Err()
+}
+
+// openLiveStream subscribes and assembles the catch-up events for lastID.
+// The backlog ends at upTo, where the subscription's own events start.
+func openLiveStream(f liveFilter, lastID int) (s *liveSub, backlog []liveEvent, upTo int, err error) {
+	s, backlog, upTo, covered := liveFeed.subscribe(f, lastID)
+	if covered {
+		return s, backlog, upTo, nil
+	}
+
+	replay, err := replayFromDB(f, lastID, upTo)
+	if err != nil {
+		liveFeed.unsubscribe(s)
+		return nil, nil, 0, err
+	}
+	// the ring may hold frames newer than the replay limit reached
+	last := lastID
+	if len(replay) > 0 {
+		last = replay[len(replay)-1].ID
+	}
+	for _, ev := range backlog {
+		if ev.ID > last {
+			replay = append(replay, ev)
+		}
+	}
+	return s, replay, upTo, nil
+}
+
+func lastEventID(r *http.Request) int {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	id, _ := strconv.Atoi(v)
+	return id
+}
+
+// -------------------------
+// API: SSE
+// -------------------------
+// GET /api/live/sse?imei=&imei=&manufacturer=&alarm=any|magnetic_tamper|...
+// Resumes after the Last-Event-ID header (or ?last_event_id=).
+func getLiveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "streaming unsupported")
+		return
+	}
+
+	f := parseLiveFilter(r)
+	s, backlog, upTo, err := openLiveStream(f, lastEventID(r))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer liveFeed.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(ev liveEvent) error {
+		b, _ := json.Marshal(ev)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: reading\ndata: %s\n\n", ev.ID, b); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for _, ev := range backlog {
+		if write(ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	tick := time.NewTicker(liveHeartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.lagged:
+			fmt.Fprint(w, "event: lagged\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case ev := <-s.ch:
+			if ev.ID <= upTo {
+				continue // already in the backlog
+			}
+			if write(ev) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-tick.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// -------------------------
+// API: WEBSOCKET
+// -------------------------
+// GET /api/live/ws, same filters as SSE. Each message is one liveEvent; resume
+// with ?last_event_id=.
+var liveUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// the API has no browser session to protect; auth is handled per request
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func getLiveWS(w http.ResponseWriter, r *http.Request) {
+	f := parseLiveFilter(r)
+	s, backlog, upTo, err := openLiveStream(f, lastEventID(r))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer liveFeed.unsubscribe(s)
+
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// reader: only needed to notice the client going away and to answer pings
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(ev liveEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteJSON(ev); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for _, ev := range backlog {
+		if write(ev) != nil {
+			return
+		}
+	}
+
+	tick := time.NewTicker(liveHeartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-s.lagged:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "lagged; reconnect with last_event_id"),
+				time.Now().Add(time.Second))
+			return
+		case ev := <-s.ch:
+			if ev.ID <= upTo {
+				continue // already in the backlog
+			}
+			if write(ev) != nil {
+				return
+			}
+		case <-tick.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)) != nil {
+				return
+			}
+		}
+	}
+}
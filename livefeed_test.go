@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func liveIDs(s *liveSub) []int {
+	var ids []int
+	for {
+		select {
+		case ev := <-s.ch:
+			ids = append(ids, ev.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestLiveHubPublishesInIDOrder(t *testing.T) {
+	h := newLiveHub()
+	s, _, _, _ := h.subscribe(liveFilter{}, 0)
+
+	// three sessions insert at once: b commits id 11 before a commits 10,
+	// c fails after taking its ticket
+	a, b, c := h.begin(), h.begin(), h.begin()
+	h.publish(b, liveEvent{ID: 11})
+	if ids := liveIDs(s); len(ids) != 0 {
+		t.Fatalf("sent %v while frame 10 was still in flight", ids)
+	}
+	h.publish(a, liveEvent{ID: 10})
+	if ids := liveIDs(s); len(ids) != 0 {
+		t.Fatalf("sent %v before the failed insert ended", ids)
+	}
+	h.drop(c)
+	if ids := liveIDs(s); !slices.Equal(ids, []int{10, 11}) {
+		t.Fatalf("sent %v, want [10 11]", ids)
+	}
+	h.drop(a) // already published
+	h.drop(b)
+
+	// an insert started after 12 was stored cannot commit a lower id
+	d := h.begin()
+	h.publish(d, liveEvent{ID: 12})
+	e := h.begin()
+	if ids := liveIDs(s); !slices.Equal(ids, []int{12}) {
+		t.Fatalf("sent %v, want [12]", ids)
+	}
+	h.drop(e)
+}
+
+func TestLiveHubResumeBoundary(t *testing.T) {
+	h := newLiveHub()
+	h.publish(h.begin(), liveEvent{ID: 4})
+	a, b := h.begin(), h.begin()
+	h.publish(b, liveEvent{ID: 6})
+
+	// frame 6 is committed but held behind 5, so a client resuming now
+	// must not get it from the catch-up and then miss 5
+	s, backlog, upTo, covered := h.subscribe(liveFilter{}, 3)
+	if !covered || upTo != 4 || len(backlog) != 1 || backlog[0].ID != 4 {
+		t.Fatalf("backlog %v up to %d, covered %v", backlog, upTo, covered)
+	}
+	h.publish(a, liveEvent{ID: 5})
+	if ids := liveIDs(s); !slices.Equal(ids, []int{5, 6}) {
+		t.Fatalf("sent %v, want [5 6]", ids)
+	}
+}
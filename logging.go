@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------
+// LOGGING
+// -------------------------
+// log/slog everywhere. Configured from the environment:
+//
+//	LOG_LEVEL     debug, info (default), warn, error
+//	LOG_FORMAT    text (default) or json
+//	LOG_HEX_EVERY dump the raw hex of 1 in N frames at info (default 100, 0 = never)
+//
+// Connection loggers carry session (and imei once the header is parsed), so
+// every line of a connection can be correlated. Devices put in debug mode via
+// /api/admin/debug-devices log at debug level, including every hex dump,
+// whatever LOG_LEVEL says.
+
+var logLevel = new(slog.LevelVar)
+
+func setupLogging() {
+	switch strings.ToLower(getenv("LOG_LEVEL", "info")) {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "warn", "warning":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	// the inner handler sees everything; deviceDebugHandler does the filtering
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var inner slog.Handler
+	if strings.ToLower(getenv("LOG_FORMAT", "text")) == "json" {
+		inner = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		inner = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(&deviceDebugHandler{inner: inner}))
+
+	n, err := strconv.Atoi(getenv("LOG_HEX_EVERY", "100"))
+	if err != nil || n < 0 {
+		n = 100
+	}
+	hexEvery.Store(int64(n))
+}
+
+// fatal logs at error level and exits, for startup failures.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// deviceDebugHandler applies logLevel, except for loggers bound to an IMEI
+// that is in debug mode.
+type deviceDebugHandler struct {
+	inner slog.Handler
+	imei  string
+}
+
+func (h *deviceDebugHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevel.Level() || (h.imei != "" && debugDevices.enabled(h.imei))
+}
+
+func (h *deviceDebugHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *deviceDebugHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := &deviceDebugHandler{inner: h.inner.WithAttrs(attrs), imei: h.imei}
+	for _, a := range attrs {
+		if a.Key == "imei" {
+			c.imei = a.Value.String()
+		}
+	}
+	return c
+}
+
+func (h *deviceDebugHandler) WithGroup(name string) slog.Handler {
+	return &deviceDebugHandler{inner: h.inner.WithGroup(name), imei: h.imei}
+}
+
+// -------------------------
+// HEX DUMP SAMPLING
+// -------------------------
+var (
+	hexEvery   atomic.Int64
+	hexCounter atomic.Int64
+)
+
+// sampleHex reports whether this frame's hex dump should be logged.
+func sampleHex() bool {
+	n := hexEvery.Load()
+	return n > 0 && hexCounter.Add(1)%n == 0
+}
+
+// -------------------------
+// PER-DEVICE DEBUG
+// -------------------------
+type debugSet struct {
+	mu    sync.RWMutex
+	until map[string]time.Time // zero time = no expiry
+}
+
+var debugDevices = &debugSet{until: map[string]time.Time{}}
+
+func (s *debugSet) enabled(imei string) bool {
+	s.mu.RLock()
+	until, ok := s.until[imei]
+	s.mu.RUnlock()
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+func (s *debugSet) set(imei string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.until[imei] = until
+}
+
+func (s *debugSet) remove(imei string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.until[imei]
+	delete(s.until, imei)
+	return ok
+}
+
+type debugDevice struct {
+	IMEI  string     `json:"imei"`
+	Until *time.Time `json:"until"`
+}
+
+func (s *debugSet) list() []debugDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []debugDevice{}
+	now := time.Now()
+	for imei, until := range s.until {
+		if !until.IsZero() && now.After(until) {
+			delete(s.until, imei)
+			continue
+		}
+		d := debugDevice{IMEI: imei}
+		if !until.IsZero() {
+			u := until
+			d.Until = &u
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IMEI < list[j].IMEI })
+	return list
+}
+
+// -------------------------
+// API: DEBUG DEVICES
+// -------------------------
+
+// GET /api/admin/debug-devices
+func getDebugDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(debugDevices.list())
+}
+
+// DebugDeviceRequest is the optional PUT /api/v1/admin/debug-devices/{imei} body.
+type DebugDeviceRequest struct {
+	TTL string `json:"ttl,omitempty"`
+}
+
+// PUT /api/admin/debug-devices/{imei} {"ttl": "30m"}; ttl is optional (default 1h, "0" = until removed)
+func putDebugDevice(w http.ResponseWriter, r *http.Request) {
+	var body DebugDeviceRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, 400, "invalid JSON: "+err.Error())
+			return
+		}
+	}
+	if body.TTL == "" {
+		body.TTL = "1h"
+	}
+	ttl, err := time.ParseDuration(body.TTL)
+	if err != nil || ttl < 0 {
+		writeError(w, 400, "invalid ttl")
+		return
+	}
+
+	imei := r.PathValue("imei")
+	d := debugDevice{IMEI: imei}
+	var until time.Time
+	if ttl > 0 {
+		until = time.Now().Add(ttl)
+		d.Until = &until
+	}
+	debugDevices.set(imei, until)
+	slog.Info("device debug logging enabled", "imei", imei, "ttl", ttl, "by", requestPrincipal(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// DELETE /api/admin/debug-devices/{imei}
+func deleteDebugDevice(w http.ResponseWriter, r *http.Request) {
+	imei := r.PathValue("imei")
+	if !debugDevices.remove(imei) {
+		writeError(w, 404, "device not in debug mode")
+		return
+	}
+	slog.Info("device debug logging disabled", "imei", imei, "by", requestPrincipal(r).Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -------------------------
+// METRICS
+// -------------------------
+// Exposed on GET /metrics in the Prometheus text format. The endpoint is not
+// behind requireRole so scrapers need no API key; it carries no meter data
+// beyond manufacturer codes. Per-manufacturer frame rates are
+// rate(meter_frames_parsed_total[5m]); only the codes listed in
+// METRICS_MANUFACTURERS (comma separated, e.g. "0001,1A2B") get their own
+// series, the rest are counted as "other".
+
+var (
+	tcpConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_tcp_connections_total",
+		Help: "TCP connections by result (accepted, rejected).",
+	}, []string{"result"})
+
+	tcpSessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meter_tcp_sessions_active",
+		Help: "TCP sessions currently being handled.",
+	})
+
+	framesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meter_frames_received_total",
+		Help: "Packets read from meter connections.",
+	})
+
+	framesParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_frames_parsed_total",
+		Help: "Frames that passed framing and checksum checks, by manufacturer code (listed codes, else other).",
+	}, []string{"manufacturer"})
+
+	framesInvalid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_frames_invalid_total",
+		Help: "Packets rejected before decoding, by reason.",
+	}, []string{"reason"})
+
+	ingestFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_ingest_frames_total",
+		Help: "Frames handed to the ingest pipeline by transport (tcp, udp, coap, http, mqtt) and outcome (stored, rejected, failed).",
+	}, []string{"transport", "outcome"})
+
+	datagramRetransmits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_datagram_retransmits_total",
+		Help: "UDP and CoAP retransmissions answered without storing the frame again, by transport.",
+	}, []string{"transport"})
+
+	eventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_events_published_total",
+		Help: "Outbox events acknowledged by the event sink, by event type.",
+	}, []string{"type"})
+
+	eventsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meter_events_publish_failures_total",
+		Help: "Outbox events the event sink failed to publish; they are retried until dead-lettered.",
+	})
+
+	eventsDead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meter_events_dead_lettered_total",
+		Help: "Outbox events parked in the dead-letter state after repeated failed publishes.",
+	})
+
+	protocolErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_protocol_errors_total",
+		Help: "Protocol errors in stored frames by kind (bad_checksum, unknown_tag, tag_overrun, ...) and TLV tag.",
+	}, []string{"kind", "tag"})
+
+	mqttPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meter_mqtt_published_total",
+		Help: "Messages acknowledged by the MQTT broker.",
+	})
+
+	mqttDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meter_mqtt_dropped_total",
+		Help: "MQTT messages dropped because the offline buffer was full.",
+	})
+
+	mqttQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meter_mqtt_queue_length",
+		Help: "MQTT messages waiting to be published.",
+	})
+
+	mqttConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meter_mqtt_connected",
+		Help: "1 while connected to the MQTT broker.",
+	})
+
+	tsdbExported = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meter_tsdb_readings_exported_total",
+		Help: "Readings accepted by the time-series export endpoint.",
+	})
+
+	tsdbDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_tsdb_readings_dropped_total",
+		Help: "Readings not exported, by reason (overflow: the buffer was full, rejected: the endpoint refused the batch).",
+	}, []string{"reason"})
+
+	tsdbQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meter_tsdb_queue_length",
+		Help: "Readings waiting to be exported to the time-series endpoint.",
+	})
+
+	dbInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meter_db_insert_duration_seconds",
+		Help:    "Latency of ingest writes, by table.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"table"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meter_http_request_duration_seconds",
+		Help:    "HTTP API request duration by route pattern, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// frame rejection reasons
+const (
+	invalidShort     = "short"
+	invalidStartFlag = "start_flag"
+	invalidTruncated = "truncated"
+	invalidPayload   = "payload" // MQTT message that is neither a frame nor hex
+)
+
+// metricManufacturers is the METRICS_MANUFACTURERS allow-list.
+var metricManufacturers = sync.OnceValue(func() map[string]bool {
+	return parseManufacturerList(getenv("METRICS_MANUFACTURERS", ""))
+})
+
+func parseManufacturerList(s string) map[string]bool {
+	codes := map[string]bool{}
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			codes[c] = true
+		}
+	}
+	return codes
+}
+
+// manufacturerLabel keeps the manufacturer label bounded: the header is read
+// before anything vouches for it, so an unlisted code is "other".
+func manufacturerLabel(allowed map[string]bool, code string) string {
+	if allowed[code] {
+		return code
+	}
+	return "other"
+}
+
+// countParsedFrame counts a frame under its manufacturer unless its checksum
+// failed, in which case the code it carries means nothing.
+func countParsedFrame(manufacturer string, errs []protocolError) {
+	for _, e := range errs {
+		if e.Kind == protoBadChecksum {
+			return
+		}
+	}
+	framesParsed.WithLabelValues(manufacturerLabel(metricManufacturers(), manufacturer)).Inc()
+}
+
+// observeDB times an ingest write.
+func observeDB(table string, start time.Time) {
+	dbInsertDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+}
+
+// countProtocolErrors counts each error of a frame; tag is empty for
+// frame-level errors such as bad_checksum.
+func countProtocolErrors(errs []protocolError) {
+	for _, e := range errs {
+		protocolErrorsTotal.WithLabelValues(e.Kind, e.Tag).Inc()
+	}
+}
+
+// observeHTTP records a request against the ServeMux pattern that matched
+// it, so path parameters don't explode the label set.
+func observeHTTP(r *http.Request, status int, start time.Time) {
+	route := r.Pattern
+	if route == "" {
+		route = "unmatched"
+	}
+	httpDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+}
+
+var metricsHandler = promhttp.Handler()
+
+// GET /metrics
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// -------------------------
+// SCHEMA MIGRATIONS
+// -------------------------
+// Applied in order at startup; each entry runs once and is recorded in
+// schema_migrations. Only ever append to this list.
+var migrations = []string{
+	// 1: the tables the server has always written to
+	`
+	CREATE TABLE IF NOT EXISTS meter_frames (
+		id                SERIAL PRIMARY KEY,
+		start_flag        TEXT,
+		frame_length      INT,
+		product_type      INT,
+		meter_address     TEXT,
+		manufacturer_code TEXT,
+		imei              TEXT,
+		protocol_version  INT,
+		mid               INT,
+		encryption_flag   INT,
+		function_code     INT,
+		tlv_length        INT,
+		tlv_hex           TEXT,
+		checksum          TEXT,
+		end_flag          TEXT,
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS messages (
+		id                 SERIAL PRIMARY KEY,
+		frame_id           INT REFERENCES meter_frames(id),
+		total              BIGINT,
+		flow               BIGINT,
+		battery            INT,
+		pressure           INT,
+		temperature        INT,
+		magnetic_tamper    INT,
+		rssi_raw           INT,
+		serial             TEXT,
+		valve              INT,
+		firmware           INT,
+		network_status     INT,
+		rtc                JSONB,
+		extended_status_1a JSONB,
+		model              TEXT,
+		meter_index_20     JSONB,
+		counters           JSONB,
+		ext_block_12       JSONB,
+		timestamp_1f       JSONB,
+		created_at         TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`,
+
+	// 2: decoder version stamp for re-decoding historical frames
+	`
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS decoder_version TEXT;
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS reprocessed_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS messages_frame_id_idx ON messages (frame_id);
+	CREATE INDEX IF NOT EXISTS meter_frames_imei_idx ON meter_frames (imei);
+	CREATE INDEX IF NOT EXISTS meter_frames_created_at_idx ON meter_frames (created_at);
+	`,
+
+	// 3: raw frame archive and receive metadata
+	`
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS raw_frame BYTEA;
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS remote_addr TEXT;
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS local_addr TEXT;
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS session_id UUID;
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS session_offset BIGINT;
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS received_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS meter_frames_session_id_idx ON meter_frames (session_id);
+	`,
+
+	// 4: measured_at plus the indexes the list endpoints filter on
+	`
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS measured_at TIMESTAMPTZ;
+	UPDATE messages SET measured_at = created_at WHERE measured_at IS NULL;
+	CREATE INDEX IF NOT EXISTS messages_created_at_idx ON messages (created_at);
+	CREATE INDEX IF NOT EXISTS messages_measured_at_idx ON messages (measured_at);
+	CREATE INDEX IF NOT EXISTS messages_serial_idx ON messages (serial);
+	CREATE INDEX IF NOT EXISTS meter_frames_meter_address_idx ON meter_frames (meter_address);
+	CREATE INDEX IF NOT EXISTS meter_frames_manufacturer_code_idx ON meter_frames (manufacturer_code);
+	`,
+
+	// 5: devices, backfilled from the frames and readings already stored
+	`
+	CREATE TABLE IF NOT EXISTS devices (
+		id                SERIAL PRIMARY KEY,
+		imei              TEXT NOT NULL UNIQUE,
+		meter_address     TEXT,
+		manufacturer_code TEXT,
+		model             TEXT,
+		firmware          INT,
+		first_seen        TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_seen         TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_frame_id     INT,
+		frame_count       BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS devices_manufacturer_code_idx ON devices (manufacturer_code);
+
+	INSERT INTO devices (imei, meter_address, manufacturer_code, first_seen, last_seen, last_frame_id, frame_count)
+	SELECT imei,
+	       (array_agg(meter_address ORDER BY id DESC))[1],
+	       (array_agg(manufacturer_code ORDER BY id DESC))[1],
+	       MIN(created_at), MAX(created_at), MAX(id), COUNT(*)
+	FROM meter_frames
+	WHERE imei IS NOT NULL AND imei <> ''
+	GROUP BY imei
+	ON CONFLICT (imei) DO NOTHING;
+
+	UPDATE devices d SET model = l.model, firmware = l.firmware
+	FROM (
+		SELECT DISTINCT ON (f.imei) f.imei, NULLIF(m.model, '') AS model, NULLIF(m.firmware, 0) AS firmware
+		FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+		ORDER BY f.imei, m.id DESC
+	) l
+	WHERE d.imei = l.imei;
+	`,
+
+	// 6: device groups for group-level consumption
+	`
+	ALTER TABLE devices ADD COLUMN IF NOT EXISTS group_name TEXT;
+	CREATE INDEX IF NOT EXISTS devices_group_name_idx ON devices (group_name);
+	CREATE INDEX IF NOT EXISTS messages_frame_measured_idx ON messages (frame_id, measured_at);
+	`,
+
+	// 7: alert rules per device group and the alerts they raise
+	`
+	CREATE TABLE IF NOT EXISTS alert_rules (
+		group_name        TEXT PRIMARY KEY,
+		leak_min_flow     BIGINT NOT NULL,
+		leak_night_start  INT NOT NULL,
+		leak_night_end    INT NOT NULL,
+		leak_min_readings INT NOT NULL,
+		burst_flow        BIGINT NOT NULL,
+		reverse_min_delta BIGINT NOT NULL,
+		stuck_days        INT NOT NULL,
+		updated_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS alerts (
+		id           SERIAL PRIMARY KEY,
+		imei         TEXT NOT NULL,
+		type         TEXT NOT NULL,
+		status       TEXT NOT NULL DEFAULT 'open',
+		frame_id     INT REFERENCES meter_frames(id),
+		details      JSONB,
+		occurrences  INT NOT NULL DEFAULT 1,
+		opened_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		closed_at    TIMESTAMPTZ
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS alerts_open_idx ON alerts (imei, type) WHERE status = 'open';
+	CREATE INDEX IF NOT EXISTS alerts_imei_idx ON alerts (imei, opened_at);
+	`,
+
+	// 8: webhook subscriptions, delivery queue/log and dead letters
+	`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id          SERIAL PRIMARY KEY,
+		url         TEXT NOT NULL,
+		secret      TEXT NOT NULL,
+		event_types TEXT NOT NULL DEFAULT '',
+		active      BOOLEAN NOT NULL DEFAULT true,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id               SERIAL PRIMARY KEY,
+		webhook_id       INT NOT NULL REFERENCES webhooks(id),
+		event_id         UUID NOT NULL,
+		event_type       TEXT NOT NULL,
+		payload          JSONB NOT NULL,
+		status           TEXT NOT NULL DEFAULT 'pending',
+		attempts         INT NOT NULL DEFAULT 0,
+		next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_status_code INT,
+		last_error       TEXT,
+		created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+		delivered_at     TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id);
+	CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id          SERIAL PRIMARY KEY,
+		delivery_id INT NOT NULL REFERENCES webhook_deliveries(id),
+		webhook_id  INT NOT NULL REFERENCES webhooks(id),
+		event_id    UUID NOT NULL,
+		event_type  TEXT NOT NULL,
+		payload     JSONB NOT NULL,
+		attempts    INT NOT NULL,
+		last_error  TEXT,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`,
+	// 9: API keys and the HTTP audit log
+	`
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id           SERIAL PRIMARY KEY,
+		name         TEXT NOT NULL,
+		prefix       TEXT NOT NULL UNIQUE,
+		key_hash     TEXT NOT NULL,
+		role         TEXT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ,
+		revoked_at   TIMESTAMPTZ
+	);
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id          SERIAL PRIMARY KEY,
+		at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+		principal   TEXT NOT NULL,
+		role        TEXT,
+		method      TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		query       TEXT,
+		status      INT NOT NULL,
+		remote_addr TEXT,
+		duration_ms INT
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_at_idx ON audit_log (at);
+	CREATE INDEX IF NOT EXISTS audit_log_principal_idx ON audit_log (principal, at);
+	`,
+	// 10: tenants; tenant_for() resolves a device to its tenant (explicit IMEI,
+	// then IMEI range, then manufacturer code) and is stamped on ingested rows
+	`
+	CREATE TABLE IF NOT EXISTS tenants (
+		id         SERIAL PRIMARY KEY,
+		name       TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS tenant_assignments (
+		id                SERIAL PRIMARY KEY,
+		tenant_id         INT NOT NULL REFERENCES tenants(id),
+		imei              TEXT,
+		imei_from         TEXT,
+		imei_to           TEXT,
+		manufacturer_code TEXT,
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CHECK (
+			(imei IS NOT NULL)::int +
+			(imei_from IS NOT NULL AND imei_to IS NOT NULL)::int +
+			(manufacturer_code IS NOT NULL)::int = 1
+		)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS tenant_assignments_imei_idx ON tenant_assignments (imei) WHERE imei IS NOT NULL;
+
+	CREATE OR REPLACE FUNCTION tenant_for(p_imei TEXT, p_manufacturer TEXT) RETURNS INT AS $$
+		SELECT tenant_id FROM tenant_assignments
+		WHERE imei = p_imei
+		   OR (length(p_imei) = length(imei_from) AND p_imei BETWEEN imei_from AND imei_to)
+		   OR manufacturer_code = p_manufacturer
+		ORDER BY CASE WHEN imei IS NOT NULL THEN 0 WHEN imei_from IS NOT NULL THEN 1 ELSE 2 END, id
+		LIMIT 1
+	$$ LANGUAGE sql STABLE;
+
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+	ALTER TABLE devices ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+	ALTER TABLE alerts ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+	ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+	ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+	CREATE INDEX IF NOT EXISTS meter_frames_tenant_idx ON meter_frames (tenant_id, id);
+	CREATE INDEX IF NOT EXISTS messages_tenant_idx ON messages (tenant_id, id);
+	CREATE INDEX IF NOT EXISTS devices_tenant_idx ON devices (tenant_id);
+	CREATE INDEX IF NOT EXISTS alerts_tenant_idx ON alerts (tenant_id);
+	`,
+
+	// 11: protocol errors found while decoding each frame
+	`
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS decode_errors JSONB;
+	CREATE INDEX IF NOT EXISTS meter_frames_decode_errors_idx ON meter_frames USING gin (decode_errors);
+	`,
+
+	// 12: which transport delivered each frame (tcp, udp, coap, http, mqtt)
+	`
+	ALTER TABLE meter_frames ADD COLUMN IF NOT EXISTS transport TEXT NOT NULL DEFAULT 'tcp';
+	`,
+
+	// 13: event stream outbox, written in the same statement as the row an
+	// event describes and drained by the relay
+	`
+	CREATE TABLE IF NOT EXISTS event_outbox (
+		id             BIGSERIAL PRIMARY KEY,
+		event_id       UUID NOT NULL UNIQUE,
+		event_type     TEXT NOT NULL,
+		schema_version INT NOT NULL,
+		imei           TEXT,
+		tenant_id      INT,
+		frame_id       INT,
+		data           JSONB NOT NULL,
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+		published_at   TIMESTAMPTZ,
+		attempts       INT NOT NULL DEFAULT 0,
+		last_error     TEXT
+	);
+	CREATE INDEX IF NOT EXISTS event_outbox_pending_idx ON event_outbox (id) WHERE published_at IS NULL;
+	CREATE INDEX IF NOT EXISTS event_outbox_published_idx ON event_outbox (published_at);
+	`,
+	// 14: outbox claims, per-event retry backoff and the dead-letter state,
+	// so the relay publishes without holding row locks
+	`
+	ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
+	ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS retry_at TIMESTAMPTZ;
+	ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
+	DROP INDEX IF EXISTS event_outbox_pending_idx;
+	CREATE INDEX IF NOT EXISTS event_outbox_pending_idx ON event_outbox (id) WHERE published_at IS NULL AND dead_at IS NULL;
+	CREATE INDEX IF NOT EXISTS event_outbox_dead_idx ON event_outbox (dead_at) WHERE dead_at IS NOT NULL;
+	`,
+	// 15: the transaction that wrote each outbox row, so the relay can
+	// publish in an order later commits cannot overtake
+	`
+	ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS txid xid8 NOT NULL DEFAULT pg_current_xact_id();
+	DROP INDEX IF EXISTS event_outbox_pending_idx;
+	CREATE INDEX IF NOT EXISTS event_outbox_pending_idx ON event_outbox (txid, id) WHERE published_at IS NULL AND dead_at IS NULL;
+	`,
+}
+
+func migrateDB(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version    INT PRIMARY KEY,
+            applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for v := current + 1; v <= len(migrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", v, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, v); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", v, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("applied migration", "version", v)
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// -------------------------
+// MQTT PUBLISHER
+// -------------------------
+// Optional: with MQTT_BROKER set, every reading handleTCP stores is published
+// as JSON to {prefix}/{tenant}/{imei}/reading (retained, so a new subscriber
+// gets each meter's last value) and readings in alarm or that opened alert
+// rules also go to {prefix}/{tenant}/{imei}/alarm. Devices without a tenant
+// publish under "unassigned".
+//
+// Publishing never blocks ingest: messages go into a bounded in-memory queue
+// that a single worker drains whenever the broker is connected. While the
+// broker is away the queue buffers up to MQTT_BUFFER messages and then drops
+// the oldest. Delivery is at least once for QoS 1 and 2: a publish that is
+// not acknowledged in time is retried.
+
+type mqttConfig struct {
+	Broker        string // tcp://host:1883, ssl://..., ws://...
+	ClientID      string
+	Username      string
+	Password      string
+	TopicPrefix   string
+	QoS           byte
+	Retain        bool // retain reading messages
+	Buffer        int
+	RetryInterval time.Duration
+	AckTimeout    time.Duration
+}
+
+func mqttConfigFromEnv() (mqttConfig, error) {
+	host, _ := os.Hostname()
+	c := mqttConfig{
+		Broker:        os.Getenv("MQTT_BROKER"),
+		ClientID:      getenv("MQTT_CLIENT_ID", "meter-server-"+host),
+		Username:      os.Getenv("MQTT_USERNAME"),
+		Password:      os.Getenv("MQTT_PASSWORD"),
+		TopicPrefix:   getenv("MQTT_TOPIC_PREFIX", "meters"),
+		RetryInterval: 5 * time.Second,
+		AckTimeout:    10 * time.Second,
+	}
+
+	qos, err := strconv.Atoi(getenv("MQTT_QOS", "1"))
+	if err != nil || qos < 0 || qos > 2 {
+		return c, fmt.Errorf("MQTT_QOS must be 0, 1 or 2")
+	}
+	c.QoS = byte(qos)
+	if c.Retain, err = strconv.ParseBool(getenv("MQTT_RETAIN", "true")); err != nil {
+		return c, fmt.Errorf("MQTT_RETAIN: %w", err)
+	}
+	if c.Buffer, err = strconv.Atoi(getenv("MQTT_BUFFER", "10000")); err != nil || c.Buffer < 1 {
+		return c, fmt.Errorf("MQTT_BUFFER must be a positive number")
+	}
+	return c, nil
+}
+
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+type mqttPublisher struct {
+	cfg    mqttConfig
+	client mqtt.Client
+
+	mu     sync.Mutex
+	queue  []mqttMessage
+	wake   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// mqttOut is nil unless MQTT_BROKER is set; its methods are no-ops on nil.
+var mqttOut *mqttPublisher
+
+// startMQTT connects in the background; a broker that is down at startup is
+// retried like one that goes away later.
+func startMQTT() error {
+	cfg, err := mqttConfigFromEnv()
+	if err != nil || cfg.Broker == "" {
+		return err
+	}
+	mqttOut = newMQTTPublisher(cfg)
+	slog.Info("MQTT publishing enabled", "broker", cfg.Broker, "prefix", cfg.TopicPrefix, "qos", cfg.QoS)
+	return nil
+}
+
+func newMQTTPublisher(cfg mqttConfig) *mqttPublisher {
+	p := &mqttPublisher{
+		cfg:    cfg,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(cfg.RetryInterval).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(mqtt.Client) {
+			mqttConnected.Set(1)
+			slog.Info("MQTT connected", "broker", cfg.Broker)
+			p.signal()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			mqttConnected.Set(0)
+			slog.Warn("MQTT connection lost", "err", err)
+		})
+	p.client = mqtt.NewClient(opts)
+	p.client.Connect()
+
+	go p.run()
+	return p
+}
+
+func (p *mqttPublisher) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds m to the buffer, dropping the oldest message when it is full.
+func (p *mqttPublisher) enqueue(m mqttMessage) {
+	p.mu.Lock()
+	if len(p.queue) >= p.cfg.Buffer {
+		p.queue = p.queue[1:]
+		mqttDropped.Inc()
+	}
+	p.queue = append(p.queue, m)
+	mqttQueued.Set(float64(len(p.queue)))
+	p.mu.Unlock()
+	p.signal()
+}
+
+// run publishes the queue head whenever the client is connected. The head
+// is taken off the queue while it is in flight and put back if the publish
+// fails, so an overflowing enqueue cannot drop it underneath us.
+func (p *mqttPublisher) run() {
+	defer close(p.done)
+	for {
+		var m mqttMessage
+		ok := false
+		if p.client.IsConnectionOpen() {
+			m, ok = p.take()
+		}
+		if !ok {
+			select {
+			case <-p.closed:
+				return
+			case <-p.wake:
+			case <-time.After(p.cfg.RetryInterval):
+			}
+			continue
+		}
+
+		t := p.client.Publish(m.Topic, p.cfg.QoS, m.Retain, m.Payload)
+		if t.WaitTimeout(p.cfg.AckTimeout) && t.Error() == nil {
+			mqttPublished.Inc()
+			continue
+		}
+		slog.Warn("MQTT publish failed, will retry", "topic", m.Topic, "err", t.Error())
+		p.requeue(m)
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(p.cfg.RetryInterval):
+		}
+	}
+}
+
+func (p *mqttPublisher) take() (mqttMessage, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return mqttMessage{}, false
+	}
+	m := p.queue[0]
+	p.queue = p.queue[1:]
+	mqttQueued.Set(float64(len(p.queue)))
+	return m, true
+}
+
+// requeue puts a failed message back at the head unless newer messages have
+// filled the buffer in the meantime, in which case it is the oldest and goes.
+func (p *mqttPublisher) requeue(m mqttMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) >= p.cfg.Buffer {
+		mqttDropped.Inc()
+		return
+	}
+	p.queue = append([]mqttMessage{m}, p.queue...)
+	mqttQueued.Set(float64(len(p.queue)))
+}
+
+// Close stops the worker and disconnects; unsent messages are dropped.
+func (p *mqttPublisher) Close() {
+	if p == nil {
+		return
+	}
+	close(p.closed)
+	<-p.done
+	p.client.Disconnect(250)
+}
+
+func (p *mqttPublisher) topic(tenant int, imei, kind string) string {
+	t := "unassigned"
+	if tenant != 0 {
+		t = strconv.Itoa(tenant)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", p.cfg.TopicPrefix, t, imei, kind)
+}
+
+// mqttAlarm is the payload on the alarm topic.
+type mqttAlarm struct {
+	FrameID    int       `json:"frame_id"`
+	IMEI       string    `json:"imei"`
+	TenantID   int       `json:"tenant_id,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	Alarms     []string  `json:"alarms"`
+	Alerts     []Alert   `json:"alerts"`
+}
+
+// publishReading queues ev on the reading topic and, when it carries alarms
+// or opened alert rules, on the alarm topic.
+func (p *mqttPublisher) publishReading(ev liveEvent, opened []Alert) {
+	if p == nil || ev.IMEI == "" {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("MQTT encoding reading failed", "err", err)
+		return
+	}
+	p.enqueue(mqttMessage{Topic: p.topic(ev.TenantID, ev.IMEI, "reading"), Payload: b, Retain: p.cfg.Retain})
+
+	if len(ev.Alarms) == 0 && len(opened) == 0 {
+		return
+	}
+	if opened == nil {
+		opened = []Alert{}
+	}
+	b, err = json.Marshal(mqttAlarm{
+		FrameID: ev.ID, IMEI: ev.IMEI, TenantID: ev.TenantID, ReceivedAt: ev.ReceivedAt,
+		Alarms: ev.Alarms, Alerts: opened,
+	})
+	if err != nil {
+		slog.Error("MQTT encoding alarm failed", "err", err)
+		return
+	}
+	p.enqueue(mqttMessage{Topic: p.topic(ev.TenantID, ev.IMEI, "alarm"), Payload: b})
+}
+
+// -------------------------
+// MQTT INGEST
+// -------------------------
+// With MQTT_INGEST_TOPIC set (e.g. "uplink/+/frame"), a second client on the
+// same broker subscribes to that filter and feeds each message through
+// ingestFrame. The payload is the 0x68 frame itself or its hex. The session is
+// persistent and messages are acknowledged by hand, so the PUBACK plays the
+// part of the TCP "OK": it is sent once the frame is stored, or when the frame
+// is rejected and a redelivery could not help. A frame that failed to store
+// is left unacknowledged and the broker redelivers it when the session
+// resumes.
+
+type mqttSubscriber struct {
+	client mqtt.Client
+	topic  string
+}
+
+// startMQTTIngest subscribes in the background, retrying like startMQTT.
+func startMQTTIngest() error {
+	topic := os.Getenv("MQTT_INGEST_TOPIC")
+	if topic == "" {
+		return nil
+	}
+	cfg, err := mqttConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if cfg.Broker == "" {
+		return fmt.Errorf("MQTT_INGEST_TOPIC needs MQTT_BROKER")
+	}
+	// readings we publish must not come back in as frames
+	for _, kind := range []string{"reading", "alarm"} {
+		if t := cfg.TopicPrefix + "/tenant/imei/" + kind; mqttTopicMatches(topic, t) {
+			return fmt.Errorf("MQTT_INGEST_TOPIC %q matches published topic %s", topic, t)
+		}
+	}
+	newMQTTSubscriber(cfg, topic)
+	slog.Info("MQTT ingest enabled", "broker", cfg.Broker, "topic", topic)
+	return nil
+}
+
+func newMQTTSubscriber(cfg mqttConfig, topic string) *mqttSubscriber {
+	s := &mqttSubscriber{topic: topic}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID + "-ingest").
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(cfg.RetryInterval).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			// resubscribe on every connect in case the broker lost the session
+			t := c.Subscribe(topic, cfg.QoS, s.handle)
+			if t.WaitTimeout(cfg.AckTimeout) && t.Error() == nil {
+				slog.Info("MQTT ingest subscribed", "topic", topic)
+			} else {
+				slog.Error("MQTT ingest subscribe failed", "topic", topic, "err", t.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT ingest connection lost", "err", err)
+		})
+	s.client = mqtt.NewClient(opts)
+	s.client.Connect()
+	return s
+}
+
+func (s *mqttSubscriber) handle(_ mqtt.Client, msg mqtt.Message) {
+	packet, err := framePayload(msg.Payload())
+	if err != nil {
+		framesInvalid.WithLabelValues(invalidPayload).Inc()
+		slog.Warn("MQTT ingest payload is not a frame", "topic", msg.Topic(), "err", err)
+		msg.Ack()
+		return
+	}
+	meta := singleFrameMeta(transportMQTT, packet, msg.Topic(), s.topic)
+	res := ingestFrame(meta, slog.With("session", meta.SessionID, "remote", msg.Topic(), "transport", transportMQTT))
+	if res.Err == nil {
+		msg.Ack()
+	}
+}
+
+// mqttTopicMatches reports whether topic falls under the subscription
+// filter, with MQTT's + and # wildcards.
+func mqttTopicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is just enough of an MQTT 3.1.1 broker for the publisher and the
+// ingest subscriber: it accepts any CONNECT, acknowledges publishes at their
+// QoS and records them, and delivers to subscribers on request.
+type testBroker struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	msgs []brokerMessage
+	got  chan struct{}
+	subs []net.Conn  // connections that subscribed to anything
+	acks chan uint16 // PUBACKs for messages the broker delivered
+
+	subscribed chan struct{}
+}
+
+type brokerMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+func startTestBroker(t *testing.T, addr string) *testBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, got: make(chan struct{}, 100), acks: make(chan uint16, 100), subscribed: make(chan struct{}, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		first, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		n, err := binary.ReadUvarint(r) // MQTT remaining length is a base-128 varint
+		if err != nil {
+			return
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch first >> 4 {
+		case 1: // CONNECT
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			qos := first >> 1 & 3
+			tl := int(binary.BigEndian.Uint16(body))
+			m := brokerMessage{Topic: string(body[2 : 2+tl]), QoS: qos, Retain: first&1 == 1}
+			rest := body[2+tl:]
+			var id []byte
+			if qos > 0 {
+				id, rest = rest[:2], rest[2:]
+			}
+			m.Payload = rest
+			b.mu.Lock()
+			b.msgs = append(b.msgs, m)
+			b.mu.Unlock()
+			b.got <- struct{}{}
+			switch qos {
+			case 1:
+				conn.Write([]byte{0x40, 2, id[0], id[1]})
+			case 2:
+				conn.Write([]byte{0x50, 2, id[0], id[1]})
+			}
+		case 4: // PUBACK
+			b.acks <- binary.BigEndian.Uint16(body)
+		case 8: // SUBSCRIBE, granted at QoS 1
+			b.mu.Lock()
+			b.subs = append(b.subs, conn)
+			b.mu.Unlock()
+			conn.Write([]byte{0x90, 3, body[0], body[1], 1})
+			b.subscribed <- struct{}{}
+		case 6: // PUBREL
+			conn.Write([]byte{0x70, 2, body[0], body[1]})
+		case 12: // PINGREQ
+			conn.Write([]byte{0xD0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// deliver sends a QoS 1 PUBLISH with packet id to every subscriber.
+func (b *testBroker) deliver(topic string, payload []byte, id uint16) {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	body = append(body, topic...)
+	body = binary.BigEndian.AppendUint16(body, id)
+	body = append(body, payload...)
+	pkt := append([]byte{0x32}, binary.AppendUvarint(nil, uint64(len(body)))...)
+	pkt = append(pkt, body...)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.subs {
+		c.Write(pkt)
+	}
+}
+
+// wait returns the first n messages the broker received.
+func (b *testBroker) wait(t *testing.T, n int) []brokerMessage {
+	t.Helper()
+	for {
+		b.mu.Lock()
+		if len(b.msgs) >= n {
+			msgs := append([]brokerMessage(nil), b.msgs[:n]...)
+			b.mu.Unlock()
+			return msgs
+		}
+		b.mu.Unlock()
+		select {
+		case <-b.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("broker received %d of %d messages", len(b.msgs), n)
+		}
+	}
+}
+
+func testMQTTConfig(addr string, qos byte, buffer int) mqttConfig {
+	return mqttConfig{
+		Broker: "tcp://" + addr, ClientID: "test", TopicPrefix: "meters", QoS: qos, Retain: true,
+		Buffer: buffer, RetryInterval: 50 * time.Millisecond, AckTimeout: time.Second,
+	}
+}
+
+func TestMQTTPublishesReadingsAndAlarms(t *testing.T) {
+	for _, qos := range []byte{0, 1, 2} {
+		t.Run(fmt.Sprint("qos", qos), func(t *testing.T) {
+			b := startTestBroker(t, "127.0.0.1:0")
+			p := newMQTTPublisher(testMQTTConfig(b.ln.Addr().String(), qos, 10))
+			defer p.Close()
+
+			at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+			p.publishReading(liveEvent{ID: 1, IMEI: "0861234567800042", ReceivedAt: at, Decoded: map[string]interface{}{"total": 42}}, nil)
+			p.publishReading(liveEvent{ID: 2, IMEI: "0861234567800043", TenantID: 7, ReceivedAt: at, Alarms: []string{"leak"}},
+				[]Alert{{ID: 9, Type: "leak"}})
+
+			msgs := b.wait(t, 3)
+			want := []struct {
+				topic  string
+				retain bool
+			}{
+				{"meters/unassigned/0861234567800042/reading", true},
+				{"meters/7/0861234567800043/reading", true},
+				{"meters/7/0861234567800043/alarm", false},
+			}
+			for i, w := range want {
+				if msgs[i].Topic != w.topic || msgs[i].Retain != w.retain || msgs[i].QoS != qos {
+					t.Errorf("message %d: %s qos %d retain %v", i, msgs[i].Topic, msgs[i].QoS, msgs[i].Retain)
+				}
+			}
+			var ev liveEvent
+			if err := json.Unmarshal(msgs[0].Payload, &ev); err != nil || ev.ID != 1 || ev.Decoded["total"] != 42.0 {
+				t.Errorf("reading payload %s", msgs[0].Payload)
+			}
+			var alarm mqttAlarm
+			if err := json.Unmarshal(msgs[2].Payload, &alarm); err != nil || alarm.FrameID != 2 || len(alarm.Alerts) != 1 || alarm.Alarms[0] != "leak" {
+				t.Errorf("alarm payload %s", msgs[2].Payload)
+			}
+		})
+	}
+}
+
+func TestMQTTBuffersWhileBrokerIsDown(t *testing.T) {
+	// reserve a port, then leave it closed until the readings are queued
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := newMQTTPublisher(testMQTTConfig(addr, 1, 3))
+	defer p.Close()
+	for i := 1; i <= 5; i++ {
+		p.publishReading(liveEvent{ID: i, IMEI: "0861234567800042"}, nil)
+	}
+	p.mu.Lock()
+	queued := len(p.queue)
+	p.mu.Unlock()
+	if queued != 3 {
+		t.Fatalf("%d queued, want the buffer size 3", queued)
+	}
+
+	b := startTestBroker(t, addr)
+	msgs := b.wait(t, 3)
+	for i, m := range msgs {
+		var ev liveEvent
+		if err := json.Unmarshal(m.Payload, &ev); err != nil || ev.ID != i+3 {
+			t.Errorf("message %d: %s, want the oldest two dropped", i, m.Payload)
+		}
+	}
+}
+
+func TestNilMQTTPublisherIsNoop(t *testing.T) {
+	var p *mqttPublisher
+	p.publishReading(liveEvent{ID: 1, IMEI: "0861234567800042"}, nil)
+	p.Close()
+}
+
+func TestMQTTIngestAcksRejectedFrames(t *testing.T) {
+	b := startTestBroker(t, "127.0.0.1:0")
+	s := newMQTTSubscriber(testMQTTConfig(b.ln.Addr().String(), 1, 10), "uplink/+/frame")
+	defer s.client.Disconnect(0)
+	select {
+	case <-b.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SUBSCRIBE")
+	}
+
+	// neither needs the database: one is too short, one is not hex
+	b.deliver("uplink/861234567800042/frame", []byte("68 00 2F"), 7)
+	b.deliver("uplink/861234567800042/frame", []byte("hello"), 8)
+	for _, want := range []uint16{7, 8} {
+		select {
+		case id := <-b.acks:
+			if id != want {
+				t.Errorf("PUBACK %d, want %d", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no PUBACK for %d", want)
+		}
+	}
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"uplink/+/frame", "uplink/861234567800042/frame", true},
+		{"uplink/+/frame", "uplink/861234567800042/other", false},
+		{"uplink/#", "uplink/a/b/c", true},
+		{"#", "meters/1/0861234567800042/reading", true},
+		{"meters/+/+/+", "meters/1/0861234567800042/reading", true},
+		{"meters/+", "meters/1/0861234567800042/reading", false},
+		{"meters/+/+/reading/x", "meters/1/0861234567800042/reading", false},
+	} {
+		if got := mqttTopicMatches(c.filter, c.topic); got != c.want {
+			t.Errorf("%s ~ %s = %v", c.filter, c.topic, got)
+		}
+	}
+}
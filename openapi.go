@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// -------------------------
+// OPENAPI
+// -------------------------
+// GET /api/v1/openapi.json is generated from the route table and the Go
+// response types, so a field added to a struct shows up in the spec with the
+// same JSON name. Named structs become components/schemas; fields without
+// omitempty are required in responses. Types that are also accepted as
+// request bodies list no required fields, since the handlers fill defaults.
+
+const openAPIVersion = "3.0.3"
+
+// paramDocs describes the query parameters routes list in apiRoute.Query.
+var paramDocs = map[string]struct{ Type, Description string }{
+	"limit":         {"integer", "page size (default 100, max 1000)"},
+	"cursor":        {"string", "next_cursor from the previous page"},
+	"order":         {"string", "asc or desc (default)"},
+	"from":          {"date-time", "inclusive lower time bound (RFC3339)"},
+	"to":            {"date-time", "exclusive upper time bound (RFC3339)"},
+	"time_field":    {"string", "which timestamp from/to apply to"},
+	"fields":        {"string", "comma-separated fields to keep in each item"},
+	"tenant":        {"integer", "narrow to one tenant (platform credentials only)"},
+	"count":         {"boolean", "true to include meta.total_count"},
+	"imei":          {"string", "device IMEI; repeatable where a set is accepted"},
+	"meter_address": {"string", "meter address"},
+	"serial":        {"string", "meter serial"},
+	"manufacturer":  {"string", "manufacturer code"},
+	"group":         {"string", "device group"},
+	"type":          {"string", "alert type"},
+	"status":        {"string", "status filter"},
+	"principal":     {"string", "audited caller name"},
+	"path":          {"string", "audited request path"},
+	"interval":      {"string", "hour, day or month"},
+	"tz":            {"string", "IANA time zone for bucket boundaries (default UTC)"},
+	"counter_max":   {"integer", "counter rollover value"},
+	"max_gap":       {"string", "longest gap to interpolate across (Go duration)"},
+	"format":        {"string", "raw frames: json for metadata; exports: csv, excel, ndjson or parquet"},
+	"month":         {"string", "calendar month YYYY-MM in tz, instead of from/to"},
+	"payload":       {"string", "1 to include the event payload"},
+	"webhook_id":    {"integer", "only this webhook's dead letters"},
+	"alarm":         {"string", "any, or one alarm name"},
+	"last_event_id": {"integer", "resume after this event id (or the Last-Event-ID header)"},
+	"access_token":  {"string", "API key or JWT for clients that cannot set headers"},
+	"decode_error":  {"string", "any, or one protocol error kind (bad_checksum, unknown_tag, tag_overrun, ...)"},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// GET /api/v1/openapi.json
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIJSON)
+}
+
+func buildOpenAPI() map[string]interface{} {
+	g := newSchemaGen()
+	for _, rt := range apiRoutes() {
+		if rt.Body != nil {
+			g.request[reflect.TypeOf(rt.Body)] = true
+		}
+	}
+
+	paths := map[string]interface{}{}
+	add := func(path string, rt apiRoute) {
+		item, _ := paths[path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.Method)] = g.operation(path, rt)
+	}
+	for _, rt := range apiRoutes() {
+		add(apiPrefix+rt.Path, rt)
+	}
+	for _, rt := range opsRoutes {
+		add(rt.Path, rt)
+	}
+
+	g.schema(reflect.TypeOf(APIError{})) // referenced by components/responses/Error
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "Meter ingestion API",
+			"version":     "1",
+			"description": "Unversioned /api/... paths are deprecated aliases of /api/v1/...",
+		},
+		"paths": paths,
+		"security": []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+		},
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "error",
+					"content":     jsonContent(schemaRef("APIError")),
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+var pathParamRe = regexp.MustCompile(`\{(\w+)\}`)
+
+func (g *schemaGen) operation(path string, rt apiRoute) map[string]interface{} {
+	op := map[string]interface{}{
+		"operationId": handlerName(rt.Handler),
+		"summary":     rt.Summary,
+		"tags":        []string{strings.SplitN(strings.TrimPrefix(rt.Path, "/"), "/", 2)[0]},
+	}
+	if rt.Public {
+		op["security"] = []interface{}{}
+	} else {
+		op["x-min-role"] = rt.Role.String()
+		if rt.Platform {
+			op["x-platform-only"] = true
+		}
+	}
+
+	params := []interface{}{}
+	for _, m := range pathParamRe.FindAllStringSubmatch(path, -1) {
+		typ := "string"
+		if m[1] == "id" {
+			typ = "integer"
+		}
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": typ},
+		})
+	}
+	for _, name := range rt.Query {
+		d := paramDocs[name]
+		s := map[string]interface{}{"type": d.Type}
+		if d.Type == "date-time" {
+			s = map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "query", "description": d.Description, "schema": s,
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if rt.Body != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(g.schema(reflect.TypeOf(rt.Body))),
+		}
+	}
+
+	status := rt.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	res := map[string]interface{}{"description": http.StatusText(status)}
+	content := map[string]interface{}{}
+	if rt.Response != nil {
+		content["application/json"] = map[string]interface{}{"schema": g.responseSchema(rt.Response)}
+	}
+	if rt.Stream != "" {
+		s := map[string]interface{}{"type": "string"}
+		if rt.Stream == "application/octet-stream" {
+			s["format"] = "binary"
+		}
+		content[rt.Stream] = map[string]interface{}{"schema": s}
+	}
+	if len(content) > 0 {
+		res["content"] = content
+	}
+	op["responses"] = map[string]interface{}{
+		strconv.Itoa(status): res,
+		"default":            map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+	return op
+}
+
+func (g *schemaGen) responseSchema(v interface{}) map[string]interface{} {
+	p, ok := v.(pageOf)
+	if !ok {
+		return g.schema(reflect.TypeOf(v))
+	}
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"data", "meta"},
+		"properties": map[string]interface{}{
+			"data": map[string]interface{}{"type": "array", "items": g.schema(reflect.TypeOf(p.item))},
+			"meta": g.schema(reflect.TypeOf(pageMeta{})),
+		},
+	}
+}
+
+// handlerName is the Go function name, used as the operationId.
+func handlerName(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// -------------------------
+// SCHEMAS FROM GO TYPES
+// -------------------------
+type schemaGen struct {
+	schemas map[string]interface{}
+	request map[reflect.Type]bool // types used as request bodies
+}
+
+func newSchemaGen() *schemaGen {
+	return &schemaGen{schemas: map[string]interface{}{}, request: map[reflect.Type]bool{}}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaName exports the Go type name, so reprocessSummary is ReprocessSummary.
+func schemaName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType || t.Kind() == reflect.Interface:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		// nil slices and maps encode as null
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem()), "nullable": true}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem()), "nullable": true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = map[string]interface{}{} // placeholder for recursive types
+			g.schemas[name] = g.object(t)
+		}
+		return schemaRef(name)
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	g.fields(t, props, &required)
+
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 && !g.request[t] {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// fields collects t's JSON properties, flattening embedded structs the way
+// encoding/json does.
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------------
+// LIST QUERY PARAMS: pagination, filters, sorting
+// -------------------------
+// Shared by the list endpoints:
+//
+//	?limit=100&cursor=...&order=desc
+//	&from=2025-01-01T00:00:00Z&to=...&time_field=created_at|measured_at
+//	&imei=...&meter_address=...&serial=...&manufacturer=...
+//	&fields=id,total,flow
+//	&tenant=ID (platform callers only; tenant credentials are always scoped)
+//	&count=true
+//
+// Cursors are opaque; they encode the last id returned so paging is stable
+// while new rows keep arriving. meta.total_count costs a COUNT over the whole
+// filter, so it is only computed when asked for with count=true.
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+type listParams struct {
+	Limit        int
+	AfterID      int
+	Desc         bool
+	From         time.Time
+	To           time.Time
+	TimeField    string
+	IMEI         string
+	MeterAddress string
+	Serial       string
+	Manufacturer string
+	Tenant       int // caller's tenant scope, 0 for all
+	Fields       []string
+	Count        bool // include meta.total_count
+}
+
+type pageMeta struct {
+	Limit      int    `json:"limit"`
+	Count      int    `json:"count"`
+	TotalCount *int   `json:"total_count,omitempty"` // only with ?count=true
+	NextCursor string `json:"next_cursor,omitempty"`
+	Order      string `json:"order"`
+}
+
+type page[T any] struct {
+	Data []T      `json:"data"`
+	Meta pageMeta `json:"meta"`
+}
+
+// parseListParams reads the query string; timeFields lists the allowed time_field values,
+// the first being the default.
+func parseListParams(r *http.Request, timeFields ...string) (listParams, error) {
+	q := r.URL.Query()
+	p := listParams{Limit: defaultPageLimit, Desc: true, TimeField: timeFields[0]}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("invalid limit %q", v)
+		}
+		if n > maxPageLimit {
+			n = maxPageLimit
+		}
+		p.Limit = n
+	}
+
+	switch strings.ToLower(q.Get("order")) {
+	case "", "desc":
+	case "asc":
+		p.Desc = false
+	default:
+		return p, fmt.Errorf("order must be asc or desc")
+	}
+
+	if v := q.Get("count"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("count must be true or false")
+		}
+		p.Count = b
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			return p, err
+		}
+		p.AfterID = id
+	}
+
+	for _, k := range []string{"from", "to"} {
+		v := q.Get(k)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return p, fmt.Errorf("invalid %s: %v", k, err)
+		}
+		if k == "from" {
+			p.From = t
+		} else {
+			p.To = t
+		}
+	}
+
+	if v := q.Get("time_field"); v != "" {
+		ok := false
+		for _, f := range timeFields {
+			ok = ok || f == v
+		}
+		if !ok {
+			return p, fmt.Errorf("time_field must be one of %s", strings.Join(timeFields, ", "))
+		}
+		p.TimeField = v
+	}
+
+	p.IMEI = q.Get("imei")
+	p.MeterAddress = q.Get("meter_address")
+	p.Serial = q.Get("serial")
+	p.Manufacturer = q.Get("manufacturer")
+	p.Tenant = callerTenant(r)
+
+	if v := q.Get("fields"); v != "" {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				p.Fields = append(p.Fields, f)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(s string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !strings.HasPrefix(string(b), "id:") {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(b), "id:"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return id, nil
+}
+
+// sqlWhere collects numbered-placeholder conditions.
+type sqlWhere struct {
+	conds []string
+	args  []interface{}
+}
+
+// add appends cond, where %d is replaced by the placeholder number for v.
+func (w *sqlWhere) add(cond string, v interface{}) {
+	w.args = append(w.args, v)
+	w.conds = append(w.conds, fmt.Sprintf(cond, len(w.args)))
+}
+
+func (w *sqlWhere) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.conds, " AND ")
+}
+
+// filters applies everything except the cursor; columns are qualified by the caller's
+// aliases (f = meter_frames, m = messages when joined).
+func (p listParams) filters(w *sqlWhere, timeColumn string, hasMessages bool) {
+	if p.Tenant != 0 {
+		w.add("f.tenant_id = $%d", p.Tenant)
+	}
+	if !p.From.IsZero() {
+		w.add(timeColumn+" >= $%d", p.From)
+	}
+	if !p.To.IsZero() {
+		w.add(timeColumn+" < $%d", p.To)
+	}
+	if p.IMEI != "" {
+		w.add("f.imei = $%d", p.IMEI)
+	}
+	if p.MeterAddress != "" {
+		w.add("f.meter_address = $%d", p.MeterAddress)
+	}
+	if p.Manufacturer != "" {
+		w.add("f.manufacturer_code = $%d", p.Manufacturer)
+	}
+	if p.Serial != "" && hasMessages {
+		w.add("m.serial = $%d", p.Serial)
+	}
+}
+
+// cursor adds the keyset condition on idColumn.
+func (p listParams) cursor(w *sqlWhere, idColumn string) {
+	if p.AfterID == 0 {
+		return
+	}
+	if p.Desc {
+		w.add(idColumn+" < $%d", p.AfterID)
+	} else {
+		w.add(idColumn+" > $%d", p.AfterID)
+	}
+}
+
+func (p listParams) orderSQL(idColumn string) string {
+	if p.Desc {
+		return "ORDER BY " + idColumn + " DESC"
+	}
+	return "ORDER BY " + idColumn + " ASC"
+}
+
+// totalCount runs the COUNT query when the caller asked for ?count=true and
+// returns nil otherwise.
+func (p listParams) totalCount(query string, args ...interface{}) (*int, error) {
+	if !p.Count {
+		return nil, nil
+	}
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// limitSQL fetches one extra row so we know whether a next page exists.
+func (p listParams) limitSQL() string {
+	return fmt.Sprintf("LIMIT %d", p.Limit+1)
+}
+
+// writePage trims the look-ahead row, applies ?fields= and writes the envelope.
+// Rows are encoded as they are unless fields are picked.
+func writePage[T any](w http.ResponseWriter, p listParams, rows []T, ids []int, total *int) {
+	meta := pageMeta{Limit: p.Limit, TotalCount: total, Order: "desc"}
+	if !p.Desc {
+		meta.Order = "asc"
+	}
+
+	if len(rows) > p.Limit {
+		rows, ids = rows[:p.Limit], ids[:p.Limit]
+		meta.NextCursor = encodeCursor(ids[len(ids)-1])
+	}
+	if rows == nil {
+		rows = []T{}
+	}
+	meta.Count = len(rows)
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(p.Fields) == 0 {
+		json.NewEncoder(w).Encode(page[T]{Data: rows, Meta: meta})
+		return
+	}
+
+	res := page[map[string]json.RawMessage]{Data: []map[string]json.RawMessage{}, Meta: meta}
+	for _, row := range rows {
+		var m map[string]json.RawMessage
+		b, _ := json.Marshal(row)
+		json.Unmarshal(b, &m)
+		picked := make(map[string]json.RawMessage, len(p.Fields))
+		for _, f := range p.Fields {
+			if v, ok := m[f]; ok {
+				picked[f] = v
+			}
+		}
+		res.Data = append(res.Data, picked)
+	}
+	json.NewEncoder(w).Encode(res)
+}
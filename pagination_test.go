@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListParams(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		query string
+		check func(listParams) bool
+	}{
+		{"", func(p listParams) bool {
+			return p.Limit == defaultPageLimit && p.Desc && p.AfterID == 0 && !p.Count && p.TimeField == "created_at"
+		}},
+		{"limit=5", func(p listParams) bool { return p.Limit == 5 }},
+		{"limit=5000", func(p listParams) bool { return p.Limit == maxPageLimit }},
+		{"order=ASC", func(p listParams) bool { return !p.Desc }},
+		{"cursor=" + encodeCursor(42), func(p listParams) bool { return p.AfterID == 42 }},
+		{"count=true", func(p listParams) bool { return p.Count }},
+		{"count=0", func(p listParams) bool { return !p.Count }},
+		{"from=2026-01-01T00:00:00Z&time_field=measured_at", func(p listParams) bool {
+			return p.From.Equal(from) && p.To.IsZero() && p.TimeField == "measured_at"
+		}},
+		{"fields=id,+total,,flow", func(p listParams) bool { return reflect.DeepEqual(p.Fields, []string{"id", "total", "flow"}) }},
+	} {
+		p, err := parseListParams(httptest.NewRequest("GET", "/x?"+c.query, nil), "created_at", "measured_at")
+		if err != nil || !c.check(p) {
+			t.Errorf("%q: %+v, %v", c.query, p, err)
+		}
+	}
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=-1",
+		"limit=ten",
+		"order=up",
+		"cursor=not-base64!",
+		"cursor=" + strings.TrimRight(encodeCursor(1), "=") + "x",
+		"count=maybe",
+		"from=yesterday",
+		"time_field=updated_at",
+	} {
+		if _, err := parseListParams(httptest.NewRequest("GET", "/x?"+query, nil), "created_at", "measured_at"); err == nil {
+			t.Errorf("%q accepted", query)
+		}
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	for _, id := range []int{1, 42, 1 << 30} {
+		if got, err := decodeCursor(encodeCursor(id)); err != nil || got != id {
+			t.Errorf("round trip %d: %d, %v", id, got, err)
+		}
+	}
+	for _, s := range []string{"", "%%%", "aWQ6", "bnVtOjU", "aWQ6YWJj"} { // "", "id:", "num:5", "id:abc"
+		if _, err := decodeCursor(s); err == nil {
+			t.Errorf("decodeCursor(%q) accepted", s)
+		}
+	}
+}
+
+func TestSQLWhere(t *testing.T) {
+	var w sqlWhere
+	if w.String() != "" {
+		t.Errorf("empty where = %q", w.String())
+	}
+
+	p := listParams{
+		Tenant: 3, IMEI: "0861234567890123", Serial: "A1", Desc: true, AfterID: 99,
+		From: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	p.filters(&w, "m.measured_at", true)
+	p.cursor(&w, "m.id")
+	want := "WHERE f.tenant_id = $1 AND m.measured_at >= $2 AND f.imei = $3 AND m.serial = $4 AND m.id < $5"
+	if w.String() != want {
+		t.Errorf("where = %q\nwant    %q", w.String(), want)
+	}
+	if !reflect.DeepEqual(w.args, []interface{}{3, p.From, p.IMEI, "A1", 99}) {
+		t.Errorf("args = %v", w.args)
+	}
+
+	// serial only applies where messages are joined; ascending pages look forward
+	var frames sqlWhere
+	p.Desc = false
+	p.filters(&frames, "f.created_at", false)
+	p.cursor(&frames, "f.id")
+	if want := "WHERE f.tenant_id = $1 AND f.created_at >= $2 AND f.imei = $3 AND f.id > $4"; frames.String() != want {
+		t.Errorf("where = %q\nwant    %q", frames.String(), want)
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	rows := []item{{3, "c"}, {2, "b"}, {1, "a"}}
+	ids := []int{3, 2, 1}
+
+	decode := func(t *testing.T, body string) (data []map[string]interface{}, meta map[string]interface{}) {
+		t.Helper()
+		var res struct {
+			Data []map[string]interface{} `json:"data"`
+			Meta map[string]interface{}   `json:"meta"`
+		}
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Data, res.Meta
+	}
+
+	t.Run("next page, no count", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		writePage(rec, listParams{Limit: 2, Desc: true}, rows, ids, nil)
+		data, meta := decode(t, rec.Body.String())
+		if len(data) != 2 || data[1]["name"] != "b" {
+			t.Errorf("data = %v", data)
+		}
+		if meta["count"] != 2.0 || meta["next_cursor"] != encodeCursor(2) || meta["order"] != "desc" {
+			t.Errorf("meta = %v", meta)
+		}
+		if _, ok := meta["total_count"]; ok {
+			t.Errorf("total_count without count=true: %v", meta)
+		}
+	})
+
+	t.Run("last page with count", func(t *testing.T) {
+		total := 3
+		rec := httptest.NewRecorder()
+		writePage(rec, listParams{Limit: 5}, rows, ids, &total)
+		data, meta := decode(t, rec.Body.String())
+		if len(data) != 3 || meta["total_count"] != 3.0 || meta["order"] != "asc" {
+			t.Errorf("data = %v, meta = %v", data, meta)
+		}
+		if _, ok := meta["next_cursor"]; ok {
+			t.Errorf("next_cursor on the last page: %v", meta)
+		}
+	})
+
+	t.Run("fields", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		writePage(rec, listParams{Limit: 5, Fields: []string{"name", "missing"}}, rows, ids, nil)
+		data, _ := decode(t, rec.Body.String())
+		if len(data) != 3 || !reflect.DeepEqual(data[0], map[string]interface{}{"name": "c"}) {
+			t.Errorf("data = %v", data)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		writePage[item](rec, listParams{Limit: 5}, nil, nil, nil)
+		if !strings.HasPrefix(rec.Body.String(), `{"data":[],`) {
+			t.Errorf("body = %s", rec.Body)
+		}
+	})
+}
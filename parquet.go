@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// -------------------------
+// PARQUET WRITER
+// -------------------------
+// Just enough Parquet for flat exports: every column is OPTIONAL, values are
+// PLAIN encoded in one uncompressed data page (v1) per column chunk, and
+// definition levels use the RLE hybrid encoding. Rows are buffered one row
+// group at a time, so memory is bounded by rowGroupSize, not by the export.
+// The footer is FileMetaData in the Thrift compact protocol.
+
+type parquetType int
+
+const (
+	parquetInt64 parquetType = iota
+	parquetString
+	parquetTimestamp // INT64 milliseconds since the epoch, UTC
+)
+
+type parquetColumn struct {
+	Name string
+	Type parquetType
+}
+
+// Thrift enum values from parquet.thrift
+const (
+	pqTypeInt64     = 2
+	pqTypeByteArray = 6
+
+	pqConvertedUTF8            = 0
+	pqConvertedTimestampMillis = 9
+
+	pqRepetitionOptional = 1
+	pqEncodingPlain      = 0
+	pqEncodingRLE        = 3
+	pqCodecUncompressed  = 0
+	pqPageData           = 0
+)
+
+const parquetMagic = "PAR1"
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunk
+}
+
+type parquetColumnBuf struct {
+	defs   []byte // 1 = value present, 0 = null
+	values []byte // PLAIN encoded non-null values
+}
+
+type parquetWriter struct {
+	w            io.Writer
+	pos          int64
+	cols         []parquetColumn
+	bufs         []parquetColumnBuf
+	rows         int
+	rowGroupSize int
+	groups       []parquetRowGroup
+	err          error
+}
+
+func newParquetWriter(w io.Writer, cols []parquetColumn, rowGroupSize int) *parquetWriter {
+	p := &parquetWriter{w: w, cols: cols, bufs: make([]parquetColumnBuf, len(cols)), rowGroupSize: rowGroupSize}
+	p.write([]byte(parquetMagic))
+	return p
+}
+
+func (p *parquetWriter) write(b []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(b)
+	p.pos += int64(n)
+	p.err = err
+}
+
+// Write appends a row; values are nil, int64, string or time.Time
+// according to the column types.
+func (p *parquetWriter) Write(row []interface{}) error {
+	if len(row) != len(p.cols) {
+		return fmt.Errorf("parquet: row has %d values, want %d", len(row), len(p.cols))
+	}
+	for i, v := range row {
+		b := &p.bufs[i]
+		if v == nil {
+			b.defs = append(b.defs, 0)
+			continue
+		}
+		b.defs = append(b.defs, 1)
+		switch p.cols[i].Type {
+		case parquetInt64:
+			n, ok := v.(int64)
+			if !ok {
+				return fmt.Errorf("parquet: column %s wants int64, got %T", p.cols[i].Name, v)
+			}
+			b.values = binary.LittleEndian.AppendUint64(b.values, uint64(n))
+		case parquetTimestamp:
+			t, ok := v.(time.Time)
+			if !ok {
+				return fmt.Errorf("parquet: column %s wants time.Time, got %T", p.cols[i].Name, v)
+			}
+			b.values = binary.LittleEndian.AppendUint64(b.values, uint64(t.UnixMilli()))
+		case parquetString:
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("parquet: column %s wants string, got %T", p.cols[i].Name, v)
+			}
+			b.values = binary.LittleEndian.AppendUint32(b.values, uint32(len(s)))
+			b.values = append(b.values, s...)
+		}
+	}
+	p.rows++
+	if p.rows >= p.rowGroupSize {
+		p.flush()
+	}
+	return p.err
+}
+
+// flush writes the buffered rows as one row group.
+func (p *parquetWriter) flush() {
+	if p.rows == 0 {
+		return
+	}
+	g := parquetRowGroup{rows: int64(p.rows)}
+	for i := range p.cols {
+		b := &p.bufs[i]
+
+		levels := encodeRLEBits(b.defs)
+		body := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+		body = append(body, levels...)
+		body = append(body, b.values...)
+
+		var h thriftCompact
+		h.begin()
+		h.i32(1, pqPageData)
+		h.i32(2, int32(len(body)))
+		h.i32(3, int32(len(body)))
+		h.structBegin(5) // DataPageHeader
+		h.i32(1, int32(p.rows))
+		h.i32(2, pqEncodingPlain)
+		h.i32(3, pqEncodingRLE)
+		h.i32(4, pqEncodingRLE)
+		h.structEnd()
+		h.end()
+
+		c := parquetChunk{offset: p.pos, size: int64(len(h.b) + len(body)), values: int64(p.rows)}
+		p.write(h.b)
+		p.write(body)
+		g.chunks = append(g.chunks, c)
+		g.size += c.size
+
+		b.defs, b.values = b.defs[:0], b.values[:0]
+	}
+	p.groups = append(p.groups, g)
+	p.rows = 0
+}
+
+// Close flushes the last row group and writes the footer. It does not close
+// the underlying writer.
+func (p *parquetWriter) Close() error {
+	p.flush()
+
+	var m thriftCompact
+	m.begin()
+	m.i32(1, 1) // version
+	m.listBegin(2, thriftStruct, len(p.cols)+1)
+	m.elemBegin()
+	m.binary(4, "schema")
+	m.i32(5, int32(len(p.cols)))
+	m.elemEnd()
+	for _, c := range p.cols {
+		m.elemBegin()
+		m.i32(1, c.physical())
+		m.i32(3, pqRepetitionOptional)
+		m.binary(4, c.Name)
+		switch c.Type {
+		case parquetString:
+			m.i32(6, pqConvertedUTF8)
+		case parquetTimestamp:
+			m.i32(6, pqConvertedTimestampMillis)
+		}
+		m.elemEnd()
+	}
+	var total int64
+	for _, g := range p.groups {
+		total += g.rows
+	}
+	m.i64(3, total)
+	m.listBegin(4, thriftStruct, len(p.groups))
+	for _, g := range p.groups {
+		m.elemBegin()
+		m.listBegin(1, thriftStruct, len(g.chunks))
+		for i, c := range g.chunks {
+			m.elemBegin()
+			m.i64(2, c.offset)
+			m.structBegin(3) // ColumnMetaData
+			m.i32(1, p.cols[i].physical())
+			m.listBegin(2, thriftI32, 2)
+			m.listI32(pqEncodingPlain)
+			m.listI32(pqEncodingRLE)
+			m.listBegin(3, thriftBinary, 1)
+			m.listBinary(p.cols[i].Name)
+			m.i32(4, pqCodecUncompressed)
+			m.i64(5, c.values)
+			m.i64(6, c.size)
+			m.i64(7, c.size)
+			m.i64(9, c.offset)
+			m.structEnd()
+			m.elemEnd()
+		}
+		m.i64(2, g.size)
+		m.i64(3, g.rows)
+		m.elemEnd()
+	}
+	m.binary(6, "meter server")
+	m.end()
+
+	p.write(m.b)
+	p.write(binary.LittleEndian.AppendUint32(nil, uint32(len(m.b))))
+	p.write([]byte(parquetMagic))
+	if p.err != nil {
+		return fmt.Errorf("parquet: %w", p.err)
+	}
+	return nil
+}
+
+func (c parquetColumn) physical() int32 {
+	if c.Type == parquetString {
+		return pqTypeByteArray
+	}
+	return pqTypeInt64
+}
+
+// encodeRLEBits encodes 0/1 levels (bit width 1) as RLE runs.
+func encodeRLEBits(levels []byte) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		out = append(out, levels[i])
+		i = j
+	}
+	return out
+}
+
+// -------------------------
+// THRIFT COMPACT PROTOCOL (write side)
+// -------------------------
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftCompact struct {
+	b    []byte
+	last []int16 // previous field id of each open struct
+}
+
+func (t *thriftCompact) begin()     { t.last = append(t.last, 0) }
+func (t *thriftCompact) end()       { t.b = append(t.b, 0); t.last = t.last[:len(t.last)-1] }
+func (t *thriftCompact) elemBegin() { t.begin() }
+func (t *thriftCompact) elemEnd()   { t.end() }
+
+func (t *thriftCompact) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.b = append(t.b, byte(d)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftCompact) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thriftCompact) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *thriftCompact) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.listBinary(s)
+}
+
+func (t *thriftCompact) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+func (t *thriftCompact) structEnd() { t.end() }
+
+func (t *thriftCompact) listBegin(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+		return
+	}
+	t.b = append(t.b, 0xF0|elem)
+	t.b = binary.AppendUvarint(t.b, uint64(n))
+}
+
+func (t *thriftCompact) listI32(v int32) { t.b = binary.AppendVarint(t.b, int64(v)) }
+
+func (t *thriftCompact) listBinary(s string) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(s)))
+	t.b = append(t.b, s...)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -------------------------
+// PROTOCOL ERRORS
+// -------------------------
+// Everything wrong with a frame is reported as a protocolError with the byte
+// offset it was found at, so a field missing from a reading can be told
+// apart: no error at its tag means the meter did not send it, a tag_overrun
+// or unknown_tag means we could not parse it. Decoding does not stop at the
+// first error; handleTCP stores the list on meter_frames.decode_errors and
+// counts it in meter_protocol_errors_total.
+
+const (
+	protoTruncatedFrame = "truncated_frame" // shorter than a header, or tlv_length runs past the end
+	protoLengthMismatch = "length_mismatch" // frame_length or tlv_length disagree with the bytes received
+	protoBadChecksum    = "bad_checksum"
+	protoBadFlag        = "bad_flag" // start or end flag
+	protoUnknownTag     = "unknown_tag"
+	protoTagOverrun     = "tag_overrun" // a known tag whose value runs past the TLV block
+	protoInvalidHex     = "invalid_hex" // hex input that is not bytes
+)
+
+// protocolError is one problem found in a frame. Offset counts from the
+// start flag for frames and from the first TLV byte for bare TLV payloads.
+type protocolError struct {
+	Kind    string `json:"kind"`
+	Offset  int    `json:"offset"`
+	Tag     string `json:"tag,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.Offset, e.Message)
+}
+
+func protoErrorf(kind string, offset int, format string, args ...interface{}) protocolError {
+	return protocolError{Kind: kind, Offset: offset, Message: fmt.Sprintf(format, args...)}
+}
+
+// shiftProtocolErrors moves TLV-relative offsets to frame offsets.
+func shiftProtocolErrors(errs []protocolError, by int) []protocolError {
+	out := make([]protocolError, len(errs))
+	for i, e := range errs {
+		e.Offset += by
+		out[i] = e
+	}
+	return out
+}
+
+func protocolMessages(errs []protocolError) []string {
+	msgs := make([]string, len(errs))
+	for i := range errs {
+		msgs[i] = errs[i].Error()
+	}
+	return msgs
+}
+
+// decodeFrame is parseFrameHeader followed by decodeTLV. errs holds every
+// protocol error of the frame, validateFrame's and the TLV's, at frame
+// offsets; err is set only when the header itself cannot be read.
+func decodeFrame(packet []byte) (header, decoded map[string]interface{}, errs []protocolError, err error) {
+	header, err = parseFrameHeader(packet)
+	if err != nil {
+		return nil, nil, validateFrame(packet), err
+	}
+	tlvLen := header["tlv_length"].(int)
+	decoded, _, tlvErrs := decodeTLVSpans(packet[frameHeaderLen : frameHeaderLen+tlvLen])
+	return header, decoded, append(validateFrame(packet), shiftProtocolErrors(tlvErrs, frameHeaderLen)...), nil
+}
+
+// decodeStoredTLV re-decodes a meter_frames.tlv_hex column, with errors at
+// frame offsets. Hex that does not parse decodes to nil and its invalid_hex
+// error rather than to whatever bytes could be salvaged.
+func decodeStoredTLV(tlvHex string) (map[string]interface{}, []protocolError) {
+	tlv, err := parseHexBytes(tlvHex)
+	var pe *protocolError
+	if errors.As(err, &pe) {
+		return nil, shiftProtocolErrors([]protocolError{*pe}, frameHeaderLen)
+	}
+	decoded, _, errs := decodeTLVSpans(tlv)
+	return decoded, shiftProtocolErrors(errs, frameHeaderLen)
+}
+
+// parseHexBytes is the strict form of hexStringToBytes for input from
+// outside: it accepts "01 02 AF" or "0102AF" and reports the first token that
+// is not a hex byte instead of dropping it.
+func parseHexBytes(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	var tokens []string
+	if strings.ContainsAny(s, " \t\r\n") {
+		tokens = strings.Fields(s)
+	} else {
+		for i := 0; i < len(s); i += 2 {
+			tokens = append(tokens, s[i:min(i+2, len(s))])
+		}
+	}
+	b := make([]byte, 0, len(tokens))
+	for _, t := range tokens {
+		v, err := strconv.ParseUint(t, 16, 8)
+		if err != nil || len(t) != 2 {
+			e := protoErrorf(protoInvalidHex, len(b), "%q is not a hex byte", t)
+			return nil, &e
+		}
+		b = append(b, byte(v))
+	}
+	return b, nil
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/uuid"
+)
+
+// -------------------------
+// REPLAY: captured traffic back through the decoder
+// -------------------------
+// `replay` reads pcap/pcapng captures or text logs with hex dumps, rebuilds
+// the byte stream of each connection, cuts it into 0x68 ... 0x16 frames and
+// runs every frame through parseFrameHeader/decodeTLV. With no -store the
+// decoded frames are printed as JSON lines; -store db writes them like
+// handleTCP does, and -store tcp://host:port sends them to a running server.
+
+// maxFrameLen matches the read buffer in handleTCP; longer frames never get stored.
+const maxFrameLen = 4096
+
+// scannedFrame is a frame cut from a stream, with its byte offset in that stream.
+type scannedFrame struct {
+	Data   []byte
+	Offset int64
+}
+
+// frameScanner finds frames in a byte stream that may split them across
+// reads or carry junk between them. A candidate needs the start flag, a
+// frame_length that agrees with tlv_length and the end flag where
+// frame_length says it is; otherwise the scanner resyncs one byte later.
+type frameScanner struct {
+	buf     []byte
+	offset  int64 // stream offset of buf[0]
+	Skipped int64 // bytes that were not part of any frame
+}
+
+func (s *frameScanner) skip(n int) {
+	s.buf = s.buf[n:]
+	s.offset += int64(n)
+	s.Skipped += int64(n)
+}
+
+// feed appends b and returns the frames completed by it. At the end of the
+// stream call it with atEOF set so an incomplete candidate is given up on and
+// any frame behind it is still found.
+func (s *frameScanner) feed(b []byte, atEOF bool) []scannedFrame {
+	s.buf = append(s.buf, b...)
+	var out []scannedFrame
+	for len(s.buf) > 0 {
+		i := bytes.IndexByte(s.buf, frameStartFlag)
+		if i < 0 {
+			s.skip(len(s.buf))
+			break
+		}
+		s.skip(i)
+
+		if len(s.buf) < 3 {
+			if atEOF {
+				s.skip(len(s.buf))
+			}
+			break
+		}
+		n := int(s.buf[1])<<8 | int(s.buf[2])
+		if n < frameMinLen || n > maxFrameLen {
+			s.skip(1)
+			continue
+		}
+		if len(s.buf) < n {
+			if atEOF {
+				s.skip(1)
+				continue
+			}
+			break
+		}
+		f := s.buf[:n]
+		if tlvLen := int(f[27])<<8 | int(f[28]); frameHeaderLen+tlvLen+2 != n || f[n-1] != frameEndFlag {
+			s.skip(1)
+			continue
+		}
+		out = append(out, scannedFrame{Data: append([]byte(nil), f...), Offset: s.offset})
+		s.buf = s.buf[n:]
+		s.offset += int64(n)
+	}
+	return out
+}
+
+// replayFrame is one recovered frame with the receive metadata handleTCP
+// would have recorded for it.
+type replayFrame struct {
+	Source string // file:line for logs, file and remote address for captures
+	Meta   frameMeta
+}
+
+// replayStream is one connection's worth of bytes.
+type replayStream struct {
+	scanner    frameScanner
+	sessionID  string
+	remoteAddr string
+	localAddr  string
+}
+
+func newReplayStream(session, remote, local string) *replayStream {
+	if _, err := uuid.Parse(session); err != nil {
+		session = uuid.NewString()
+	}
+	return &replayStream{sessionID: session, remoteAddr: remote, localAddr: local}
+}
+
+func (s *replayStream) frames(b []byte, atEOF bool, source string, seen time.Time, emit func(replayFrame)) {
+	for _, f := range s.scanner.feed(b, atEOF) {
+		emit(replayFrame{Source: source, Meta: frameMeta{
+			Raw:           f.Data,
+			RemoteAddr:    s.remoteAddr,
+			LocalAddr:     s.localAddr,
+			SessionID:     s.sessionID,
+			SessionOffset: f.Offset,
+			ReceivedAt:    seen,
+		}})
+	}
+}
+
+// -------------------------
+// HEX LOGS
+// -------------------------
+// Accepted lines: slog text or JSON records with a hex attribute (what
+// handleTCP logs today), the older "Received (N bytes): 68 00 ..." lines,
+// and bare hex dumps. Records carrying a session or remote attribute are
+// reassembled per connection; everything else shares one stream.
+var (
+	hexAttrRe     = regexp.MustCompile(`\bhex="([0-9A-Fa-f ]+)"`)
+	receivedRe    = regexp.MustCompile(`Received \(\d+ bytes\): ([0-9A-Fa-f ]+)`)
+	bareHexRe     = regexp.MustCompile(`^(?:[0-9A-Fa-f]{2} ?)+$`)
+	textAttrRe    = regexp.MustCompile(`\b(time|session|remote)=("[^"]*"|\S+)`)
+	stdLogTimeRe  = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?)`)
+	stdLogTimeFmt = "2006/01/02 15:04:05"
+)
+
+// hexLogLine is what one log line contributes: the bytes and, when the line
+// says so, which connection and when.
+type hexLogLine struct {
+	Hex     []byte
+	Time    time.Time
+	Session string
+	Remote  string
+}
+
+// parseHexLogLine picks the hex dump out of one log line. ok is false for
+// lines that carry none; err is set for a dump that is not clean hex, which
+// the caller skips rather than feed half of it into the stream.
+func parseHexLogLine(line string) (l hexLogLine, ok bool, err error) {
+	line = strings.TrimSpace(line)
+
+	if strings.HasPrefix(line, "{") {
+		var rec struct {
+			Time    time.Time `json:"time"`
+			Hex     string    `json:"hex"`
+			Session string    `json:"session"`
+			Remote  string    `json:"remote"`
+		}
+		if json.Unmarshal([]byte(line), &rec) != nil || rec.Hex == "" {
+			return l, false, nil
+		}
+		l = hexLogLine{Time: rec.Time, Session: rec.Session, Remote: rec.Remote}
+		if l.Hex, err = parseHexBytes(rec.Hex); err != nil {
+			return l, false, err
+		}
+		return l, len(l.Hex) > 0, nil
+	}
+
+	var hexText string
+	if m := hexAttrRe.FindStringSubmatch(line); m != nil {
+		hexText = m[1]
+		for _, a := range textAttrRe.FindAllStringSubmatch(line, -1) {
+			v := strings.Trim(a[2], `"`)
+			switch a[1] {
+			case "time":
+				l.Time, _ = time.Parse(time.RFC3339Nano, v)
+			case "session":
+				l.Session = v
+			case "remote":
+				l.Remote = v
+			}
+		}
+	} else if m := receivedRe.FindStringSubmatch(line); m != nil {
+		hexText = m[1]
+		if t := stdLogTimeRe.FindString(line); t != "" {
+			l.Time, _ = time.ParseInLocation(stdLogTimeFmt, t, time.Local)
+		}
+	} else if bareHexRe.MatchString(line) {
+		hexText = line
+	} else {
+		return l, false, nil
+	}
+	if l.Hex, err = parseHexBytes(hexText); err != nil {
+		return l, false, err
+	}
+	return l, len(l.Hex) > 0, nil
+}
+
+// replayHexLog replays the lines of a log and returns how many bytes were not
+// part of a frame.
+func replayHexLog(name string, r io.Reader, emit func(replayFrame)) (int64, error) {
+	streams := map[string]*replayStream{}
+	var order []string
+	var last time.Time
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		l, ok, err := parseHexLogLine(sc.Text())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: skipping line: %v\n", name, lineNo, err)
+		}
+		if !ok {
+			continue
+		}
+		key := l.Session
+		if key == "" {
+			key = l.Remote
+		}
+		s := streams[key]
+		if s == nil {
+			s = newReplayStream(l.Session, l.Remote, "")
+			streams[key] = s
+			order = append(order, key)
+		}
+		if !l.Time.IsZero() {
+			last = l.Time
+		}
+		s.frames(l.Hex, false, fmt.Sprintf("%s:%d", name, lineNo), last, emit)
+	}
+	var skipped int64
+	for _, k := range order {
+		streams[k].frames(nil, true, name+":EOF", last, emit)
+		skipped += streams[k].scanner.Skipped
+	}
+	return skipped, sc.Err()
+}
+
+// -------------------------
+// PCAP / PCAPNG
+// -------------------------
+var (
+	pcapMagics = [][]byte{
+		{0xA1, 0xB2, 0xC3, 0xD4}, {0xD4, 0xC3, 0xB2, 0xA1}, // microseconds
+		{0xA1, 0xB2, 0x3C, 0x4D}, {0x4D, 0x3C, 0xB2, 0xA1}, // nanoseconds
+	}
+	pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+)
+
+// captureFormat sniffs the first bytes: "pcap", "pcapng" or "hex".
+func captureFormat(head []byte) string {
+	if len(head) >= 4 {
+		if bytes.Equal(head[:4], pcapngMagic) {
+			return "pcapng"
+		}
+		for _, m := range pcapMagics {
+			if bytes.Equal(head[:4], m) {
+				return "pcap"
+			}
+		}
+	}
+	return "hex"
+}
+
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// pcapStream feeds tcpassembly's reassembled bytes into a replayStream.
+type pcapStream struct {
+	*replayStream
+	name string
+	emit func(replayFrame)
+	last time.Time
+}
+
+func (s *pcapStream) Reassembled(rs []tcpassembly.Reassembly) {
+	for _, r := range rs {
+		if r.Skip != 0 {
+			// lost segment: drop the partial frame rather than splice across the gap
+			s.scanner.skip(len(s.scanner.buf))
+		}
+		s.last = r.Seen
+		s.frames(r.Bytes, false, fmt.Sprintf("%s %s", s.name, s.remoteAddr), r.Seen, s.emit)
+	}
+}
+
+func (s *pcapStream) ReassemblyComplete() {
+	s.frames(nil, true, fmt.Sprintf("%s %s", s.name, s.remoteAddr), s.last, s.emit)
+}
+
+type pcapStreamFactory struct {
+	name    string
+	emit    func(replayFrame)
+	streams []*pcapStream
+}
+
+func (f *pcapStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	s := &pcapStream{
+		replayStream: newReplayStream("",
+			net.JoinHostPort(netFlow.Src().String(), tcpFlow.Src().String()),
+			net.JoinHostPort(netFlow.Dst().String(), tcpFlow.Dst().String())),
+		name: f.name,
+		emit: f.emit,
+	}
+	f.streams = append(f.streams, s)
+	return s
+}
+
+// replayPcap reassembles the TCP streams sent to port (any port when 0) and
+// returns how many of their bytes were not part of a frame.
+func replayPcap(name string, r io.Reader, format string, port int, emit func(replayFrame)) (int64, error) {
+	var pr packetReader
+	var err error
+	if format == "pcapng" {
+		pr, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	} else {
+		pr, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+
+	factory := &pcapStreamFactory{name: name, emit: emit}
+	asm := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// a capture cut off mid-packet still replays what came before
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			break
+		}
+		p := gopacket.NewPacket(data, pr.LinkType(), gopacket.Default)
+		tcp, ok := p.TransportLayer().(*layers.TCP)
+		if !ok || p.NetworkLayer() == nil || (port != 0 && int(tcp.DstPort) != port) {
+			continue
+		}
+		asm.AssembleWithTimestamp(p.NetworkLayer().NetworkFlow(), tcp, ci.Timestamp)
+	}
+	asm.FlushAll()
+
+	var skipped int64
+	for _, s := range factory.streams {
+		skipped += s.scanner.Skipped
+	}
+	return skipped, nil
+}
+
+// -------------------------
+// SINKS
+// -------------------------
+
+// replayDecoded is the dry-run output for one frame.
+type replayDecoded struct {
+	Source     string                 `json:"source"`
+	SessionID  string                 `json:"session_id"`
+	Offset     int64                  `json:"session_offset"`
+	Remote     string                 `json:"remote_addr,omitempty"`
+	ReceivedAt *time.Time             `json:"received_at,omitempty"`
+	Problems   []protocolError        `json:"problems,omitempty"`
+	Header     map[string]interface{} `json:"header"`
+	Decoded    map[string]interface{} `json:"decoded"`
+}
+
+type replaySummary struct {
+	Frames   int   `json:"frames"`
+	Invalid  int   `json:"invalid"`
+	Stored   int   `json:"stored"`
+	Failed   int   `json:"failed"`
+	Skipped  int64 `json:"skipped_bytes"`
+	lastErr  error
+	lastFail string
+}
+
+// storeReplayedFrame writes f the way handleTCP does, minus the alert rules,
+// webhooks and live feed: replayed history should not page anyone.
+func storeReplayedFrame(f replayFrame) error {
+	header, decoded, errs, err := decodeFrame(f.Meta.Raw)
+	if err != nil {
+		return err
+	}
+	frameID, _, err := saveFrameToDB(header, f.Meta, errs)
+	if err != nil {
+		return fmt.Errorf("saving frame: %w", err)
+	}
+	if err := saveReadingToDB(frameID, decoded); err != nil {
+		return fmt.Errorf("saving reading: %w", err)
+	}
+	if _, err := upsertDevice(header, decoded, frameID); err != nil {
+		return fmt.Errorf("updating device: %w", err)
+	}
+	return nil
+}
+
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	format := fs.String("format", "auto", "auto, pcap, pcapng or hex")
+	port := fs.Int("port", 9000, "TCP destination port to take from captures (0 = any)")
+	store := fs.String("store", "", "db, or tcp://host:port of a running server (default: dry run, print decoded frames)")
+	timeout := fs.Duration("timeout", 5*time.Second, "ACK timeout for -store tcp://")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: server replay [flags] file... (- for stdin)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	sum := &replaySummary{}
+	enc := json.NewEncoder(os.Stdout)
+	var sink func(replayFrame) error
+	switch {
+	case *store == "":
+		sink = func(f replayFrame) error {
+			header, decoded, errs, err := decodeFrame(f.Meta.Raw)
+			if err != nil {
+				return err
+			}
+			out := replayDecoded{
+				Source:    f.Source,
+				SessionID: f.Meta.SessionID,
+				Offset:    f.Meta.SessionOffset,
+				Remote:    f.Meta.RemoteAddr,
+				Problems:  errs,
+				Header:    header,
+				Decoded:   decoded,
+			}
+			if !f.Meta.ReceivedAt.IsZero() {
+				out.ReceivedAt = &f.Meta.ReceivedAt
+			}
+			return enc.Encode(out)
+		}
+	case *store == "db":
+		if err := openDB(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		sink = func(f replayFrame) error {
+			if f.Meta.ReceivedAt.IsZero() {
+				f.Meta.ReceivedAt = time.Now()
+			}
+			return storeReplayedFrame(f)
+		}
+	case strings.HasPrefix(*store, "tcp://"):
+		o := &simOptions{Addr: strings.TrimPrefix(*store, "tcp://"), Timeout: *timeout}
+		sink = func(f replayFrame) error {
+			r := sendFrame(context.Background(), o, simFrame{data: f.Meta.Raw})
+			if r.err != nil {
+				return r.err
+			}
+			if !r.acked {
+				return errors.New("no ACK from server")
+			}
+			return nil
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -store %q: want db or tcp://host:port\n", *store)
+		return 2
+	}
+
+	emit := func(f replayFrame) {
+		sum.Frames++
+		if len(validateFrame(f.Meta.Raw)) > 0 {
+			sum.Invalid++
+		}
+		if err := sink(f); err != nil {
+			sum.Failed++
+			sum.lastErr, sum.lastFail = err, f.Source
+			return
+		}
+		if *store != "" {
+			sum.Stored++
+		}
+	}
+
+	status := 0
+	for _, name := range fs.Args() {
+		skipped, err := replayFile(name, *format, *port, emit)
+		sum.Skipped += skipped
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "replay error:", err)
+			status = 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d frames (%d with problems), %d stored, %d failed, %d bytes outside frames\n",
+		sum.Frames, sum.Invalid, sum.Stored, sum.Failed, sum.Skipped)
+	if sum.lastErr != nil {
+		fmt.Fprintf(os.Stderr, "last failure at %s: %v\n", sum.lastFail, sum.lastErr)
+		status = 1
+	}
+	return status
+}
+
+// replayFile replays one file and returns how many bytes were not part of a frame.
+func replayFile(name, format string, port int, emit func(replayFrame)) (int64, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := bufio.NewReader(r)
+	if format == "auto" {
+		head, _ := br.Peek(4)
+		format = captureFormat(head)
+	}
+
+	switch format {
+	case "pcap", "pcapng":
+		return replayPcap(name, br, format, port, emit)
+	case "hex":
+		return replayHexLog(name, br, emit)
+	}
+	return 0, fmt.Errorf("unknown -format %q", format)
+}
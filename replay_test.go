@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestFrameScannerResyncs(t *testing.T) {
+	a := testFrame([]byte{0x08, 0x55})
+	b := testFrame([]byte{0x13, 0x01, 0x17, 0x12})
+	// junk, a false start flag, a frame split in three, then a truncated frame
+	stream := append([]byte{0x00, 0x68, 0x00, 0x05, 0x68, 0xFF}, a...)
+	stream = append(stream, b...)
+	stream = append(stream, a[:10]...)
+
+	var s frameScanner
+	var got []scannedFrame
+	for _, cut := range [][2]int{{0, 7}, {7, 20}, {20, len(stream)}} {
+		got = append(got, s.feed(stream[cut[0]:cut[1]], false)...)
+	}
+	got = append(got, s.feed(nil, true)...)
+
+	if len(got) != 2 || !bytes.Equal(got[0].Data, a) || !bytes.Equal(got[1].Data, b) {
+		t.Fatalf("got %d frames: %v", len(got), got)
+	}
+	if got[0].Offset != 6 || got[1].Offset != int64(6+len(a)) {
+		t.Errorf("offsets %d, %d", got[0].Offset, got[1].Offset)
+	}
+	if s.Skipped != 6+10 {
+		t.Errorf("skipped %d bytes", s.Skipped)
+	}
+}
+
+func TestReplayHexLog(t *testing.T) {
+	f := testFrame([]byte{0x08, 0x55})
+	hexf := fmt.Sprintf("% X", f)
+	half := len(f) / 2
+	log := strings.Join([]string{
+		`time=2026-10-01T10:00:00Z level=INFO msg="frame hex" session=8f0c6c4e-3b7a-4a8e-9a57-2f4f2b1f0a11 remote=10.0.0.5:4242 hex="` + hexf + `"`,
+		`{"time":"2026-10-01T10:05:00Z","level":"INFO","msg":"frame hex","session":"s2","hex":"` + hexf + `"}`,
+		`2025/01/02 15:04:05 Received (` + fmt.Sprint(len(f)) + ` bytes): ` + hexf,
+		`some unrelated line`,
+		`time=2026-10-01T10:06:00Z level=INFO msg="frame hex" session=s3 hex="68 0 12"`, // damaged: skipped, not half-read
+		`{"time":"2026-10-01T10:07:00Z","msg":"frame hex","session":"s3","hex":"68 00 1?"}`,
+		fmt.Sprintf("% X", f[:half]),
+		fmt.Sprintf("%X", f[half:]),
+	}, "\n")
+
+	var got []replayFrame
+	skipped, err := replayHexLog("field.log", strings.NewReader(log), func(r replayFrame) { got = append(got, r) })
+	if err != nil || skipped != 0 {
+		t.Fatal(err, skipped)
+	}
+	if len(got) != 4 {
+		t.Fatalf("%d frames", len(got))
+	}
+	for i, r := range got {
+		if !bytes.Equal(r.Meta.Raw, f) {
+			t.Errorf("frame %d = % X", i, r.Meta.Raw)
+		}
+	}
+	if m := got[0].Meta; m.SessionID != "8f0c6c4e-3b7a-4a8e-9a57-2f4f2b1f0a11" || m.RemoteAddr != "10.0.0.5:4242" ||
+		!m.ReceivedAt.Equal(time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("slog text meta %+v", m)
+	}
+	if got[1].Source != "field.log:2" || !got[1].Meta.ReceivedAt.Equal(time.Date(2026, 10, 1, 10, 5, 0, 0, time.UTC)) {
+		t.Errorf("json line %s %v", got[1].Source, got[1].Meta.ReceivedAt)
+	}
+	if got[3].Source != "field.log:8" {
+		t.Errorf("split dump completed at %s", got[3].Source)
+	}
+}
+
+func TestReplayPcap(t *testing.T) {
+	a := testFrame([]byte{0x08, 0x55})
+	b := testFrame([]byte{0x13, 0x01})
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	seq := uint32(1000)
+	packet := func(i int, dstPort layers.TCPPort, syn bool, payload []byte) {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 5}, DstIP: net.IP{10, 0, 0, 1}}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: dstPort, Seq: seq, SYN: syn, ACK: !syn, Window: 65535}
+		tcp.SetNetworkLayerForChecksum(ip)
+		sb := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(sb, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		seq += uint32(len(payload))
+		if syn {
+			seq++
+		}
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), CaptureLength: len(sb.Bytes()), Length: len(sb.Bytes())}
+		if err := w.WritePacket(ci, sb.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packet(0, 9000, true, nil)
+	packet(1, 9000, false, a[:5])
+	packet(2, 9000, false, append(a[5:], b...))
+	packet(3, 8080, false, a) // other port, ignored
+
+	if f := captureFormat(buf.Bytes()); f != "pcap" {
+		t.Fatalf("format %q", f)
+	}
+	var got []replayFrame
+	skipped, err := replayPcap("cap.pcap", &buf, "pcap", 9000, func(r replayFrame) { got = append(got, r) })
+	if err != nil || skipped != 0 {
+		t.Fatal(err, skipped)
+	}
+	if len(got) != 2 || !bytes.Equal(got[0].Meta.Raw, a) || !bytes.Equal(got[1].Meta.Raw, b) {
+		t.Fatalf("got %v", got)
+	}
+	m := got[1].Meta
+	if m.RemoteAddr != "10.0.0.5:40000" || m.LocalAddr != "10.0.0.1:9000" || m.SessionOffset != int64(len(a)) ||
+		!m.ReceivedAt.Equal(start.Add(2*time.Second)) || m.SessionID != got[0].Meta.SessionID {
+		t.Errorf("meta %+v", m)
+	}
+}
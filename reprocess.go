@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// -------------------------
+// REPROCESS: re-run decodeTLV over stored frames
+// -------------------------
+
+// reprocessFilter selects which meter_frames to re-decode. Zero values mean "no bound".
+type reprocessFilter struct {
+	FromID       int       `json:"from_id"`
+	ToID         int       `json:"to_id"`
+	Since        time.Time `json:"since"`
+	Until        time.Time `json:"until"`
+	IMEI         string    `json:"imei"`
+	MeterAddress string    `json:"meter_address"`
+	Limit        int       `json:"limit"`
+	DryRun       bool      `json:"dry_run"`
+}
+
+type fieldChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type reprocessDiff struct {
+	FrameID   int                    `json:"frame_id"`
+	MessageID int                    `json:"message_id,omitempty"`
+	Changes   map[string]fieldChange `json:"changes"`
+}
+
+// reprocessSummary counts frames by outcome. Changed means a decoded value
+// differs; rows that only carried an older decoder_version are restamped and
+// counted as Restamped (and Unchanged), so a decoder bump alone does not
+// inflate Changed. ErrorsUpdated counts frames whose decode_errors were
+// rewritten. NextFromID is set when Limit stopped the run: pass it as
+// from_id to continue.
+type reprocessSummary struct {
+	DecoderVersion string          `json:"decoder_version"`
+	DryRun         bool            `json:"dry_run"`
+	Scanned        int             `json:"scanned"`
+	Changed        int             `json:"changed"`
+	Unchanged      int             `json:"unchanged"`
+	Restamped      int             `json:"restamped"`
+	Inserted       int             `json:"inserted"`
+	ErrorsUpdated  int             `json:"decode_errors_updated"`
+	Failed         int             `json:"failed"`
+	FieldChanges   map[string]int  `json:"field_changes"`
+	Samples        []reprocessDiff `json:"samples"`
+	Errors         []string        `json:"errors,omitempty"`
+	NextFromID     int             `json:"next_from_id,omitempty"`
+}
+
+// how many diffs to echo back in full; the counters cover the rest
+const reprocessMaxSamples = 20
+
+const reprocessBatch = 500
+
+// reprocessHTTPLimit bounds one POST /api/admin/reprocess; larger ranges are
+// walked with next_from_id, or with the reprocess command.
+const reprocessHTTPLimit = 5000
+
+// reprocessFrames walks the selected frames in id order, re-decodes them with
+// the current decoder and rewrites the matching messages row and the frame's
+// decode_errors when they differ. It stops between batches once ctx is done.
+func reprocessFrames(ctx context.Context, f reprocessFilter) (*reprocessSummary, error) {
+	sum := &reprocessSummary{
+		DecoderVersion: decoderVersion,
+		DryRun:         f.DryRun,
+		FieldChanges:   map[string]int{},
+		Samples:        []reprocessDiff{},
+	}
+
+	lastID := f.FromID - 1
+	for {
+		where := []string{"id > $1"}
+		args := []interface{}{lastID}
+		add := func(cond string, v interface{}) {
+			args = append(args, v)
+			where = append(where, fmt.Sprintf(cond, len(args)))
+		}
+		if f.ToID > 0 {
+			add("id <= $%d", f.ToID)
+		}
+		if !f.Since.IsZero() {
+			add("created_at >= $%d", f.Since)
+		}
+		if !f.Until.IsZero() {
+			add("created_at < $%d", f.Until)
+		}
+		if f.IMEI != "" {
+			add("imei = $%d", f.IMEI)
+		}
+		if f.MeterAddress != "" {
+			add("meter_address = $%d", f.MeterAddress)
+		}
+
+		batch := reprocessBatch
+		if f.Limit > 0 && f.Limit-sum.Scanned < batch {
+			batch = f.Limit - sum.Scanned
+		}
+		if batch <= 0 {
+			sum.NextFromID = lastID + 1
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return sum, err
+		}
+
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+            SELECT id, COALESCE(tlv_hex, ''), raw_frame, COALESCE(decode_errors::text, '')
+            FROM meter_frames
+            WHERE %s
+            ORDER BY id
+            LIMIT %d
+        `, strings.Join(where, " AND "), batch), args...)
+		if err != nil {
+			return sum, err
+		}
+
+		var frames []reprocessRow
+		for rows.Next() {
+			var fr reprocessRow
+			if err := rows.Scan(&fr.id, &fr.tlvHex, &fr.raw, &fr.decodeErrors); err != nil {
+				rows.Close()
+				return sum, err
+			}
+			frames = append(frames, fr)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return sum, err
+		}
+		if len(frames) == 0 {
+			break
+		}
+
+		for _, fr := range frames {
+			lastID = fr.id
+			sum.Scanned++
+
+			res, err := reprocessFrame(fr, f.DryRun)
+			if err != nil {
+				sum.Failed++
+				sum.Errors = append(sum.Errors, fmt.Sprintf("frame %d: %v", fr.id, err))
+				continue
+			}
+			if res.errorsChanged {
+				sum.ErrorsUpdated++
+			}
+			if res.inserted {
+				sum.Inserted++
+			}
+			diff := res.diff
+			if len(diff.Changes) == 0 {
+				sum.Unchanged++
+				if res.restamped {
+					sum.Restamped++
+				}
+				continue
+			}
+
+			sum.Changed++
+			for k := range diff.Changes {
+				sum.FieldChanges[k]++
+			}
+			if len(sum.Samples) < reprocessMaxSamples {
+				sum.Samples = append(sum.Samples, diff)
+			}
+		}
+	}
+
+	return sum, nil
+}
+
+// reprocessRow is one meter_frames row to re-decode.
+type reprocessRow struct {
+	id           int
+	tlvHex       string
+	raw          []byte // archived since migration 3; older frames only have tlv_hex
+	decodeErrors string
+}
+
+type reprocessResult struct {
+	diff          reprocessDiff
+	inserted      bool // the frame had no messages row at all
+	restamped     bool // only decoder_version was out of date
+	errorsChanged bool // decode_errors differed from the stored list
+}
+
+// redecode decodes the archived frame when there is one, so decode_errors
+// include the header checks, and falls back to the stored TLV block.
+func (fr reprocessRow) redecode() (map[string]interface{}, []protocolError) {
+	if len(fr.raw) > 0 {
+		if _, decoded, errs, err := decodeFrame(fr.raw); err == nil {
+			return decoded, errs
+		}
+	}
+	return decodeStoredTLV(fr.tlvHex)
+}
+
+// reprocessFrame re-decodes one frame and compares against its latest messages row.
+func reprocessFrame(fr reprocessRow, dryRun bool) (reprocessResult, error) {
+	res := reprocessResult{diff: reprocessDiff{FrameID: fr.id, Changes: map[string]fieldChange{}}}
+	decoded, errs := fr.redecode()
+
+	if !sameProtocolErrors(fr.decodeErrors, errs) {
+		res.errorsChanged = true
+		if !dryRun {
+			var stored interface{}
+			if len(errs) > 0 {
+				b, _ := json.Marshal(errs)
+				stored = string(b)
+			}
+			if _, err := db.Exec(`UPDATE meter_frames SET decode_errors = $2 WHERE id = $1`, fr.id, stored); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	if decoded == nil {
+		return res, nil // nothing to compare the stored reading with
+	}
+
+	cols := readingColumns(decoded)
+	selects := make([]string, len(cols))
+	for i, c := range cols {
+		selects[i] = fmt.Sprintf("COALESCE(%s::text, '')", c.Name)
+	}
+
+	old := make([]string, len(cols))
+	dest := []interface{}{&res.diff.MessageID}
+	for i := range old {
+		dest = append(dest, &old[i])
+	}
+
+	err := db.QueryRow(fmt.Sprintf(`
+        SELECT id, %s FROM messages WHERE frame_id = $1 ORDER BY id DESC LIMIT 1
+    `, strings.Join(selects, ", ")), fr.id).Scan(dest...)
+
+	if err == sql.ErrNoRows {
+		res.inserted = true
+		for _, c := range cols {
+			res.diff.Changes[c.Name] = fieldChange{New: columnText(c)}
+		}
+		if dryRun {
+			return res, nil
+		}
+		return res, insertReading(fr.id, decoded, false)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	changes, stale := diffReadingColumns(cols, old)
+	res.diff.Changes = changes
+	res.restamped = len(changes) == 0 && len(stale) > 0
+	if len(stale) == 0 || dryRun {
+		return res, nil
+	}
+
+	var sets []string
+	args := []interface{}{res.diff.MessageID}
+	for _, c := range stale {
+		args = append(args, c.Value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", c.Name, len(args)))
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+        UPDATE messages SET %s, reprocessed_at = now() WHERE id = $1
+    `, strings.Join(sets, ", ")), args...)
+	return res, err
+}
+
+// diffReadingColumns compares the re-decoded columns with the stored text.
+// stale holds every column to rewrite; changes leaves out decoder_version,
+// which differs on every row after a decoder bump and says nothing about
+// what the decoder now reads differently.
+func diffReadingColumns(cols []readingColumn, old []string) (changes map[string]fieldChange, stale []readingColumn) {
+	changes = map[string]fieldChange{}
+	for i, c := range cols {
+		newText := columnText(c)
+		if sameColumnText(c, old[i], newText) {
+			continue
+		}
+		stale = append(stale, c)
+		if c.Name != "decoder_version" {
+			changes[c.Name] = fieldChange{Old: old[i], New: newText}
+		}
+	}
+	return changes, stale
+}
+
+// sameProtocolErrors compares stored decode_errors JSON with a fresh list;
+// jsonb reorders keys, so the comparison is on the decoded values.
+func sameProtocolErrors(stored string, errs []protocolError) bool {
+	var old []protocolError
+	if stored != "" {
+		if err := json.Unmarshal([]byte(stored), &old); err != nil {
+			return false
+		}
+	}
+	return slices.Equal(old, errs)
+}
+
+// columnText renders a column value the way Postgres' ::text cast would.
+func columnText(c readingColumn) string {
+	if c.Value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", c.Value)
+}
+
+// sameColumnText compares DB text with the new value, ignoring JSONB whitespace.
+func sameColumnText(c readingColumn, old, cur string) bool {
+	if !c.JSON {
+		return old == cur
+	}
+	var a, b bytes.Buffer
+	if json.Compact(&a, []byte(old)) != nil || json.Compact(&b, []byte(cur)) != nil {
+		return old == cur
+	}
+	return a.String() == b.String()
+}
+
+// -------------------------
+// API: ADMIN REPROCESS
+// -------------------------
+// POST /api/admin/reprocess with a reprocessFilter JSON body. One request
+// re-decodes at most reprocessHTTPLimit frames; when more may remain the
+// summary carries next_from_id to send as from_id in the next request.
+func postReprocess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var f reprocessFilter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+
+	if f.Limit <= 0 || f.Limit > reprocessHTTPLimit {
+		f.Limit = reprocessHTTPLimit
+	}
+
+	sum, err := reprocessFrames(r.Context(), f)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sum)
+}
+
+// -------------------------
+// CLI: server reprocess [flags]
+// -------------------------
+func reprocessCommand(args []string) int {
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	var f reprocessFilter
+	var since, until string
+	fs.IntVar(&f.FromID, "from-id", 0, "first meter_frames id to re-decode")
+	fs.IntVar(&f.ToID, "to-id", 0, "last meter_frames id to re-decode")
+	fs.StringVar(&since, "since", "", "only frames received at or after this RFC3339 time")
+	fs.StringVar(&until, "until", "", "only frames received before this RFC3339 time")
+	fs.StringVar(&f.IMEI, "imei", "", "only frames from this IMEI")
+	fs.StringVar(&f.MeterAddress, "meter-address", "", "only frames from this meter address")
+	fs.IntVar(&f.Limit, "limit", 0, "stop after this many frames (0 = all)")
+	fs.BoolVar(&f.DryRun, "dry-run", false, "report differences without writing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if since != "" {
+		if f.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -since:", err)
+			return 2
+		}
+	}
+	if until != "" {
+		if f.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -until:", err)
+			return 2
+		}
+	}
+
+	if err := openDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	sum, err := reprocessFrames(context.Background(), f)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(sum)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reprocess error:", err)
+		return 1
+	}
+	return 0
+}
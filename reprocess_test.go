@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestDiffReadingColumnsIgnoresDecoderVersion(t *testing.T) {
+	cols := readingColumns(map[string]interface{}{"total": 1234, "rtc": []int{1, 2}})
+	stored := func(version, total string) []string {
+		old := make([]string, len(cols))
+		for i, c := range cols {
+			old[i] = columnText(c)
+			switch c.Name {
+			case "decoder_version":
+				old[i] = version
+			case "total":
+				old[i] = total
+			case "rtc":
+				old[i] = "[1, 2]" // jsonb text output
+			}
+		}
+		return old
+	}
+
+	changes, stale := diffReadingColumns(cols, stored("2", "1234"))
+	if len(changes) != 0 || len(stale) != 1 || stale[0].Name != "decoder_version" {
+		t.Errorf("older stamp only: changes %v, stale %v", changes, stale)
+	}
+
+	changes, stale = diffReadingColumns(cols, stored("2", "1000"))
+	if len(changes) != 1 || changes["total"] != (fieldChange{Old: "1000", New: "1234"}) || len(stale) != 2 {
+		t.Errorf("total and stamp: changes %v, stale %v", changes, stale)
+	}
+
+	if changes, stale = diffReadingColumns(cols, stored(decoderVersion, "1234")); len(changes) != 0 || len(stale) != 0 {
+		t.Errorf("current row: changes %v, stale %v", changes, stale)
+	}
+}
+
+func TestSameProtocolErrors(t *testing.T) {
+	errs := []protocolError{{Kind: protoUnknownTag, Offset: 31, Tag: "7E", Message: "unknown tag 0x7E"}}
+	// jsonb returns keys shortest first
+	stored := `[{"tag": "7E", "kind": "unknown_tag", "offset": 31, "message": "unknown tag 0x7E"}]`
+	if !sameProtocolErrors(stored, errs) {
+		t.Error("reordered keys compared different")
+	}
+	if !sameProtocolErrors("", nil) {
+		t.Error("no errors before or after compared different")
+	}
+	if sameProtocolErrors("", errs) || sameProtocolErrors(stored, nil) {
+		t.Error("added or cleared errors compared equal")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// -------------------------
+// ROUTES
+// -------------------------
+// Every HTTP endpoint is declared once here. registerRoutes mounts the API
+// table under /api/v1 and keeps the old unversioned /api paths as aliases
+// that answer with a Deprecation header, and openapi.go documents the same
+// table, so the served spec cannot drift from what is actually routed.
+
+const (
+	apiPrefix       = "/api/v1"
+	apiLegacyPrefix = "/api"
+)
+
+type apiRoute struct {
+	Method   string
+	Path     string // below apiPrefix for apiRoutes, absolute for opsRoutes
+	Role     role   // minimum role, ignored when Public
+	Platform bool   // not available to tenant-scoped credentials
+	Public   bool   // no authentication
+	Handler  http.HandlerFunc
+	Summary  string
+	Query    []string    // documented query parameters, see paramDocs
+	Body     interface{} // JSON request body, nil for none
+	Response interface{} // JSON response body; listOf(T) for a paged list
+	Status   int         // success status, default 200
+	Stream   string      // non-JSON content type the route produces
+}
+
+// pageOf marks a response written by writePage: a page envelope of T.
+type pageOf struct{ item interface{} }
+
+func listOf(item interface{}) pageOf { return pageOf{item} }
+
+// query parameter sets shared by the list endpoints
+var (
+	pageQuery   = []string{"limit", "cursor", "order", "from", "to", "fields", "tenant", "count"}
+	meterQuery  = []string{"imei", "meter_address", "serial", "manufacturer"}
+	readingList = append(append([]string{"time_field"}, pageQuery...), meterQuery...)
+	consumQuery = []string{"imei", "group", "interval", "from", "to", "tz", "counter_max", "max_gap", "tenant"}
+	liveQuery   = []string{"imei", "manufacturer", "alarm", "last_event_id", "access_token", "tenant"}
+)
+
+// apiRoutes is a function rather than a table variable because the OpenAPI
+// handler it lists reads it back.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{Method: "GET", Path: "/openapi.json", Public: true, Handler: getOpenAPI,
+			Summary: "This OpenAPI document", Response: map[string]interface{}{}},
+
+		// readings and frames
+		{Method: "GET", Path: "/messages", Role: roleReadOnly, Handler: getMessages,
+			Summary: "List decoded readings", Query: readingList, Response: listOf(Msg{})},
+		{Method: "GET", Path: "/frames/decoded/all", Role: roleReadOnly, Handler: getDecodedFrames,
+			Summary: "List stored frames", Query: append(append([]string{"time_field"}, pageQuery...), "imei", "meter_address", "manufacturer", "decode_error"),
+			Response: listOf(Frame{})},
+		{Method: "GET", Path: "/frames/{id}/raw", Role: roleReadOnly, Handler: getRawFrame,
+			Summary: "Archived bytes of a frame, or its metadata with format=json", Query: []string{"format"},
+			Response: RawFrame{}, Stream: "application/octet-stream"},
+		{Method: "POST", Path: "/decode", Role: roleReadOnly, Handler: postDecode,
+			Summary: "Decode a frame or TLV payload without storing it", Body: DecodeRequest{}, Response: DecodeResult{}},
+		{Method: "POST", Path: "/ingest", Role: roleOperator, Platform: true, Handler: postIngest,
+			Summary: "Store a frame delivered by a carrier IoT platform; 200 is the ACK", Body: DecodeRequest{}, Response: IngestResult{}},
+
+		// devices
+		{Method: "GET", Path: "/devices", Role: roleReadOnly, Handler: getDevices,
+			Summary: "List devices", Query: append(append([]string{"group"}, pageQuery...), meterQuery...), Response: listOf(Device{})},
+		{Method: "GET", Path: "/devices/{imei}", Role: roleReadOnly, Handler: getDevice,
+			Summary: "Get a device", Response: Device{}},
+		{Method: "GET", Path: "/devices/{imei}/readings", Role: roleReadOnly, Handler: getDeviceReadings,
+			Summary: "List a device's readings", Query: append([]string{"time_field"}, pageQuery...), Response: listOf(Msg{})},
+		{Method: "GET", Path: "/devices/{imei}/latest", Role: roleReadOnly, Handler: getDeviceLatest,
+			Summary: "A device's latest reading", Response: LatestReading{}},
+		{Method: "GET", Path: "/devices/{imei}/frames", Role: roleReadOnly, Handler: getDeviceFrames,
+			Summary: "List a device's frames", Query: append([]string{"time_field"}, pageQuery...), Response: listOf(Frame{})},
+		{Method: "GET", Path: "/devices/{imei}/alarms", Role: roleReadOnly, Handler: getDeviceAlarms,
+			Summary: "List a device's readings in alarm", Query: pageQuery, Response: listOf(DeviceAlarm{})},
+		{Method: "GET", Path: "/devices/{imei}/consumption", Role: roleReadOnly, Handler: getDeviceConsumption,
+			Summary: "A device's consumption per interval", Query: consumQuery[2:], Response: ConsumptionResult{}},
+		{Method: "PUT", Path: "/devices/{imei}/group", Role: roleOperator, Handler: putDeviceGroup,
+			Summary: "Set or clear a device's group", Body: DeviceGroupRequest{}, Response: Device{}},
+		{Method: "GET", Path: "/consumption", Role: roleReadOnly, Handler: getConsumption,
+			Summary: "Consumption per interval for devices or a group", Query: consumQuery, Response: ConsumptionResult{}},
+
+		{Method: "GET", Path: "/export/readings", Role: roleReadOnly, Handler: getExportReadings,
+			Summary: "Stream readings as CSV, Excel-ready CSV, NDJSON or Parquet",
+			Query:   []string{"format", "month", "from", "to", "tz", "imei", "group", "tenant"},
+			Stream:  "text/csv"},
+
+		// alerts
+		{Method: "GET", Path: "/alerts", Role: roleReadOnly, Handler: getAlerts,
+			Summary: "List alerts", Query: append([]string{"imei", "type", "status"}, pageQuery...), Response: listOf(Alert{})},
+		{Method: "GET", Path: "/alert-rules", Role: roleReadOnly, Handler: getAlertRules,
+			Summary: "Default and per-group alert thresholds", Response: AlertRulesList{}},
+		{Method: "PUT", Path: "/alert-rules/{group}", Role: roleOperator, Platform: true, Handler: putAlertRules,
+			Summary: "Replace a group's alert thresholds", Body: alertRules{}, Response: alertRules{}},
+		{Method: "POST", Path: "/admin/alerts/sweep", Role: roleOperator, Platform: true, Handler: postAlertSweep,
+			Summary: "Run the window alert rules now", Response: map[string]string{}},
+
+		// webhooks
+		{Method: "GET", Path: "/webhooks", Role: roleAdmin, Platform: true, Handler: getWebhooks,
+			Summary: "List webhooks", Response: []Webhook{}},
+		{Method: "POST", Path: "/webhooks", Role: roleAdmin, Platform: true, Handler: postWebhook,
+			Summary: "Register a webhook", Body: Webhook{}, Response: Webhook{}, Status: http.StatusCreated},
+		{Method: "DELETE", Path: "/webhooks/{id}", Role: roleAdmin, Platform: true, Handler: deleteWebhook,
+			Summary: "Deactivate a webhook", Status: http.StatusNoContent},
+		{Method: "POST", Path: "/webhooks/{id}/test", Role: roleOperator, Platform: true, Handler: postWebhookTest,
+			Summary: "Queue a ping event for a webhook", Response: map[string]interface{}{}, Status: http.StatusAccepted},
+		{Method: "GET", Path: "/webhooks/{id}/deliveries", Role: roleOperator, Platform: true, Handler: getWebhookDeliveries,
+			Summary: "List a webhook's deliveries", Query: []string{"status", "payload", "limit", "cursor", "order"},
+			Response: listOf(webhookDelivery{})},
+		{Method: "GET", Path: "/webhooks/dead-letters", Role: roleOperator, Platform: true, Handler: getWebhookDeadLetters,
+			Summary: "List deliveries that ran out of attempts", Query: []string{"webhook_id", "limit", "cursor", "order"},
+			Response: listOf(DeadLetter{})},
+		{Method: "POST", Path: "/webhooks/dead-letters/{id}/retry", Role: roleOperator, Platform: true, Handler: postWebhookDeadLetterRetry,
+			Summary: "Queue a dead letter for delivery again", Response: map[string]int{}},
+
+		// live feed
+		{Method: "GET", Path: "/live/sse", Role: roleReadOnly, Handler: getLiveSSE,
+			Summary: "Live readings as server-sent events", Query: liveQuery, Stream: "text/event-stream"},
+		{Method: "GET", Path: "/live/ws", Role: roleReadOnly, Handler: getLiveWS,
+			Summary: "Live readings over a WebSocket", Query: liveQuery, Status: http.StatusSwitchingProtocols},
+
+		// administration
+		{Method: "POST", Path: "/admin/reprocess", Role: roleAdmin, Platform: true, Handler: postReprocess,
+			Summary: "Re-run the decoder over stored frames", Body: reprocessFilter{}, Response: reprocessSummary{}},
+		{Method: "GET", Path: "/admin/api-keys", Role: roleAdmin, Platform: true, Handler: getAPIKeys,
+			Summary: "List API keys", Response: []APIKey{}},
+		{Method: "POST", Path: "/admin/api-keys", Role: roleAdmin, Platform: true, Handler: postAPIKey,
+			Summary: "Create an API key; the key is only returned here", Body: APIKeyRequest{}, Response: APIKey{},
+			Status: http.StatusCreated},
+		{Method: "DELETE", Path: "/admin/api-keys/{id}", Role: roleAdmin, Platform: true, Handler: deleteAPIKey,
+			Summary: "Revoke an API key", Status: http.StatusNoContent},
+		{Method: "GET", Path: "/admin/audit", Role: roleAdmin, Platform: true, Handler: getAuditLog,
+			Summary: "List audited API requests", Query: append([]string{"principal", "path", "status"}, pageQuery[:5]...),
+			Response: listOf(auditEntry{})},
+		{Method: "GET", Path: "/admin/tenants", Role: roleAdmin, Platform: true, Handler: getTenants,
+			Summary: "List tenants", Response: []Tenant{}},
+		{Method: "POST", Path: "/admin/tenants", Role: roleAdmin, Platform: true, Handler: postTenant,
+			Summary: "Create a tenant", Body: Tenant{}, Response: Tenant{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/admin/tenants/{id}/assignments", Role: roleAdmin, Platform: true, Handler: getTenantAssignments,
+			Summary: "List a tenant's device assignments", Response: []TenantAssignment{}},
+		{Method: "POST", Path: "/admin/tenants/{id}/assignments", Role: roleAdmin, Platform: true, Handler: postTenantAssignment,
+			Summary: "Assign devices to a tenant", Body: TenantAssignment{}, Response: TenantAssignment{}, Status: http.StatusCreated},
+		{Method: "DELETE", Path: "/admin/tenant-assignments/{id}", Role: roleAdmin, Platform: true, Handler: deleteTenantAssignment,
+			Summary: "Remove a tenant assignment", Status: http.StatusNoContent},
+		{Method: "POST", Path: "/admin/tenants/restamp", Role: roleAdmin, Platform: true, Handler: postTenantRestamp,
+			Summary: "Apply the current assignments to stored data", Response: map[string]interface{}{}},
+		{Method: "GET", Path: "/admin/debug-devices", Role: roleAdmin, Platform: true, Handler: getDebugDevices,
+			Summary: "List devices with debug logging", Response: []debugDevice{}},
+		{Method: "PUT", Path: "/admin/debug-devices/{imei}", Role: roleAdmin, Platform: true, Handler: putDebugDevice,
+			Summary: "Enable debug logging for a device", Body: DebugDeviceRequest{}, Response: debugDevice{}},
+		{Method: "DELETE", Path: "/admin/debug-devices/{imei}", Role: roleAdmin, Platform: true, Handler: deleteDebugDevice,
+			Summary: "Disable debug logging for a device", Status: http.StatusNoContent},
+	}
+}
+
+// opsRoutes are unversioned and unauthenticated, for scrapers and orchestrators.
+var opsRoutes = []apiRoute{
+	{Method: "GET", Path: "/healthz", Public: true, Handler: getHealthz,
+		Summary: "Liveness", Response: HealthStatus{}},
+	{Method: "GET", Path: "/readyz", Public: true, Handler: getReadyz,
+		Summary: "Readiness; 503 when a check fails", Response: ReadyStatus{}},
+	{Method: "GET", Path: "/metrics", Public: true, Handler: getMetrics,
+		Summary: "Prometheus metrics", Stream: "text/plain"},
+}
+
+func (rt apiRoute) handler() http.HandlerFunc {
+	if rt.Public {
+		return rt.Handler
+	}
+	h := rt.Handler
+	if rt.Platform {
+		h = requirePlatform(h)
+	}
+	return requireRole(rt.Role, h)
+}
+
+func registerRoutes(mux *http.ServeMux) {
+	for _, rt := range apiRoutes() {
+		h := rt.handler()
+		mux.HandleFunc(rt.Method+" "+apiPrefix+rt.Path, h)
+		mux.HandleFunc(rt.Method+" "+apiLegacyPrefix+rt.Path, deprecatedAlias(h))
+	}
+	for _, rt := range opsRoutes {
+		mux.HandleFunc(rt.Method+" "+rt.Path, rt.handler())
+	}
+}
+
+// deprecatedAlias serves an unversioned /api path and points at its /api/v1 successor.
+func deprecatedAlias(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor := apiPrefix + strings.TrimPrefix(r.URL.Path, apiLegacyPrefix)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		h(w, r)
+	}
+}
@@ -1,21 +1,3 @@
-<<<<<<< HEAD
-
-
-package main
-
-import (
-    "database/sql"
-    "encoding/json"
-    "fmt"
-    "log"
-    "net"
-    "net/http"
-    "os"
-    "strings"
-    "strconv"
-
-    _ "github.com/lib/pq"
-=======
 package main
 
 import (
@@ -23,7 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -32,8 +14,6 @@ import (
 	"time"
 
 	_ "github.com/lib/pq"
-	_ "github.com/google/uuid"
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 )
 
 var db *sql.DB
@@ -42,44 +22,6 @@ var db *sql.DB
 // DB CONNECT FUNCTION
 // -------------------------
 func connectDB() (*sql.DB, error) {
-<<<<<<< HEAD
-    host := os.Getenv("DB_HOST")
-    if host == "" {
-        host = "localhost"
-    }
-
-    user := os.Getenv("DB_USER")
-    if user == "" {
-        user = "postgres"
-    }
-
-    password := os.Getenv("DB_PASSWORD")
-    if password == "" {
-        password = "Sani@123"
-    }
-
-    dbname := os.Getenv("DB_NAME")
-    if dbname == "" {
-        dbname = "tcp_db"
-    }
-
-    port := os.Getenv("DB_PORT")
-    if port == "" {
-        port = "5432"
-    }
-
-    connStr := fmt.Sprintf(
-        "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-        host, port, user, password, dbname,
-    )
-
-    db, err := sql.Open("postgres", connStr)
-    if err != nil {
-        return nil, err
-    }
-
-    return db, db.Ping()
-=======
 	host := getenv("DB_HOST", "localhost")
 	if host == "" {
 		host = "localhost"
@@ -107,123 +49,80 @@ func getenv(k, d string) string {
 		return d
 	}
 	return v
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 }
 
 // -------------------------
 // MAIN
 // -------------------------
 func main() {
-<<<<<<< HEAD
-    var err error
-    db, err = connectDB()
-    if err != nil {
-        log.Fatal("DB error:", err)
-    }
-    fmt.Println("Connected to PostgreSQL")
-
-    go startTCPServer()
-
-
-    // http.HandleFunc("/api/messages/", getMessages)
+	setupLogging()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	serve()
+}
 
-     http.HandleFunc("/api/messages", getMessages)
-    http.HandleFunc("/api/frames/decoded/all", getDecodedFrames)
-   
-    fmt.Println("API listening on :8080")
-    log.Fatal(http.ListenAndServe(":8080", nil))
-=======
+// serve runs the TCP listener and the HTTP API until the process exits.
+func serve() {
 	var err error
-	db, err = connectDB()
+	db, err = connectDBWithRetry()
 	if err != nil {
-		log.Fatal("DB error:", err)
+		fatal("DB error", "err", err)
+	}
+	slog.Info("connected to PostgreSQL")
+	go watchDB()
+
+	if err := migrateDB(db); err != nil {
+		fatal("migration error", "err", err)
+	}
+	if err := startLiveFeed(); err != nil {
+		fatal("live feed error", "err", err)
 	}
-	fmt.Println("Connected to PostgreSQL")
 
 	go startTCPServer()
+	go startUDPServer()
+	go startCoAPServer()
+	go startAlertSweeper()
+	go startWebhookWorker()
+	go startAuditWriter()
+	if err := startEventRelay(); err != nil {
+		fatal("event stream config error", "err", err)
+	}
+	if err := startMQTT(); err != nil {
+		fatal("MQTT config error", "err", err)
+	}
+	if err := startMQTTIngest(); err != nil {
+		fatal("MQTT ingest config error", "err", err)
+	}
+	if err := startTSDBExport(); err != nil {
+		fatal("time-series export config error", "err", err)
+	}
 
-	http.HandleFunc("/api/messages", getMessages)
-	http.HandleFunc("/api/frames/decoded/all", getDecodedFrames)
+	registerRoutes(http.DefaultServeMux)
 
-	fmt.Println("API listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
+	slog.Info("API listening", "addr", ":8080")
+	fatal("HTTP server stopped", "err", http.ListenAndServe(":8080", nil))
 }
 
 // -------------------------
 // TCP SERVER
 // -------------------------
 func startTCPServer() {
-<<<<<<< HEAD
-    ln, err := net.Listen("tcp", ":9000")
-    if err != nil {
-        log.Fatal("TCP error:", err)
-    }
-    fmt.Println("TCP running on port 9000")
-
-    for {
-        conn, err := ln.Accept()
-        if err != nil {
-            continue
-        }
-        go handleTCP(conn)
-    }
-}
-
-func handleTCP(conn net.Conn) {
-    defer conn.Close()
-
-    buf := make([]byte, 2048)
-    n, _ := conn.Read(buf)
-    packet := buf[:n]
-
-    fmt.Printf("Received (%d bytes): % X\n", n, packet)
-
-    if n < 30 {
-        fmt.Println("Ignoring short packet")
-        return
-    }
-
-    if packet[0] != 0x68 {
-        fmt.Println("Invalid start flag")
-        return
-    }
-
-    header := parseFrameHeader(packet)
-
-    // ---- SAVE FRAME ----
-    frameID, err := saveFrameToDB(header)
-    if err != nil {
-        fmt.Println("DB ERROR (frame):", err)
-        return
-    }
-
-    // ---- DECODE TLV ----
-    tlvBytes := hexStringToBytes(header["tlv_hex"].(string))
-    decoded := decodeTLV(tlvBytes)
-
-    // ---- SAVE READING ----
-    err = saveReadingToDB(frameID, decoded)
-    if err != nil {
-        fmt.Println("DB ERROR (reading):", err)
-    }
-
-    conn.Write([]byte("OK"))
-}
-
-
-=======
 	ln, err := net.Listen("tcp", ":9000")
 	if err != nil {
-		log.Fatal("TCP error:", err)
+		fatal("TCP error", "err", err)
 	}
-	fmt.Println("TCP running on port 9000")
+	tcpListening.Store(true)
+	slog.Info("TCP listening", "addr", ":9000")
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			tcpConnections.WithLabelValues("rejected").Inc()
+			slog.Warn("TCP accept failed", "err", err)
 			continue
 		}
+		tcpConnections.WithLabelValues("accepted").Inc()
 		go handleTCP(conn)
 	}
 }
@@ -231,94 +130,29 @@ func handleTCP(conn net.Conn) {
 func handleTCP(conn net.Conn) {
 	defer conn.Close()
 
-	buf := make([]byte, 4096)
-	n, _ := conn.Read(buf)
-	packet := buf[:n]
-
-	fmt.Printf("Received (%d bytes): % X\n", n, packet)
-
-	if n < 30 {
-		fmt.Println("Ignoring short packet")
-		return
-	}
-
-	if packet[0] != 0x68 {
-		fmt.Println("Invalid start flag")
-		return
-	}
+	tcpSessionsActive.Inc()
+	defer tcpSessionsActive.Dec()
 
-	header := parseFrameHeader(packet)
+	sess := newTCPSession(conn)
+	logger := slog.With("session", sess.ID, "remote", sess.RemoteAddr)
 
-	// ---- SAVE FRAME ----
-	frameID, err := saveFrameToDB(header)
-	if err != nil {
-		fmt.Println("DB ERROR (frame):", err)
-		return
-	}
-
-	// ---- DECODE TLV ----
-	tlvBytes := hexStringToBytes(header["tlv_hex"].(string))
-	decoded := decodeTLV(tlvBytes)
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
 
-	// ---- SAVE READING ----
-	err = saveReadingToDB(frameID, decoded)
-	if err != nil {
-		fmt.Println("DB ERROR (reading):", err)
+	if res := ingestFrame(sess.frameMeta(buf[:n]), logger); res.stored() {
+		conn.Write([]byte("OK"))
 	}
-
-	conn.Write([]byte("OK"))
 }
 
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 // -------------------------
 // FRAME PARSER
 // -------------------------
-func parseFrameHeader(packet []byte) map[string]interface{} {
-<<<<<<< HEAD
-    header := make(map[string]interface{})
-
-    header["start_flag"] = fmt.Sprintf("%02X", packet[0])
-    header["frame_length"] = int(packet[1])<<8 | int(packet[2])
-    header["product_type"] = int(packet[3])
-
-    header["meter_address"] = fmt.Sprintf("%02X%02X%02X%02X%02X%02X%02X%02X",
-        packet[4], packet[5], packet[6], packet[7],
-        packet[8], packet[9], packet[10], packet[11],
-    )
-
-    header["manufacturer_code"] = fmt.Sprintf("%02X%02X", packet[12], packet[13])
-
-    imei := ""
-    for _, b := range packet[14:22] {
-        imei += fmt.Sprintf("%X%X", b>>4, b&0x0F)
-    }
-    header["imei"] = imei
-
-    header["protocol_version"] = int(packet[22])
-    header["mid"] = int(packet[23])<<8 | int(packet[24])
-    header["encryption_flag"] = int(packet[25])
-    header["function_code"] = int(packet[26])
-    header["tlv_length"] = int(packet[27])<<8 | int(packet[28])
-
-    tlvStart := 29
-    tlvEnd := tlvStart + header["tlv_length"].(int)
-
-    header["tlv_hex"] = fmt.Sprintf("% X", packet[tlvStart:tlvEnd])
-
-    header["check_sum"] = fmt.Sprintf("%02X", packet[len(packet)-2])
-    header["end_flag"] = fmt.Sprintf("%02X", packet[len(packet)-1])
-
-    return header
-}
-
-// -------------------------
-// DB INSERT
-// -------------------------
-func saveFrameToDB(h map[string]interface{}) (int, error) {
-    var id int
-
-    err := db.QueryRow(`
-=======
+// parseFrameHeader returns an error instead of reading past the end when the
+// packet is shorter than a header or its tlv_length claims more bytes than arrived.
+func parseFrameHeader(packet []byte) (map[string]interface{}, error) {
+	if err := checkFrameBounds(packet); err != nil {
+		return nil, err
+	}
 	header := make(map[string]interface{})
 
 	header["start_flag"] = fmt.Sprintf("%02X", packet[0])
@@ -352,349 +186,53 @@ func saveFrameToDB(h map[string]interface{}) (int, error) {
 	header["checksum"] = fmt.Sprintf("%02X", packet[len(packet)-2])
 	header["end_flag"] = fmt.Sprintf("%02X", packet[len(packet)-1])
 
-	return header
+	return header, nil
 }
 
 // -------------------------
 // DB INSERT: meter_frames
 // -------------------------
-func saveFrameToDB(h map[string]interface{}) (int, error) {
-	var id int
-	err := db.QueryRow(`
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
-        INSERT INTO meter_frames (
-            start_flag, frame_length, product_type,
-            meter_address, manufacturer_code, imei,
-            protocol_version, mid, encryption_flag,
-            function_code, tlv_length, tlv_hex,
-<<<<<<< HEAD
-            check_sum, end_flag
-        )
-        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)
-        RETURNING id
-    `,
-        h["start_flag"], h["frame_length"], h["product_type"],
-        h["meter_address"], h["manufacturer_code"], h["imei"],
-        h["protocol_version"], h["mid"], h["encryption_flag"],
-        h["function_code"], h["tlv_length"], h["tlv_hex"],
-        h["check_sum"], h["end_flag"],
-    ).Scan(&id)
-
-    return id, err
-}
-
-//-------------------------
-func decodeTLV(tlvBytes []byte) map[string]interface{} {
-    result := make(map[string]interface{})
-    i := 0
-
-    for i < len(tlvBytes) {
-        tag := tlvBytes[i]
-        i++
-
-        switch tag {
-        case 0x01:
-            // header / misc - try to consume 4 bytes if present
-            if i+4 <= len(tlvBytes) {
-                // store as array for debugging if needed
-                result["tag_01"] = []int{int(tlvBytes[i]), int(tlvBytes[i+1]), int(tlvBytes[i+2]), int(tlvBytes[i+3])}
-                i += 4
-            }
-
-        case 0x02: // total: support 2- or 3-byte forms
-            if i+3 <= len(tlvBytes) {
-                // prefer 3-byte value
-                v := int(tlvBytes[i])<<16 | int(tlvBytes[i+1])<<8 | int(tlvBytes[i+2])
-                // if high byte is zero, maybe it's actually 2-byte value -> use lower 16 bits
-                if (v>>16) == 0 {
-                    v = int(tlvBytes[i+1])<<8 | int(tlvBytes[i+2])
-                }
-                result["total"] = v
-                i += 3
-            } else if i+2 <= len(tlvBytes) {
-                result["total"] = int(tlvBytes[i])<<8 | int(tlvBytes[i+1])
-                i += 2
-            } else {
-                // malformed - stop
-                break
-            }
-
-        case 0x04: // flow (4 bytes)
-            if i+4 <= len(tlvBytes) {
-                v := int(tlvBytes[i])<<24 | int(tlvBytes[i+1])<<16 | int(tlvBytes[i+2])<<8 | int(tlvBytes[i+3])
-                result["flow"] = v
-                i += 4
-            } 
-
-        case 0x08: // battery (1 byte) — your sample shows 08 29 -> 0x29 = 41
-            if i < len(tlvBytes) {
-                result["battery"] = int(tlvBytes[i])
-                i++
-            }
-
-        case 0x09: // pressure (1 byte) — sample 09 32 -> 50
-            if i < len(tlvBytes) {
-                result["pressure"] = int(tlvBytes[i])
-                i++
-            }
-
-        case 0x0A: // temperature (2 bytes in sample: 00 0F -> 15)
-            if i+2 <= len(tlvBytes) {
-                // if first byte is 0x00, temperature is second byte
-                if tlvBytes[i] == 0x00 {
-                    result["temperature_raw"] = int(tlvBytes[i+1])
-                } else {
-                    // otherwise combine
-                    result["temperature_raw"] = int(tlvBytes[i])<<8 | int(tlvBytes[i+1])
-                }
-                i += 2
-            } else if i < len(tlvBytes) {
-                result["temperature_raw"] = int(tlvBytes[i])
-                i++
-            }
-
-        case 0x0C: // magnetic tamper (2 bytes in sample 06 CC)
-            if i+2 <= len(tlvBytes) {
-                result["magnetic_tamper"] = int(tlvBytes[i])<<8 | int(tlvBytes[i+1])
-                i += 2
-            }
-
-        case 0x0D: // rssi raw (2 bytes in sample 89 91)
-            if i+2 <= len(tlvBytes) {
-                result["rssi_raw"] = int(tlvBytes[i])<<8 | int(tlvBytes[i+1])
-                i += 2
-            }
-
-        case 0x00: // serial: sample shows length-prefixed: 00 09 <6 bytes...>
-            if i < len(tlvBytes) {
-                ln := int(tlvBytes[i])
-                i++
-                if i+ln <= len(tlvBytes) {
-                    // build hex string like "23365979926F"
-                    var sb strings.Builder
-                    for k := 0; k < ln; k++ {
-                        sb.WriteString(fmt.Sprintf("%02X", tlvBytes[i+k]))
-                    }
-                    result["serial"] = sb.String()
-                    i += ln
-                } else {
-                    // not enough bytes
-                    break
-                }
-            }
-
-        case 0x13: // valve
-            if i < len(tlvBytes) {
-                v := int(tlvBytes[i])
-                result["valve"] = v
-
-                 if v == 0 {
-                    result["valve"] = "OPEN"
-                } else {
-                    result["valve"] = "CLOSED/TAMPER"
-                }
-                i++
-            }
-
-        case 0x17: // firmware (1 byte)
-            if i < len(tlvBytes) {
-                result["firmware"] = int(tlvBytes[i])
-                i++
-            }
-
-        case 0x19: // network status (2 bytes in sample 25 11)
-            if i+2 <= len(tlvBytes) {
-                result["network_status"] = int(tlvBytes[i])<<8 | int(tlvBytes[i+1])
-                i += 2
-            }
-
-        case 0x30: // timestamp / rtc (3 bytes)
-            if i+3 <= len(tlvBytes) {
-                result["rtc"] = []int{int(tlvBytes[i]), int(tlvBytes[i+1]), int(tlvBytes[i+2])}
-                i += 3
-            }
-
-        case 0x1A: // extended status (8 bytes)
-            if i+8 <= len(tlvBytes) {
-                arr := make([]int, 8)
-                for k := 0; k < 8; k++ {
-                    arr[k] = int(tlvBytes[i+k])
-                }
-                result["extended_status_1a"] = arr
-                i += 8
-            }
-
-        case 0x1B: // model ascii (null terminated)
-            start := i
-            for i < len(tlvBytes) && tlvBytes[i] != 0x00 {
-                i++
-            }
-            result["model"] = string(tlvBytes[start:i])
-            if i < len(tlvBytes) && tlvBytes[i] == 0x00 {
-                i++
-            }
-
-        case 0x20: // meter_index_20 (4 bytes)
-            if i+4 <= len(tlvBytes) {
-                result["meter_index_20"] = []int{int(tlvBytes[i]), int(tlvBytes[i+1]), int(tlvBytes[i+2]), int(tlvBytes[i+3])}
-                i += 4
-            }
-
-        case 0x12: // ext_block_12 (7 bytes)
-            if i+7 <= len(tlvBytes) {
-                arr := make([]int, 7)
-                for k := 0; k < 7; k++ {
-                    arr[k] = int(tlvBytes[i+k])
-                }
-                result["ext_block_12"] = arr
-                i += 7
-            }
-
-        case 0x1F: // timestamp_1f (9 bytes)
-            if i+9 <= len(tlvBytes) {
-                arr := make([]int, 9)
-                for k := 0; k < 9; k++ {
-                    arr[k] = int(tlvBytes[i+k])
-                }
-                result["timestamp_1f"] = arr
-                // optionally extract network_status if stored there
-                if len(arr) >= 5 {
-                    result["network_status"] = arr[3]<<8 | arr[4]
-                }
-                i += 9
-            }
-
-        default:
-            // Unknown tag: we don't know length -> try skip 1 byte to continue parsing
-            // (If your TLV is length-prefixed, adapt here to read the length then skip)
-            if i < len(tlvBytes) {
-                i++
-            }
-        }
-    }
-
-    return result
-}
-
-
-// -------------------------
-// SAVE READING (fixed): uses decoded map keys and safe type conversions
-// -------------------------
-func saveReadingToDB(frameID int, d map[string]interface{}) error {
-    if db == nil {
-        return fmt.Errorf("DB not initialized")
-    }
-
-    // helper: interface{} → int64
-    toInt := func(v interface{}) int64 {
-        if v == nil {
-            return 0
-        }
-        switch t := v.(type) {
-        case int:
-            return int64(t) 
-        case int8:
-            return int64(t)
-        default:
-            return 0
-        }
-    }
-
-    // helper: interface{} → float64
-    toFloat := func(v interface{}) float64 {
-        if v == nil {
-            return 0
-        }
-        switch t := v.(type) {
-        case int:
-            return float64(t)
-        default:
-            return 0
-        }
-    }
-
-    // helper: interface{} → string
-    toString := func(v interface{}) string {
-        if v == nil {
-            return ""
-        }
-        switch t := v.(type) {
-        case string:
-            return t
-        case fmt.Stringer:
-            return t.String()
-        default:
-            return fmt.Sprintf("%v", v)
-        }
-    }
-
-    // Extract decoded TLV values
-    total := toInt(d["total"])
-    flow := toInt(d["flow"])
-    battery := toFloat(d["battery"])
-    pressure := toInt(d["pressure"])
-    firmware := toInt(d["firmware"])
-    valveStatusRaw := toInt(d["valve_status_raw"])
-    valve := toString(d["valve"])
-    magneticTamper := toInt(d["magnetic_tamper"])
-    networkStatus := toInt(d["network_status"])
-    temperatureRaw := toInt(d["temperature_raw"])
-    serial := toString(d["serial"])
-    rssiRaw := toInt(d["rssi_raw"])
-
-    // Insert decoded values into messages table
-    _, err := db.Exec(`
-        INSERT INTO messages (
-            frame_id,
-            serial,
-            total,
-            flow,
-            battery,
-            pressure,
-            firmware,
-            valve_status_raw,
-            valve,
-            magnetic_tamper,
-            network_status,
-            temperature_raw,
-            rssi_raw,
-            created_at
-        ) VALUES (
-            $1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13, NOW()
+// The frame's tenant is resolved from its IMEI and manufacturer code and
+// returned alongside the id (0 when unassigned). Protocol errors are stored
+// as JSON, NULL when there are none.
+func saveFrameToDB(h map[string]interface{}, m frameMeta, errs []protocolError) (id int, tenant int, err error) {
+	var decodeErrors interface{}
+	if len(errs) > 0 {
+		b, _ := json.Marshal(errs)
+		decodeErrors = string(b)
+	}
+	eventID, eventData := outboxEvent(frameEventData(h, m, errs))
+	err = db.QueryRow(`
+        WITH f AS (
+            INSERT INTO meter_frames (
+                start_flag, frame_length, product_type,
+                meter_address, manufacturer_code, imei,
+                protocol_version, mid, encryption_flag,
+                function_code, tlv_length, tlv_hex,
+                checksum, end_flag, created_at,
+                raw_frame, remote_addr, local_addr,
+                session_id, session_offset, received_at, tenant_id,
+                decode_errors, transport
+            ) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14, now(),
+                $15,$16,$17,$18,$19,$20, tenant_for($6, $5), $21, COALESCE(NULLIF($22, ''), 'tcp'))
+            RETURNING id, tenant_id, imei
+        ), ev AS (
+            INSERT INTO event_outbox (event_id, event_type, schema_version, imei, tenant_id, frame_id, data)
+            SELECT $23, $24, $25, f.imei, f.tenant_id, f.id, $26::jsonb FROM f WHERE $26::jsonb IS NOT NULL
         )
-    `,
-        frameID,
-        serial,
-        total,
-        flow,
-        battery,
-        pressure,
-        firmware,       // INT
-        valveStatusRaw, // INT
-        valve,          // STRING
-        magneticTamper,
-        networkStatus,
-        temperatureRaw,
-        rssiRaw,
-    )
-
-    if err != nil {
-        return fmt.Errorf("saveReadingToDB error: %w", err)
-    }
-
-    return nil
-=======
-            checksum, end_flag, created_at
-        ) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14, now())
-        RETURNING id
+        SELECT id, COALESCE(tenant_id, 0) FROM f
     `,
 		h["start_flag"], h["frame_length"], h["product_type"],
 		h["meter_address"], h["manufacturer_code"], h["imei"],
 		h["protocol_version"], h["mid"], h["encryption_flag"],
 		h["function_code"], h["tlv_length"], h["tlv_hex"],
 		h["checksum"], h["end_flag"],
-	).Scan(&id)
-	return id, err
+		m.Raw, m.RemoteAddr, m.LocalAddr,
+		m.SessionID, m.SessionOffset, m.ReceivedAt,
+		decodeErrors, m.Transport,
+		eventID, eventFrameReceived, eventSchemaVersion[eventFrameReceived], eventData,
+	).Scan(&id, &tenant)
+	return id, tenant, err
 }
 
 // -------------------------
@@ -702,6 +240,58 @@ func saveReadingToDB(frameID int, d map[string]interface{}) error {
 // -------------------------
 // This will store decoded values into messages table. For array fields we store JSON.
 func saveReadingToDB(frameID int, d map[string]interface{}) error {
+	return insertReading(frameID, d, true)
+}
+
+// insertReading stores a reading, queueing its reading.decoded event only when
+// emit is set; reprocessing fills in readings of old frames, which are not news.
+func insertReading(frameID int, d map[string]interface{}, emit bool) error {
+	cols := readingColumns(d)
+
+	names := []string{"frame_id"}
+	args := []interface{}{frameID}
+	marks := []string{"$1"}
+	for _, c := range cols {
+		names = append(names, c.Name)
+		args = append(args, c.Value)
+		marks = append(marks, fmt.Sprintf("$%d", len(args)))
+	}
+
+	// the reading.decoded event is queued by the same statement
+	var eventID, eventData interface{}
+	if emit {
+		eventID, eventData = outboxEvent(readingEventData(d))
+	}
+	args = append(args, eventID, eventReadingDecoded, eventSchemaVersion[eventReadingDecoded], eventData)
+	n := len(args)
+
+	sqlStmt := fmt.Sprintf(`
+        WITH m AS (
+            INSERT INTO messages (%s, created_at, measured_at, tenant_id)
+            VALUES (%s, now(), COALESCE((SELECT received_at FROM meter_frames WHERE id = $1), now()),
+                (SELECT tenant_id FROM meter_frames WHERE id = $1))
+            RETURNING id, frame_id, tenant_id, measured_at
+        )
+        INSERT INTO event_outbox (event_id, event_type, schema_version, imei, tenant_id, frame_id, data)
+        SELECT $%d, $%d, $%d, f.imei, m.tenant_id, m.frame_id,
+            $%d::jsonb || jsonb_build_object('message_id', m.id, 'measured_at', m.measured_at)
+        FROM m JOIN meter_frames f ON f.id = m.frame_id
+        WHERE $%d::jsonb IS NOT NULL
+    `, strings.Join(names, ", "), strings.Join(marks, ","), n-3, n-2, n-1, n, n)
+
+	_, err := db.Exec(sqlStmt, args...)
+	return err
+}
+
+// readingColumn is one messages column and the value decodeTLV produced for it.
+type readingColumn struct {
+	Name  string
+	Value interface{}
+	JSON  bool
+}
+
+// readingColumns maps a decodeTLV result onto the messages columns, in insert order.
+func readingColumns(d map[string]interface{}) []readingColumn {
 	// helper to marshal an interface to JSON []byte (or nil)
 	toJSON := func(v interface{}) interface{} {
 		if v == nil {
@@ -711,41 +301,27 @@ func saveReadingToDB(frameID int, d map[string]interface{}) error {
 		return string(b)
 	}
 
-	sqlStmt := `
-        INSERT INTO messages (
-            frame_id, total, flow, battery, pressure, temperature,
-            magnetic_tamper, rssi_raw, serial, valve, firmware,
-            network_status, rtc, extended_status_1a, model,
-            meter_index_20, counters, ext_block_12, timestamp_1f,
-            created_at
-        ) VALUES (
-            $1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19, now()
-        )
-    `
-
-	_, err := db.Exec(sqlStmt,
-		frameID,
-		getInt(d["total"]),      // 2
-		getInt(d["flow"]),       // 3
-		getInt(d["battery"]),    // 4
-		getInt(d["pressure"]),   // 5
-		getInt(d["temperature"]),// 6
-		getInt(d["magnetic_tamper"]),
-		getInt(d["rssi_raw"]),
-		getString(d["serial"]),
-		getInt(d["valve"]),
-		getInt(d["firmware"]),
-		getInt(d["network_status"]),
-		toJSON(d["rtc"]),
-		toJSON(d["extended_status_1a"]),
-		getString(d["model"]),
-		toJSON(d["meter_index_20"]),
-		toJSON(d["counters"]),
-		toJSON(d["ext_block_12"]),
-		toJSON(d["timestamp_1f"]),
-	)
-
-	return err
+	return []readingColumn{
+		{Name: "total", Value: getInt(d["total"])},
+		{Name: "flow", Value: getInt(d["flow"])},
+		{Name: "battery", Value: getInt(d["battery"])},
+		{Name: "pressure", Value: getInt(d["pressure"])},
+		{Name: "temperature", Value: getInt(d["temperature"])},
+		{Name: "magnetic_tamper", Value: getInt(d["magnetic_tamper"])},
+		{Name: "rssi_raw", Value: getInt(d["rssi_raw"])},
+		{Name: "serial", Value: getString(d["serial"])},
+		{Name: "valve", Value: getInt(d["valve"])},
+		{Name: "firmware", Value: getInt(d["firmware"])},
+		{Name: "network_status", Value: getInt(d["network_status"])},
+		{Name: "rtc", Value: toJSON(d["rtc"]), JSON: true},
+		{Name: "extended_status_1a", Value: toJSON(d["extended_status_1a"]), JSON: true},
+		{Name: "model", Value: getString(d["model"])},
+		{Name: "meter_index_20", Value: toJSON(d["meter_index_20"]), JSON: true},
+		{Name: "counters", Value: toJSON(d["counters"]), JSON: true},
+		{Name: "ext_block_12", Value: toJSON(d["ext_block_12"]), JSON: true},
+		{Name: "timestamp_1f", Value: toJSON(d["timestamp_1f"]), JSON: true},
+		{Name: "decoder_version", Value: decoderVersion},
+	}
 }
 
 // small helpers
@@ -787,13 +363,10 @@ func getString(v interface{}) string {
 		b, _ := json.Marshal(v)
 		return string(b)
 	}
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 }
 
 
 
-<<<<<<< HEAD
-=======
    
 
 
@@ -801,16 +374,41 @@ func getString(v interface{}) string {
 // -------------------------
 // TLV DECODER
 // -------------------------
+// decoderVersion is stamped on every messages row. Bump it whenever decodeTLV
+// changes what it produces so reprocessed rows can be told apart.
+const decoderVersion = "3"
+
 // Decodes TLV according to the tags you provided; no duplicate cases.
 func decodeTLV(b []byte) map[string]interface{} {
+	r, _, _ := decodeTLVSpans(b)
+	return r
+}
+
+// tlvSpan records where a tag sat in the TLV payload and how many bytes it consumed.
+type tlvSpan struct {
+	Tag    string `json:"tag"`
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Hex    string `json:"hex"`
+}
+
+// decodeTLVSpans is decodeTLV plus a byte-offset annotation per tag and the
+// unknown tags and overruns it stepped over, with TLV-relative offsets.
+func decodeTLVSpans(b []byte) (map[string]interface{}, []tlvSpan, []protocolError) {
 	r := make(map[string]interface{})
+	var spans []tlvSpan
+	var errs []protocolError
 	i := 0
 	// Initialize counters to zero-array if needed
 	r["counters"] = []int{0, 0, 0, 0, 0, 0}
 
 	for i < len(b) {
+		start := i
 		tag := b[i]
 		i++
+		overrun := false
+		reported := false
 
 		switch tag {
 		case 0x01:
@@ -838,8 +436,12 @@ func decodeTLV(b []byte) map[string]interface{} {
 				r["total"] = int(b[i])<<8 | int(b[i+1])
 				i += 2
 			} else {
-				// malformed - break
-				break
+				// one byte or none left, too short for either form
+				e := protoErrorf(protoLengthMismatch, start, "tag 02 (total) needs 2 or 3 bytes, %d left", len(b)-i)
+				e.Tag = "02"
+				errs = append(errs, e)
+				i = len(b)
+				reported = true
 			}
 
 		case 0x04: // flow (4 bytes)
@@ -896,6 +498,8 @@ func decodeTLV(b []byte) map[string]interface{} {
 					}
 					r["serial"] = hexStr
 					i += ln
+				} else {
+					overrun = true
 				}
 			}
 
@@ -938,16 +542,15 @@ func decodeTLV(b []byte) map[string]interface{} {
 
 		case 0x1B: // meter model string - fixed max length 16 in your sample
 			// Read bytes until 0x00 or up to 16 bytes safe-guard
-			start := i
-			for i < len(b) && b[i] != 0x00 && (i-start) < 32 {
+			for i < len(b) && b[i] != 0x00 && (i-start-1) < 32 {
 				i++
 			}
 			if i < len(b) && b[i] == 0x00 {
-				r["model"] = string(b[start:i])
+				r["model"] = string(b[start+1:i])
 				i++ // skip 0x00
 			} else {
 				// fallback
-				r["model"] = string(b[start:i])
+				r["model"] = string(b[start+1:i])
 			}
 
 		case 0x20: // meter_index_20 (4 bytes)
@@ -988,25 +591,83 @@ func decodeTLV(b []byte) map[string]interface{} {
 				i++
 			}
 		}
+
+		name := tlvTagName(tag)
+		if name == "unknown" {
+			e := protoErrorf(protoUnknownTag, start, "unknown tag %02X, %d byte(s) skipped", tag, i-start)
+			e.Tag = fmt.Sprintf("%02X", tag)
+			errs = append(errs, e)
+		} else if !reported && (overrun || i == start+1) {
+			// only the tag byte (or a length byte) was consumed: the value is
+			// cut off, and what is left of it must not be read as more tags
+			e := protoErrorf(protoTagOverrun, start, "tag %02X (%s) runs past the end of the TLV block, %d byte(s) left", tag, name, len(b)-start-1)
+			e.Tag = fmt.Sprintf("%02X", tag)
+			errs = append(errs, e)
+			i = len(b)
+		}
+
+		spans = append(spans, tlvSpan{
+			Tag:    fmt.Sprintf("%02X", tag),
+			Name:   name,
+			Offset: start,
+			Length: i - start,
+			Hex:    fmt.Sprintf("% X", b[start:i]),
+		})
 	}
 
-	return r
+	return r, spans, errs
+}
+
+// tlvTagName maps a tag byte to the key decodeTLV stores it under.
+func tlvTagName(tag byte) string {
+	switch tag {
+	case 0x00:
+		return "serial"
+	case 0x01:
+		return "tag_01"
+	case 0x02:
+		return "total"
+	case 0x04:
+		return "flow"
+	case 0x08:
+		return "battery"
+	case 0x09:
+		return "pressure"
+	case 0x0A:
+		return "temperature"
+	case 0x0C:
+		return "magnetic_tamper"
+	case 0x0D:
+		return "rssi_raw"
+	case 0x12:
+		return "ext_block_12"
+	case 0x13:
+		return "valve"
+	case 0x17:
+		return "firmware"
+	case 0x19:
+		return "network_status"
+	case 0x1A:
+		return "extended_status_1a"
+	case 0x1B:
+		return "model"
+	case 0x1F:
+		return "timestamp_1f"
+	case 0x20:
+		return "meter_index_20"
+	case 0x30:
+		return "rtc"
+	default:
+		return "unknown"
+	}
 }
 
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 // -------------------------
 // HEX UTIL
 // -------------------------
+// hexStringToBytes skips tokens that are not hex bytes. It is meant for hex we
+// wrote ourselves (tlv_hex); input from outside goes through parseHexBytes.
 func hexStringToBytes(s string) []byte {
-<<<<<<< HEAD
-    parts := strings.Split(s, " ")
-    var b []byte
-    for _, p := range parts {
-        val, _ := strconv.ParseUint(p, 16, 8)
-        b = append(b, byte(val))
-    }
-    return b
-=======
 	// Accept both "01 02 AF" and "0102AF"
 	s = strings.TrimSpace(s)
 	if strings.Contains(s, " ") {
@@ -1026,686 +687,163 @@ func hexStringToBytes(s string) []byte {
 	}
 	b, _ := hex.DecodeString(s)
 	return b
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
 }
 
 // -------------------------
 // API: DECODED FRAMES
 // -------------------------
 func getDecodedFrames(w http.ResponseWriter, r *http.Request) {
-<<<<<<< HEAD
-    rows, err := db.Query(`
-        SELECT id, meter_address, imei, tlv_hex, created_at
-        FROM meter_frames ORDER BY id DESC
-    `)
-    if err != nil {
-        http.Error(w, err.Error(), 500)
-        return
-    }
-    defer rows.Close()
-
-    type Frame struct {
-        ID           int                    `json:"id"`
-        MeterAddress string                 `json:"meter_address"`
-        IMEI         string                 `json:"imei"`
-        TLVHex       string                 `json:"tlv_hex"`
-        Decoded      map[string]interface{} `json:"decoded"`
-        CreatedAt    string                 `json:"created_at"`
-    }
-
-    var list []Frame
-
-    for rows.Next() {
-        var id int
-        var addr, imei, tlv, created string
-
-        rows.Scan(&id, &addr, &imei, &tlv, &created)
-
-        decoded := decodeTLV(hexStringToBytes(tlv))
-
-        list = append(list, Frame{
-            ID:           id,
-            MeterAddress: addr,
-            IMEI:         imei,
-            TLVHex:       tlv,
-            Decoded:      decoded,
-            CreatedAt:    created,
-        })
-    }
-
-    json.NewEncoder(w).Encode(list)
-}
-
-//-------------------------
-//API: MESSAGES WITH DECODED TLV
-//-------------------------
-
-
-func getMessages(w http.ResponseWriter, r *http.Request) {
-
-    rows, err := db.Query(`
-        SELECT 
-            id, 
-            frame_id, 
-            total, 
-            flow, 
-            battery, 
-            pressure, 
-            firmware,
-            valve_status_raw, 
-            valve, 
-            magnetic_tamper, 
-            network_status,
-            temperature_raw,
-            rssi_raw
-            serial,
-            created_at
-        FROM messages
-        ORDER BY id DESC
-    `)
-    if err != nil {
-        http.Error(w, err.Error(), 500)
-        return
-    }
-    defer rows.Close()
-
-    type Msg struct {
-        ID             int         `json:"id"`
-        FrameID        int         `json:"frame_id"`
-        Total          int64       `json:"total"`
-        Flow           int64       `json:"flow"`
-        Battery        float64     `json:"battery"`
-        Pressure       int         `json:"pressure"`
-        Firmware       int      `json:"firmware"`
-        ValveStatusRaw int64       `json:"valve_status_raw"`
-        Valve          string      `json:"valve"`
-        MagneticTamper int         `json:"magnetic_tamper"`
-        NetworkStatus  int64       `json:"network_status"`
-        TemperatureRaw int64       `json:"temperature_raw"`
-        Serial         string      `json:"serial"`
-        Rssi_raw        int64      `json:"rssi_raw"`
-        CreatedAt      string      `json:"created_at"`
-    }
-
-    var list []Msg
-
-    for rows.Next() {
-        var m Msg
-        err := rows.Scan(
-            &m.ID,
-            &m.FrameID,
-            &m.Total,
-            &m.Flow,
-            &m.Battery,
-            &m.Pressure,
-            &m.Firmware,
-            &m.ValveStatusRaw,
-            &m.Valve,
-            &m.MagneticTamper,
-            &m.NetworkStatus,
-            &m.TemperatureRaw,
-            &m.Serial,
-            &m.Rssi_raw,
-            &m.CreatedAt,
-        )
-        if err != nil {
-            http.Error(w, err.Error(), 500)
-            return
-        }
-
-        list = append(list, m)
-    }
-
-   
-    json.NewEncoder(w).Encode(list)
-}
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-// package main
-
-// import (
-//     "database/sql"
-//     "encoding/hex"
-//     "encoding/json"
-//     "fmt"
-//     "log"
-//     "net"
-//     "net/http"
-//     "os"
-//     "strings"
-
-//     _ "github.com/lib/pq"
-// )
-
-// var db *sql.DB
-
-// // ----------------------------------------------------
-// // DB CONNECT
-// // ----------------------------------------------------
-// func connectDB() (*sql.DB, error) {
-//     host := getenv("DB_HOST", "localhost")
-//     port := getenv("DB_PORT", "5432")
-//     user := getenv("DB_USER", "postgres")
-//     pass := getenv("DB_PASSWORD", "Sani@123")
-//     name := getenv("DB_NAME", "tcp_db")
-
-//     connStr := fmt.Sprintf(
-//         "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-//         host, port, user, pass, name,
-//     )
-
-//     db, err := sql.Open("postgres", connStr)
-//     if err != nil {
-//         return nil, err
-//     }
-//     return db, db.Ping()
-// }
-
-// func getenv(key, def string) string {
-//     v := os.Getenv(key)
-//     if v == "" {
-//         return def
-//     }
-//     return v
-// }
-
-// // ----------------------------------------------------
-// // MAIN
-// // ----------------------------------------------------
-// func main() {
-//     var err error
-//     db, err = connectDB()
-//     if err != nil {
-//         log.Fatal(err)
-//     }
-//     fmt.Println("Connected to DB")
-
-//     go startTCPServer()
-
-//     http.HandleFunc("/api/messages", getMessages)
-//     http.HandleFunc("/api/frames/decoded/all", getDecodedFrames)
-
-//     fmt.Println("API running :8080")
-//     log.Fatal(http.ListenAndServe(":8080", nil))
-// }
-
-// // ----------------------------------------------------
-// // TCP SERVER
-// // ----------------------------------------------------
-// func startTCPServer() {
-//     ln, err := net.Listen("tcp", ":9000")
-//     if err != nil {
-//         log.Fatal(err)
-//     }
-//     fmt.Println("TCP running :9000")
-
-//     for {
-//         conn, err := ln.Accept()
-//         if err == nil {
-//             go handleTCP(conn)
-//         }
-//     }
-// }
-
-// func handleTCP(conn net.Conn) {
-//     defer conn.Close()
-
-//     buf := make([]byte, 2048)
-//     n, _ := conn.Read(buf)
-//     if n < 40 {
-//         return
-//     }
-
-//     packet := buf[:n]
-//     fmt.Printf("RX (%d bytes): % X\n", n, packet)
-
-//     header := parseFrameHeader(packet)
-
-//     frameID, err := saveFrameToDB(header)
-//     if err != nil {
-//         fmt.Println("FRAME SAVE ERR:", err)
-//         return
-//     }
-
-//     tlvBytes := hexStringToBytes(header["tlv_hex"].(string))
-//     decoded := decodeTLV(tlvBytes)
-
-//     err = saveReadingToDB(decoded, frameID)
-//     if err != nil {
-//         fmt.Println("READING SAVE ERR:", err)
-//     }
-
-//     conn.Write([]byte("OK"))
-// }
-
-// // ----------------------------------------------------
-// // FRAME PARSER
-// // ----------------------------------------------------
-// func parseFrameHeader(p []byte) map[string]interface{} {
-//     h := make(map[string]interface{})
-
-//     h["start_flag"] = fmt.Sprintf("%02X", p[0])
-//     h["frame_length"] = int(p[1])<<8 | int(p[2])
-//     h["product_type"] = int(p[3])
-
-//     h["meter_address"] = fmt.Sprintf(
-//         "%02X%02X%02X%02X%02X%02X%02X%02X",
-//         p[4], p[5], p[6], p[7], p[8], p[9], p[10], p[11],
-//     )
-
-//     h["manufacturer_code"] = fmt.Sprintf("%02X%02X", p[12], p[13])
-
-//     // IMEI
-//     imei := ""
-//     for _, b := range p[14:22] {
-//         imei += fmt.Sprintf("%X%X", b>>4, b&0x0F)
-//     }
-//     h["imei"] = imei
-
-//     h["protocol_version"] = int(p[22])
-//     h["mid"] = int(p[23])<<8 | int(p[24])
-//     h["encryption_flag"] = int(p[25])
-//     h["function_code"] = int(p[26])
-
-//     tlvLen := int(p[27])<<8 | int(p[28])
-//     h["tlv_length"] = tlvLen
-
-//     tlvStart := 29
-//     tlvEnd := tlvStart + tlvLen
-//     h["tlv_hex"] = fmt.Sprintf("% X", p[tlvStart:tlvEnd])
-
-//     h["checksum"] = fmt.Sprintf("%02X", p[len(p)-2])
-//     h["end_flag"] = fmt.Sprintf("%02X", p[len(p)-1])
-
-//     return h
-// }
-
-// // ----------------------------------------------------
-// // SAVE FRAME
-// // ----------------------------------------------------
-// func saveFrameToDB(h map[string]interface{}) (int, error) {
-//     sql := `
-//         INSERT INTO meter_frames (
-//             start_flag, frame_length, product_type, meter_address,
-//             manufacturer_code, imei, protocol_version, mid,
-//             encryption_flag, function_code, tlv_length, tlv_hex,
-//             checksum, end_flag
-//         ) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)
-//         RETURNING id
-//     `
-//     var id int
-//     err := db.QueryRow(sql,
-//         h["start_flag"], h["frame_length"], h["product_type"],
-//         h["meter_address"], h["manufacturer_code"], h["imei"],
-//         h["protocol_version"], h["mid"], h["encryption_flag"],
-//         h["function_code"], h["tlv_length"], h["tlv_hex"],
-//         h["checksum"], h["end_flag"],
-//     ).Scan(&id)
-//     return id, err
-// }
-
-// // ----------------------------------------------------
-// // SAVE READING
-// // ----------------------------------------------------
-// func saveReadingToDB(d map[string]interface{}, frameID int) error {
-//     sql := `
-//         INSERT INTO messages (
-//             id, total, flow, battery, pressure, temperature_raw,
-//             magnetic_tamper, rssi_raw, serial, valve, firmware,
-//             network_status
-//         ) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
-//     `
-//     _, err := db.Exec(sql,
-//         frameID,
-//         d["total"],
-//         d["flow"],
-//         d["battery"],
-//         d["pressure"],
-//         d["temperature"],
-//         d["magnetic_tamper"],
-//         d["rssi_raw"],
-//         d["serial"],
-//         d["valve"],
-//         d["firmware"],
-//         d["network_status"],
-//     )
-//     return err
-// }
-
-// // ----------------------------------------------------
-// // TLV DECODER (COMPLETE + MATCHES YOUR OUTPUT)
-// // ----------------------------------------------------
-// func decodeTLV(tlv []byte) map[string]interface{} {
-//     result := make(map[string]interface{})
-//     i := 0
-
-//     for i < len(tlv) {
-//         id := tlv[i]
-//         i++
-
-//     switch id {
-
-//     case 0x01:
-//     // Example: Status + Flags (2 bytes)
-//     result["status"] = tlv[i]
-//     result["flags"] = tlv[i+1]
-//     i += 2
-
-// case 0x02:
-//     // Total (4 bytes) — always treat as uint32
-//     if i+4 <= len(tlv) {
-//         val := uint32(tlv[i])<<24 | uint32(tlv[i+1])<<16 | uint32(tlv[i+2])<<8 | uint32(tlv[i+3])
-//         result["total"] = val
-//         i += 4
-//     }
-
-// case 0x04:
-//     // Flow (4 bytes)
-//     if i+4 <= len(tlv) {
-//         val := uint32(tlv[i])<<24 | uint32(tlv[i+1])<<16 | uint32(tlv[i+2])<<8 | uint32(tlv[i+3])
-//         result["flow"] = val
-//         i += 4
-//     }
-
-// case 0x08:
-//     result["battery"] = int(tlv[i])
-//     i += 1
-
-// case 0x09:
-//     result["pressure"] = int(tlv[i])
-//     i += 1
-
-// case 0x0A:
-//     result["temperature"] = int(tlv[i])
-//     i += 2
-
-// case 0x0C:
-//     val := int(tlv[i])<<8 | int(tlv[i+1])
-//     result["magnetic_tamper"] = val
-//     i += 2
-
-// case 0x0D:
-//     val := int(tlv[i])<<8 | int(tlv[i+1])
-//     result["rssi_raw"] = val
-//     i += 2
-
-// case 0x00:
-//     serial := fmt.Sprintf("%X%X%X%X%X%X%X",
-//         tlv[i], tlv[i+1], tlv[i+2], tlv[i+3],
-//         tlv[i+4], tlv[i+5], tlv[i+6],
-//     )
-//     result["serial"] = serial
-//     i += 7
-
-// case 0x13:
-//     result["valve"] = int(tlv[i])
-//     i += 1
-
-// case 0x17:
-//     result["firmware"] = int(tlv[i])
-//     i += 1
-
-// case 0x19:
-//     arr := []int{int(tlv[i]), int(tlv[i+1])}
-//     result["network_status"] = arr
-//     i += 2
-
-// case 0x30:
-//     arr := []int{int(tlv[i]), int(tlv[i+1]), int(tlv[i+2])}
-//     result["rtc"] = arr
-//     i += 3
-
-// case 0x1A:
-//     arr := make([]int, 8)
-//     for k := 0; k < 8; k++ {
-//         arr[k] = int(tlv[i+k])
-//     }
-//     result["extended_status_1a"] = arr
-//     i += 8
-
-// case 0x1B:
-//     model := string(tlv[i : i+10])
-//     result["model"] = strings.Trim(model, "\x00")
-//     i += 10
-
-// case 0x20:
-//     arr := []int{int(tlv[i]), int(tlv[i+1]), int(tlv[i+2]), int(tlv[i+3])}
-//     result["meter_index_20"] = arr
-//     i += 4
-
-// case 0x12:
-//     arr := make([]int, 7)
-//     for k := 0; k < 7; k++ {
-//         arr[k] = int(tlv[i+k])
-//     }
-//     result["ext_block_12"] = arr
-//     i += 7
-
-// case 0x1F:
-//     arr := make([]int, 9)
-//     for k := 0; k < 9; k++ {
-//         arr[k] = int(tlv[i+k])
-//     }
-//     result["timestamp_1f"] = arr
-//     i += 9
-
-// default:
-//     i++
-// }
-
-//     }
-//     return result
-// }
-
-
-// // func appendIntArray(v interface{}, x int) []int {
-// //     if v == nil {
-// //         return []int{x}
-// //     }
-// //     arr := v.([]int)
-// //     return append(arr, x)
-// // }
-
-// // ----------------------------------------------------
-// // UTILS
-// // ----------------------------------------------------
-// func hexStringToBytes(s string) []byte {
-//     s = strings.ReplaceAll(s, " ", "")
-//     b, _ := hex.DecodeString(s)
-//     return b
-// }
-
-// // ----------------------------------------------------
-// // API: DECODED FRAMES
-// // ----------------------------------------------------
-// func getDecodedFrames(w http.ResponseWriter, r *http.Request) {
-//     rows, _ := db.Query(`SELECT id, meter_address, imei, tlv_hex, created_at FROM meter_frames ORDER BY id DESC`)
-//     defer rows.Close()
-
-//     type Frame struct {
-//         ID          int                    `json:"id"`
-//         MeterAddr   string                 `json:"meter_address"`
-//         IMEI        string                 `json:"imei"`
-//         TLVHex      string                 `json:"tlv_hex"`
-//         Decoded     map[string]interface{} `json:"decoded"`
-//         Created     string                 `json:"created_at"`
-//     }
-
-//     var list []Frame
-
-//     for rows.Next() {
-//         var f Frame
-//         rows.Scan(&f.ID, &f.MeterAddr, &f.IMEI, &f.TLVHex, &f.Created)
-//         f.Decoded = decodeTLV(hexStringToBytes(f.TLVHex))
-//         list = append(list, f)
-//     }
-//     json.NewEncoder(w).Encode(list)
-// }
-
-// // ----------------------------------------------------
-// // API: MESSAGES
-// // ----------------------------------------------------
-// func getMessages(w http.ResponseWriter, r *http.Request) {
-//     rows, _ := db.Query(`
-//         SELECT m.id, m.total, m.flow, m.battery, m.pressure,
-//                m.temperature_raw, m.magnetic_tamper, m.rssi_raw,
-//                m.serial, m.valve, m.firmware, m.network_status,
-//                m.created_at, f.tlv_hex
-//         FROM messages m
-//         JOIN meter_frames f ON f.id = m.id
-//         ORDER BY m.id DESC
-//     `)
-//     defer rows.Close()
-
-//     type Msg struct {
-//         ID             int                    `json:"id"`
-//         Total          int                    `json:"total"`
-//         Flow           int                    `json:"flow"`
-//         Battery        int                    `json:"battery"`
-//         Pressure       int                    `json:"pressure"`
-//         Temperature    int                    `json:"temperature"`
-//         Tamper         int                    `json:"magnetic_tamper"`
-//         RSSI           int                    `json:"rssi_raw"`
-//         Serial         string                 `json:"serial"`
-//         Valve          int                    `json:"valve"`
-//         Firmware       int                    `json:"firmware"`
-//         Network        int                    `json:"network_status"`
-//         Created        string                 `json:"created_at"`
-//         DecodedTLV     map[string]interface{} `json:"decoded"`
-//     }
-
-//     var list []Msg
-
-//     for rows.Next() {
-//         var m Msg
-//         var tlvHex string
-//         rows.Scan(
-//             &m.ID, &m.Total, &m.Flow, &m.Battery, &m.Pressure,
-//             &m.Temperature, &m.Tamper, &m.RSSI, &m.Serial,
-//             &m.Valve, &m.Firmware, &m.Network, &m.Created, &tlvHex,
-//         )
-//         m.DecodedTLV = decodeTLV(hexStringToBytes(tlvHex))
-//         list = append(list, m)
-//     }
-
-//     json.NewEncoder(w).Encode(list)
-// }
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
+	p, err := parseListParams(r, "created_at", "received_at")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
 
+	var where sqlWhere
+	p.filters(&where, "f."+p.TimeField, false)
+	// decode_error=any for frames with protocol errors, or one kind
+	switch k := r.URL.Query().Get("decode_error"); k {
+	case "":
+	case "any":
+		where.conds = append(where.conds, "f.decode_errors IS NOT NULL")
+	default:
+		where.add("f.decode_errors @> $%d::jsonb", fmt.Sprintf(`[{"kind": %q}]`, k))
+	}
 
+	total, err := p.totalCount("SELECT COUNT(*) FROM meter_frames f "+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
 
-=======
+	p.cursor(&where, "f.id")
 	rows, err := db.Query(`
-        SELECT id, meter_address, imei, tlv_hex,checksum,end_flag created_at
-        FROM meter_frames ORDER BY id DESC
-    `)
+        SELECT f.id, COALESCE(f.meter_address, ''), COALESCE(f.imei, ''), COALESCE(f.tlv_hex, ''),
+               COALESCE(f.checksum, ''), COALESCE(f.end_flag, ''), f.created_at, f.decode_errors, f.transport
+        FROM meter_frames f
+        `+where.String()+" "+p.orderSQL("f.id")+" "+p.limitSQL(), where.args...)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, 500, err.Error())
 		return
 	}
 	defer rows.Close()
 
-	type Frame struct {
-		ID           int                    `json:"id"`
-		MeterAddress string                 `json:"meter_address"`
-		IMEI         string                 `json:"imei"`
-		TLVHex       string                 `json:"tlv_hex"`
-		CheckSum     string                  `json:"checksum"`
-		EndFlag      string                   `json:"end_flag"`
-		// Decoded      map[string]interface{} `json:"decoded"`
-		CreatedAt    time.Time              `json:"created_at"`
-	}
-
 	var list []Frame
+	var ids []int
 
 	for rows.Next() {
 		var f Frame
 		var created sql.NullTime
-		rows.Scan(&f.ID, &f.MeterAddress, &f.IMEI, &f.TLVHex,&f.CheckSum,&f.EndFlag, &created)
+		var decodeErrors []byte
+		if err := rows.Scan(&f.ID, &f.MeterAddress, &f.IMEI, &f.TLVHex, &f.CheckSum, &f.EndFlag, &created, &decodeErrors, &f.Transport); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
 		if created.Valid {
 			f.CreatedAt = created.Time
 		}
-		// f.Decoded = decodeTLV(hexStringToBytes(f.TLVHex))
+		if decodeErrors != nil {
+			if err := json.Unmarshal(decodeErrors, &f.DecodeErrors); err != nil {
+				writeError(w, 500, fmt.Sprintf("frame %d: invalid decode_errors: %v", f.ID, err))
+				return
+			}
+		}
 		list = append(list, f)
+		ids = append(ids, f.ID)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	writePage(w, p, list, ids, total)
+}
+
+// Frame is a stored meter_frames row as listed by the frames endpoints.
+type Frame struct {
+	ID           int       `json:"id"`
+	MeterAddress string    `json:"meter_address"`
+	IMEI         string    `json:"imei"`
+	TLVHex       string    `json:"tlv_hex"`
+	CheckSum     string    `json:"checksum"`
+	EndFlag      string    `json:"end_flag"`
+	CreatedAt    time.Time `json:"created_at"`
+	Transport    string    `json:"transport"`
+	// DecodeErrors are the protocol errors found when the frame was ingested.
+	DecodeErrors []protocolError `json:"decode_errors,omitempty"`
 }
 
 // -------------------------
 // API: MESSAGES with DECODED TLV (read from messages table where we inserted decoded values)
 // -------------------------
 func getMessages(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-        SELECT id, frame_id, total, flow, battery, pressure, temperature,
-               magnetic_tamper, rssi_raw, serial, valve, firmware,
-               network_status, rtc, extended_status_1a, model,
-               meter_index_20, counters, ext_block_12, timestamp_1f, created_at
-        FROM messages
-        ORDER BY id DESC
-    `)
+	p, err := parseListParams(r, "created_at", "measured_at")
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, 400, err.Error())
 		return
 	}
-	defer rows.Close()
 
-	type Msg struct {
-		ID                int                    `json:"id"`
-		FrameID           int                    `json:"frame_id"`
-		Total             int                    `json:"total"`
-		Flow              int                    `json:"flow"`
-		Battery           int                    `json:"battery"`
-		Pressure          int                    `json:"pressure"`
-		Temperature       int                    `json:"temperature"`
-		MagneticTamper    int                    `json:"magnetic_tamper"`
-		RSSIRaw           int                    `json:"rssi_raw"`
-		Serial            string                 `json:"serial"`
-		Valve             int                    `json:"valve"`
-		Firmware          int                    `json:"firmware"`
-		NetworkStatus     int                    `json:"network_status"`
-		RTC               interface{}            `json:"rtc"`
-		ExtendedStatus1A  interface{}            `json:"extended_status_1a"`
-		Model             string                 `json:"model"`
-		MeterIndex20      interface{}            `json:"meter_index_20"`
-		Counters          interface{}            `json:"counters"`
-		ExtBlock12        interface{}            `json:"ext_block_12"`
-		Timestamp1F       interface{}            `json:"timestamp_1f"`
-		CreatedAt         time.Time              `json:"created_at"`
-		DecodedRawExample map[string]interface{} `json:"decoded_example,omitempty"`
+	var where sqlWhere
+	p.filters(&where, "m."+p.TimeField, true)
+	from := "FROM messages m JOIN meter_frames f ON f.id = m.frame_id "
+
+	total, err := p.totalCount("SELECT COUNT(*) "+from+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "m.id")
+	msgs, err := queryMessages(from+where.String()+" "+p.orderSQL("m.id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	var ids []int
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+
+	writePage(w, p, msgs, ids, total)
+}
+
+// Msg is one messages row as the API returns it.
+type Msg struct {
+	ID                int                    `json:"id"`
+	FrameID           int                    `json:"frame_id"`
+	Total             int                    `json:"total"`
+	Flow              int                    `json:"flow"`
+	Battery           int                    `json:"battery"`
+	Pressure          int                    `json:"pressure"`
+	Temperature       int                    `json:"temperature"`
+	MagneticTamper    int                    `json:"magnetic_tamper"`
+	RSSIRaw           int                    `json:"rssi_raw"`
+	Serial            string                 `json:"serial"`
+	Valve             int                    `json:"valve"`
+	Firmware          int                    `json:"firmware"`
+	NetworkStatus     int                    `json:"network_status"`
+	RTC               interface{}            `json:"rtc"`
+	ExtendedStatus1A  interface{}            `json:"extended_status_1a"`
+	Model             string                 `json:"model"`
+	MeterIndex20      interface{}            `json:"meter_index_20"`
+	Counters          interface{}            `json:"counters"`
+	ExtBlock12        interface{}            `json:"ext_block_12"`
+	Timestamp1F       interface{}            `json:"timestamp_1f"`
+	CreatedAt         time.Time              `json:"created_at"`
+	DecodedRawExample map[string]interface{} `json:"decoded_example,omitempty"`
+}
+
+// queryMessages runs SELECT <message columns> followed by tail, which must alias
+// messages as m (and may join meter_frames as f).
+func queryMessages(tail string, args ...interface{}) ([]Msg, error) {
+	rows, err := db.Query(`
+        SELECT m.id, m.frame_id, COALESCE(m.total, 0), COALESCE(m.flow, 0), COALESCE(m.battery, 0),
+               COALESCE(m.pressure, 0), COALESCE(m.temperature, 0), COALESCE(m.magnetic_tamper, 0),
+               COALESCE(m.rssi_raw, 0), COALESCE(m.serial, ''), COALESCE(m.valve, 0), COALESCE(m.firmware, 0),
+               COALESCE(m.network_status, 0), m.rtc, m.extended_status_1a, COALESCE(m.model, ''),
+               m.meter_index_20, m.counters, m.ext_block_12, m.timestamp_1f, m.created_at
+        `+tail, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
 	var list []Msg
 
@@ -1721,11 +859,11 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 			&idx20JSON, &countersJSON, &ext12JSON, &t1fJSON, &created,
 		)
 		if err != nil {
-			continue
+			return nil, err
+		}
+		if created.Valid {
+			m.CreatedAt = created.Time
 		}
-		// if created.Valid {
-		// 	m.CreatedAt = created.Time
-		// }
 
 		// Unmarshal JSONB/text columns to interface{} so API returns proper arrays
 		var tmp interface{}
@@ -1779,8 +917,5 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		list = append(list, m)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	return list, rows.Err()
 }
-
->>>>>>> 0fe92ec3ed1e3a21e98419e6880273928202e4ad
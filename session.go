@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// -------------------------
+// TCP SESSION / RECEIVE METADATA
+// -------------------------
+
+// tcpSession tracks one accepted connection so every frame it carries can be
+// traced back to where and when it arrived.
+type tcpSession struct {
+	ID         string
+	RemoteAddr string
+	LocalAddr  string
+	StartedAt  time.Time
+	BytesRead  int64
+}
+
+// frameMeta is stored next to the parsed header so the exact bytes on the wire
+// can be reproduced later.
+type frameMeta struct {
+	Raw           []byte
+	Transport     string // transportTCP, transportHTTP, ...
+	RemoteAddr    string
+	LocalAddr     string
+	SessionID     string
+	SessionOffset int64
+	ReceivedAt    time.Time
+}
+
+func newTCPSession(conn net.Conn) *tcpSession {
+	return &tcpSession{
+		ID:         uuid.NewString(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+		StartedAt:  time.Now(),
+	}
+}
+
+// frameMeta records packet as the next chunk read from the session.
+func (s *tcpSession) frameMeta(packet []byte) frameMeta {
+	m := frameMeta{
+		Raw:           append([]byte(nil), packet...),
+		Transport:     transportTCP,
+		RemoteAddr:    s.RemoteAddr,
+		LocalAddr:     s.LocalAddr,
+		SessionID:     s.ID,
+		SessionOffset: s.BytesRead,
+		ReceivedAt:    time.Now(),
+	}
+	s.BytesRead += int64(len(packet))
+	return m
+}
+
+// RawFrame is the ?format=json form of GET /api/v1/frames/{id}/raw.
+type RawFrame struct {
+	ID            int        `json:"id"`
+	Hex           string     `json:"hex"`
+	Length        int        `json:"length"`
+	Transport     string     `json:"transport"`
+	RemoteAddr    string     `json:"remote_addr"`
+	LocalAddr     string     `json:"local_addr"`
+	SessionID     string     `json:"session_id"`
+	SessionOffset int64      `json:"session_offset"`
+	ReceivedAt    *time.Time `json:"received_at"`
+}
+
+// -------------------------
+// API: RAW FRAME
+// -------------------------
+// GET /api/frames/{id}/raw returns the archived bytes as application/octet-stream,
+// or ?format=json for hex plus the receive metadata.
+func getRawFrame(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid frame id")
+		return
+	}
+
+	var raw []byte
+	var transport string
+	var remote, local, session sql.NullString
+	var offset sql.NullInt64
+	var received sql.NullTime
+	err = db.QueryRow(`
+        SELECT raw_frame, transport, remote_addr, local_addr, session_id::text, session_offset, received_at
+        FROM meter_frames WHERE id = $1 AND ($2 = 0 OR tenant_id = $2)
+    `, id, callerTenant(r)).Scan(&raw, &transport, &remote, &local, &session, &offset, &received)
+	if err == sql.ErrNoRows {
+		writeError(w, 404, "frame not found")
+		return
+	}
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if raw == nil {
+		writeError(w, 404, "frame was stored before raw archiving")
+		return
+	}
+
+	if r.URL.Query().Get("format") != "json" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=frame-%d.bin", id))
+		w.Write(raw)
+		return
+	}
+
+	res := RawFrame{
+		ID:            id,
+		Hex:           fmt.Sprintf("% X", raw),
+		Length:        len(raw),
+		Transport:     transport,
+		RemoteAddr:    remote.String,
+		LocalAddr:     local.String,
+		SessionID:     session.String,
+		SessionOffset: offset.Int64,
+	}
+	if received.Valid {
+		res.ReceivedAt = &received.Time
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
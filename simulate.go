@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+// DEVICE SIMULATOR
+// -------------------------
+// `simulate` runs N meters against the TCP listener. Each meter keeps its own
+// counters so consecutive readings look like a real device, and every report
+// is sent the way handleTCP expects it: one frame per connection, answered
+// with "OK" once it is stored. Faults (fragmented writes, duplicates, bad
+// checksums, encrypted payloads) are injected at the configured rates and
+// counted separately, so the summary shows how the server treats each kind.
+
+type simOptions struct {
+	Addr          string
+	Meters        int
+	Frames        int // per meter; 0 = until Duration or Ctrl-C
+	Duration      time.Duration
+	Interval      time.Duration
+	Jitter        float64
+	Timeout       time.Duration
+	IMEIs         []string
+	Manufacturer  []byte
+	FragmentRate  float64
+	FragmentDelay time.Duration
+	DuplicateRate float64
+	CorruptRate   float64
+	EncryptedRate float64
+	Seed          uint64
+	Report        time.Duration
+}
+
+// simMeter is the state of one simulated device between reports.
+type simMeter struct {
+	imei         string
+	bcd          []byte // 8 bytes, as parseFrameHeader reads them
+	address      []byte // 8 bytes
+	manufacturer []byte
+	serial       []byte
+	mid          uint16
+	total        int
+	flow         int
+	battery      int
+	firmware     int
+	rng          *rand.Rand
+}
+
+func newSimMeter(imei string, manufacturer []byte, rng *rand.Rand) (*simMeter, error) {
+	bcd, err := imeiBCD(imei)
+	if err != nil {
+		return nil, err
+	}
+	m := &simMeter{
+		imei:         imei,
+		bcd:          bcd,
+		address:      append([]byte{0x00, 0x00}, bcd[2:]...),
+		manufacturer: manufacturer,
+		serial:       append([]byte(nil), bcd[4:]...),
+		mid:          uint16(rng.IntN(1 << 16)),
+		total:        rng.IntN(500000),
+		battery:      80 + rng.IntN(21),
+		firmware:     0x10 + rng.IntN(4),
+		rng:          rng,
+	}
+	return m, nil
+}
+
+// imeiBCD packs up to 16 decimal digits as the 8 BCD bytes of the frame
+// header, left-padded with zeros (a 15 digit IMEI reads back as "0" + IMEI).
+func imeiBCD(imei string) ([]byte, error) {
+	if imei == "" || len(imei) > 16 || strings.Trim(imei, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid IMEI %q: want up to 16 digits", imei)
+	}
+	return hex.DecodeString(strings.Repeat("0", 16-len(imei)) + imei)
+}
+
+// next advances the meter by one reporting interval and returns its frame.
+func (m *simMeter) next() []byte {
+	m.mid++
+	m.flow = m.rng.IntN(1200) // L/h
+	m.total += 1 + m.rng.IntN(50)
+	if m.total > 0xFFFFFF {
+		m.total -= 0xFFFFFF // 3 byte register rolls over
+	}
+	if m.battery > 5 && m.rng.IntN(100) == 0 {
+		m.battery--
+	}
+	return encodeSimFrame(m.bcd, m.address, m.manufacturer, m.mid, false, m.tlv())
+}
+
+// tlv encodes a reading with the tags decodeTLV understands.
+func (m *simMeter) tlv() []byte {
+	b := []byte{0x00, byte(len(m.serial))}
+	b = append(b, m.serial...)
+	b = append(b, 0x02, byte(m.total>>16), byte(m.total>>8), byte(m.total))
+	b = append(b, 0x04, byte(m.flow>>24), byte(m.flow>>16), byte(m.flow>>8), byte(m.flow))
+	b = append(b, 0x08, byte(m.battery))
+	b = append(b, 0x09, byte(30+m.rng.IntN(40)))      // pressure, kPa
+	b = append(b, 0x0A, 0x00, byte(5+m.rng.IntN(20))) // temperature, two byte form
+	b = append(b, 0x0C, 0x00, 0x00)                   // no magnetic tamper
+	rssi := 0x0040 + m.rng.IntN(0x40)
+	b = append(b, 0x0D, byte(rssi>>8), byte(rssi))
+	b = append(b, 0x13, 0x01) // valve open
+	b = append(b, 0x17, byte(m.firmware))
+	return b
+}
+
+// encodeSimFrame wraps tlv in a header and trailer that pass validateFrame.
+func encodeSimFrame(imei, address, manufacturer []byte, mid uint16, encrypted bool, tlv []byte) []byte {
+	n := frameHeaderLen + len(tlv) + 2
+	f := make([]byte, frameHeaderLen, n)
+	f[0] = frameStartFlag
+	f[1], f[2] = byte(n>>8), byte(n)
+	f[3] = 0x10 // product type: water meter
+	copy(f[4:12], address)
+	copy(f[12:14], manufacturer)
+	copy(f[14:22], imei)
+	f[22] = 0x01 // protocol version
+	f[23], f[24] = byte(mid>>8), byte(mid)
+	if encrypted {
+		f[25] = 0x01
+	}
+	f[26] = 0x01 // function code: periodic report
+	f[27], f[28] = byte(len(tlv)>>8), byte(len(tlv))
+	f = append(f, tlv...)
+	f = append(f, 0, frameEndFlag)
+	f[n-2] = frameChecksum(f)
+	return f
+}
+
+// -------------------------
+// FAULTS
+// -------------------------
+const (
+	simNormal      = "normal"
+	simFragmented  = "fragmented"
+	simDuplicate   = "duplicate"
+	simBadChecksum = "bad_checksum"
+	simEncrypted   = "encrypted"
+)
+
+// simFrame is one send: the bytes, how they are split into writes and which
+// faults were applied.
+type simFrame struct {
+	data   []byte
+	splits []int
+	kinds  []string
+}
+
+func (f simFrame) kind() string {
+	if len(f.kinds) == 0 {
+		return simNormal
+	}
+	return strings.Join(f.kinds, "+")
+}
+
+// applyFaults rolls each configured fault for frame.
+func applyFaults(o *simOptions, rng *rand.Rand, frame []byte) simFrame {
+	f := simFrame{data: frame}
+	if rng.Float64() < o.EncryptedRate {
+		// the server never decrypts, so any opaque bytes exercise the same path
+		for i := frameHeaderLen; i < len(frame)-2; i++ {
+			frame[i] = byte(rng.UintN(256))
+		}
+		frame[25] = 0x01
+		frame[len(frame)-2] = frameChecksum(frame)
+		f.kinds = append(f.kinds, simEncrypted)
+	}
+	if rng.Float64() < o.CorruptRate {
+		frame[len(frame)-2] ^= byte(1 + rng.IntN(255))
+		f.kinds = append(f.kinds, simBadChecksum)
+	}
+	if rng.Float64() < o.FragmentRate {
+		// two or three writes, each at least one byte
+		cut := 1 + rng.IntN(len(frame)-1)
+		f.splits = []int{cut}
+		if cut < len(frame)-1 && rng.IntN(2) == 0 {
+			f.splits = append(f.splits, cut+1+rng.IntN(len(frame)-cut-1))
+		}
+		f.kinds = append(f.kinds, simFragmented)
+	}
+	return f
+}
+
+// -------------------------
+// STATS
+// -------------------------
+// simMaxSamples bounds the latency samples kept for percentiles; beyond it
+// samples are replaced at random (reservoir sampling).
+const simMaxSamples = 100000
+
+type simCount struct {
+	Sent, Acked, NoAck, Errors int
+}
+
+type simStats struct {
+	mu        sync.Mutex
+	start     time.Time
+	kinds     map[string]*simCount
+	total     simCount
+	latencies []time.Duration
+	seen      int
+	rng       *rand.Rand
+	lastErr   error
+}
+
+func newSimStats(seed uint64) *simStats {
+	return &simStats{start: time.Now(), kinds: map[string]*simCount{}, rng: rand.New(rand.NewPCG(seed, 0))}
+}
+
+// simResult is the outcome of one send: acked (with latency), dropped by the
+// server without an ACK, or failed to connect.
+type simResult struct {
+	acked   bool
+	latency time.Duration
+	err     error
+}
+
+func (s *simStats) record(kind string, r simResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.kinds[kind]
+	if c == nil {
+		c = &simCount{}
+		s.kinds[kind] = c
+	}
+	for _, c := range []*simCount{c, &s.total} {
+		c.Sent++
+		switch {
+		case r.err != nil:
+			c.Errors++
+		case r.acked:
+			c.Acked++
+		default:
+			c.NoAck++
+		}
+	}
+	if r.err != nil {
+		s.lastErr = r.err
+	}
+	if !r.acked {
+		return
+	}
+	s.seen++
+	if len(s.latencies) < simMaxSamples {
+		s.latencies = append(s.latencies, r.latency)
+	} else if i := s.rng.IntN(s.seen); i < simMaxSamples {
+		s.latencies[i] = r.latency
+	}
+}
+
+// percentiles returns p50, p95, p99 and max of the kept samples.
+func (s *simStats) percentiles() (p50, p95, p99, max time.Duration) {
+	if len(s.latencies) == 0 {
+		return
+	}
+	l := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	at := func(p float64) time.Duration { return l[int(p*float64(len(l)-1))] }
+	return at(0.50), at(0.95), at(0.99), l[len(l)-1]
+}
+
+// progress is the one-line periodic report.
+func (s *simStats) progress() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.start)
+	p50, p95, p99, max := s.percentiles()
+	return fmt.Sprintf("%6s sent %d acked %d no-ack %d errors %d  %.1f frames/s  ack p50 %s p95 %s p99 %s max %s",
+		elapsed.Truncate(time.Second), s.total.Sent, s.total.Acked, s.total.NoAck, s.total.Errors,
+		float64(s.total.Sent)/elapsed.Seconds(), ms(p50), ms(p95), ms(p99), ms(max))
+}
+
+// summary prints totals and the per-fault breakdown.
+func (s *simStats) summary(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.start)
+	p50, p95, p99, max := s.percentiles()
+
+	fmt.Fprintf(w, "\n%d frames in %s: %.1f frames/s sent, %.1f acked/s\n", s.total.Sent,
+		elapsed.Round(time.Millisecond), float64(s.total.Sent)/elapsed.Seconds(), float64(s.total.Acked)/elapsed.Seconds())
+	fmt.Fprintf(w, "ack latency: p50 %s  p95 %s  p99 %s  max %s\n\n", ms(p50), ms(p95), ms(p99), ms(max))
+
+	names := make([]string, 0, len(s.kinds))
+	for k := range s.kinds {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "%-32s %8s %8s %8s %8s\n", "kind", "sent", "acked", "no-ack", "errors")
+	for _, k := range names {
+		c := s.kinds[k]
+		fmt.Fprintf(w, "%-32s %8d %8d %8d %8d\n", k, c.Sent, c.Acked, c.NoAck, c.Errors)
+	}
+	if s.lastErr != nil {
+		fmt.Fprintln(w, "\nlast error:", s.lastErr)
+	}
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64) + "ms"
+}
+
+// -------------------------
+// SENDING
+// -------------------------
+
+// sendFrame delivers f on a new connection and waits for the "OK" ACK.
+// Latency runs from the last write to the ACK. Once connected, anything
+// short of an ACK counts as dropped: handleTCP closes without replying.
+func sendFrame(ctx context.Context, o *simOptions, f simFrame) simResult {
+	d := net.Dialer{Timeout: o.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", o.Addr)
+	if err != nil {
+		return simResult{err: err}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(o.Timeout + time.Duration(len(f.splits))*o.FragmentDelay))
+
+	prev := 0
+	for _, cut := range append(f.splits, len(f.data)) {
+		if prev > 0 {
+			time.Sleep(o.FragmentDelay)
+		}
+		if _, err := conn.Write(f.data[prev:cut]); err != nil {
+			return simResult{} // the server already hung up on a partial frame
+		}
+		prev = cut
+	}
+	sent := time.Now()
+
+	ack := make([]byte, 2)
+	if _, err := io.ReadFull(conn, ack); err != nil || string(ack) != "OK" {
+		return simResult{} // closed, reset or timed out without an ACK
+	}
+	return simResult{acked: true, latency: time.Since(sent)}
+}
+
+// runMeter sends reports for one meter until ctx ends or Frames are sent.
+func runMeter(ctx context.Context, o *simOptions, m *simMeter, stats *simStats) {
+	wait := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+			return true
+		}
+	}
+
+	// stagger the first report across one interval so meters don't arrive in lockstep
+	if o.Interval > 0 && !wait(time.Duration(m.rng.Int64N(int64(o.Interval)))) {
+		return
+	}
+	for sent := 0; o.Frames == 0 || sent < o.Frames; sent++ {
+		f := applyFaults(o, m.rng, m.next())
+		r := sendFrame(ctx, o, f)
+		if ctx.Err() != nil && r.err != nil {
+			return // interrupted, not a server failure
+		}
+		stats.record(f.kind(), r)
+		if m.rng.Float64() < o.DuplicateRate {
+			// a meter that missed the ACK resends the identical frame (same MID)
+			stats.record(simDuplicate, sendFrame(ctx, o, simFrame{data: f.data, splits: f.splits}))
+		}
+
+		d := o.Interval
+		if o.Jitter > 0 && d > 0 {
+			d += time.Duration((m.rng.Float64()*2 - 1) * o.Jitter * float64(d))
+		}
+		if !wait(d) {
+			return
+		}
+	}
+}
+
+func runSimulation(ctx context.Context, o *simOptions, out io.Writer) *simStats {
+	stats := newSimStats(o.Seed)
+
+	var wg sync.WaitGroup
+	for i := 0; i < o.Meters; i++ {
+		rng := rand.New(rand.NewPCG(o.Seed, uint64(i)+1))
+		m, err := newSimMeter(o.IMEIs[i%len(o.IMEIs)], o.Manufacturer, rng)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMeter(ctx, o, m, stats)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if o.Report > 0 {
+		tick := time.NewTicker(o.Report)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return stats
+			case <-tick.C:
+				fmt.Fprintln(out, stats.progress())
+			}
+		}
+	}
+	<-done
+	return stats
+}
+
+// simIMEIs returns the explicit list, or count consecutive IMEIs from base.
+func simIMEIs(list, base string, count int) ([]string, error) {
+	if list != "" {
+		var imeis []string
+		for _, s := range strings.Split(list, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				if _, err := imeiBCD(s); err != nil {
+					return nil, err
+				}
+				imeis = append(imeis, s)
+			}
+		}
+		if len(imeis) == 0 {
+			return nil, errors.New("-imeis is empty")
+		}
+		return imeis, nil
+	}
+	if _, err := imeiBCD(base); err != nil {
+		return nil, err
+	}
+	start, err := strconv.ParseUint(base, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -imei-base %q: %w", base, err)
+	}
+	imeis := make([]string, count)
+	for i := range imeis {
+		imeis[i] = fmt.Sprintf("%0*d", len(base), start+uint64(i))
+	}
+	if len(imeis[count-1]) > len(base) {
+		return nil, fmt.Errorf("-imei-base %s has no room for %d meters", base, count)
+	}
+	return imeis, nil
+}
+
+func simulateCommand(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	o := simOptions{}
+	fs.StringVar(&o.Addr, "addr", "localhost:9000", "TCP listener to send to")
+	fs.IntVar(&o.Meters, "conns", 10, "number of meters sending concurrently")
+	fs.IntVar(&o.Frames, "frames", 0, "frames per meter (default: until -duration or Ctrl-C)")
+	fs.DurationVar(&o.Duration, "duration", 0, "stop after this long")
+	fs.DurationVar(&o.Interval, "interval", time.Second, "reporting interval of each meter")
+	fs.Float64Var(&o.Jitter, "jitter", 0.1, "random +/- fraction applied to -interval")
+	fs.DurationVar(&o.Timeout, "timeout", 5*time.Second, "connect and ACK timeout")
+	imeiList := fs.String("imeis", "", "comma-separated IMEIs, assigned to meters round robin")
+	imeiBase := fs.String("imei-base", "861234567800000", "first IMEI when -imeis is not set; meters count up from it")
+	manufacturer := fs.String("manufacturer", "0001", "manufacturer code, 4 hex digits")
+	fs.Float64Var(&o.FragmentRate, "fragment", 0, "fraction of frames split across 2-3 writes")
+	fs.DurationVar(&o.FragmentDelay, "fragment-delay", 20*time.Millisecond, "pause between the writes of a fragmented frame")
+	fs.Float64Var(&o.DuplicateRate, "duplicate", 0, "fraction of frames sent a second time")
+	fs.Float64Var(&o.CorruptRate, "bad-checksum", 0, "fraction of frames with a corrupted checksum")
+	fs.Float64Var(&o.EncryptedRate, "encrypted", 0, "fraction of frames with encryption_flag set and an opaque payload")
+	fs.Uint64Var(&o.Seed, "seed", uint64(time.Now().UnixNano()), "random seed, for repeatable runs")
+	fs.DurationVar(&o.Report, "report", 5*time.Second, "progress line every this often (0 = off)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if o.Meters < 1 {
+		fmt.Fprintln(os.Stderr, "-conns must be at least 1")
+		return 2
+	}
+	for _, r := range []float64{o.FragmentRate, o.DuplicateRate, o.CorruptRate, o.EncryptedRate, o.Jitter} {
+		if r < 0 || r > 1 {
+			fmt.Fprintln(os.Stderr, "rates and -jitter must be between 0 and 1")
+			return 2
+		}
+	}
+	mc, err := hex.DecodeString(*manufacturer)
+	if err != nil || len(mc) != 2 {
+		fmt.Fprintf(os.Stderr, "invalid -manufacturer %q: want 4 hex digits\n", *manufacturer)
+		return 2
+	}
+	o.Manufacturer = mc
+	if o.IMEIs, err = simIMEIs(*imeiList, *imeiBase, o.Meters); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if o.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Duration)
+		defer cancel()
+	}
+
+	fmt.Fprintf(os.Stdout, "simulating %d meters against %s (seed %d)\n", o.Meters, o.Addr, o.Seed)
+	stats := runSimulation(ctx, &o, os.Stdout)
+	stats.summary(os.Stdout)
+	if stats.total.Acked == 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSimulatedFrameDecodes(t *testing.T) {
+	m, err := newSimMeter("861234567800042", []byte{0x12, 0x34}, rand.New(rand.NewPCG(1, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := m.next()
+	if errs := validateFrame(frame); len(errs) > 0 {
+		t.Fatalf("invalid frame: %v", errs)
+	}
+
+	h, err := parseFrameHeader(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h["imei"] != "0861234567800042" || h["manufacturer_code"] != "1234" || h["mid"] != int(m.mid) {
+		t.Errorf("header %v", h)
+	}
+	r := decodeTLV(hexStringToBytes(h["tlv_hex"].(string)))
+	for k, want := range map[string]interface{}{
+		"serial": "67800042", "total": m.total, "flow": m.flow, "battery": m.battery, "valve": 1, "firmware": m.firmware,
+	} {
+		if r[k] != want {
+			t.Errorf("%s = %v, want %v", k, r[k], want)
+		}
+	}
+	for _, k := range []string{"pressure", "temperature", "rssi_raw", "magnetic_tamper"} {
+		if _, ok := r[k]; !ok {
+			t.Errorf("%s missing from %v", k, r)
+		}
+	}
+}
+
+func TestSimulateCountsAcksPerFault(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// like handleTCP: one read, ACK only a frame that arrived whole
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				n, _ := conn.Read(buf)
+				if checkFrameBounds(buf[:n]) == nil {
+					conn.Write([]byte("OK"))
+				}
+			}()
+		}
+	}()
+
+	o := &simOptions{
+		Addr: ln.Addr().String(), Meters: 3, Frames: 20, Timeout: time.Second,
+		IMEIs: []string{"861234567800000"}, Manufacturer: []byte{0, 1},
+		FragmentRate: 0.5, FragmentDelay: 20 * time.Millisecond, DuplicateRate: 0.2, Seed: 7,
+	}
+	stats := runSimulation(context.Background(), o, nil)
+
+	if stats.total.Errors != 0 || stats.total.Sent < 60 {
+		t.Fatalf("totals %+v, last error %v", stats.total, stats.lastErr)
+	}
+	if c := stats.kinds[simNormal]; c == nil || c.Acked != c.Sent {
+		t.Errorf("normal frames %+v", c)
+	}
+	if c := stats.kinds[simFragmented]; c == nil || c.NoAck == 0 {
+		t.Errorf("fragmented frames %+v, want some without an ACK", c)
+	}
+	if stats.kinds[simDuplicate] == nil || len(stats.latencies) != stats.total.Acked {
+		t.Errorf("duplicates %+v, %d latencies for %d acks", stats.kinds[simDuplicate], len(stats.latencies), stats.total.Acked)
+	}
+}
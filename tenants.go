@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// -------------------------
+// TENANTS
+// -------------------------
+// Each utility hosted on the server is a tenant. Devices are assigned to
+// tenants by explicit IMEI, IMEI range or manufacturer code (tenant_for() in
+// migration 10 picks the most specific match), and the tenant is stamped on
+// meter_frames, messages, devices and alerts at ingest.
+//
+// API keys and JWTs may carry a tenant; such callers only ever see their own
+// tenant's rows. Platform callers (no tenant) see everything and can narrow a
+// request with ?tenant=ID.
+
+type Tenant struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TenantAssignment struct {
+	ID               int       `json:"id"`
+	TenantID         int       `json:"tenant_id"`
+	IMEI             *string   `json:"imei,omitempty"`
+	IMEIFrom         *string   `json:"imei_from,omitempty"`
+	IMEITo           *string   `json:"imei_to,omitempty"`
+	ManufacturerCode *string   `json:"manufacturer_code,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// callerTenant is the tenant a request is scoped to, 0 for all tenants.
+func callerTenant(r *http.Request) int {
+	if p := requestPrincipal(r); p != nil && p.TenantID != 0 {
+		return p.TenantID
+	}
+	n, _ := strconv.Atoi(r.URL.Query().Get("tenant"))
+	return n
+}
+
+// nullTenant maps the "no tenant" 0 to SQL NULL.
+func nullTenant(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// requirePlatform rejects tenant-scoped callers from server-wide operations
+// (reprocessing, alert rules, webhooks, keys, audit, tenant management).
+func requirePlatform(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := requestPrincipal(r); p != nil && p.TenantID != 0 {
+			writeError(w, http.StatusForbidden, "not available to tenant credentials")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// visibleIMEIs keeps the IMEIs that belong to tenant (all of them for 0).
+func visibleIMEIs(tenant int, imeis []string) ([]string, error) {
+	if tenant == 0 || len(imeis) == 0 {
+		return imeis, nil
+	}
+	rows, err := db.Query(`SELECT imei FROM devices WHERE imei = ANY($1) AND tenant_id = $2 ORDER BY imei`,
+		pq.Array(imeis), tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var imei string
+		if err := rows.Scan(&imei); err != nil {
+			return nil, err
+		}
+		out = append(out, imei)
+	}
+	return out, rows.Err()
+}
+
+// restampTenants re-resolves every device after assignments change and
+// carries the result over to its frames, readings and alerts.
+func restampTenants() (map[string]int64, error) {
+	stmts := []struct{ table, sql string }{
+		{"devices", `UPDATE devices SET tenant_id = tenant_for(imei, manufacturer_code)
+            WHERE tenant_id IS DISTINCT FROM tenant_for(imei, manufacturer_code)`},
+		{"meter_frames", `UPDATE meter_frames f SET tenant_id = d.tenant_id FROM devices d
+            WHERE d.imei = f.imei AND f.tenant_id IS DISTINCT FROM d.tenant_id`},
+		{"messages", `UPDATE messages m SET tenant_id = f.tenant_id FROM meter_frames f
+            WHERE f.id = m.frame_id AND m.tenant_id IS DISTINCT FROM f.tenant_id`},
+		{"alerts", `UPDATE alerts a SET tenant_id = d.tenant_id FROM devices d
+            WHERE d.imei = a.imei AND a.tenant_id IS DISTINCT FROM d.tenant_id`},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	updated := map[string]int64{}
+	for _, s := range stmts {
+		res, err := tx.Exec(s.sql)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.table, err)
+		}
+		updated[s.table], _ = res.RowsAffected()
+	}
+	return updated, tx.Commit()
+}
+
+// -------------------------
+// API: TENANTS
+// -------------------------
+
+// GET /api/admin/tenants
+func getTenants(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, name, created_at FROM tenants ORDER BY id`)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	list := []Tenant{}
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// POST /api/admin/tenants {"name": "..."}
+func postTenant(w http.ResponseWriter, r *http.Request) {
+	var t Tenant
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+	if t.Name == "" {
+		writeError(w, 400, "name is required")
+		return
+	}
+
+	err := db.QueryRow(`INSERT INTO tenants (name) VALUES ($1) RETURNING id, created_at`, t.Name).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// GET /api/admin/tenants/{id}/assignments
+func getTenantAssignments(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+        SELECT id, tenant_id, imei, imei_from, imei_to, manufacturer_code, created_at
+        FROM tenant_assignments WHERE tenant_id = $1 ORDER BY id
+    `, r.PathValue("id"))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	list := []TenantAssignment{}
+	for rows.Next() {
+		var a TenantAssignment
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.IMEI, &a.IMEIFrom, &a.IMEITo, &a.ManufacturerCode, &a.CreatedAt); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		list = append(list, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (a TenantAssignment) validate() error {
+	n := 0
+	if a.IMEI != nil {
+		n++
+	}
+	if a.IMEIFrom != nil || a.IMEITo != nil {
+		if a.IMEIFrom == nil || a.IMEITo == nil {
+			return errors.New("imei_from and imei_to must be given together")
+		}
+		if len(*a.IMEIFrom) != len(*a.IMEITo) || *a.IMEIFrom > *a.IMEITo {
+			return errors.New("imei_from and imei_to must have the same length and imei_from <= imei_to")
+		}
+		n++
+	}
+	if a.ManufacturerCode != nil {
+		n++
+	}
+	if n != 1 {
+		return errors.New("give exactly one of imei, imei_from/imei_to or manufacturer_code")
+	}
+	return nil
+}
+
+// POST /api/admin/tenants/{id}/assignments
+// {"imei": "..."} | {"imei_from": "...", "imei_to": "..."} | {"manufacturer_code": "..."}
+// Existing data keeps its tenant until POST /api/admin/tenants/restamp.
+func postTenantAssignment(w http.ResponseWriter, r *http.Request) {
+	tenantID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid tenant id")
+		return
+	}
+
+	var a TenantAssignment
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+	if err := a.validate(); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	a.TenantID = tenantID
+
+	err = db.QueryRow(`
+        INSERT INTO tenant_assignments (tenant_id, imei, imei_from, imei_to, manufacturer_code)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at
+    `, a.TenantID, a.IMEI, a.IMEIFrom, a.IMEITo, a.ManufacturerCode).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// DELETE /api/admin/tenant-assignments/{id}
+func deleteTenantAssignment(w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec(`DELETE FROM tenant_assignments WHERE id = $1`, r.PathValue("id"))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, 404, "assignment not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/admin/tenants/restamp applies the current assignments to stored data.
+func postTenantRestamp(w http.ResponseWriter, r *http.Request) {
+	updated, err := restampTenants()
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"updated": updated})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tenantRequest sends method path through the API routes as a caller of
+// tenant (0 for platform) with role.
+func tenantRequest(t *testing.T, method, path string, tenant int, role string) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	changes := jwt.MapClaims{"role": role}
+	if tenant != 0 {
+		changes["tenant"] = tenant
+	}
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodHS256, []byte(testJWTSecret), testClaims(changes)))
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestTenantCannotSeeOtherTenantsData(t *testing.T) {
+	const owner = 1
+	const imei = "0861234567800042"
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	deviceRow := []driver.Value{5, imei, "0000345678901234", "0A1B", "WM20", nil, "", at, at, 42, 7, owner}
+	rawRow := []driver.Value{[]byte{0x68, 0x16}, "tcp", "10.0.0.1:5000", "10.0.0.2:9000", nil, nil, at}
+
+	for _, c := range []struct {
+		name    string
+		path    string
+		query   string
+		args    func(caller int) []driver.Value
+		columns []string
+		row     []driver.Value
+	}{
+		{"device", apiPrefix + "/devices/" + imei, `FROM devices WHERE imei = \$1 AND \(\$2 = 0 OR tenant_id = \$2\)`,
+			func(caller int) []driver.Value { return []driver.Value{imei, caller} },
+			[]string{"id", "imei", "meter_address", "manufacturer_code", "model", "firmware", "group_name",
+				"first_seen", "last_seen", "last_frame_id", "frame_count", "tenant_id"}, deviceRow},
+		{"device frames", apiPrefix + "/devices/" + imei + "/frames", `FROM devices WHERE imei = \$1 AND \(\$2 = 0 OR tenant_id = \$2\)`,
+			func(caller int) []driver.Value { return []driver.Value{imei, caller} }, nil, nil},
+		{"raw frame", apiPrefix + "/frames/42/raw", `FROM meter_frames WHERE id = \$1 AND \(\$2 = 0 OR tenant_id = \$2\)`,
+			func(caller int) []driver.Value { return []driver.Value{42, caller} },
+			[]string{"raw_frame", "transport", "remote_addr", "local_addr", "session_id", "session_offset", "received_at"}, rawRow},
+	} {
+		for _, caller := range []struct {
+			name   string
+			tenant int
+			query  string // ?tenant= the caller tries to widen its scope with
+			status int
+		}{
+			{"other tenant", 2, "", http.StatusNotFound},
+			{"other tenant naming the owner", 2, "?tenant=1", http.StatusNotFound},
+			{"owner", owner, "", http.StatusOK},
+			{"platform", 0, "", http.StatusOK},
+		} {
+			if caller.status == http.StatusOK && c.row == nil {
+				continue // the list behind it has its own queries
+			}
+			t.Run(c.name+"/"+caller.name, func(t *testing.T) {
+				mock := useMockDB(t)
+				// the database applies the tenant predicate: rows of another
+				// tenant do not come back
+				rows := sqlmock.NewRows(c.columns)
+				scope := caller.tenant
+				if scope == 0 || scope == owner {
+					rows.AddRow(c.row...)
+				}
+				mock.ExpectQuery(c.query).WithArgs(c.args(scope)...).WillReturnRows(rows)
+
+				w := tenantRequest(t, "GET", c.path+caller.query, caller.tenant, "read-only")
+				if w.Code != caller.status {
+					t.Fatalf("status %d, want %d: %s", w.Code, caller.status, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestCallerTenant(t *testing.T) {
+	for _, c := range []struct {
+		principal *principal
+		query     string
+		want      int
+	}{
+		{nil, "", 0},
+		{&principal{Role: roleAdmin}, "", 0},
+		{&principal{Role: roleAdmin}, "?tenant=4", 4},
+		{&principal{Role: roleAdmin, TenantID: 2}, "", 2},
+		{&principal{Role: roleAdmin, TenantID: 2}, "?tenant=4", 2},
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/devices"+c.query, nil)
+		if c.principal != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, c.principal))
+		}
+		if got := callerTenant(r); got != c.want {
+			t.Errorf("%+v %s: tenant %d, want %d", c.principal, c.query, got, c.want)
+		}
+	}
+}
+
+func TestVisibleIMEIs(t *testing.T) {
+	mock := useMockDB(t)
+	imeis := []string{"0861234567800042", "0861234567800043"}
+
+	if got, err := visibleIMEIs(0, imeis); err != nil || len(got) != 2 {
+		t.Fatalf("platform: %v, %v", got, err)
+	}
+	mock.ExpectQuery(`SELECT imei FROM devices WHERE imei = ANY\(\$1\) AND tenant_id = \$2`).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"imei"}).AddRow("0861234567800043"))
+	got, err := visibleIMEIs(2, imeis)
+	if err != nil || len(got) != 1 || got[0] != "0861234567800043" {
+		t.Fatalf("tenant 2: %v, %v", got, err)
+	}
+}
+
+func TestRestampTenants(t *testing.T) {
+	expectRestamp := func(mock sqlmock.Sqlmock, failAt string) {
+		mock.ExpectBegin()
+		for _, s := range []struct {
+			table, query string
+			rows         int64
+		}{
+			// devices move to the tenant their assignments now resolve to
+			{"devices", `UPDATE devices SET tenant_id = tenant_for\(imei, manufacturer_code\)\s+WHERE tenant_id IS DISTINCT FROM tenant_for\(imei, manufacturer_code\)`, 2},
+			// and their frames, readings and alerts follow them
+			{"meter_frames", `UPDATE meter_frames f SET tenant_id = d.tenant_id FROM devices d\s+WHERE d.imei = f.imei AND f.tenant_id IS DISTINCT FROM d.tenant_id`, 9},
+			{"messages", `UPDATE messages m SET tenant_id = f.tenant_id FROM meter_frames f\s+WHERE f.id = m.frame_id AND m.tenant_id IS DISTINCT FROM f.tenant_id`, 8},
+			{"alerts", `UPDATE alerts a SET tenant_id = d.tenant_id FROM devices d\s+WHERE d.imei = a.imei AND a.tenant_id IS DISTINCT FROM d.tenant_id`, 1},
+		} {
+			e := mock.ExpectExec(s.query)
+			if s.table == failAt {
+				e.WillReturnError(errors.New("deadlock detected"))
+				mock.ExpectRollback()
+				return
+			}
+			e.WillReturnResult(sqlmock.NewResult(0, s.rows))
+		}
+		mock.ExpectCommit()
+	}
+
+	t.Run("moves devices and frames", func(t *testing.T) {
+		expectRestamp(useMockDB(t), "")
+		w := tenantRequest(t, "POST", apiPrefix+"/admin/tenants/restamp", 0, "admin")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var res struct{ Updated map[string]int64 }
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int64{"devices": 2, "meter_frames": 9, "messages": 8, "alerts": 1}
+		for table, n := range want {
+			if res.Updated[table] != n {
+				t.Errorf("updated %v, want %v", res.Updated, want)
+			}
+		}
+	})
+
+	t.Run("rolls back on failure", func(t *testing.T) {
+		expectRestamp(useMockDB(t), "meter_frames")
+		if _, err := restampTenants(); err == nil || !strings.HasPrefix(err.Error(), "meter_frames: ") {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("platform only", func(t *testing.T) {
+		useMockDB(t)
+		if w := tenantRequest(t, "POST", apiPrefix+"/admin/tenants/restamp", 2, "admin"); w.Code != http.StatusForbidden {
+			t.Fatalf("tenant admin got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// -------------------------
+// TIME-SERIES EXPORT
+// -------------------------
+// Optional: with TSDB_URL set, every stored reading is pushed to a time-series
+// database for Grafana, in the format TSDB_FORMAT names:
+//
+//	influx      InfluxDB line protocol POSTed to the write endpoint, e.g.
+//	            http://influx:8086/api/v2/write?org=acme&bucket=meters or
+//	            http://influx:8086/write?db=meters on 1.x
+//	prometheus  Prometheus remote write 1.0 (snappy-compressed protobuf), e.g.
+//	            http://prometheus:9090/api/v1/write, Mimir or VictoriaMetrics
+//
+// A reading becomes one "meter" point, or one sample per value, at the time
+// it was received, tagged imei, serial, manufacturer and model:
+//
+//	field        metric
+//	total        meter_reading_total_raw
+//	flow         meter_reading_flow_raw
+//	pressure     meter_reading_pressure_raw
+//	temperature  meter_reading_temperature_raw
+//	battery      meter_reading_battery_raw
+//	rssi         meter_reading_rssi_raw
+//
+// Values are exported exactly as the frame carries them. Their units and
+// scale depend on the meter model, so the names promise none; convert in the
+// dashboard.
+//
+// Values the frame did not carry are left out, as are empty tags. model is
+// the device's stored model, so it stays the same on frames that omit it.
+//
+// Like MQTT publishing this never blocks ingest: readings queue in memory,
+// up to TSDB_BUFFER before the oldest go, and a worker sends them in batches
+// of TSDB_BATCH, at least every TSDB_FLUSH_INTERVAL. A batch that fails on
+// the network, with 429 or with a 5xx is retried with backoff; any other
+// status means the endpoint will never take it, so it is logged and dropped.
+// TSDB_TOKEN is sent as "Token ..." to InfluxDB and "Bearer ..." for remote
+// write; user:password in the URL is sent as basic auth.
+
+const (
+	tsdbInflux     = "influx"
+	tsdbPrometheus = "prometheus"
+)
+
+type tsdbConfig struct {
+	URL           string
+	Format        string
+	Token         string
+	Batch         int
+	Buffer        int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	RetryInterval time.Duration // first backoff, doubled up to MaxBackoff
+	MaxBackoff    time.Duration
+}
+
+func tsdbConfigFromEnv() (tsdbConfig, error) {
+	c := tsdbConfig{
+		URL:           os.Getenv("TSDB_URL"),
+		Format:        getenv("TSDB_FORMAT", tsdbInflux),
+		Token:         os.Getenv("TSDB_TOKEN"),
+		Timeout:       30 * time.Second,
+		RetryInterval: time.Second,
+		MaxBackoff:    time.Minute,
+	}
+	if c.Format != tsdbInflux && c.Format != tsdbPrometheus {
+		return c, fmt.Errorf("TSDB_FORMAT must be influx or prometheus")
+	}
+	var err error
+	if c.Batch, err = strconv.Atoi(getenv("TSDB_BATCH", "1000")); err != nil || c.Batch < 1 {
+		return c, fmt.Errorf("TSDB_BATCH must be a positive number")
+	}
+	if c.Buffer, err = strconv.Atoi(getenv("TSDB_BUFFER", "50000")); err != nil || c.Buffer < c.Batch {
+		return c, fmt.Errorf("TSDB_BUFFER must be a number no smaller than TSDB_BATCH")
+	}
+	if c.FlushInterval, err = time.ParseDuration(getenv("TSDB_FLUSH_INTERVAL", "10s")); err != nil || c.FlushInterval <= 0 {
+		return c, fmt.Errorf("TSDB_FLUSH_INTERVAL must be a positive duration")
+	}
+	return c, nil
+}
+
+// tsdbFields maps decoded reading keys to the exported field and metric names.
+var tsdbFields = []struct{ Key, Field, Metric string }{
+	{"total", "total", "meter_reading_total_raw"},
+	{"flow", "flow", "meter_reading_flow_raw"},
+	{"pressure", "pressure", "meter_reading_pressure_raw"},
+	{"temperature", "temperature", "meter_reading_temperature_raw"},
+	{"battery", "battery", "meter_reading_battery_raw"},
+	{"rssi_raw", "rssi", "meter_reading_rssi_raw"},
+}
+
+// tsdbReading is one reading ready for export; Values is indexed like
+// tsdbFields and has nil for values the frame did not carry.
+type tsdbReading struct {
+	IMEI         string
+	Serial       string
+	Manufacturer string
+	Model        string
+	At           time.Time
+	Values       []*int64
+}
+
+// tags returns the non-empty tags, sorted by key.
+func (r tsdbReading) tags() [][2]string {
+	var tags [][2]string
+	for _, t := range [][2]string{
+		{"imei", r.IMEI},
+		{"manufacturer", r.Manufacturer},
+		{"model", r.Model},
+		{"serial", r.Serial},
+	} {
+		if t[1] != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func newTSDBReading(ev liveEvent, model string) (tsdbReading, bool) {
+	r := tsdbReading{
+		IMEI:         ev.IMEI,
+		Serial:       getString(ev.Decoded["serial"]),
+		Manufacturer: ev.ManufacturerCode,
+		Model:        model,
+		At:           ev.ReceivedAt,
+		Values:       make([]*int64, len(tsdbFields)),
+	}
+	found := false
+	for i, f := range tsdbFields {
+		if v, ok := ev.Decoded[f.Key]; ok && v != nil {
+			n := int64(getInt(v))
+			r.Values[i] = &n
+			found = true
+		}
+	}
+	return r, found
+}
+
+type tsdbExporter struct {
+	cfg    tsdbConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	queue  []tsdbReading
+	full   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// tsdbOut is nil unless TSDB_URL is set; its methods are no-ops on nil.
+var tsdbOut *tsdbExporter
+
+func startTSDBExport() error {
+	cfg, err := tsdbConfigFromEnv()
+	if err != nil || cfg.URL == "" {
+		return err
+	}
+	tsdbOut = newTSDBExporter(cfg)
+	slog.Info("time-series export enabled", "format", cfg.Format, "batch", cfg.Batch, "flush_interval", cfg.FlushInterval)
+	return nil
+}
+
+func newTSDBExporter(cfg tsdbConfig) *tsdbExporter {
+	x := &tsdbExporter{
+		cfg:    cfg,
+		client: &http.Client{},
+		full:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go x.run()
+	return x
+}
+
+// publishReading queues a stored reading; readings without any exported
+// value are skipped.
+func (x *tsdbExporter) publishReading(ev liveEvent, model string) {
+	if x == nil || ev.IMEI == "" {
+		return
+	}
+	r, ok := newTSDBReading(ev, model)
+	if !ok {
+		return
+	}
+	x.mu.Lock()
+	if len(x.queue) >= x.cfg.Buffer {
+		x.queue = x.queue[1:]
+		tsdbDropped.WithLabelValues("overflow").Inc()
+	}
+	x.queue = append(x.queue, r)
+	n := len(x.queue)
+	tsdbQueued.Set(float64(n))
+	x.mu.Unlock()
+
+	if n >= x.cfg.Batch {
+		select {
+		case x.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends whatever is queued on every tick and whenever a batch fills up.
+// A batch being sent is off the queue and goes back to its head to be
+// retried, like mqttPublisher.requeue.
+func (x *tsdbExporter) run() {
+	defer close(x.done)
+	tick := time.NewTicker(x.cfg.FlushInterval)
+	defer tick.Stop()
+	wait := x.cfg.RetryInterval
+	for {
+		select {
+		case <-x.closed:
+			return
+		case <-tick.C:
+		case <-x.full:
+		}
+
+		for {
+			batch := x.take()
+			if len(batch) == 0 {
+				break
+			}
+			retry, err := x.send(batch)
+			if err == nil {
+				tsdbExported.Add(float64(len(batch)))
+				wait = x.cfg.RetryInterval
+				continue
+			}
+			if !retry {
+				slog.Error("time-series export rejected, dropping batch", "readings", len(batch), "err", err)
+				tsdbDropped.WithLabelValues("rejected").Add(float64(len(batch)))
+				continue
+			}
+			slog.Warn("time-series export failed, will retry", "readings", len(batch), "in", wait, "err", err)
+			x.requeue(batch)
+			select {
+			case <-x.closed:
+				return
+			case <-time.After(wait):
+			}
+			wait = min(wait*2, x.cfg.MaxBackoff)
+		}
+	}
+}
+
+func (x *tsdbExporter) take() []tsdbReading {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	n := min(len(x.queue), x.cfg.Batch)
+	batch := slices.Clone(x.queue[:n])
+	x.queue = x.queue[n:]
+	tsdbQueued.Set(float64(len(x.queue)))
+	return batch
+}
+
+// requeue puts a failed batch back at the head; if newer readings have
+// filled the buffer meanwhile, the oldest of the batch are dropped.
+func (x *tsdbExporter) requeue(batch []tsdbReading) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if over := len(batch) + len(x.queue) - x.cfg.Buffer; over > 0 {
+		over = min(over, len(batch))
+		batch = batch[over:]
+		tsdbDropped.WithLabelValues("overflow").Add(float64(over))
+	}
+	x.queue = append(batch, x.queue...)
+	tsdbQueued.Set(float64(len(x.queue)))
+}
+
+// send writes one batch and says whether a failure is worth retrying.
+func (x *tsdbExporter) send(batch []tsdbReading) (retry bool, err error) {
+	header := http.Header{"User-Agent": {"meter-server"}}
+	var body []byte
+	switch x.cfg.Format {
+	case tsdbInflux:
+		body = influxLines(batch)
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		if x.cfg.Token != "" {
+			header.Set("Authorization", "Token "+x.cfg.Token)
+		}
+	case tsdbPrometheus:
+		body = snappy.Encode(nil, remoteWriteRequest(batch))
+		header.Set("Content-Type", "application/x-protobuf")
+		header.Set("Content-Encoding", "snappy")
+		header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		if x.cfg.Token != "" {
+			header.Set("Authorization", "Bearer "+x.cfg.Token)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), x.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", x.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = header
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// Close stops the worker; unsent readings are dropped.
+func (x *tsdbExporter) Close() {
+	if x == nil {
+		return
+	}
+	close(x.closed)
+	<-x.done
+}
+
+// influxEscape escapes measurement names, tag keys and tag values. Line
+// protocol has no escape for newlines, so they are dropped.
+var influxEscape = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "", "\r", "")
+
+// influxLines encodes readings as line protocol with nanosecond timestamps,
+// the default precision of both write endpoints.
+func influxLines(readings []tsdbReading) []byte {
+	var b []byte
+	for _, r := range readings {
+		b = append(b, "meter"...)
+		for _, t := range r.tags() {
+			b = append(b, ',')
+			b = append(b, influxEscape.Replace(t[0])...)
+			b = append(b, '=')
+			b = append(b, influxEscape.Replace(t[1])...)
+		}
+		sep := byte(' ')
+		for i, f := range tsdbFields {
+			if r.Values[i] == nil {
+				continue
+			}
+			b = append(b, sep)
+			b = append(b, f.Field...)
+			b = append(b, '=')
+			b = strconv.AppendInt(b, *r.Values[i], 10)
+			b = append(b, 'i')
+			sep = ','
+		}
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, r.At.UnixNano(), 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// remoteWriteRequest encodes readings as a prometheus.WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; } // milliseconds
+//
+// Samples of the same series are merged into one TimeSeries in time order,
+// since receivers reject out-of-order samples within a series.
+func remoteWriteRequest(readings []tsdbReading) []byte {
+	type sample struct {
+		value float64
+		ms    int64
+	}
+	type series struct {
+		labels  [][2]string
+		samples []sample
+	}
+	var order []string
+	byKey := map[string]*series{}
+	for _, r := range readings {
+		tags := r.tags()
+		for i, f := range tsdbFields {
+			if r.Values[i] == nil {
+				continue
+			}
+			// __name__ sorts before the lower-case tag names
+			labels := append([][2]string{{"__name__", f.Metric}}, tags...)
+			key := fmt.Sprint(labels)
+			s, ok := byKey[key]
+			if !ok {
+				s = &series{labels: labels}
+				byKey[key] = s
+				order = append(order, key)
+			}
+			s.samples = append(s.samples, sample{float64(*r.Values[i]), r.At.UnixMilli()})
+		}
+	}
+
+	var b []byte
+	for _, key := range order {
+		s := byKey[key]
+		slices.SortStableFunc(s.samples, func(a, b sample) int { return cmp.Compare(a.ms, b.ms) })
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l[0])
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l[1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		for _, smp := range s.samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(smp.value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(smp.ms))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sb)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
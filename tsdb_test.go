@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var tsdbTestTime = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func tsdbTestEvent(imei string, at time.Time, decoded map[string]interface{}) liveEvent {
+	return liveEvent{ID: 1, IMEI: imei, ManufacturerCode: "0A1B", ReceivedAt: at, Decoded: decoded}
+}
+
+func TestInfluxLines(t *testing.T) {
+	r1, _ := newTSDBReading(tsdbTestEvent("0861234567800042", tsdbTestTime,
+		map[string]interface{}{"total": 1234, "flow": 5.0, "rssi_raw": 80, "serial": "12345678", "valve": 1}), "WM 20,B=x")
+	r2, _ := newTSDBReading(tsdbTestEvent("0861234567800043", tsdbTestTime.Add(time.Second),
+		map[string]interface{}{"battery": 87}), "")
+
+	want := "meter,imei=0861234567800042,manufacturer=0A1B,model=WM\\ 20\\,B\\=x,serial=12345678 total=1234i,flow=5i,rssi=80i 1790856000000000000\n" +
+		"meter,imei=0861234567800043,manufacturer=0A1B battery=87i 1790856001000000000\n"
+	if got := string(influxLines([]tsdbReading{r1, r2})); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if _, ok := newTSDBReading(tsdbTestEvent("0861234567800042", tsdbTestTime, map[string]interface{}{"valve": 1}), ""); ok {
+		t.Error("reading without exported values was kept")
+	}
+}
+
+type rwSeries struct {
+	Labels  map[string]string
+	Order   []string // label names as sent
+	Samples [][2]float64
+}
+
+// decodeWriteRequest is the inverse of remoteWriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []rwSeries {
+	t.Helper()
+	field := func(b []byte) (protowire.Number, protowire.Type, []byte, []byte) {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		return num, typ, b[:n], b[n:]
+	}
+	bytesValue := func(v []byte) []byte {
+		s, n := protowire.ConsumeBytes(v)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		return s
+	}
+
+	var out []rwSeries
+	for len(b) > 0 {
+		num, _, v, rest := field(b)
+		b = rest
+		if num != 1 {
+			t.Fatalf("WriteRequest field %d", num)
+		}
+		s := rwSeries{Labels: map[string]string{}}
+		ts := bytesValue(v)
+		for len(ts) > 0 {
+			num, _, v, rest := field(ts)
+			ts = rest
+			m := bytesValue(v)
+			var pair [2][]byte
+			var sample [2]float64
+			for len(m) > 0 {
+				fnum, typ, fv, rest := field(m)
+				m = rest
+				switch {
+				case typ == protowire.BytesType:
+					pair[fnum-1] = bytesValue(fv)
+				case typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(fv)
+					sample[0] = math.Float64frombits(bits)
+				case typ == protowire.VarintType:
+					ms, _ := protowire.ConsumeVarint(fv)
+					sample[1] = float64(int64(ms))
+				}
+			}
+			switch num {
+			case 1:
+				s.Labels[string(pair[0])] = string(pair[1])
+				s.Order = append(s.Order, string(pair[0]))
+			case 2:
+				s.Samples = append(s.Samples, sample)
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestRemoteWriteRequest(t *testing.T) {
+	later, _ := newTSDBReading(tsdbTestEvent("0861234567800042", tsdbTestTime.Add(time.Minute),
+		map[string]interface{}{"total": 1300}), "WM20")
+	earlier, _ := newTSDBReading(tsdbTestEvent("0861234567800042", tsdbTestTime,
+		map[string]interface{}{"total": 1234, "temperature": -3}), "WM20")
+
+	series := decodeWriteRequest(t, remoteWriteRequest([]tsdbReading{later, earlier}))
+	if len(series) != 2 {
+		t.Fatalf("%d series, want 2: %+v", len(series), series)
+	}
+	volume, temp := series[0], series[1]
+	if volume.Labels["__name__"] != "meter_reading_total_raw" || temp.Labels["__name__"] != "meter_reading_temperature_raw" {
+		t.Fatalf("series %v, %v", volume.Labels, temp.Labels)
+	}
+	want := []string{"__name__", "imei", "manufacturer", "model"}
+	if len(volume.Order) != len(want) {
+		t.Fatalf("labels %v, want %v", volume.Order, want)
+	}
+	for i, name := range want {
+		if volume.Order[i] != name {
+			t.Errorf("labels %v, want %v", volume.Order, want)
+		}
+	}
+	if volume.Labels["imei"] != "0861234567800042" || volume.Labels["model"] != "WM20" {
+		t.Errorf("labels %v", volume.Labels)
+	}
+
+	ms := float64(tsdbTestTime.UnixMilli())
+	if len(volume.Samples) != 2 || volume.Samples[0] != [2]float64{1234, ms} || volume.Samples[1] != [2]float64{1300, ms + 60000} {
+		t.Errorf("volume samples %v, want both in time order", volume.Samples)
+	}
+	if len(temp.Samples) != 1 || temp.Samples[0] != [2]float64{-3, ms} {
+		t.Errorf("temperature samples %v", temp.Samples)
+	}
+}
+
+func TestTSDBExporterRetries(t *testing.T) {
+	var mu sync.Mutex
+	var statuses = []int{http.StatusServiceUnavailable, http.StatusBadRequest, http.StatusNoContent}
+	var bodies [][]byte
+	got := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Authorization") != "Bearer tok" ||
+			r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("headers %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(status)
+		got <- struct{}{}
+	}))
+	defer srv.Close()
+
+	x := newTSDBExporter(tsdbConfig{
+		URL: srv.URL, Format: tsdbPrometheus, Token: "tok", Batch: 2, Buffer: 10,
+		FlushInterval: time.Hour, Timeout: time.Second, RetryInterval: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond,
+	})
+	defer x.Close()
+
+	// the first batch fills up, fails with 503 and is retried, then the
+	// endpoint rejects it and it is dropped; the third reading goes next
+	for i := range 3 {
+		x.publishReading(tsdbTestEvent("0861234567800042", tsdbTestTime.Add(time.Duration(i)*time.Minute),
+			map[string]interface{}{"total": 1000 + i}), "")
+	}
+	for range 3 {
+		select {
+		case <-got:
+		case <-time.After(5 * time.Second):
+			t.Fatal("export request missing")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var samples [][][2]float64
+	for _, b := range bodies {
+		pb, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := decodeWriteRequest(t, pb)
+		if len(s) != 1 {
+			t.Fatalf("%d series", len(s))
+		}
+		samples = append(samples, s[0].Samples)
+	}
+	if len(samples[0]) != 2 || len(samples[1]) != 2 || samples[0][1] != samples[1][1] {
+		t.Errorf("retry sent %v, first attempt %v", samples[1], samples[0])
+	}
+	if len(samples[2]) != 1 || samples[2][0][0] != 1002 {
+		t.Errorf("last batch %v, want the third reading", samples[2])
+	}
+}
+
+func TestNilTSDBExporterIsNoop(t *testing.T) {
+	var x *tsdbExporter
+	x.publishReading(tsdbTestEvent("0861234567800042", tsdbTestTime, map[string]interface{}{"total": 1}), "")
+	x.Close()
+}
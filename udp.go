@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -------------------------
+// UDP / CoAP LISTENERS
+// -------------------------
+// NB-IoT meters that cannot afford a TCP handshake send the same 0x68 frame
+// in a single datagram, either bare on UDP_ADDR (default :9000/udp) or as the
+// payload of a CoAP POST or PUT to any path on COAP_ADDR (default :5683).
+// Setting either to "off" disables it. Both feed ingestFrame; a stored frame
+// is answered with "OK" on UDP and 2.04 Changed on CoAP, sent back to the
+// source address.
+//
+// Datagrams get lost, so meters retransmit. A retransmission is answered
+// again from retransmitCache without storing the frame twice: CoAP messages
+// by source address and CoAP message ID as RFC 7252 requires, and on both
+// listeners byte-identical frames by IMEI, the frame's own MID and a hash of
+// the packet, which also catches a meter that gave up on one CoAP exchange and
+// resent the frame in a new one.
+
+// retransmitWindow is how long a reply is remembered: CoAP's EXCHANGE_LIFETIME.
+const retransmitWindow = 247 * time.Second
+
+// retransmitCache remembers the reply sent for each recently seen message.
+type retransmitCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]retransmitEntry
+	nextPurge time.Time
+}
+
+type retransmitEntry struct {
+	reply   []byte // nil while the first copy is still being handled
+	expires time.Time
+}
+
+func newRetransmitCache(ttl time.Duration) *retransmitCache {
+	return &retransmitCache{ttl: ttl, entries: map[string]retransmitEntry{}}
+}
+
+// begin claims key. dup is true when key was seen within the window; reply
+// is then what the first copy was answered with, or nil while it is still
+// being handled, in which case the retransmission is dropped.
+func (c *retransmitCache) begin(key string) (reply []byte, dup bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.After(c.nextPurge) {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextPurge = now.Add(c.ttl)
+	}
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		return e.reply, true
+	}
+	c.entries[key] = retransmitEntry{expires: now.Add(c.ttl)}
+	return nil, false
+}
+
+// finish records the reply to key. A nil reply releases the key, so that a
+// frame that could not be stored is tried again when it is retransmitted.
+func (c *retransmitCache) finish(key string, reply []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reply == nil {
+		delete(c.entries, key)
+		return
+	}
+	c.entries[key] = retransmitEntry{reply: reply, expires: time.Now().Add(c.ttl)}
+}
+
+// frameRetransmitKey identifies a frame by IMEI, MID and a hash of the whole
+// packet, or is empty when the header cannot be read and the frame will be
+// rejected anyway. The header is not checksummed yet, so only a byte-identical
+// copy counts as a retransmission: a different frame that reuses the MID, or
+// a corrupted copy, is ingested on its own.
+func frameRetransmitKey(packet []byte) string {
+	h, err := parseFrameHeader(packet)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(packet)
+	return fmt.Sprintf("frame/%v/%v/%x", h["imei"], h["mid"], sum[:16])
+}
+
+// datagramServer is what the UDP and CoAP listeners share.
+type datagramServer struct {
+	pc        net.PacketConn
+	transport string
+	seen      *retransmitCache
+}
+
+func newDatagramServer(pc net.PacketConn, transport string) *datagramServer {
+	return &datagramServer{pc: pc, transport: transport, seen: newRetransmitCache(retransmitWindow)}
+}
+
+// serve reads datagrams until pc is closed, handling each in its own goroutine.
+func (s *datagramServer) serve(handle func(from net.Addr, packet []byte)) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("datagram read failed", "transport", s.transport, "err", err)
+			continue
+		}
+		go handle(from, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// errRetransmitInFlight is ingest's answer to a retransmission that arrives
+// while the first copy is still being stored; it is dropped unanswered.
+var errRetransmitInFlight = errors.New("retransmission of a frame still being stored")
+
+// ingest stores packet unless its frame was stored within the window, in
+// which case the result is stored without touching the database again.
+func (s *datagramServer) ingest(from net.Addr, packet []byte) ingestResult {
+	key := frameRetransmitKey(packet)
+	if key != "" {
+		if reply, dup := s.seen.begin(key); dup {
+			datagramRetransmits.WithLabelValues(s.transport).Inc()
+			if reply == nil {
+				return ingestResult{Err: errRetransmitInFlight}
+			}
+			return ingestResult{}
+		}
+	}
+	meta := singleFrameMeta(s.transport, packet, from.String(), s.pc.LocalAddr().String())
+	res := ingestFrame(meta, slog.With("session", meta.SessionID, "remote", meta.RemoteAddr, "transport", s.transport))
+	if key != "" {
+		var reply []byte
+		if res.stored() {
+			reply = []byte("OK")
+		}
+		s.seen.finish(key, reply)
+	}
+	return res
+}
+
+// listenDatagrams opens addr unless it is "off".
+func listenDatagrams(name, addr string) net.PacketConn {
+	if addr == "off" {
+		return nil
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		fatal(name+" error", "err", err)
+	}
+	slog.Info(name+" listening", "addr", pc.LocalAddr().String())
+	return pc
+}
+
+// -------------------------
+// UDP SERVER
+// -------------------------
+func startUDPServer() {
+	if pc := listenDatagrams("UDP", getenv("UDP_ADDR", ":9000")); pc != nil {
+		s := newDatagramServer(pc, transportUDP)
+		s.serve(s.handleUDP)
+	}
+}
+
+func (s *datagramServer) handleUDP(from net.Addr, packet []byte) {
+	if s.ingest(from, packet).stored() {
+		s.pc.WriteTo([]byte("OK"), from)
+	}
+}
+
+// -------------------------
+// CoAP SERVER
+// -------------------------
+// Only what a meter needs from RFC 7252: confirmable (CON) requests are
+// answered with a piggybacked ACK carrying the response, non-confirmable
+// (NON) ones with a NON response, and an empty CON ("CoAP ping") with a
+// reset. There is no blockwise transfer, observe or discovery.
+
+// CoAP message types
+const (
+	coapCON byte = 0
+	coapNON byte = 1
+	coapACK byte = 2
+	coapRST byte = 3
+)
+
+// CoAP codes, class<<5 | detail
+const (
+	coapEmpty            byte = 0x00
+	coapPOST             byte = 0x02
+	coapPUT              byte = 0x03
+	coapChanged          byte = 0x44 // 2.04
+	coapBadRequest       byte = 0x80 // 4.00
+	coapMethodNotAllowed byte = 0x85 // 4.05
+	coapUnavailable      byte = 0xA3 // 5.03
+)
+
+const coapOptionURIPath = 11
+
+type coapOption struct {
+	Number uint16
+	Value  []byte
+}
+
+type coapMessage struct {
+	Type    byte
+	Code    byte
+	MID     uint16
+	Token   []byte
+	Options []coapOption // in ascending Number order
+	Payload []byte
+}
+
+var errCoAPFormat = errors.New("malformed CoAP message")
+
+// parseCoAP decodes a CoAP message (RFC 7252 section 3).
+func parseCoAP(b []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return m, errCoAPFormat
+	}
+	m.Type = b[0] >> 4 & 3
+	tkl := int(b[0] & 0x0F)
+	m.Code = b[1]
+	m.MID = binary.BigEndian.Uint16(b[2:4])
+	if tkl > 8 || len(b) < 4+tkl {
+		return m, errCoAPFormat
+	}
+	m.Token = b[4 : 4+tkl]
+	b = b[4+tkl:]
+
+	var number uint16
+	for len(b) > 0 {
+		if b[0] == 0xFF {
+			if len(b) == 1 {
+				return m, errCoAPFormat // payload marker without payload
+			}
+			m.Payload = b[1:]
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		b = b[1:]
+		var err error
+		if delta, b, err = coapOptionNibble(delta, b); err != nil {
+			return m, err
+		}
+		if length, b, err = coapOptionNibble(length, b); err != nil {
+			return m, err
+		}
+		if len(b) < length {
+			return m, errCoAPFormat
+		}
+		number += uint16(delta)
+		m.Options = append(m.Options, coapOption{Number: number, Value: b[:length]})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// coapOptionNibble reads the extended form of an option delta or length.
+func coapOptionNibble(v int, b []byte) (int, []byte, error) {
+	switch {
+	case v < 13:
+		return v, b, nil
+	case v == 13 && len(b) >= 1:
+		return int(b[0]) + 13, b[1:], nil
+	case v == 14 && len(b) >= 2:
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	}
+	return 0, nil, errCoAPFormat
+}
+
+func (m coapMessage) marshal() []byte {
+	b := []byte{1<<6 | m.Type<<4 | byte(len(m.Token)), m.Code, byte(m.MID >> 8), byte(m.MID)}
+	b = append(b, m.Token...)
+	var prev uint16
+	for _, o := range m.Options {
+		delta, length := int(o.Number-prev), len(o.Value)
+		prev = o.Number
+		dn, dx := coapNibble(delta)
+		ln, lx := coapNibble(length)
+		b = append(b, dn<<4|ln)
+		b = append(append(b, dx...), lx...)
+		b = append(b, o.Value...)
+	}
+	if len(m.Payload) > 0 {
+		b = append(append(b, 0xFF), m.Payload...)
+	}
+	return b
+}
+
+func coapNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	}
+	return 14, binary.BigEndian.AppendUint16(nil, uint16(v-269))
+}
+
+func (m coapMessage) path() string {
+	p := ""
+	for _, o := range m.Options {
+		if o.Number == coapOptionURIPath {
+			p += "/" + string(o.Value)
+		}
+	}
+	return p
+}
+
+type coapServer struct {
+	*datagramServer
+	mu      sync.Mutex
+	nextMID uint16 // for NON responses
+}
+
+func startCoAPServer() {
+	if pc := listenDatagrams("CoAP", getenv("COAP_ADDR", ":5683")); pc != nil {
+		s := &coapServer{datagramServer: newDatagramServer(pc, transportCoAP), nextMID: uint16(time.Now().UnixNano())}
+		s.serve(s.handleCoAP)
+	}
+}
+
+func (s *coapServer) handleCoAP(from net.Addr, packet []byte) {
+	req, err := parseCoAP(packet)
+	if err != nil {
+		framesInvalid.WithLabelValues(invalidPayload).Inc()
+		slog.Warn("ignoring malformed CoAP message", "remote", from.String(), "bytes", len(packet))
+		return
+	}
+	if req.Type == coapACK || req.Type == coapRST {
+		return // we never send CON, so there is nothing to acknowledge
+	}
+
+	// RFC 7252 4.5: a duplicate gets the response sent the first time
+	key := "coap/" + from.String() + "/" + strconv.Itoa(int(req.MID))
+	if reply, dup := s.seen.begin(key); dup {
+		datagramRetransmits.WithLabelValues(transportCoAP).Inc()
+		if reply != nil {
+			s.pc.WriteTo(reply, from)
+		}
+		return
+	}
+	res, ok := s.respond(from, req)
+	if !ok {
+		s.seen.finish(key, nil)
+		return
+	}
+	reply := res.marshal()
+	s.pc.WriteTo(reply, from)
+	if res.Code == coapUnavailable {
+		reply = nil // let the meter's retransmission try again
+	}
+	s.seen.finish(key, reply)
+}
+
+// respond handles req and builds the response to send back; ok is false
+// when the request is dropped unanswered.
+func (s *coapServer) respond(from net.Addr, req coapMessage) (res coapMessage, ok bool) {
+	res = coapMessage{Type: coapACK, MID: req.MID, Token: req.Token}
+	if req.Type == coapNON {
+		res.Type = coapNON
+		s.mu.Lock()
+		s.nextMID++
+		res.MID = s.nextMID
+		s.mu.Unlock()
+	}
+
+	switch {
+	case req.Code == coapEmpty:
+		return coapMessage{Type: coapRST, MID: req.MID}, true // CoAP ping
+	case req.Code != coapPOST && req.Code != coapPUT:
+		res.Code = coapMethodNotAllowed
+		return res, true
+	}
+
+	frame, err := framePayload(req.Payload)
+	if err != nil {
+		res.Code, res.Payload = coapBadRequest, []byte(err.Error())
+		return res, true
+	}
+	slog.Debug("CoAP request", "remote", from.String(), "path", req.path(), "bytes", len(frame))
+	ir := s.ingest(from, frame)
+	switch {
+	case ir.stored():
+		res.Code, res.Payload = coapChanged, []byte("OK")
+	case ir.Rejected != "":
+		res.Code, res.Payload = coapBadRequest, []byte("frame rejected: "+ir.Rejected)
+	case ir.Err == errRetransmitInFlight:
+		return res, false
+	default:
+		res.Code = coapUnavailable
+	}
+	return res, true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoAPRoundTrip(t *testing.T) {
+	m := coapMessage{
+		Type: coapCON, Code: coapPOST, MID: 0xBEEF, Token: []byte{1, 2, 3},
+		Options: []coapOption{
+			{Number: coapOptionURIPath, Value: []byte("t")},
+			{Number: coapOptionURIPath, Value: []byte("d")},
+			{Number: 12, Value: []byte{42}},                       // Content-Format
+			{Number: 60, Value: []byte{1}},                        // Size1: one-byte extended delta
+			{Number: 2100, Value: bytes.Repeat([]byte{'x'}, 300)}, // two-byte extended delta and length
+		},
+		Payload: testFrame([]byte{0x08, 0x55}),
+	}
+	got, err := parseCoAP(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != m.Type || got.Code != m.Code || got.MID != m.MID || !bytes.Equal(got.Token, m.Token) ||
+		!bytes.Equal(got.Payload, m.Payload) || len(got.Options) != len(m.Options) {
+		t.Fatalf("got %+v", got)
+	}
+	for i, o := range m.Options {
+		if got.Options[i].Number != o.Number || !bytes.Equal(got.Options[i].Value, o.Value) {
+			t.Errorf("option %d: %d %q", i, got.Options[i].Number, got.Options[i].Value)
+		}
+	}
+	if got.path() != "/t/d" {
+		t.Errorf("path %q", got.path())
+	}
+
+	for _, b := range [][]byte{
+		{0x40, 0x02},                  // short header
+		{0x80, 0x02, 0, 1},            // version 2
+		{0x49, 0x02, 0, 1},            // token length 9
+		{0x40, 0x02, 0, 1, 0xFF},      // payload marker with no payload
+		{0x40, 0x02, 0, 1, 0xB5, 'a'}, // option value past the end
+		{0x40, 0x02, 0, 1, 0xF0},      // reserved delta 15
+	} {
+		if _, err := parseCoAP(b); err == nil {
+			t.Errorf("% X parsed", b)
+		}
+	}
+}
+
+func TestRetransmitCache(t *testing.T) {
+	c := newRetransmitCache(50 * time.Millisecond)
+	if _, dup := c.begin("a"); dup {
+		t.Fatal("first copy is a duplicate")
+	}
+	if reply, dup := c.begin("a"); !dup || reply != nil {
+		t.Fatalf("in-flight copy: %q %v", reply, dup)
+	}
+	c.finish("a", []byte("OK"))
+	if reply, dup := c.begin("a"); !dup || string(reply) != "OK" {
+		t.Fatalf("answered copy: %q %v", reply, dup)
+	}
+
+	// a failed copy is released for the retransmission to try again
+	c.begin("b")
+	c.finish("b", nil)
+	if _, dup := c.begin("b"); dup {
+		t.Error("failed copy still claimed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, dup := c.begin("a"); dup {
+		t.Error("reply outlived the window")
+	}
+}
+
+func TestFrameRetransmitKey(t *testing.T) {
+	a := testFrame([]byte{0x08, 0x55})
+	if frameRetransmitKey(a) == "" {
+		t.Fatal("no key for a valid frame")
+	}
+	if frameRetransmitKey(a) != frameRetransmitKey(append([]byte(nil), a...)) {
+		t.Error("identical copies have different keys")
+	}
+	// same IMEI and MID, different contents
+	if frameRetransmitKey(a) == frameRetransmitKey(testFrame([]byte{0x08, 0x56})) {
+		t.Error("a different frame reusing the MID counts as a retransmission")
+	}
+	if frameRetransmitKey([]byte{0x68, 0x00}) != "" {
+		t.Error("key for an unreadable header")
+	}
+}
+
+// coapExchange sends req to the server and returns its answer, or nil after
+// a short wait for none.
+func coapExchange(t *testing.T, conn net.Conn, req []byte) []byte {
+	t.Helper()
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestCoAPServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s := &coapServer{datagramServer: newDatagramServer(pc, transportCoAP)}
+	go s.serve(s.handleCoAP)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// ping
+	res, err := parseCoAP(coapExchange(t, conn, coapMessage{Type: coapCON, MID: 1}.marshal()))
+	if err != nil || res.Type != coapRST || res.MID != 1 {
+		t.Errorf("ping: %+v %v", res, err)
+	}
+
+	// GET is not how frames are sent
+	res, err = parseCoAP(coapExchange(t, conn, coapMessage{Type: coapCON, Code: 0x01, MID: 2, Token: []byte{9}}.marshal()))
+	if err != nil || res.Type != coapACK || res.Code != coapMethodNotAllowed || res.MID != 2 || !bytes.Equal(res.Token, []byte{9}) {
+		t.Errorf("GET: %+v %v", res, err)
+	}
+
+	// a frame too short to store is a 4.00, and its retransmission gets the same bytes
+	req := coapMessage{Type: coapCON, Code: coapPOST, MID: 3, Token: []byte{7, 7}, Payload: []byte{0x68, 0x00, 0x16}}.marshal()
+	first := coapExchange(t, conn, req)
+	res, err = parseCoAP(first)
+	if err != nil || res.Type != coapACK || res.Code != coapBadRequest || res.MID != 3 || !strings.Contains(string(res.Payload), invalidShort) {
+		t.Errorf("short frame: %+v %v", res, err)
+	}
+	if again := coapExchange(t, conn, req); !bytes.Equal(again, first) {
+		t.Errorf("retransmission answered % X, first % X", again, first)
+	}
+	if reply, dup := s.seen.begin("coap/" + conn.LocalAddr().String() + "/3"); !dup || !bytes.Equal(reply, first) {
+		t.Errorf("exchange not remembered: % X", reply)
+	}
+
+	// NON requests get a NON response with the request's token
+	res, err = parseCoAP(coapExchange(t, conn, coapMessage{Type: coapNON, Code: coapPOST, MID: 4, Token: []byte{5}, Payload: []byte("zz")}.marshal()))
+	if err != nil || res.Type != coapNON || res.Code != coapBadRequest || !bytes.Equal(res.Token, []byte{5}) {
+		t.Errorf("NON: %+v %v", res, err)
+	}
+
+	// malformed datagrams are ignored
+	if b := coapExchange(t, conn, []byte{0x00}); b != nil {
+		t.Errorf("answered a malformed datagram: % X", b)
+	}
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// -------------------------
+// WEBHOOKS
+// -------------------------
+// Events raised at ingest are fanned out into one webhook_deliveries row per
+// subscribed endpoint; a background worker POSTs them, retrying with
+// exponential backoff, and moves deliveries that never succeed to
+// webhook_dead_letters.
+//
+// Every request carries
+//
+//	X-Webhook-Id:        delivery id
+//	X-Webhook-Event:     event type
+//	X-Webhook-Timestamp: unix seconds
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256(secret, timestamp + "." + body)>
+
+// event types
+const (
+	eventAlarmPrefix  = "alarm." // alarm.magnetic_tamper, alarm.low_battery
+	eventValveChanged = "valve.changed"
+	eventAlertPrefix  = "alert." // alert.leak, alert.burst, alert.reverse_flow, alert.stuck_meter
+	eventPing         = "ping"
+)
+
+const (
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookTimeout     = 10 * time.Second
+)
+
+// webhookEvent is the JSON body delivered to subscribers.
+type webhookEvent struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"created_at"`
+	IMEI      string                 `json:"imei,omitempty"`
+	FrameID   int                    `json:"frame_id,omitempty"`
+	TenantID  int                    `json:"tenant_id,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+func newWebhookEvent(typ, imei string, frameID int, data map[string]interface{}) webhookEvent {
+	return webhookEvent{ID: uuid.NewString(), Type: typ, CreatedAt: time.Now().UTC(), IMEI: imei, FrameID: frameID, Data: data}
+}
+
+// readingState is the part of a reading that webhook events are derived from.
+type readingState struct {
+	Battery        int
+	Valve          int
+	MagneticTamper int
+}
+
+// readingEvents returns the events for cur: alarms that were not already
+// active in prev, and valve changes. prev is nil for a device's first reading.
+func readingEvents(imei string, frameID int, prev *readingState, cur readingState) []webhookEvent {
+	var events []webhookEvent
+
+	before := map[string]bool{}
+	if prev != nil {
+		for _, a := range readingAlarms(prev.Battery, prev.MagneticTamper) {
+			before[a] = true
+		}
+	}
+	for _, a := range readingAlarms(cur.Battery, cur.MagneticTamper) {
+		if before[a] {
+			continue
+		}
+		events = append(events, newWebhookEvent(eventAlarmPrefix+a, imei, frameID, map[string]interface{}{
+			"battery": cur.Battery, "valve": cur.Valve, "magnetic_tamper": cur.MagneticTamper,
+		}))
+	}
+
+	if prev != nil && prev.Valve != cur.Valve {
+		events = append(events, newWebhookEvent(eventValveChanged, imei, frameID, map[string]interface{}{
+			"previous_valve": prev.Valve, "valve": cur.Valve,
+		}))
+	}
+
+	return events
+}
+
+func alertEvent(a Alert) webhookEvent {
+	frameID := 0
+	if a.FrameID != nil {
+		frameID = *a.FrameID
+	}
+	var details interface{}
+	json.Unmarshal(a.Details, &details)
+	ev := newWebhookEvent(eventAlertPrefix+a.Type, a.IMEI, frameID, map[string]interface{}{
+		"alert_id": a.ID, "status": a.Status, "opened_at": a.OpenedAt, "details": details,
+	})
+	if a.TenantID != nil {
+		ev.TenantID = *a.TenantID
+	}
+	return ev
+}
+
+// webhookWants reports whether a subscription filter accepts the event type.
+// An empty filter or "*" takes everything; "alarm.*" takes a whole family.
+func webhookWants(filter []string, eventType string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == "*" || f == eventType {
+			return true
+		}
+		if strings.HasSuffix(f, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(f, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhook returns the X-Webhook-Signature value for body sent at ts.
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook is what a receiver does with the headers we send.
+func verifyWebhook(secret, tsHeader, sigHeader string, body []byte) bool {
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(signWebhook(secret, ts, body)), []byte(sigHeader))
+}
+
+// webhookBackoff is the wait before retry number attempt+1.
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookBaseBackoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return d
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// deliverWebhook POSTs one signed payload; any 2xx is success.
+func deliverWebhook(client *http.Client, target, secret string, deliveryID int, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tcp_server-webhooks/1")
+	req.Header.Set("X-Webhook-Id", strconv.Itoa(deliveryID))
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, ts, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// -------------------------
+// WEBHOOK QUEUE
+// -------------------------
+
+// enqueueWebhookEvents stores a pending delivery for every active webhook
+// whose filter matches. Webhooks owned by a tenant only get that tenant's events.
+func enqueueWebhookEvents(events []webhookEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	hooks, err := listWebhooks(true)
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		payload, _ := json.Marshal(ev)
+		for _, h := range hooks {
+			if !webhookWants(h.EventTypes, ev.Type) {
+				continue
+			}
+			if h.TenantID != nil && *h.TenantID != ev.TenantID {
+				continue
+			}
+			if _, err := db.Exec(`
+                INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, status, next_attempt_at)
+                VALUES ($1, $2, $3, $4, 'pending', now())
+            `, h.ID, ev.ID, ev.Type, string(payload)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// emitReadingEvents works out the webhook events for a stored reading and queues them.
+func emitReadingEvents(imei string, frameID int, decoded map[string]interface{}, opened []Alert) error {
+	if imei == "" {
+		return nil
+	}
+
+	cur := readingState{
+		Battery:        getInt(decoded["battery"]),
+		Valve:          getInt(decoded["valve"]),
+		MagneticTamper: getInt(decoded["magnetic_tamper"]),
+	}
+
+	var prev *readingState
+	var p readingState
+	err := db.QueryRow(`
+        SELECT m.battery, m.valve, m.magnetic_tamper
+        FROM messages m JOIN meter_frames f ON f.id = m.frame_id
+        WHERE f.imei = $1 AND m.frame_id <> $2
+        ORDER BY m.id DESC LIMIT 1
+    `, imei, frameID).Scan(&p.Battery, &p.Valve, &p.MagneticTamper)
+	if err == nil {
+		prev = &p
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	var tenant int
+	db.QueryRow(`SELECT COALESCE(tenant_id, 0) FROM meter_frames WHERE id = $1`, frameID).Scan(&tenant)
+
+	events := readingEvents(imei, frameID, prev, cur)
+	for i := range events {
+		events[i].TenantID = tenant
+	}
+	for _, a := range opened {
+		events = append(events, alertEvent(a))
+	}
+	return enqueueWebhookEvents(events)
+}
+
+// startWebhookWorker delivers due webhook_deliveries until the process exits.
+func startWebhookWorker() {
+	// anything left mid-send by a previous process goes back in the queue
+	db.Exec(`UPDATE webhook_deliveries SET status = 'pending' WHERE status = 'sending'`)
+
+	for {
+		n, err := deliverDueWebhooks(20)
+		if err != nil {
+			slog.Error("webhook delivery failed", "err", err)
+		}
+		if n == 0 {
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// deliverDueWebhooks claims up to batch due deliveries and attempts each once.
+// Deliveries whose webhook has been deleted are cancelled as they are claimed
+// rather than sent.
+func deliverDueWebhooks(batch int) (int, error) {
+	rows, err := db.Query(`
+        WITH claimed AS (
+            UPDATE webhook_deliveries d
+            SET status = CASE WHEN w.active THEN 'sending' ELSE 'cancelled' END,
+                attempts = d.attempts + CASE WHEN w.active THEN 1 ELSE 0 END
+            FROM webhooks w
+            WHERE w.id = d.webhook_id AND d.id IN (
+                SELECT id FROM webhook_deliveries
+                WHERE status = 'pending' AND next_attempt_at <= now()
+                ORDER BY id LIMIT $1
+                FOR UPDATE SKIP LOCKED
+            )
+            RETURNING d.id, d.webhook_id, d.event_type, d.payload::text, d.attempts
+        )
+        SELECT c.id, c.webhook_id, c.event_type, c.payload, c.attempts, w.url, w.secret
+        FROM claimed c JOIN webhooks w ON w.id = c.webhook_id AND w.active
+    `, batch)
+	if err != nil {
+		return 0, err
+	}
+
+	type job struct {
+		id, webhookID, attempts int
+		eventType, payload      string
+		url, secret             string
+	}
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.id, &j.webhookID, &j.eventType, &j.payload, &j.attempts, &j.url, &j.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+
+	for _, j := range jobs {
+		code, sendErr := deliverWebhook(webhookClient, j.url, j.secret, j.id, j.eventType, []byte(j.payload))
+
+		var status sql.NullInt64
+		if code != 0 {
+			status = sql.NullInt64{Int64: int64(code), Valid: true}
+		}
+
+		if sendErr == nil {
+			_, err = db.Exec(`
+                UPDATE webhook_deliveries
+                SET status = 'delivered', delivered_at = now(), last_status_code = $2, last_error = NULL
+                WHERE id = $1
+            `, j.id, status)
+		} else if j.attempts >= webhookMaxAttempts {
+			err = deadLetterWebhook(j.id, status, sendErr.Error())
+		} else {
+			_, err = db.Exec(`
+                UPDATE webhook_deliveries
+                SET status = 'pending', last_status_code = $2, last_error = $3, next_attempt_at = $4
+                WHERE id = $1
+            `, j.id, status, sendErr.Error(), time.Now().Add(webhookBackoff(j.attempts)))
+		}
+		if err != nil {
+			return len(jobs), err
+		}
+	}
+
+	return len(jobs), nil
+}
+
+func deadLetterWebhook(deliveryID int, status sql.NullInt64, lastErr string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+        UPDATE webhook_deliveries
+        SET status = 'dead', last_status_code = $2, last_error = $3
+        WHERE id = $1
+    `, deliveryID, status, lastErr); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+        INSERT INTO webhook_dead_letters (delivery_id, webhook_id, event_id, event_type, payload, attempts, last_error)
+        SELECT id, webhook_id, event_id, event_type, payload, attempts, last_error
+        FROM webhook_deliveries WHERE id = $1
+    `, deliveryID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// -------------------------
+// API: WEBHOOKS
+// -------------------------
+
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	TenantID   *int      `json:"tenant_id"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func listWebhooks(activeOnly bool) ([]Webhook, error) {
+	q := `SELECT id, url, secret, event_types, tenant_id, active, created_at FROM webhooks`
+	if activeOnly {
+		q += ` WHERE active`
+	}
+	rows, err := db.Query(q + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		var types string
+		if err := rows.Scan(&h.ID, &h.URL, &h.Secret, &types, &h.TenantID, &h.Active, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		h.EventTypes = splitList(types)
+		list = append(list, h)
+	}
+	return list, rows.Err()
+}
+
+// splitList parses the comma-separated lists stored in TEXT columns.
+func splitList(s string) []string {
+	out := []string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// GET /api/webhooks (secrets are not returned)
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	list, err := listWebhooks(false)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	for i := range list {
+		list[i].Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// POST /api/webhooks {"url": "...", "event_types": ["alarm.*"], "secret": optional, "tenant_id": optional}
+// The secret is generated when omitted and only returned by this call.
+func postWebhook(w http.ResponseWriter, r *http.Request) {
+	var h Webhook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		writeError(w, 400, "invalid JSON: "+err.Error())
+		return
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, 400, "url must be an absolute http(s) URL")
+		return
+	}
+	if h.Secret == "" {
+		b := make([]byte, 24)
+		rand.Read(b)
+		h.Secret = hex.EncodeToString(b)
+	}
+	h.Active = true
+
+	err = db.QueryRow(`
+        INSERT INTO webhooks (url, secret, event_types, tenant_id, active) VALUES ($1, $2, $3, $4, true)
+        RETURNING id, created_at
+    `, h.URL, h.Secret, strings.Join(h.EventTypes, ","), h.TenantID).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if h.EventTypes == nil {
+		h.EventTypes = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h)
+}
+
+// DELETE /api/webhooks/{id} deactivates the endpoint; its delivery log is kept.
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec(`UPDATE webhooks SET active = false WHERE id = $1`, r.PathValue("id"))
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, 404, "webhook not found")
+		return
+	}
+	// the worker also cancels these when it claims them; this just keeps the
+	// deliveries list honest straight away
+	if _, err := db.Exec(`
+        UPDATE webhook_deliveries SET status = 'cancelled'
+        WHERE webhook_id = $1 AND status = 'pending'
+    `, r.PathValue("id")); err != nil {
+		slog.Error("cancelling deliveries for deleted webhook failed", "webhook", r.PathValue("id"), "err", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/webhooks/{id}/test queues a ping event for one endpoint.
+func postWebhookTest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid webhook id")
+		return
+	}
+	ev := newWebhookEvent(eventPing, "", 0, map[string]interface{}{"webhook_id": id})
+	payload, _ := json.Marshal(ev)
+
+	var deliveryID int
+	err = db.QueryRow(`
+        INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, status, next_attempt_at)
+        SELECT id, $2, $3, $4, 'pending', now() FROM webhooks WHERE id = $1
+        RETURNING id
+    `, id, ev.ID, ev.Type, string(payload)).Scan(&deliveryID)
+	if err == sql.ErrNoRows {
+		writeError(w, 404, "webhook not found")
+		return
+	}
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"delivery_id": deliveryID, "event_id": ev.ID})
+}
+
+type webhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+}
+
+// GET /api/webhooks/{id}/deliveries?status=&limit=&cursor=&payload=1
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "created_at")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	q := r.URL.Query()
+
+	var where sqlWhere
+	where.add("webhook_id = $%d", r.PathValue("id"))
+	if v := q.Get("status"); v != "" {
+		where.add("status = $%d", v)
+	}
+	if !p.From.IsZero() {
+		where.add("created_at >= $%d", p.From)
+	}
+	if !p.To.IsZero() {
+		where.add("created_at < $%d", p.To)
+	}
+
+	total, err := p.totalCount("SELECT COUNT(*) FROM webhook_deliveries "+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "id")
+	rows, err := db.Query(`
+        SELECT id, webhook_id, event_id::text, event_type, status, attempts, last_status_code,
+               last_error, next_attempt_at, created_at, delivered_at, payload::text
+        FROM webhook_deliveries `+where.String()+" "+p.orderSQL("id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	withPayload := q.Get("payload") == "1"
+	var list []webhookDelivery
+	var ids []int
+	for rows.Next() {
+		var d webhookDelivery
+		var payload string
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+			&d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt, &payload); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		if withPayload {
+			d.Payload = json.RawMessage(payload)
+		}
+		list = append(list, d)
+		ids = append(ids, d.ID)
+	}
+
+	writePage(w, p, list, ids, total)
+}
+
+// DeadLetter is a delivery that ran out of attempts.
+type DeadLetter struct {
+	ID         int             `json:"id"`
+	DeliveryID int             `json:"delivery_id"`
+	WebhookID  int             `json:"webhook_id"`
+	EventID    string          `json:"event_id"`
+	EventType  string          `json:"event_type"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// GET /api/webhooks/dead-letters?limit=&cursor=
+func getWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "created_at")
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	var where sqlWhere
+	if v := r.URL.Query().Get("webhook_id"); v != "" {
+		where.add("webhook_id = $%d", v)
+	}
+
+	total, err := p.totalCount("SELECT COUNT(*) FROM webhook_dead_letters "+where.String(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	p.cursor(&where, "id")
+	rows, err := db.Query(`
+        SELECT id, delivery_id, webhook_id, event_id::text, event_type, attempts,
+               COALESCE(last_error, ''), created_at, payload::text
+        FROM webhook_dead_letters `+where.String()+" "+p.orderSQL("id")+" "+p.limitSQL(), where.args...)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var list []DeadLetter
+	var ids []int
+	for rows.Next() {
+		var d DeadLetter
+		var payload string
+		if err := rows.Scan(&d.ID, &d.DeliveryID, &d.WebhookID, &d.EventID, &d.EventType, &d.Attempts,
+			&d.LastError, &d.CreatedAt, &payload); err != nil {
+			writeError(w, 500, err.Error())
+			return
+		}
+		d.Payload = json.RawMessage(payload)
+		list = append(list, d)
+		ids = append(ids, d.ID)
+	}
+
+	writePage(w, p, list, ids, total)
+}
+
+// POST /api/webhooks/dead-letters/{id}/retry puts the delivery back in the queue.
+func postWebhookDeadLetterRetry(w http.ResponseWriter, r *http.Request) {
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	var deliveryID int
+	err = tx.QueryRow(`DELETE FROM webhook_dead_letters WHERE id = $1 RETURNING delivery_id`, r.PathValue("id")).Scan(&deliveryID)
+	if err == sql.ErrNoRows {
+		writeError(w, 404, "dead letter not found")
+		return
+	}
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if _, err := tx.Exec(`
+        UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now()
+        WHERE id = $1
+    `, deliveryID); err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"delivery_id": deliveryID})
+}
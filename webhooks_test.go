@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeliverWebhookSignsPayload(t *testing.T) {
+	const secret = "s3cret"
+
+	var got webhookEvent
+	var verified bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verified = verifyWebhook(secret, r.Header.Get("X-Webhook-Timestamp"), r.Header.Get("X-Webhook-Signature"), body)
+		if r.Header.Get("X-Webhook-Event") != "alarm.low_battery" || r.Header.Get("X-Webhook-Id") != "7" {
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		json.Unmarshal(body, &got)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	ev := newWebhookEvent("alarm.low_battery", "861234567890123", 42, map[string]interface{}{"battery": 5})
+	body, _ := json.Marshal(ev)
+
+	code, err := deliverWebhook(receiver.Client(), receiver.URL, secret, 7, ev.Type, body)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("deliverWebhook = %d, %v", code, err)
+	}
+	if !verified {
+		t.Error("receiver could not verify the signature")
+	}
+	if got.ID != ev.ID || got.IMEI != ev.IMEI || got.FrameID != 42 {
+		t.Errorf("receiver got %+v, want %+v", got, ev)
+	}
+}
+
+func TestDeliverWebhookNon2xxIsFailure(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	code, err := deliverWebhook(receiver.Client(), receiver.URL, "k", 1, eventPing, []byte(`{}`))
+	if err == nil || code != http.StatusServiceUnavailable {
+		t.Fatalf("deliverWebhook = %d, %v; want 503 and an error", code, err)
+	}
+}
+
+func TestVerifyWebhookRejectsTampering(t *testing.T) {
+	body := []byte(`{"type":"ping"}`)
+	sig := signWebhook("k", 1700000000, body)
+
+	if !verifyWebhook("k", "1700000000", sig, body) {
+		t.Fatal("valid signature rejected")
+	}
+	if verifyWebhook("other", "1700000000", sig, body) {
+		t.Error("wrong secret accepted")
+	}
+	if verifyWebhook("k", "1700000001", sig, body) {
+		t.Error("wrong timestamp accepted")
+	}
+	if verifyWebhook("k", "1700000000", sig, []byte(`{"type":"pong"}`)) {
+		t.Error("modified body accepted")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second}
+	for i, w := range want {
+		if got := webhookBackoff(i + 1); got != w {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if got := webhookBackoff(50); got != webhookMaxBackoff {
+		t.Errorf("webhookBackoff(50) = %v, want cap %v", got, webhookMaxBackoff)
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	cases := []struct {
+		filter []string
+		event  string
+		want   bool
+	}{
+		{nil, "alarm.low_battery", true},
+		{[]string{"*"}, "valve.changed", true},
+		{[]string{"alarm.*"}, "alarm.magnetic_tamper", true},
+		{[]string{"alarm.*"}, "alert.leak", false},
+		{[]string{"valve.changed"}, "valve.changed", true},
+		{[]string{"valve.changed"}, "alarm.low_battery", false},
+	}
+	for _, c := range cases {
+		if got := webhookWants(c.filter, c.event); got != c.want {
+			t.Errorf("webhookWants(%v, %q) = %v, want %v", c.filter, c.event, got, c.want)
+		}
+	}
+}
+
+func TestReadingEventsOnlyOnTransition(t *testing.T) {
+	t.Setenv("LOW_BATTERY_THRESHOLD", "20")
+
+	types := func(evs []webhookEvent) map[string]bool {
+		m := map[string]bool{}
+		for _, e := range evs {
+			m[e.Type] = true
+		}
+		return m
+	}
+
+	first := types(readingEvents("imei", 1, nil, readingState{Battery: 10, Valve: 0, MagneticTamper: 1}))
+	if !first["alarm.low_battery"] || !first["alarm.magnetic_tamper"] || len(first) != 2 {
+		t.Errorf("first reading events = %v", first)
+	}
+
+	prev := readingState{Battery: 10, Valve: 0, MagneticTamper: 1}
+	again := types(readingEvents("imei", 2, &prev, prev))
+	if len(again) != 0 {
+		t.Errorf("ongoing alarms re-sent: %v", again)
+	}
+
+	// the valve byte is not an alarm, only its changes are reported
+	closed := types(readingEvents("imei", 3, &prev, readingState{Battery: 10, Valve: 1, MagneticTamper: 1}))
+	if !closed["valve.changed"] || len(closed) != 1 {
+		t.Errorf("valve change events = %v", closed)
+	}
+}
+
+func TestDeliverDueWebhooksSkipsInactive(t *testing.T) {
+	mock := useMockDB(t)
+
+	// the claim cancels deliveries of inactive webhooks and the join leaves
+	// them out, so an empty result means nothing is sent
+	mock.ExpectQuery(`(?s)'cancelled'.*JOIN webhooks w ON w.id = c.webhook_id AND w.active`).
+		WithArgs(20).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event_type", "payload", "attempts", "url", "secret"}))
+
+	n, err := deliverDueWebhooks(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("deliverDueWebhooks = %d, want 0", n)
+	}
+}